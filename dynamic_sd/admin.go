@@ -0,0 +1,193 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI 在 Caddy 的管理端点上暴露动态服务发现的运行状态，
+// 在没有配置 Prometheus 时也可以直接拉取各 provider 的统计信息。
+type adminAPI struct{}
+
+// CaddyModule 返回 Caddy 模块信息。
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.dynamic_sd",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes 返回本模块处理的管理端点。
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/dynamic_sd/metrics",
+			Handler: caddy.AdminHandlerFunc(a.handleMetrics),
+		},
+		{
+			Pattern: "/dynamic_sd/srv",
+			Handler: caddy.AdminHandlerFunc(a.handleSRV),
+		},
+		{
+			Pattern: "/dynamic_sd/config",
+			Handler: caddy.AdminHandlerFunc(a.handleConfig),
+		},
+		{
+			Pattern: "/dynamic_sd/ready",
+			Handler: caddy.AdminHandlerFunc(a.handleReady),
+		},
+		{
+			Pattern: "/dynamic_sd/cordon",
+			Handler: caddy.AdminHandlerFunc(a.handleCordon),
+		},
+		{
+			Pattern: "/dynamic_sd/uncordon",
+			Handler: caddy.AdminHandlerFunc(a.handleUncordon),
+		},
+	}
+}
+
+// handleMetrics 以 JSON 返回每个 provider 的实例数量、最近一次刷新时间和错误率。
+func (adminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(metrics.Stats())
+}
+
+// handleSRV 以 SRV 记录的形式返回每个 dynamic_sd 当前的上游，供外部负载均衡器等工具使用。
+func (adminAPI) handleSRV(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(srvSnapshot(time.Now()))
+}
+
+// handleConfig 以 JSON 返回每个 dynamic_sd 及其 provider 实际解析得到的配置，密码、令牌等敏感字段被替换。
+func (adminAPI) handleConfig(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(configSnapshot())
+}
+
+// handleReady 是供 Kubernetes 就绪探针使用的端点：所有 provider 都已得到上游（规则见 readinessSnapshot）时返回 200，否则返回 503，
+// 响应体是各 provider 的就绪状态。查询参数 policy=any 时只要求至少一个 provider 就绪，默认为 all。
+// 管理端点默认只监听 localhost:2019，httpGet 探针需要把 admin 监听在 Pod 的地址上，或者改用 exec 探针。
+func (adminAPI) handleReady(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	result, err := readinessSnapshot(r.URL.Query().Get("policy"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(result)
+}
+
+// cordonRequest 是 cordon 和 uncordon 端点的请求体。
+type cordonRequest struct {
+	Dial string `json:"dial"`
+}
+
+// handleCordon 处理上游隔离：GET 返回当前被隔离的地址，POST 隔离请求体中的地址。
+// 被隔离的地址不会出现在任何 dynamic_sd 的 GetUpstreams 结果中，注册中心中的实例不受影响。
+func (adminAPI) handleCordon(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(cordoned.list())
+	case http.MethodPost:
+		dial, err := decodeCordonRequest(r)
+		if err != nil {
+			return err
+		}
+		if cordoned.add(dial) {
+			caddy.Log().Named("admin.api.dynamic_sd").Info("upstream cordoned", zap.String("dial", dial))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// handleUncordon 解除请求体中地址的隔离。
+func (adminAPI) handleUncordon(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	dial, err := decodeCordonRequest(r)
+	if err != nil {
+		return err
+	}
+	if !cordoned.remove(dial) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("upstream '%s' is not cordoned", dial),
+		}
+	}
+	caddy.Log().Named("admin.api.dynamic_sd").Info("upstream uncordoned", zap.String("dial", dial))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// decodeCordonRequest 解析请求体中的上游地址。
+func decodeCordonRequest(r *http.Request) (string, error) {
+	var req cordonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if req.Dial == "" {
+		return "", caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("dial is required"),
+		}
+	}
+	return req.Dial, nil
+}
+
+// 接口符合性检查
+var _ caddy.AdminRouter = (*adminAPI)(nil)
@@ -0,0 +1,63 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+)
+
+func TestHandleMetricsFields(t *testing.T) {
+	metrics.RecordResult("consul", "admin-metrics-test", 3, nil)
+	metrics.RecordResult("consul", "admin-metrics-test", 0, errors.New("connection refused"))
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/dynamic_sd/metrics", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got Content-Type %q, want application/json", ct)
+	}
+
+	var body []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	for _, entry := range body {
+		if entry["service"] == "admin-metrics-test" {
+			got = entry
+		}
+	}
+	if got == nil {
+		t.Fatalf("admin-metrics-test missing from %s", rec.Body)
+	}
+	want := map[string]any{
+		"provider":   "consul",
+		"count":      float64(0),
+		"last_error": "connection refused",
+		"error_rate": 0.5,
+		"refreshes":  float64(2),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("field %s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["last_refresh"].(string); !ok {
+		t.Errorf("field last_refresh = %v, want a timestamp", got["last_refresh"])
+	}
+}
+
+func TestHandleMetricsRejectsPost(t *testing.T) {
+	err := (adminAPI{}).handleMetrics(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/dynamic_sd/metrics", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusMethodNotAllowed {
+		t.Fatalf("got %v, want a 405 APIError", err)
+	}
+}
@@ -0,0 +1,77 @@
+package dynamic_sd
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// defaultCanaryMetaKey 是未配置 canary_meta_key 时用于标记灰度实例的 metadata key。
+const defaultCanaryMetaKey = "canary"
+
+// canarySplit 根据实例的 metadata 把上游分为灰度和稳定两个桶，
+// 并根据请求头决定请求落到哪个桶。两个桶只在 provider 的上游列表变化时重建。
+type canarySplit struct {
+	header  string
+	metaKey string
+
+	mu     sync.Mutex
+	src    []*reverseproxy.Upstream
+	canary map[*reverseproxy.Upstream]struct{}
+}
+
+// newCanarySplit 创建一个按 header 请求头和 metaKey 属性分桶的 canarySplit。
+func newCanarySplit(header, metaKey string) *canarySplit {
+	if metaKey == "" {
+		metaKey = defaultCanaryMetaKey
+	}
+	return &canarySplit{header: header, metaKey: metaKey}
+}
+
+// filter 返回 upstreams 中属于请求所在桶的上游，顺序保持不变。
+// 请求头为 true 的请求只落到 metadata 标记为 true 的实例上，其余请求只落到其他实例上；
+// 所选的桶为空时返回全部上游，避免因为灰度实例缺失而无法提供服务。
+// all 和 instances 是 provider 当前的完整上游和实例列表，用于判断缓存是否仍然有效。
+func (cs *canarySplit) filter(r *http.Request, all []*reverseproxy.Upstream, instances []*discovery.Instance, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	canary := cs.buckets(all, instances)
+	want := isTrue(r.Header.Get(cs.header))
+
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if _, ok := canary[up]; ok == want {
+			kept = append(kept, up)
+		}
+	}
+	if len(kept) == 0 {
+		return upstreams
+	}
+	return kept
+}
+
+// buckets 返回灰度桶中的上游集合，上游列表未变化时复用上一次的结果。
+// 不在灰度桶中的上游即属于稳定桶。
+func (cs *canarySplit) buckets(all []*reverseproxy.Upstream, instances []*discovery.Instance) map[*reverseproxy.Upstream]struct{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.canary == nil || !sameUpstreams(cs.src, all) {
+		cs.src = all
+		cs.canary = make(map[*reverseproxy.Upstream]struct{})
+		for _, in := range instances {
+			if v, ok := in.Meta(cs.metaKey); ok && isTrue(v) {
+				cs.canary[in.Upstream] = struct{}{}
+			}
+		}
+	}
+	return cs.canary
+}
+
+// isTrue 报告 v 是否是一个表示 true 的布尔值，非法的值按 false 处理。
+func isTrue(v string) bool {
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
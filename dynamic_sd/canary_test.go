@@ -0,0 +1,69 @@
+package dynamic_sd
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+func TestCanarySplitRoutesToBucket(t *testing.T) {
+	instances := []*discovery.Instance{
+		discovery.NewInstance("10.0.0.1:80", nil, 0),
+		discovery.NewInstance("10.0.0.2:80", map[string]string{"canary": "true"}, 0),
+		discovery.NewInstance("10.0.0.3:80", map[string]string{"canary": "false"}, 0),
+	}
+	all := make([]*reverseproxy.Upstream, len(instances))
+	for i, in := range instances {
+		all[i] = in.Upstream
+	}
+
+	cs := newCanarySplit("X-Canary", "")
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"true", []string{"10.0.0.2:80"}},
+		{"1", []string{"10.0.0.2:80"}},
+		{"", []string{"10.0.0.1:80", "10.0.0.3:80"}},
+		{"false", []string{"10.0.0.1:80", "10.0.0.3:80"}},
+		{"garbage", []string{"10.0.0.1:80", "10.0.0.3:80"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Canary", tt.header)
+		}
+		assertDials(t, "X-Canary: "+tt.header, cs.filter(r, all, instances, all), tt.want)
+	}
+}
+
+func TestCanarySplitFallsBackWhenBucketEmpty(t *testing.T) {
+	instances := []*discovery.Instance{
+		discovery.NewInstance("10.0.0.1:80", nil, 0),
+		discovery.NewInstance("10.0.0.2:80", nil, 0),
+	}
+	all := []*reverseproxy.Upstream{instances[0].Upstream, instances[1].Upstream}
+
+	cs := newCanarySplit("X-Canary", "stage")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "true")
+	assertDials(t, "empty canary bucket", cs.filter(r, all, instances, all), []string{"10.0.0.1:80", "10.0.0.2:80"})
+}
+
+func TestCanarySplitRebuildsOnChange(t *testing.T) {
+	stable := discovery.NewInstance("10.0.0.1:80", nil, 0)
+	canary := discovery.NewInstance("10.0.0.2:80", map[string]string{"stage": "true"}, 0)
+	cs := newCanarySplit("X-Canary", "stage")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Canary", "true")
+
+	first := []*reverseproxy.Upstream{stable.Upstream}
+	assertDials(t, "before", cs.filter(r, first, []*discovery.Instance{stable}, first), []string{"10.0.0.1:80"})
+
+	second := []*reverseproxy.Upstream{stable.Upstream, canary.Upstream}
+	assertDials(t, "after", cs.filter(r, second, []*discovery.Instance{stable, canary}, second), []string{"10.0.0.2:80"})
+}
@@ -0,0 +1,136 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// cidrFilter 按 allow_cidrs 和 deny_cidrs 过滤上游地址，防止注册中心中被注入任意的转发目标。
+// 判断结果按地址缓存，只在 provider 的上游列表变化时清空。
+type cidrFilter struct {
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	resolve bool
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	src     []*reverseproxy.Upstream
+	allowed map[string]bool
+}
+
+// parsePrefixes 解析 CIDR 列表，单个 IP 地址被视为只包含它自己的网段。
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s': %v", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %v", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// newCIDRFilter 解析 allow 和 deny 列表。
+func newCIDRFilter(allow, deny []string, resolve bool, logger *zap.Logger) (*cidrFilter, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %v", err)
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %v", err)
+	}
+	return &cidrFilter{
+		allow:   allowPrefixes,
+		deny:    denyPrefixes,
+		resolve: resolve,
+		logger:  logger,
+	}, nil
+}
+
+// filter 返回 upstreams 中被允许的上游，顺序保持不变。all 是 provider 当前的完整上游列表，用于判断缓存是否仍然有效。
+func (cf *cidrFilter) filter(all, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.allowed == nil || !sameUpstreams(cf.src, all) {
+		cf.src = all
+		cf.allowed = make(map[string]bool)
+	}
+
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		ok, cached := cf.allowed[up.Dial]
+		if !cached {
+			ok = cf.check(up.Dial)
+			cf.allowed[up.Dial] = ok
+		}
+		if ok {
+			kept = append(kept, up)
+		}
+	}
+	return kept
+}
+
+// check 判断 dial 是否被允许：命中 deny 的地址总是被拒绝，配置了 allow 时只允许命中 allow 的地址。
+// 主机名在 resolve 为 true 时已经由 hostResolver 展开为 IP，仍为主机名说明无法解析，因此被拒绝；
+// resolve 为 false 时主机名直接放行。
+func (cf *cidrFilter) check(dial string) bool {
+	host, _, err := net.SplitHostPort(dial)
+	if err != nil {
+		host = dial
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		if !cf.resolve {
+			return true
+		}
+		cf.logger.Warn("dropping upstream whose hostname cannot be resolved for CIDR filtering",
+			zap.String("dial", dial),
+		)
+		return false
+	}
+
+	if !cf.permits(addr.Unmap().WithZone("")) {
+		cf.logger.Warn("dropping upstream outside of allowed CIDRs",
+			zap.String("dial", dial),
+			zap.String("ip", addr.String()),
+		)
+		return false
+	}
+	return true
+}
+
+// permits 判断单个 IP 是否被允许。
+func (cf *cidrFilter) permits(addr netip.Addr) bool {
+	for _, prefix := range cf.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(cf.allow) == 0 {
+		return true
+	}
+	for _, prefix := range cf.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
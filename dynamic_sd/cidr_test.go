@@ -0,0 +1,75 @@
+package dynamic_sd
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	all := testUpstreams("10.0.0.1:80", "10.0.1.1:80", "192.168.0.1:80", "[fd00::1]:80", "backend.internal:80")
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		resolve bool
+		want    []string
+	}{
+		{
+			name:  "allow",
+			allow: []string{"10.0.0.0/8", "fd00::/8"},
+			want:  []string{"10.0.0.1:80", "10.0.1.1:80", "[fd00::1]:80", "backend.internal:80"},
+		},
+		{
+			name: "deny",
+			deny: []string{"192.168.0.0/16", "10.0.1.1"},
+			want: []string{"10.0.0.1:80", "[fd00::1]:80", "backend.internal:80"},
+		},
+		{
+			// deny 优先于重叠的 allow
+			name:  "overlap",
+			allow: []string{"10.0.0.0/8"},
+			deny:  []string{"10.0.1.0/24"},
+			want:  []string{"10.0.0.1:80", "backend.internal:80"},
+		},
+		{
+			// resolve_hostnames 开启时仍为主机名的上游无法解析，被拒绝
+			name:    "unresolved hostname",
+			allow:   []string{"10.0.0.0/8"},
+			resolve: true,
+			want:    []string{"10.0.0.1:80", "10.0.1.1:80"},
+		},
+	}
+	for _, tt := range tests {
+		cf, err := newCIDRFilter(tt.allow, tt.deny, tt.resolve, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertDials(t, tt.name, cf.filter(all, all), tt.want)
+	}
+}
+
+func TestCIDRFilterCacheFollowsUpstreams(t *testing.T) {
+	cf, err := newCIDRFilter(nil, []string{"10.0.0.2"}, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testUpstreams("10.0.0.1:80", "10.0.0.2:80")
+	assertDials(t, "first", cf.filter(first, first), []string{"10.0.0.1:80"})
+
+	second := append(first, &reverseproxy.Upstream{Dial: "10.0.0.3:80"})
+	assertDials(t, "second", cf.filter(second, second), []string{"10.0.0.1:80", "10.0.0.3:80"})
+	if len(cf.allowed) != 3 {
+		t.Fatalf("got %d cached decisions, want 3 after the upstream list changed", len(cf.allowed))
+	}
+}
+
+func TestParsePrefixesRejectsInvalid(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := newCIDRFilter([]string{cidr}, nil, false, zap.NewNop()); err == nil {
+			t.Errorf("%s: got nil error", cidr)
+		}
+	}
+}
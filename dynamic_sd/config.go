@@ -0,0 +1,63 @@
+package dynamic_sd
+
+import (
+	"sort"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// moduleConfig 是一个 dynamic_sd 实际解析得到的配置。
+type moduleConfig struct {
+	// Module 是 dynamic_sd 本身的配置。provider 和 named_providers 包含未替换的敏感字段，已从中删除，见 Providers。
+	Module    map[string]any   `json:"module"`
+	Providers []providerConfig `json:"providers"`
+}
+
+// providerConfig 是一个 provider 的配置，敏感字段已被替换。
+type providerConfig struct {
+	// Name 是命名 provider 的名字，默认 provider 为空。
+	Name     string `json:"name,omitempty"`
+	Provider string `json:"provider"`
+	Service  string `json:"service"`
+	Config   any    `json:"config"`
+}
+
+// configSnapshot 返回所有 dynamic_sd 的配置，按第一个 provider 的类型和服务名排序，
+// 用于确认 Caddy 实际从 Caddyfile 中解析得到的配置。
+func configSnapshot() []moduleConfig {
+	modules := activeModules()
+	configs := make([]moduleConfig, 0, len(modules))
+	for _, d := range modules {
+		mc := moduleConfig{Module: moduleSettings(d), Providers: []providerConfig{}}
+		for _, entry := range d.allProviders() {
+			mc.Providers = append(mc.Providers, providerConfig{
+				Name:     entry.name,
+				Provider: entry.typeName,
+				Service:  entry.provider.Service(),
+				Config:   entry.provider.MarshalConfig(),
+			})
+		}
+		configs = append(configs, mc)
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configSortKey(configs[i]) < configSortKey(configs[j])
+	})
+	return configs
+}
+
+// moduleSettings 返回 d 自身的配置，不包括 provider 的配置。
+func moduleSettings(d *DynamicSD) map[string]any {
+	config := discovery.RedactConfig(d)
+	delete(config, "provider")
+	delete(config, "named_providers")
+	return config
+}
+
+// configSortKey 返回 mc 的排序依据。
+func configSortKey(mc moduleConfig) string {
+	if len(mc.Providers) == 0 {
+		return ""
+	}
+	return mc.Providers[0].Provider + "\x00" + mc.Providers[0].Service
+}
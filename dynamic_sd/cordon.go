@@ -0,0 +1,77 @@
+package dynamic_sd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// cordoned 是通过管理端点隔离的上游地址集合，对所有 dynamic_sd 实例生效。
+// 它只保存在内存中，在配置重载后仍然有效，Caddy 进程重启后清空。
+var cordoned = &cordonSet{dials: make(map[string]struct{})}
+
+// cordonSet 记录被隔离的上游地址（provider 发现的 "host:port"，即改写之前的地址）。
+type cordonSet struct {
+	mu    sync.RWMutex
+	dials map[string]struct{}
+}
+
+// add 隔离 dial，dial 已经被隔离时返回 false。
+func (cs *cordonSet) add(dial string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.dials[dial]; ok {
+		return false
+	}
+	cs.dials[dial] = struct{}{}
+	return true
+}
+
+// remove 解除对 dial 的隔离，dial 没有被隔离时返回 false。
+func (cs *cordonSet) remove(dial string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.dials[dial]; !ok {
+		return false
+	}
+	delete(cs.dials, dial)
+	return true
+}
+
+// has 报告 dial 是否被隔离。
+func (cs *cordonSet) has(dial string) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	_, ok := cs.dials[dial]
+	return ok
+}
+
+// list 返回按字典序排序的被隔离地址。
+func (cs *cordonSet) list() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	dials := make([]string, 0, len(cs.dials))
+	for dial := range cs.dials {
+		dials = append(dials, dial)
+	}
+	sort.Strings(dials)
+	return dials
+}
+
+// filter 返回去掉被隔离地址后的上游列表，没有任何地址被隔离时直接返回 upstreams。
+func (cs *cordonSet) filter(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if len(cs.dials) == 0 {
+		return upstreams
+	}
+
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if _, ok := cs.dials[up.Dial]; !ok {
+			kept = append(kept, up)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,74 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// getUpstreams 以 r 调用 GetUpstreams，r 为 nil 时使用一个普通的 GET 请求。
+func getUpstreams(t *testing.T, d *DynamicSD, r *http.Request) []*reverseproxy.Upstream {
+	t.Helper()
+	if r == nil {
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+	}
+	upstreams, err := d.GetUpstreams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstreams
+}
+
+// postCordon 以 dial 调用 handler，返回响应的状态码或 API 错误的状态码。
+func postCordon(t *testing.T, handler func(http.ResponseWriter, *http.Request) error, dial string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"dial":"` + dial + `"}`)
+	if err := handler(rec, httptest.NewRequest(http.MethodPost, "/", body)); err != nil {
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("got %v, want an APIError", err)
+		}
+		return apiErr.HTTPStatus
+	}
+	return rec.Code
+}
+
+func TestCordonExcludesUpstream(t *testing.T) {
+	d := fileModule(t, "", "10.0.0.1:80", "10.0.0.2:80")
+	t.Cleanup(func() { cordoned.remove("10.0.0.1:80") })
+
+	if code := postCordon(t, adminAPI{}.handleCordon, "10.0.0.1:80"); code != http.StatusNoContent {
+		t.Fatalf("cordon: got status %d, want 204", code)
+	}
+	assertDials(t, "cordoned", getUpstreams(t, d, nil), []string{"10.0.0.2:80"})
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleCordon(rec, httptest.NewRequest(http.MethodGet, "/dynamic_sd/cordon", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != "10.0.0.1:80" {
+		t.Fatalf("got cordoned %v, want [10.0.0.1:80]", list)
+	}
+
+	if code := postCordon(t, adminAPI{}.handleUncordon, "10.0.0.1:80"); code != http.StatusNoContent {
+		t.Fatalf("uncordon: got status %d, want 204", code)
+	}
+	assertDials(t, "uncordoned", getUpstreams(t, d, nil), []string{"10.0.0.1:80", "10.0.0.2:80"})
+	if code := postCordon(t, adminAPI{}.handleUncordon, "10.0.0.1:80"); code != http.StatusNotFound {
+		t.Fatalf("uncordon twice: got status %d, want 404", code)
+	}
+	if code := postCordon(t, adminAPI{}.handleCordon, ""); code != http.StatusBadRequest {
+		t.Fatalf("cordon without dial: got status %d, want 400", code)
+	}
+}
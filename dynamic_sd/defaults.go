@@ -0,0 +1,105 @@
+package dynamic_sd
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("dynamic_sd_defaults", parseDefaults)
+}
+
+// providerDefaults 保存通过全局选项 dynamic_sd_defaults 注册的 provider 默认配置，
+// key 为默认配置的名字，value 为包含名字和配置块的 token 序列。
+// 全局选项总是在站点块之前解析，因此 provider 块中的 inherit 可以引用同一个 Caddyfile 中定义的默认配置。
+var (
+	providerDefaults   = make(map[string]caddyfile.Segment)
+	providerDefaultsMu sync.RWMutex
+)
+
+// parseDefaults 解析全局选项：
+//
+//	dynamic_sd_defaults <name> {
+//	    server_addr 10.0.0.1
+//	    server_port 8848
+//	}
+//
+// 块中的内容与 provider 块中的子指令相同，provider 块通过 `inherit <name>` 引用。
+func parseDefaults(d *caddyfile.Dispenser, _ any) (any, error) {
+	d.Next() // 消费选项名
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	seg := d.NextSegment()
+	if len(seg) < 2 {
+		return nil, d.Errf("dynamic_sd_defaults '%s' requires a block", name)
+	}
+
+	providerDefaultsMu.Lock()
+	providerDefaults[name] = seg
+	providerDefaultsMu.Unlock()
+	return nil, nil
+}
+
+// unmarshalProvider 解析 provider 的配置块，disp 的当前 token 为 provider 名字。
+// 块中的 `inherit <name>` 会先应用对应的默认配置，块中的其他子指令再覆盖默认值。
+func unmarshalProvider(disp *caddyfile.Dispenser, prov providers.Provider) error {
+	names, rest, err := splitInherit(disp.NextSegment())
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		providerDefaultsMu.RLock()
+		seg, ok := providerDefaults[name.Text]
+		providerDefaultsMu.RUnlock()
+		if !ok {
+			d := caddyfile.NewDispenser([]caddyfile.Token{name})
+			d.Next()
+			return d.Errf("unknown dynamic_sd_defaults '%s'", name.Text)
+		}
+		d := caddyfile.NewDispenser(seg)
+		d.Next()
+		if err := prov.UnmarshalCaddyfile(d); err != nil {
+			return err
+		}
+	}
+
+	d := caddyfile.NewDispenser(rest)
+	d.Next()
+	return prov.UnmarshalCaddyfile(d)
+}
+
+// splitInherit 从 provider 块中取出顶层的 `inherit <name>` 行，返回引用的名字和剩余的 token。
+func splitInherit(seg caddyfile.Segment) ([]caddyfile.Token, caddyfile.Segment, error) {
+	var names []caddyfile.Token
+	rest := make(caddyfile.Segment, 0, len(seg))
+	nesting := 0
+	for i := 0; i < len(seg); i++ {
+		tkn := seg[i]
+		switch tkn.Text {
+		case "{":
+			nesting++
+		case "}":
+			nesting--
+		}
+		if nesting == 1 && tkn.Text == "inherit" && seg[i-1].Line != tkn.Line {
+			d := caddyfile.NewDispenser(seg[i:])
+			d.Next()
+			args := d.RemainingArgs()
+			if len(args) != 1 {
+				return nil, nil, d.ArgErr()
+			}
+			names = append(names, seg[i+1])
+			i++
+			continue
+		}
+		rest = append(rest, tkn)
+	}
+	return names, rest, nil
+}
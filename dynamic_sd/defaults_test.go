@@ -0,0 +1,69 @@
+package dynamic_sd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers/consul"
+)
+
+// registerDefaults 解析一个 dynamic_sd_defaults 全局选项，测试结束时删除它。
+func registerDefaults(t *testing.T, name, input string) {
+	t.Helper()
+	if _, err := parseDefaults(caddyfile.NewTestDispenser(input), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		providerDefaultsMu.Lock()
+		delete(providerDefaults, name)
+		providerDefaultsMu.Unlock()
+	})
+}
+
+func TestInheritDefaults(t *testing.T) {
+	registerDefaults(t, "defaults-test", `dynamic_sd_defaults defaults-test {
+		address 10.0.0.1:8500
+		datacenter dc1
+		poll_interval 5s
+	}`)
+
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		provider consul {
+			inherit defaults-test
+			service_name orders
+			datacenter dc2
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := d.provider.(*consul.ConsulProvider)
+	// 块中的子指令覆盖默认配置，其余的配置继承自默认配置
+	if cp.Address != "10.0.0.1:8500" || cp.PollInterval != 5*time.Second {
+		t.Errorf("got address %q poll_interval %v, want them inherited", cp.Address, cp.PollInterval)
+	}
+	if cp.ServiceName != "orders" || cp.Datacenter != "dc2" {
+		t.Errorf("got service_name %q datacenter %q, want the block's own values", cp.ServiceName, cp.Datacenter)
+	}
+	// 继承的配置也写入 JSON，caddy adapt 的输出不依赖全局选项
+	if !strings.Contains(string(d.ProviderRaw), `"address":"10.0.0.1:8500"`) {
+		t.Errorf("got provider JSON %s, want the inherited address", d.ProviderRaw)
+	}
+}
+
+func TestInheritUnknownDefaults(t *testing.T) {
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		provider consul {
+			inherit missing-defaults
+			service_name orders
+		}
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "unknown dynamic_sd_defaults 'missing-defaults'") {
+		t.Fatalf("got %v, want an unknown defaults error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package dynamic_sd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// fileModule 返回一个已经 Provision 的 dynamic_sd，它的 file provider 提供 dials，options 是块中的其余子指令。
+// 测试结束时 Cleanup。
+func fileModule(t *testing.T, options string, dials ...string) *DynamicSD {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upstreams")
+	if err := os.WriteFile(path, []byte(strings.Join(dials, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser("dynamic_sd {\n\tprovider file {\n\t\tpath " + path + "\n\t}\n" + options + "\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := d.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Cleanup() })
+	return d
+}
+
+func TestCleanupDrainsInFlightRequests(t *testing.T) {
+	d := fileModule(t, "cleanup_drain_timeout 10s", "10.0.0.1:80", "10.0.0.2:80")
+
+	// 10.0.0.1:80 上有一个进行中的请求，直到 finish 被关闭
+	finish := make(chan struct{})
+	defer func(f func(*reverseproxy.Upstream) int) { upstreamRequests = f }(upstreamRequests)
+	upstreamRequests = func(up *reverseproxy.Upstream) int {
+		select {
+		case <-finish:
+			return 0
+		default:
+		}
+		if up.Dial == "10.0.0.1:80" {
+			return 1
+		}
+		return 0
+	}
+
+	// 清理期间和清理之后，仍在使用旧配置的请求继续拿到最后的上游列表
+	stop := make(chan struct{})
+	var lookups, failures atomic.Int64
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if ups, err := d.GetUpstreams(httptest.NewRequest(http.MethodGet, "/", nil)); err != nil || len(ups) != 2 {
+					failures.Add(1)
+				}
+				lookups.Add(1)
+			}
+		}()
+	}
+
+	cleaned := make(chan error, 1)
+	go func() { cleaned <- d.Cleanup() }()
+	select {
+	case err := <-cleaned:
+		t.Fatalf("Cleanup returned %v with a request still in flight", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	close(finish)
+	select {
+	case err := <-cleaned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cleanup did not return after the in-flight request finished")
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if lookups.Load() == 0 || failures.Load() != 0 {
+		t.Fatalf("got %d failed lookups out of %d during teardown, want none", failures.Load(), lookups.Load())
+	}
+}
+
+func TestCleanupDrainTimesOut(t *testing.T) {
+	d := fileModule(t, "cleanup_drain_timeout 200ms", "10.0.0.1:80")
+	defer func(f func(*reverseproxy.Upstream) int) { upstreamRequests = f }(upstreamRequests)
+	upstreamRequests = func(*reverseproxy.Upstream) int { return 1 }
+
+	start := time.Now()
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Cleanup took %v, want it bounded by cleanup_drain_timeout", elapsed)
+	}
+}
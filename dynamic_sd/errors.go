@@ -0,0 +1,44 @@
+package dynamic_sd
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+)
+
+// ConfigError 表示 dynamic_sd 或 provider 的配置无效，由 Provision、Validate 和 GetUpstreams 返回。
+// 调用方可以通过 errors.As 区分配置错误和运行时的发现失败。
+type ConfigError = discovery.ConfigError
+
+// DiscoveryError 表示运行时无法从注册中心得到可用的上游，通常是暂时性的，可以重试。
+type DiscoveryError = discovery.DiscoveryError
+
+// noProviderError 返回没有配置 provider 时的错误。
+func noProviderError() error {
+	return &ConfigError{Err: errors.New("no service discovery provider is configured: " +
+		"add a 'provider <name> { ... }' block to dynamic_sd in the Caddyfile, " +
+		"or a \"provider\" object with a \"type\" field in the JSON config")}
+}
+
+// noUpstreamsError 把 provider 没有可用上游的错误包装为带有刷新状态的 NoUpstreamsError，
+// 并以结构化字段记录一条警告日志；provider 返回的配置错误保持不变。
+func (d *DynamicSD) noUpstreamsError(entry providerEntry, err error) error {
+	var ce *ConfigError
+	if errors.As(err, &ce) {
+		return err
+	}
+	nue := &discovery.NoUpstreamsError{
+		Provider: entry.typeName,
+		Service:  entry.provider.Service(),
+		Err:      err,
+	}
+	if st, ok := metrics.Lookup(nue.Provider, nue.Service); ok {
+		nue.LastRefresh = st.LastRefresh
+		nue.LastError = st.LastError
+	}
+	d.logger.Warn("no upstreams available", zap.Object("no_upstreams", nue))
+	return &DiscoveryError{Err: nue}
+}
@@ -0,0 +1,67 @@
+package dynamic_sd
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+)
+
+func TestNoUpstreamsErrorLogsFields(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	d := &DynamicSD{logger: zap.New(core)}
+	metrics.RecordResult("consul", "errors-test", 0, errors.New("connection refused"))
+
+	entry := providerEntry{typeName: "consul", provider: &stubProvider{service: "errors-test"}}
+	err := d.noUpstreamsError(entry, errors.New("no healthy upstreams"))
+
+	var nue *discovery.NoUpstreamsError
+	if !errors.As(err, &nue) {
+		t.Fatalf("got %T, want a NoUpstreamsError", err)
+	}
+	var de *DiscoveryError
+	if !errors.As(err, &de) {
+		t.Fatalf("got %T, want a DiscoveryError", err)
+	}
+
+	if logs.Len() != 1 {
+		t.Fatalf("got %d log entries, want 1", logs.Len())
+	}
+	fields, ok := logs.All()[0].ContextMap()["no_upstreams"].(map[string]any)
+	if !ok {
+		t.Fatalf("no_upstreams field missing: %v", logs.All()[0].ContextMap())
+	}
+	want := map[string]string{
+		"provider":   "consul",
+		"service":    "errors-test",
+		"last_error": "connection refused",
+		"error":      "no healthy upstreams",
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("field %s = %v, want %s", k, fields[k], v)
+		}
+	}
+	if _, ok := fields["last_refresh"]; !ok {
+		t.Error("field last_refresh missing")
+	}
+}
+
+func TestNoUpstreamsErrorKeepsConfigError(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	d := &DynamicSD{logger: zap.New(core)}
+	cfg := &ConfigError{Err: errors.New("bad config")}
+
+	err := d.noUpstreamsError(providerEntry{provider: &stubProvider{}}, cfg)
+	if err != cfg {
+		t.Fatalf("got %v, want the original ConfigError", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("got %d log entries, want none", logs.Len())
+	}
+}
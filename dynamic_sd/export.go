@@ -0,0 +1,87 @@
+package dynamic_sd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// exportFile 是写入 export_file 的上游列表，供 sidecar 或脚本读取 Caddy 的服务发现结果。
+type exportFile struct {
+	Providers []exportProvider `json:"providers"`
+}
+
+// exportProvider 是一个 provider 当前的上游列表。
+type exportProvider struct {
+	// Name 是命名 provider 的名字，默认 provider 为空。
+	Name      string           `json:"name,omitempty"`
+	Provider  string           `json:"provider"`
+	Service   string           `json:"service"`
+	Upstreams []exportUpstream `json:"upstreams"`
+}
+
+// exportUpstream 是 exportProvider 中的一个上游，地址是 provider 给出的原始地址（改写、解析之前）。
+type exportUpstream struct {
+	Dial       string            `json:"dial"`
+	ID         string            `json:"id,omitempty"`
+	Hostname   string            `json:"hostname,omitempty"`
+	Weight     float64           `json:"weight,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	Protocols  []string          `json:"protocols,omitempty"`
+	// Departing 为 true 表示实例已从注册中心移除，正处于 scale_in_grace 期间。
+	Departing bool `json:"departing,omitempty"`
+}
+
+// exportUpstreams 在任意 provider 更新后把所有 provider 当前的上游写入 ExportFile，内容没有变化时不重写。
+// 写入失败只记录日志，不影响转发。
+func (d *DynamicSD) exportUpstreams() {
+	if d.ExportFile == "" {
+		return
+	}
+	d.exportMu.Lock()
+	defer d.exportMu.Unlock()
+
+	export := exportFile{Providers: []exportProvider{}}
+	for _, entry := range d.allProviders() {
+		ep := exportProvider{
+			Name:      entry.name,
+			Provider:  entry.typeName,
+			Service:   entry.provider.Service(),
+			Upstreams: []exportUpstream{},
+		}
+		for _, in := range entry.provider.Instances() {
+			ep.Upstreams = append(ep.Upstreams, exportUpstream{
+				Dial:       in.Upstream.Dial,
+				ID:         in.ID,
+				Hostname:   in.Hostname,
+				Weight:     in.Weight,
+				Metadata:   in.Metadata,
+				Tags:       in.Tags,
+				Host:       in.Host,
+				PathPrefix: in.PathPrefix,
+				Protocols:  in.Protocols,
+				Departing:  in.Departing(),
+			})
+		}
+		export.Providers = append(export.Providers, ep)
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		d.logger.Error("failed to write export file", zap.String("export_file", d.ExportFile), zap.Error(fmt.Errorf("encoding upstreams: %v", err)))
+		return
+	}
+	if bytes.Equal(data, d.exported) {
+		return
+	}
+	if err := writeFileAtomic(d.ExportFile, data); err != nil {
+		d.logger.Error("failed to write export file", zap.String("export_file", d.ExportFile), zap.Error(err))
+		return
+	}
+	d.exported = data
+}
@@ -0,0 +1,160 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/providers/file"
+)
+
+// readExport 读取并解析 export_file，文件不存在时返回 false。
+func readExport(t *testing.T, path string) (exportFile, bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return exportFile{}, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export exportFile
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatalf("export file is not valid JSON: %v", err)
+	}
+	return export, true
+}
+
+// exportedDials 返回导出文件中第一个 provider 的上游地址。
+func exportedDials(export exportFile) []string {
+	var dials []string
+	if len(export.Providers) > 0 {
+		for _, up := range export.Providers[0].Upstreams {
+			dials = append(dials, up.Dial)
+		}
+	}
+	return dials
+}
+
+func TestExportFileRewrittenOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.json")
+	d := fileModule(t, "export_file "+path, "10.0.0.1:80", "10.0.0.2:80")
+
+	waitFor(t, func() bool {
+		export, ok := readExport(t, path)
+		return ok && len(exportedDials(export)) == 2
+	})
+	export, _ := readExport(t, path)
+	if p := export.Providers[0]; p.Provider != "file" || p.Name != "" {
+		t.Fatalf("got provider %+v, want the default file provider", p)
+	}
+
+	upstreams := d.provider.(*file.FileProvider).Path
+	tmp := upstreams + ".tmp"
+	if err := os.WriteFile(tmp, []byte("10.0.0.3:80\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, upstreams); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		export, _ := readExport(t, path)
+		dials := exportedDials(export)
+		return len(dials) == 1 && dials[0] == "10.0.0.3:80"
+	})
+}
+
+func TestExportIncludesMetadataAndWeights(t *testing.T) {
+	in := discovery.NewInstance("10.0.0.1:80", map[string]string{"version": "v2"}, 3)
+	in.ID = "api-1"
+	in.Tags = []string{"canary"}
+	path := filepath.Join(t.TempDir(), "export.json")
+	d := &DynamicSD{
+		ExportFile:   path,
+		logger:       zap.NewNop(),
+		providerName: "consul",
+		provider: &instancesProvider{
+			stubProvider: stubProvider{service: "api"},
+			instances:    []*discovery.Instance{in},
+		},
+	}
+	d.exportUpstreams()
+
+	export, ok := readExport(t, path)
+	if !ok || len(export.Providers) != 1 || len(export.Providers[0].Upstreams) != 1 {
+		t.Fatalf("got %+v, want one provider with one upstream", export)
+	}
+	up := export.Providers[0].Upstreams[0]
+	if up.ID != "api-1" || up.Weight != 3 || up.Metadata["version"] != "v2" || len(up.Tags) != 1 || up.Tags[0] != "canary" {
+		t.Fatalf("got %+v, want the instance's ID, weight, metadata and tags", up)
+	}
+
+	// 内容没有变化时不重写
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := stat.ModTime().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	d.exportUpstreams()
+	if stat, err = os.Stat(path); err != nil || !stat.ModTime().Equal(old) {
+		t.Fatalf("export file was rewritten without a change: %v", err)
+	}
+}
+
+func TestExportWriteErrorIsLogged(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	d := &DynamicSD{
+		ExportFile: filepath.Join(t.TempDir(), "missing", "export.json"),
+		logger:     zap.New(core),
+		provider:   &instancesProvider{instances: []*discovery.Instance{discovery.NewInstance("10.0.0.1:80", nil, 0)}},
+	}
+	d.exportUpstreams()
+	if logs.FilterMessage("failed to write export file").Len() != 1 {
+		t.Fatalf("got logs %v, want one export error", logs.All())
+	}
+	if d.exported != nil {
+		t.Fatal("failed write was recorded as exported")
+	}
+}
+
+func TestProtocolsFromMetadata(t *testing.T) {
+	prov := storeProvider(t, func(s *discovery.Store) { s.ProtocolMetadataKey = "alt_svc" },
+		discovery.NewInstance("10.0.0.1:443", map[string]string{"alt_svc": `h3=":443"; ma=86400, H2=":443", h3-29=":443"`}, 0),
+		discovery.NewInstance("10.0.0.2:443", map[string]string{"alt_svc": "h2"}, 0),
+		discovery.NewInstance("10.0.0.3:443", nil, 0),
+	)
+	tests := []struct {
+		want []string
+		h3   bool
+	}{
+		{[]string{"h3", "h2", "h3-29"}, true},
+		{[]string{"h2"}, false},
+		{nil, false},
+	}
+	for i, tt := range tests {
+		in := prov.instances[i]
+		if !slices.Equal(in.Protocols, tt.want) || in.SupportsProtocol("h3") != tt.h3 {
+			t.Errorf("%s: got protocols %v, want %v", in.Upstream.Dial, in.Protocols, tt.want)
+		}
+	}
+
+	// 协议能力随上游一起导出，供外部的 transport 选择 HTTP/3
+	path := filepath.Join(t.TempDir(), "export.json")
+	d := &DynamicSD{ExportFile: path, logger: zap.NewNop(), provider: prov}
+	d.exportUpstreams()
+	export, _ := readExport(t, path)
+	if got := export.Providers[0].Upstreams[0].Protocols; !slices.Equal(got, tests[0].want) {
+		t.Fatalf("got exported protocols %v, want %v", got, tests[0].want)
+	}
+}
@@ -0,0 +1,58 @@
+package dynamic_sd
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+// upstreamFails 返回上游当前的被动健康检查失败次数，还没有被反向代理使用过的上游为 0。
+// 反向代理只能在内部增加失败次数，测试通过替换这个变量模拟失败。
+var upstreamFails = func(up *reverseproxy.Upstream) int {
+	if up.Host == nil {
+		return 0
+	}
+	return up.Host.Fails()
+}
+
+// dropFailing 丢弃被动健康检查失败次数已经达到实例自己的 FailThreshold 的上游。
+//
+// 反向代理的 max_fails 对所有上游生效，Caddy 不支持按上游设置阈值，因此由这里在返回上游列表之前补充检查：
+// 失败次数仍由反向代理的被动健康检查统计（需要配置 fail_duration），并按 fail_duration 过期。
+// 实例的阈值只有小于 max_fails 时才有意义，例如让 canary 实例失败一次就被摘除；
+// 需要对某些实例放宽阈值时，应把 max_fails 设为较大的值，再为其余实例登记较小的阈值。
+// 还没有被反向代理使用过的上游没有失败记录，总是被保留。
+func (d *DynamicSD) dropFailing(prov providers.Provider, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	// 阈值按改写之后的地址索引，解析展开的上游通过 origin 找回解析之前的地址
+	var thresholds map[string]int
+	for _, in := range prov.Instances() {
+		if in.FailThreshold <= 0 {
+			continue
+		}
+		if thresholds == nil {
+			thresholds = make(map[string]int)
+		}
+		dial := in.Upstream.Dial
+		if d.rewriter != nil {
+			dial = d.rewriter.rewriteOne(in.Upstream).Dial
+		}
+		thresholds[dial] = in.FailThreshold
+	}
+	if len(thresholds) == 0 {
+		return upstreams
+	}
+
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		dial := up.Dial
+		if d.resolver != nil {
+			if origin, ok := d.resolver.origin(dial); ok {
+				dial = origin
+			}
+		}
+		if threshold, ok := thresholds[dial]; ok && upstreamFails(up) >= threshold {
+			continue
+		}
+		kept = append(kept, up)
+	}
+	return kept
+}
@@ -0,0 +1,41 @@
+package dynamic_sd
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+func TestDropFailingUsesInstanceThreshold(t *testing.T) {
+	canary := discovery.NewInstance("10.0.0.1:80", nil, 0)
+	canary.FailThreshold = 1
+	strict := discovery.NewInstance("10.0.0.2:80", nil, 0)
+	strict.FailThreshold = 3
+	plain := discovery.NewInstance("10.0.0.3:80", nil, 0)
+	prov := &instancesProvider{instances: []*discovery.Instance{canary, strict, plain}}
+
+	fails := map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 2, "10.0.0.3:80": 10}
+	defer func(f func(*reverseproxy.Upstream) int) { upstreamFails = f }(upstreamFails)
+	upstreamFails = func(up *reverseproxy.Upstream) int { return fails[up.Dial] }
+
+	d := &DynamicSD{}
+	got := d.dropFailing(prov, []*reverseproxy.Upstream{canary.Upstream, strict.Upstream, plain.Upstream})
+	// canary 达到自己的阈值被丢弃；strict 还没有达到；plain 没有阈值，由反向代理的 max_fails 处理
+	if len(got) != 2 || got[0].Dial != "10.0.0.2:80" || got[1].Dial != "10.0.0.3:80" {
+		t.Fatalf("got %v, want 10.0.0.2:80 and 10.0.0.3:80", got)
+	}
+
+	fails["10.0.0.2:80"] = 3
+	got = d.dropFailing(prov, []*reverseproxy.Upstream{canary.Upstream, strict.Upstream, plain.Upstream})
+	if len(got) != 1 || got[0].Dial != "10.0.0.3:80" {
+		t.Fatalf("got %v, want only 10.0.0.3:80", got)
+	}
+}
+
+func TestUpstreamFailsWithoutHost(t *testing.T) {
+	if n := upstreamFails(&reverseproxy.Upstream{Dial: "10.0.0.1:80"}); n != 0 {
+		t.Fatalf("got %d fails for an upstream the proxy never used, want 0", n)
+	}
+}
@@ -0,0 +1,99 @@
+package dynamic_sd
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// defaultHashReplicas 是权重最大的上游在哈希环上对应的虚拟节点数。
+const defaultHashReplicas = 160
+
+// hashRing 是一个基于虚拟节点的一致性哈希环。
+// 当上游集合发生少量变化时，大部分 key 仍会映射到原来的上游。
+type hashRing struct {
+	// src 是构建哈希环时使用的上游切片，用于检测上游集合是否发生了变化。
+	src []*reverseproxy.Upstream
+
+	points []uint32
+	owners map[uint32]int
+}
+
+// newHashRing 根据给定的上游列表构建哈希环。
+// weight 返回每个上游的权重，权重越大，在环上占据的虚拟节点越多。
+// 权重按最大值归一化，权重最大的上游占据 defaultHashReplicas 个虚拟节点。
+func newHashRing(upstreams []*reverseproxy.Upstream, weight func(*reverseproxy.Upstream) float64) *hashRing {
+	ring := &hashRing{
+		src:    upstreams,
+		owners: make(map[uint32]int),
+	}
+
+	weights := make([]float64, len(upstreams))
+	maxWeight := 0.0
+	for i, up := range upstreams {
+		weights[i] = 1
+		if weight != nil {
+			if w := weight(up); w > 0 {
+				weights[i] = w
+			}
+		}
+		maxWeight = math.Max(maxWeight, weights[i])
+	}
+
+	for i, up := range upstreams {
+		replicas := int(math.Ceil(defaultHashReplicas * weights[i] / maxWeight))
+		for j := 0; j < replicas; j++ {
+			p := hashKey(up.Dial + "#" + strconv.Itoa(j))
+			// 发生哈希冲突时保留先加入的节点，保证结果确定
+			if _, ok := ring.owners[p]; ok {
+				continue
+			}
+			ring.owners[p] = i
+			ring.points = append(ring.points, p)
+		}
+	}
+	sort.Slice(ring.points, func(a, b int) bool { return ring.points[a] < ring.points[b] })
+	return ring
+}
+
+// builtFrom 报告哈希环是否由给定的上游切片构建而来。
+// 地址未变化的上游会在刷新之间复用同一个对象，但权重可能已经改变，
+// 因此比较的是切片本身而不是其中的元素：provider 每次刷新都会发布一个新的切片。
+func (hr *hashRing) builtFrom(upstreams []*reverseproxy.Upstream) bool {
+	if len(hr.src) != len(upstreams) {
+		return false
+	}
+	return len(upstreams) == 0 || &hr.src[0] == &upstreams[0]
+}
+
+// lookup 返回从 key 在环上的位置开始顺时针遍历得到的、去重后的上游列表。
+// 列表的第一个元素即为 key 对应的上游，后续元素可作为故障转移的备选。
+func (hr *hashRing) lookup(key string) []*reverseproxy.Upstream {
+	if len(hr.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= h })
+
+	ordered := make([]*reverseproxy.Upstream, 0, len(hr.src))
+	seen := make(map[int]struct{}, len(hr.src))
+	for i := 0; i < len(hr.points) && len(ordered) < len(hr.src); i++ {
+		idx := hr.owners[hr.points[(start+i)%len(hr.points)]]
+		if _, ok := seen[idx]; ok {
+			continue
+		}
+		seen[idx] = struct{}{}
+		ordered = append(ordered, hr.src[idx])
+	}
+	return ordered
+}
+
+// hashKey 使用 FNV-1a 计算字符串的 32 位哈希值。
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
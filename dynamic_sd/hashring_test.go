@@ -0,0 +1,60 @@
+package dynamic_sd
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func testUpstreams(dials ...string) []*reverseproxy.Upstream {
+	ups := make([]*reverseproxy.Upstream, len(dials))
+	for i, dial := range dials {
+		ups[i] = &reverseproxy.Upstream{Dial: dial}
+	}
+	return ups
+}
+
+func TestHashRingKeyStability(t *testing.T) {
+	dials := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}
+	ring := newHashRing(testUpstreams(dials...), nil)
+	// 用新的切片重建（provider 的下一次刷新）时，每个 key 仍然映射到同一个上游
+	rebuilt := newHashRing(testUpstreams(dials...), nil)
+	// 移除一个上游时，只有原来映射到它的 key 改变映射
+	shrunk := newHashRing(testUpstreams(dials[:3]...), nil)
+
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		got := ring.lookup(key)
+		if len(got) != len(dials) {
+			t.Fatalf("lookup(%s) returned %d upstreams, want %d", key, len(got), len(dials))
+		}
+		if again := rebuilt.lookup(key)[0].Dial; again != got[0].Dial {
+			t.Fatalf("lookup(%s) = %s after rebuild, want %s", key, again, got[0].Dial)
+		}
+		if got[0].Dial == dials[3] {
+			continue
+		}
+		if after := shrunk.lookup(key)[0].Dial; after != got[0].Dial {
+			t.Fatalf("lookup(%s) moved from %s to %s after removing %s", key, got[0].Dial, after, dials[3])
+		}
+	}
+}
+
+func TestHashRingWeightedDistribution(t *testing.T) {
+	ups := testUpstreams("10.0.0.1:80", "10.0.0.2:80")
+	weights := map[string]float64{"10.0.0.1:80": 1, "10.0.0.2:80": 3}
+	ring := newHashRing(ups, func(up *reverseproxy.Upstream) float64 { return weights[up.Dial] })
+
+	const keys = 10000
+	heavy := 0
+	for i := 0; i < keys; i++ {
+		if ring.lookup("key-" + strconv.Itoa(i))[0].Dial == "10.0.0.2:80" {
+			heavy++
+		}
+	}
+	// 权重 3:1 时较重的上游应得到明显多于一半的 key，虚拟节点有限，只检查一个宽松的范围
+	if share := float64(heavy) / keys; share < 0.6 || share > 0.85 {
+		t.Fatalf("upstream with weight 3 got %.2f of keys, want between 0.60 and 0.85", share)
+	}
+}
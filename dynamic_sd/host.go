@@ -0,0 +1,99 @@
+package dynamic_sd
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+const (
+	// upstreamHostPlaceholder 是被选中上游的目标 Host，配合 `header_up Host {dynamic_sd.upstream.host}` 使用。
+	// 实例没有通过 host_metadata_key 取得 Host 时，返回上游的 "host:port"，resolve_hostnames 展开的上游返回解析之前的主机名。
+	upstreamHostPlaceholder = "dynamic_sd.upstream.host"
+
+	// upstreamIDPlaceholder 是被选中上游在注册中心中的实例 ID，provider 没有提供时为空，
+	// 例如用 `header_down X-Upstream-ID {dynamic_sd.upstream.id}` 按实例身份而不是 IP 关联日志。
+	upstreamIDPlaceholder = "dynamic_sd.upstream.id"
+
+	// upstreamTagsPlaceholder 是被选中上游在注册中心中的标签，以逗号分隔，例如用于 header_down 或访问日志。
+	upstreamTagsPlaceholder = "dynamic_sd.upstream.tags"
+
+	// upstreamPathPrefixPlaceholder 是被选中上游通过 path_prefix_metadata_key 取得的路径前缀，没有时为空，
+	// 例如用 `header_up X-Forwarded-Prefix {dynamic_sd.upstream.path_prefix}` 告诉后端被剥离的前缀。
+	upstreamPathPrefixPlaceholder = "dynamic_sd.upstream.path_prefix"
+
+	// upstreamMetaPlaceholderPrefix 加上 metadata 的 key 是被选中上游的对应属性，
+	// 例如 {dynamic_sd.upstream.meta.version}，实例没有该属性时为空。
+	upstreamMetaPlaceholderPrefix = "dynamic_sd.upstream.meta."
+
+	// hostMappedVar 标记当前请求的 replacer 已经注册过 upstreamHostPlaceholder，
+	// 反向代理重试时会再次调用 GetUpstreams，避免重复注册。
+	hostMappedVar = "dynamic_sd.host_mapped"
+)
+
+// provideUpstreamHost 为请求注册 upstreamHostPlaceholder 以及上游 ID、标签、路径前缀和 metadata 的占位符。
+// 占位符在反向代理选中上游、设置 {http.reverse_proxy.upstream.hostport} 之后才会被求值，
+// 因此它总是对应本次实际转发的上游。
+func (d *DynamicSD) provideUpstreamHost(r *http.Request, prov providers.Provider) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	if mapped, _ := caddyhttp.GetVar(r.Context(), hostMappedVar).(bool); mapped {
+		return
+	}
+	caddyhttp.SetVar(r.Context(), hostMappedVar, true)
+
+	repl.Map(func(key string) (any, bool) {
+		if key != upstreamHostPlaceholder && key != upstreamIDPlaceholder && key != upstreamTagsPlaceholder && key != upstreamPathPrefixPlaceholder &&
+			!strings.HasPrefix(key, upstreamMetaPlaceholderPrefix) {
+			return nil, false
+		}
+		hostport, ok := repl.GetString("http.reverse_proxy.upstream.hostport")
+		if !ok {
+			return nil, false
+		}
+		if d.resolver != nil {
+			if origin, ok := d.resolver.origin(hostport); ok {
+				hostport = origin
+			}
+		}
+		in := d.upstreamInstance(prov, hostport)
+
+		switch {
+		case key == upstreamHostPlaceholder:
+			if in != nil && in.Host != "" {
+				return in.Host, true
+			}
+			return hostport, true
+		case in == nil:
+			return "", true
+		case key == upstreamIDPlaceholder:
+			return in.ID, true
+		case key == upstreamTagsPlaceholder:
+			return strings.Join(in.Tags, ","), true
+		case key == upstreamPathPrefixPlaceholder:
+			return in.PathPrefix, true
+		default:
+			return in.Metadata[strings.TrimPrefix(key, upstreamMetaPlaceholderPrefix)], true
+		}
+	})
+}
+
+// upstreamInstance 返回 prov 中地址为 dial 的实例，dial 是改写之后的地址，找不到时返回 nil。
+func (d *DynamicSD) upstreamInstance(prov providers.Provider, dial string) *discovery.Instance {
+	for _, in := range prov.Instances() {
+		instDial := in.Upstream.Dial
+		if d.rewriter != nil {
+			instDial = d.rewriter.rewriteOne(in.Upstream).Dial
+		}
+		if instDial == dial {
+			return in
+		}
+	}
+	return nil
+}
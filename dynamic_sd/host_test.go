@@ -0,0 +1,98 @@
+package dynamic_sd
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// storeProvider 经由 configure 配置的 Store 发布 instances，返回持有发布后实例的 provider。
+func storeProvider(t *testing.T, configure func(*discovery.Store), instances ...*discovery.Instance) *instancesProvider {
+	t.Helper()
+	var s discovery.Store
+	configure(&s)
+	s.Setup(zap.NewNop(), "store-provider")
+	if !s.Update(instances) {
+		t.Fatal("store rejected the update")
+	}
+	return &instancesProvider{instances: s.Instances()}
+}
+
+// upstreamPlaceholder 模拟反向代理选中地址为 hostport 的上游之后对 placeholder 求值。
+func upstreamPlaceholder(d *DynamicSD, prov *instancesProvider, hostport, placeholder string) string {
+	repl := caddy.NewReplacer()
+	ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, make(map[string]any))
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+	d.provideUpstreamHost(r, prov)
+	repl.Set("http.reverse_proxy.upstream.hostport", hostport)
+	return repl.ReplaceAll("{"+placeholder+"}", "")
+}
+
+func TestUpstreamHostFromMetadata(t *testing.T) {
+	prov := storeProvider(t, func(s *discovery.Store) { s.HostMetadataKey = "vhost" },
+		discovery.NewInstance("10.0.0.1:80", map[string]string{"vhost": "api.example.com"}, 0),
+		discovery.NewInstance("10.0.0.2:80", nil, 0),
+	)
+	if got := prov.instances[0].Host; got != "api.example.com" {
+		t.Fatalf("got host %q captured from metadata, want api.example.com", got)
+	}
+
+	d := &DynamicSD{}
+	tests := []struct {
+		hostport string
+		want     string
+	}{
+		{"10.0.0.1:80", "api.example.com"},
+		// 实例没有 Host 时返回上游本身的地址
+		{"10.0.0.2:80", "10.0.0.2:80"},
+		{"10.0.0.9:80", "10.0.0.9:80"},
+	}
+	for _, tt := range tests {
+		if got := upstreamPlaceholder(d, prov, tt.hostport, upstreamHostPlaceholder); got != tt.want {
+			t.Errorf("upstream %s: got host %q, want %q", tt.hostport, got, tt.want)
+		}
+	}
+
+	// 反向代理看到的是改写之后的地址，仍然能找到对应的实例
+	rewriter, err := newDialRewriter([]*DialRewrite{{Match: `^10\.0\.0\.1:80$`, Replace: "nat.example.com:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.rewriter = rewriter
+	if got := upstreamPlaceholder(d, prov, "nat.example.com:8080", upstreamHostPlaceholder); got != "api.example.com" {
+		t.Fatalf("got host %q for the rewritten upstream, want api.example.com", got)
+	}
+}
+
+func TestUpstreamPathPrefixFromMetadata(t *testing.T) {
+	prov := storeProvider(t, func(s *discovery.Store) { s.PathPrefixMetadataKey = "prefix" },
+		discovery.NewInstance("10.0.0.1:80", map[string]string{"prefix": "orders/"}, 0),
+		discovery.NewInstance("10.0.0.2:80", map[string]string{"prefix": "/"}, 0),
+		discovery.NewInstance("10.0.0.3:80", nil, 0),
+	)
+
+	d := &DynamicSD{}
+	tests := []struct {
+		hostport string
+		want     string
+	}{
+		// 前缀被规范为以 "/" 开头、不以 "/" 结尾
+		{"10.0.0.1:80", "/orders"},
+		{"10.0.0.2:80", ""},
+		{"10.0.0.3:80", ""},
+		{"10.0.0.9:80", ""},
+	}
+	for _, tt := range tests {
+		if got := upstreamPlaceholder(d, prov, tt.hostport, upstreamPathPrefixPlaceholder); got != tt.want {
+			t.Errorf("upstream %s: got path prefix %q, want %q", tt.hostport, got, tt.want)
+		}
+	}
+}
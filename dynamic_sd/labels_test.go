@@ -0,0 +1,79 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProviderLabelsAppearInLogs(t *testing.T) {
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		named_provider users file {
+			path ` + upstreamsFile(t, "10.0.0.1:80") + `
+			label team payments
+			label env prod
+		}
+		provider_key {http.request.header.X-Service}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	entry := d.named["users"]
+	if err := entry.provider.Provision(providerLogger(zap.New(core), entry)); err != nil {
+		t.Fatal(err)
+	}
+	defer entry.provider.Cleanup()
+
+	provisioning := logs.FilterMessage("provisioning file service discovery provider").All()
+	if len(provisioning) != 1 {
+		t.Fatalf("got logs %v, want one provisioning log", logs.All())
+	}
+	fields := provisioning[0].ContextMap()
+	labels, _ := fields["labels"].(map[string]string)
+	if want := map[string]string{"team": "payments", "env": "prod"}; !maps.Equal(labels, want) || fields["named_provider"] != "users" {
+		t.Fatalf("got fields %v, want labels %v and named_provider users", fields, want)
+	}
+}
+
+func TestProviderLabelsValidate(t *testing.T) {
+	var tooMany strings.Builder
+	for i := range 9 {
+		fmt.Fprintf(&tooMany, "label key%d value\n", i)
+	}
+	tests := []struct {
+		labels string
+		want   string
+	}{
+		{"label 9team payments", "invalid label key"},
+		{"label team-name payments", "invalid label key"},
+		{"label __name payments", "invalid label key"},
+		{tooMany.String(), "at most 8 labels"},
+	}
+	for _, tt := range tests {
+		d := new(DynamicSD)
+		err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+			provider file {
+				path /tmp/upstreams
+				` + tt.labels + `
+			}
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want an error containing %q", tt.labels, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package dynamic_sd
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+const (
+	// latencyAlpha 是 EWMA 的平滑系数，越大越偏向最近一次的测量结果。
+	latencyAlpha = 0.3
+
+	// defaultProbeInterval 是 latency_aware 模式下默认的主动探测间隔。
+	defaultProbeInterval = 10 * time.Second
+
+	// probeTimeout 是单次探测的超时时间，探测失败的上游按该值计入延迟。
+	probeTimeout = 2 * time.Second
+
+	// defaultProbeConcurrency 是同时进行的探测的默认上限，避免上游很多时占满文件描述符。
+	defaultProbeConcurrency = 32
+)
+
+// latencyTracker 记录每个上游地址的延迟 EWMA，由主动探测（TCP 建连耗时）驱动。
+type latencyTracker struct {
+	mu   sync.RWMutex
+	ewma map[string]float64
+	// pending 是探测失败而被摘除、等待重新探测的地址，只在配置了 recheck_interval 时使用。
+	pending map[string]struct{}
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{ewma: make(map[string]float64), pending: make(map[string]struct{})}
+}
+
+// observe 将一次测量结果计入 dial 的 EWMA。
+func (lt *latencyTracker) observe(dial string, rtt time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	sample := float64(rtt)
+	if prev, ok := lt.ewma[dial]; ok {
+		sample = latencyAlpha*sample + (1-latencyAlpha)*prev
+	}
+	lt.ewma[dial] = sample
+}
+
+// forget 删除不在 dials 中的地址，避免已下线的上游一直留在表中。
+func (lt *latencyTracker) forget(dials map[string]struct{}) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for dial := range lt.ewma {
+		if _, ok := dials[dial]; !ok {
+			delete(lt.ewma, dial)
+		}
+	}
+	for dial := range lt.pending {
+		if _, ok := dials[dial]; !ok {
+			delete(lt.pending, dial)
+		}
+	}
+}
+
+// sorted 返回按延迟 EWMA 从低到高排序的上游列表副本。
+// 尚未测量过的上游排在已测量的上游之后，保持原有的相对顺序。
+func (lt *latencyTracker) sorted(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	lt.mu.RLock()
+	latency := make([]float64, len(upstreams))
+	for i, up := range upstreams {
+		latency[i] = math.Inf(1)
+		if v, ok := lt.ewma[up.Dial]; ok {
+			latency[i] = v
+		}
+	}
+	lt.mu.RUnlock()
+
+	idx := make([]int, len(upstreams))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return latency[idx[a]] < latency[idx[b]] })
+
+	ordered := make([]*reverseproxy.Upstream, len(upstreams))
+	for i, j := range idx {
+		ordered[i] = upstreams[j]
+	}
+	return ordered
+}
+
+// probeLoop 每隔 interval 对 provider 当前的所有上游进行一次探测，直到 ctx 被取消。
+// 每一轮最多同时进行 ProbeConcurrency 个探测，总耗时不超过 ProbeBudget（默认为 interval）。
+func (d *DynamicSD) probeLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	concurrency := d.ProbeConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultProbeConcurrency
+	}
+	budget := time.Duration(d.ProbeBudget)
+	if budget <= 0 {
+		budget = interval
+	}
+
+	for {
+		d.probeAll(ctx, concurrency, budget)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeAll 对每个上游建立一次 TCP 连接，并将建连耗时计入 EWMA。
+// 最多同时进行 concurrency 个探测；budget 用完时尚未探测或被中断的上游保留之前的 EWMA，
+// 从未测量过的上游继续排在已测量的上游之后。
+func (d *DynamicSD) probeAll(ctx context.Context, concurrency int, budget time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	instances := d.provider.Instances()
+	dials := make(map[string]struct{}, len(instances))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for _, in := range instances {
+		dial := in.Upstream.Dial
+		if _, ok := dials[dial]; ok {
+			continue
+		}
+		dials[dial] = struct{}{}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if rtt, up, ok := probe(ctx, dial); ok {
+				d.recordProbe(dial, rtt, up)
+			}
+		}()
+	}
+	wg.Wait()
+	d.latency.forget(dials)
+}
+
+// probe 返回与 dial 建立 TCP 连接的耗时，失败时 up 为 false 并返回 probeTimeout。
+// ctx 在探测完成之前结束（budget 用完或模块被清理）时 ok 为 false，此次探测不计入。
+// 测试通过替换这个变量模拟探测。
+var probe = func(ctx context.Context, dial string) (rtt time.Duration, up, ok bool) {
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(probeCtx, "tcp", dial)
+	if err != nil {
+		return probeTimeout, false, ctx.Err() == nil
+	}
+	rtt = time.Since(start)
+	conn.Close()
+	return rtt, true, true
+}
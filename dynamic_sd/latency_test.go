@@ -0,0 +1,150 @@
+package dynamic_sd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// closedAddr 返回一个刚刚关闭的本地监听地址，连接它会立即被拒绝。
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// instancesProvider 是一个返回固定实例列表的 provider。
+type instancesProvider struct {
+	stubProvider
+	instances []*discovery.Instance
+}
+
+func (p *instancesProvider) Instances() []*discovery.Instance { return p.instances }
+
+func TestLatencyTrackerOrdersByEWMA(t *testing.T) {
+	lt := newLatencyTracker()
+	lt.observe("10.0.0.1:80", 30*time.Millisecond)
+	lt.observe("10.0.0.2:80", 10*time.Millisecond)
+	lt.observe("10.0.0.3:80", 20*time.Millisecond)
+
+	ups := testUpstreams("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.5:80")
+	// 尚未测量过的上游排在最后，保持原有的相对顺序
+	assertDials(t, "initial", lt.sorted(ups), []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80", "10.0.0.4:80", "10.0.0.5:80"})
+	if ups[0].Dial != "10.0.0.1:80" {
+		t.Fatal("sorted reordered the provider's upstream list in place")
+	}
+
+	// 一次慢的测量只按 latencyAlpha 拉高 EWMA：10ms -> 0.3*40ms + 0.7*10ms = 19ms，仍快于 20ms
+	lt.observe("10.0.0.2:80", 40*time.Millisecond)
+	assertDials(t, "one slow sample", lt.sorted(ups[:3]), []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"})
+	// 持续变慢之后排到后面
+	lt.observe("10.0.0.2:80", 40*time.Millisecond)
+	lt.observe("10.0.0.2:80", 40*time.Millisecond)
+	assertDials(t, "consistently slow", lt.sorted(ups[:3]), []string{"10.0.0.3:80", "10.0.0.2:80", "10.0.0.1:80"})
+
+	lt.forget(map[string]struct{}{"10.0.0.3:80": {}})
+	assertDials(t, "forgotten", lt.sorted(ups[:3]), []string{"10.0.0.3:80", "10.0.0.1:80", "10.0.0.2:80"})
+}
+
+func TestProbeAllMeasuresRoundTrips(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	down := closedAddr(t)
+
+	d := &DynamicSD{
+		provider: &instancesProvider{instances: []*discovery.Instance{
+			discovery.NewInstance(down, nil, 0),
+			discovery.NewInstance(ln.Addr().String(), nil, 0),
+		}},
+		latency: newLatencyTracker(),
+	}
+	d.probeAll(context.Background(), defaultProbeConcurrency, time.Second)
+
+	// 探测失败的上游按 probeTimeout 计入延迟，排在可以连接的上游之后
+	ups := testUpstreams(down, ln.Addr().String())
+	assertDials(t, "probed", d.latency.sorted(ups), []string{ln.Addr().String(), down})
+	if got := d.latency.ewma[down]; got != float64(probeTimeout) {
+		t.Fatalf("got latency %v for the unreachable upstream, want %v", time.Duration(got), probeTimeout)
+	}
+}
+
+// fakeProbe 替换 probe，测试结束时恢复。
+func fakeProbe(t *testing.T, fn func(ctx context.Context, dial string) (time.Duration, bool, bool)) {
+	orig := probe
+	probe = fn
+	t.Cleanup(func() { probe = orig })
+}
+
+// manyInstances 返回一个有 n 个不同地址实例的 provider。
+func manyInstances(n int) *instancesProvider {
+	prov := &instancesProvider{}
+	for i := range n {
+		prov.instances = append(prov.instances, discovery.NewInstance(fmt.Sprintf("10.0.%d.%d:80", i/250, i%250+1), nil, 0))
+	}
+	return prov
+}
+
+func TestProbeAllRespectsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak, probed int
+	fakeProbe(t, func(ctx context.Context, dial string) (time.Duration, bool, bool) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		probed++
+		mu.Unlock()
+		return time.Millisecond, true, true
+	})
+
+	d := &DynamicSD{provider: manyInstances(40), latency: newLatencyTracker()}
+	d.probeAll(context.Background(), 4, time.Minute)
+
+	if peak > 4 {
+		t.Fatalf("got %d concurrent probes, want at most 4", peak)
+	}
+	if probed != 40 || len(d.latency.ewma) != 40 {
+		t.Fatalf("probed %d upstreams and measured %d, want all 40", probed, len(d.latency.ewma))
+	}
+}
+
+func TestProbeAllStopsAtBudget(t *testing.T) {
+	fakeProbe(t, func(ctx context.Context, dial string) (time.Duration, bool, bool) {
+		// 探测一直持续到 budget 用完
+		<-ctx.Done()
+		return probeTimeout, false, false
+	})
+
+	prov := manyInstances(10)
+	d := &DynamicSD{provider: prov, latency: newLatencyTracker()}
+	measured := prov.instances[9].Upstream.Dial
+	d.latency.observe(measured, 3*time.Millisecond)
+
+	start := time.Now()
+	d.probeAll(context.Background(), 2, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("probing took %v, want it bounded by the 50ms budget", elapsed)
+	}
+	// 被中断的探测不计入，之前的测量结果保留
+	if len(d.latency.ewma) != 1 || d.latency.ewma[measured] != float64(3*time.Millisecond) {
+		t.Fatalf("got latencies %v, want only the previous measurement of %s", d.latency.ewma, measured)
+	}
+}
@@ -0,0 +1,130 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+func init() {
+	caddy.RegisterModule(MatchUpstreamTag{})
+}
+
+// MatchUpstreamTag 在某个服务当前至少有一个可用实例满足所有条件时匹配请求，
+// 例如只在存在 canary 实例时把请求路由到对应的 handle 块：
+//
+//	@canary upstream_tag api canary version=v2
+//
+// 条件的形式为 "tag" 或 "key=value"：前者要求实例带有该标签（Consul 的 Service.Tags），
+// 后者要求实例的 metadata（Consul 的 Meta、Nacos 的 metadata、mDNS 的 TXT 记录）中 key 的值等于 value。
+// 服务名与 dynamic_sd 的 provider 配置的服务名相同，被隔离或正在预热、移除的实例不计入。
+type MatchUpstreamTag struct {
+	Service string   `json:"service,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// CaddyModule 返回 Caddy 模块信息。
+func (MatchUpstreamTag) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.upstream_tag",
+		New: func() caddy.Module { return new(MatchUpstreamTag) },
+	}
+}
+
+// Validate 检查必要的配置是否已提供。
+func (m MatchUpstreamTag) Validate() error {
+	if m.Service == "" {
+		return fmt.Errorf("upstream_tag: service is required")
+	}
+	if len(m.Tags) == 0 {
+		return fmt.Errorf("upstream_tag: at least one tag is required")
+	}
+	for _, tag := range m.Tags {
+		if tag == "" || strings.HasPrefix(tag, "=") {
+			return fmt.Errorf("upstream_tag: invalid tag '%s'", tag)
+		}
+	}
+	return nil
+}
+
+// Match 实现 caddyhttp.RequestMatcher。
+func (m MatchUpstreamTag) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError 实现 caddyhttp.RequestMatcherWithError。
+func (m MatchUpstreamTag) MatchWithError(r *http.Request) (bool, error) {
+	active.mu.Lock()
+	var matched []providers.Provider
+	for d := range active.set {
+		for _, entry := range d.allProviders() {
+			if entry.provider.Service() == m.Service {
+				matched = append(matched, entry.provider)
+			}
+		}
+	}
+	active.mu.Unlock()
+
+	now := time.Now()
+	for _, prov := range matched {
+		for _, in := range prov.Instances() {
+			if in.Retention(now) < 1 || cordoned.has(in.Upstream.Dial) {
+				continue
+			}
+			if m.matches(in) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matches 报告 in 是否满足所有条件。
+func (m MatchUpstreamTag) matches(in *discovery.Instance) bool {
+	for _, tag := range m.Tags {
+		if key, value, ok := strings.Cut(tag, "="); ok {
+			if v, found := in.Meta(key); !found || v != value {
+				return false
+			}
+			continue
+		}
+		if !in.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalCaddyfile 解析 `upstream_tag <service> <tag|key=value>...`。
+func (m *MatchUpstreamTag) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		m.Service = d.Val()
+		tags := d.RemainingArgs()
+		if len(tags) == 0 {
+			return d.ArgErr()
+		}
+		m.Tags = append(m.Tags, tags...)
+		if d.NextBlock(0) {
+			return d.Err("upstream_tag does not accept a block")
+		}
+	}
+	return nil
+}
+
+// 接口符合性检查：确保 MatchUpstreamTag 实现了匹配器所需的接口。
+var (
+	_ caddyhttp.RequestMatcherWithError = (*MatchUpstreamTag)(nil)
+	_ caddy.Validator                   = (*MatchUpstreamTag)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchUpstreamTag)(nil)
+)
@@ -0,0 +1,84 @@
+package dynamic_sd
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+func TestUpstreamTagMatchesRequest(t *testing.T) {
+	stable := discovery.NewInstance("10.0.0.1:80", map[string]string{"version": "v1"}, 0)
+	stable.Tags = []string{"primary"}
+	prov := &instancesProvider{
+		stubProvider: stubProvider{service: "tag-api"},
+		instances:    []*discovery.Instance{stable},
+	}
+	d := &DynamicSD{provider: prov}
+	registerActive(d)
+	t.Cleanup(func() { unregisterActive(d) })
+
+	var m MatchUpstreamTag
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`upstream_tag tag-api canary version=v2`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if m.Match(r) {
+		t.Fatal("matched without a canary instance")
+	}
+
+	canary := discovery.NewInstance("10.0.0.2:80", map[string]string{"version": "v2"}, 0)
+	canary.Tags = []string{"canary"}
+	prov.instances = []*discovery.Instance{stable, canary}
+	if !m.Match(r) {
+		t.Fatal("did not match with a canary instance tagged version=v2")
+	}
+
+	// 被隔离的实例不计入
+	cordoned.add("10.0.0.2:80")
+	t.Cleanup(func() { cordoned.remove("10.0.0.2:80") })
+	if m.Match(r) {
+		t.Fatal("matched only a cordoned instance")
+	}
+
+	other := MatchUpstreamTag{Service: "tag-other", Tags: []string{"primary"}}
+	if other.Match(r) {
+		t.Fatal("matched instances of a different service")
+	}
+}
+
+func TestUpstreamTagConditions(t *testing.T) {
+	in := discovery.NewInstance("10.0.0.1:80", map[string]string{"version": "v2", "zone": "a"}, 0)
+	in.Tags = []string{"canary", "http"}
+
+	tests := []struct {
+		tags []string
+		want bool
+	}{
+		{[]string{"canary"}, true},
+		{[]string{"canary", "http", "version=v2", "zone=a"}, true},
+		{[]string{"version=v1"}, false},
+		{[]string{"canary", "grpc"}, false},
+		{[]string{"missing="}, false},
+	}
+	for _, tt := range tests {
+		if got := (MatchUpstreamTag{Tags: tt.tags}).matches(in); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{`upstream_tag`, `upstream_tag api`, "upstream_tag api canary {\n\tversion=v2\n}"} {
+		var m MatchUpstreamTag
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%q: got nil error", input)
+		}
+	}
+	if err := (MatchUpstreamTag{Service: "api", Tags: []string{"=v2"}}).Validate(); err == nil {
+		t.Error("got nil error for a condition without a key")
+	}
+}
@@ -3,32 +3,229 @@
 package dynamic_sd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
 
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
 	// 导入你的内部 providers 包
 	"github.com/liuxd6825/caddy-plus/internal/providers"
 )
 
 func init() {
-	caddy.RegisterModule(DynamicSD{})
+	caddy.RegisterModule(new(DynamicSD))
 }
 
 // DynamicSD 是一个 Caddy 动态上游模块，它本身不执行服务发现，
 // 而是作为一个容器，将任务委派给一个具体的海服务发现提供者。
 type DynamicSD struct {
+	// Selection 指定在 provider 返回的上游列表之上使用的选择模式。
+	// 为空时直接返回 provider 的上游列表，由反向代理的 lb_policy 负责选择。
+	// 可选值: "consistent_hash"、"latency_aware"、"seeded"。
+	Selection string `json:"selection,omitempty"`
+
+	// HashKey 是 consistent_hash 模式下用于计算哈希的请求 key，支持 Caddy 占位符。
+	// 默认为客户端 IP，即 "{http.request.remote.host}"。
+	HashKey string `json:"hash_key,omitempty"`
+
+	// SeedHeader 是 seeded 模式下作为排序种子的请求头，例如 "X-Trace-Id"。
+	// 携带相同值的请求（例如重放的请求）在上游集合不变时总是得到相同的顺序，便于复现问题；没有该请求头时随机排序。
+	SeedHeader string `json:"seed_header,omitempty"`
+
+	// ProbeInterval 是 latency_aware 模式下对上游进行主动探测的间隔，默认 10s。
+	ProbeInterval caddy.Duration `json:"probe_interval,omitempty"`
+
+	// ProbeConcurrency 是 latency_aware 模式下同时进行的探测数量上限，默认 32。
+	ProbeConcurrency int `json:"probe_concurrency,omitempty"`
+
+	// ProbeBudget 是每一轮探测的总时间上限，默认等于 ProbeInterval。
+	// 超出预算时尚未完成探测的上游保留之前的测量结果。
+	ProbeBudget caddy.Duration `json:"probe_budget,omitempty"`
+
+	// RecheckInterval 大于 0 时，latency_aware 模式下探测失败的上游被摘除，并每隔 RecheckInterval 重新探测一次，
+	// 探测成功后重新加入，而不必等待下一轮完整的探测。应小于 ProbeInterval。为 0 时探测失败只计入延迟，不摘除上游。
+	RecheckInterval caddy.Duration `json:"recheck_interval,omitempty"`
+
+	// Split 按实例 metadata 的取值和百分比在实例分组之间分配请求，为 nil 表示不分组。
+	Split *TrafficSplit `json:"split,omitempty"`
+
+	// Rewrites 是按顺序应用于每个上游地址的正则改写规则，
+	// 可用于在不新增 provider 的情况下把发现到的地址映射为实际可访问的地址。
+	Rewrites []*DialRewrite `json:"rewrites,omitempty"`
+
+	// CanaryHeader 是用于灰度分流的请求头，例如 "X-Canary"。
+	// 配置后，该请求头为 true 的请求只会被转发到 metadata 中 CanaryMetaKey 为 true 的实例，
+	// 其余请求只会被转发到其他实例。为空时不分流。
+	CanaryHeader string `json:"canary_header,omitempty"`
+
+	// CanaryMetaKey 是标记灰度实例的 metadata key，默认为 "canary"。
+	CanaryMetaKey string `json:"canary_meta_key,omitempty"`
+
+	// AllowCIDRs 和 DenyCIDRs 限制上游地址（改写之后）所在的网段，防止注册中心被篡改后把流量转发到任意目标。
+	// 命中 DenyCIDRs 的地址总是被丢弃；配置了 AllowCIDRs 时只保留命中其中任意一个网段的地址。
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty"`
+
+	// ResolveHostnames 为 true 时，主机名形式的上游（改写之后）在刷新时被预先解析，并展开为每个 IP 一个的上游，
+	// 反向代理不再在每个连接上解析 DNS；{dynamic_sd.upstream.host} 仍然返回原来的主机名。
+	// 配置了 CIDR 列表时，展开后的每个 IP 分别接受检查，无法解析的主机名被丢弃；
+	// 为 false 时主机名形式的上游不受 CIDR 列表限制。
+	ResolveHostnames bool `json:"resolve_hostnames,omitempty"`
+
+	// ExcludeSelf 为 true 时丢弃 IP 为本机网卡地址（包括回环地址）的上游（改写、解析之后），
+	// 避免 Caddy 与后端部署在同一台机器上时把请求转发给自己。本机地址每分钟重新读取一次。
+	ExcludeSelf bool `json:"exclude_self,omitempty"`
+
+	// ResolutionTTL 是 ResolveHostnames 时解析结果的缓存时间，默认 1m。
+	// 过期后在后台重新解析，期间以及解析失败时继续使用上一次的结果。
+	ResolutionTTL caddy.Duration `json:"resolution_ttl,omitempty"`
+
+	// StateFile 是保存最近一次可用上游列表的文件路径。
+	// 每次刷新成功后写入，启动时读取作为种子，在第一次实时刷新成功之前使用，
+	// 以便在注册中心暂时不可用时重启 Caddy 仍有上游可用。
+	StateFile string `json:"state_file,omitempty"`
+
+	// ExportFile 是导出所有 provider 当前上游列表（JSON，包括 metadata 和权重）的文件路径，供外部工具读取或监听。
+	// 上游列表每次变化时原子地重写，写入失败只记录日志，不影响转发。
+	ExportFile string `json:"export_file,omitempty"`
+
+	// Prewarm 为 true 时，每次刷新后对新加入的上游（改写之后的地址）在后台建立一次 TCP 连接（实例带有 SNI 时完成 TLS 握手）
+	// 后立即关闭，提前完成 DNS、ARP 和 conntrack 等准备工作，降低新上游第一个请求的延迟。
+	Prewarm bool `json:"prewarm,omitempty"`
+
+	// CoalesceWindow 大于 0 时，provider 在该时间内的多次更新被合并为一次，只应用最后一次得到的上游列表，
+	// 减少注册中心频繁变更时上游列表的替换次数；相应地，变更最多延迟该时间生效。对所有 provider 生效。
+	CoalesceWindow caddy.Duration `json:"coalesce_window,omitempty"`
+
+	// CleanupDrainTimeout 是 Cleanup 在停止 provider 之前等待进行中的请求完成的最长时间，0 表示不等待。
+	// 进行中的请求数按上游的地址统计，配置重载后新配置发往同一地址的请求也会被计入，
+	// 因此等待总是以该超时为上限。
+	CleanupDrainTimeout caddy.Duration `json:"cleanup_drain_timeout,omitempty"`
+
+	// ReadyGrace 大于 0 时，就绪检查端点最多等待这么久（从 Provision 完成时算起）让每个 provider 得到第一批上游，
+	// 超过之后仍然没有上游的 provider 不再使模块处于未就绪状态，响应中以 grace_expired 标出。
+	// 用于避免注册中心在启动时不可用或服务暂时没有实例导致 Pod 一直无法就绪、滚动更新被卡住，0 表示一直等待。
+	ReadyGrace caddy.Duration `json:"ready_grace,omitempty"`
+
+	// ValidateOnly 为 true 时 Provision 只检查 provider 的连通性：连接注册中心、执行一次查询后立即释放资源，
+	// 不启动任何后台任务。用于配合 `caddy validate` 在部署前确认地址和凭据，这样的配置不能用于转发流量。
+	ValidateOnly bool `json:"validate_only,omitempty"`
+
+	// ProviderKey 是配置了 named_provider 时选择 provider 的请求 key，支持 Caddy 占位符，
+	// 例如 "{http.request.header.X-Service}"。求值结果没有对应的命名 provider 时使用默认的 provider。
+	ProviderKey string `json:"provider_key,omitempty"`
+
+	// PathRoutes 把请求路径前缀映射到命名 provider 的名字，请求路径（r.URL.Path，handle_path 剥离之后的路径）
+	// 匹配多个前缀时最长的前缀优先。前缀按字符串匹配，"/orders" 也会匹配 "/orders-admin"，需要按路径段区分时以 "/" 结尾。
+	// 没有匹配的前缀时按 ProviderKey 选择。用于一个 dynamic_sd 为同一个注册中心中按路径区分的多个服务提供上游。
+	PathRoutes map[string]string `json:"path_routes,omitempty"`
+
+	// RequireAllProviders 为 true（默认，nil 视为 true）时，任何一个 provider（默认 provider 或 named_provider）
+	// Provision 失败都会使整个模块加载失败。设置为 false 时失败的 provider 被记录并跳过，模块使用其余的 provider 继续运行：
+	// 发往它的请求按没有匹配的 named_provider 处理，回退到默认 provider；所有 provider 都失败时仍然加载失败。
+	RequireAllProviders *bool `json:"require_all_providers,omitempty"`
+
+	// ProviderRaw 是默认 provider 的 JSON 配置：一个对象，"type" 为 provider 的类型（如 "consul"），
+	// 其余的 key 是该 provider 的配置项。解析 Caddyfile 时根据 provider 子指令生成，因此 caddy adapt 的输出可以直接加载。
+	ProviderRaw json.RawMessage `json:"provider,omitempty"`
+
+	// NamedProvidersRaw 是 named_provider 的 JSON 配置，按名字索引，每个值的格式与 ProviderRaw 相同。
+	NamedProvidersRaw map[string]json.RawMessage `json:"named_providers,omitempty"`
+
 	// provider 存储了被选中的、实现了 Provider 接口的实例 (例如 NacosProvider)。
-	// `json:"-"` 标签防止 Caddy 在 JSON 配置中处理此字段。
-	provider providers.Provider `json:"-"`
+	// 它由 Caddyfile 的 provider 子指令创建，或者在加载 JSON 配置时由 ProviderRaw 创建。
+	provider providers.Provider
+	// providerName 是 provider 的类型名字，用于管理接口。
+	providerName string
+	// named 是 named_provider 配置的 provider，按名字索引，加载 JSON 配置时由 NamedProvidersRaw 创建。
+	// 使用命名 provider 时，一个 dynamic_sd 可以按 ProviderKey 为不同的请求提供不同服务的上游。
+	named map[string]providerEntry
+	// provisioned 是已经调用过 Provision 的 provider，Cleanup 只清理它们。
+	// Provision 失败的 provider 可能已经占用了部分资源，因此也包括在内。
+	provisioned []providerEntry
+	// failed 是 RequireAllProviders 为 false 时 Provision 失败、被跳过的 provider，按名字（默认 provider 为空）索引。
+	// 只在 Provision 中写入。
+	failed map[string]error
+	// provisionedAt 是 Provision 完成的时间，就绪检查据此计算 ReadyGrace。
+	provisionedAt time.Time
+	// releaseLabels 释放 provider 的 provider_labels 指标序列，在 Cleanup 时调用。
+	releaseLabels []func()
+
+	// ring 是 consistent_hash 模式下的哈希环，在上游集合变化时重建。
+	ring   *hashRing
+	ringMu sync.Mutex
+
+	// latency 是 latency_aware 模式下各上游的延迟记录，stopProbe 停止后台探测。
+	latency   *latencyTracker
+	stopProbe context.CancelFunc
+
+	// rewriter 在 Provision 时根据 Rewrites 创建，未配置改写规则时为 nil。
+	rewriter *dialRewriter
+
+	// canary 在 Provision 时根据 CanaryHeader 创建，未配置灰度分流时为 nil。
+	canary *canarySplit
+
+	// cidrs 在 Provision 时根据 AllowCIDRs 和 DenyCIDRs 创建，都未配置时为 nil。
+	cidrs *cidrFilter
+
+	// resolver 在 ResolveHostnames 为 true 时创建，否则为 nil。
+	resolver *hostResolver
+
+	// self 在 ExcludeSelf 为 true 时创建，否则为 nil。
+	self *selfFilter
+
+	// exported 是上一次写入 ExportFile 的内容，exportMu 保证多个 provider 的更新依次写入。
+	exported []byte
+	exportMu sync.Mutex
+
+	// prewarmed 是上一次更新时所有 provider 的上游地址，用于找出新加入的上游；prewarmCtx 在 Cleanup 时被取消。
+	prewarmed   map[string]struct{}
+	prewarmMu   sync.Mutex
+	prewarmCtx  context.Context
+	stopPrewarm context.CancelFunc
+
+	// seed 是启动时从 StateFile 读取的上游列表，seedInstances 是对应的实例（携带保存时的权重和 metadata），
+	// live 表示 provider 是否已经成功刷新过。
+	seed          []*reverseproxy.Upstream
+	seedInstances []*discovery.Instance
+	live          atomic.Bool
+	logger        *zap.Logger
 }
 
+const (
+	// selectionConsistentHash 按请求 key 的一致性哈希对上游排序。
+	selectionConsistentHash = "consistent_hash"
+
+	// selectionLatencyAware 按主动探测得到的延迟 EWMA 从低到高对上游排序。
+	selectionLatencyAware = "latency_aware"
+
+	// selectionSeeded 以请求头 SeedHeader 的值为种子按权重对上游随机排序，同一个种子得到相同的顺序。
+	selectionSeeded = "seeded"
+
+	// defaultHashKey 是 consistent_hash 模式下默认使用的请求 key。
+	defaultHashKey = "{http.request.remote.host}"
+
+	// connectivityTimeout 是 validate_only 模式下连通性检查的超时时间。
+	connectivityTimeout = 10 * time.Second
+)
+
 // CaddyModule 返回 Caddy 模块信息。
 // 这是将 DynamicSD 注册为 Caddy 模块的关键。
-func (DynamicSD) CaddyModule() caddy.ModuleInfo {
+func (*DynamicSD) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.reverse_proxy.upstreams.dynamic_sd",
 		New: func() caddy.Module { return new(DynamicSD) },
@@ -38,81 +235,857 @@ func (DynamicSD) CaddyModule() caddy.ModuleInfo {
 // Provision 在 Caddy 加载和初始化配置时被调用。
 // 它负责创建 logger 并将其注入到具体的提供者中。
 func (d *DynamicSD) Provision(ctx caddy.Context) error {
-	if d.provider == nil {
-		return fmt.Errorf("no service discovery provider is configured")
+	if err := d.loadProviders(); err != nil {
+		return &ConfigError{Err: err}
+	}
+	if d.provider == nil && len(d.named) == 0 {
+		return noProviderError()
 	}
 
 	// 使用 'd' (它是一个合法的 caddy.Module) 来创建 logger。
 	logger := ctx.Logger(d)
+	d.logger = logger
+
+	if d.ValidateOnly {
+		return d.validateConnectivity(ctx)
+	}
+
+	if d.Selection == selectionConsistentHash && d.HashKey == "" {
+		d.HashKey = defaultHashKey
+	}
+
+	if len(d.Rewrites) > 0 {
+		rewriter, err := newDialRewriter(d.Rewrites)
+		if err != nil {
+			return &ConfigError{Err: err}
+		}
+		d.rewriter = rewriter
+	}
+
+	if d.CanaryHeader != "" {
+		d.canary = newCanarySplit(d.CanaryHeader, d.CanaryMetaKey)
+	}
+
+	if d.ResolveHostnames {
+		ttl := time.Duration(d.ResolutionTTL)
+		if ttl <= 0 {
+			ttl = defaultResolutionTTL
+		}
+		d.resolver = newHostResolver(ttl, logger)
+	}
+
+	if d.ExcludeSelf {
+		d.self = newSelfFilter(logger)
+	}
+
+	if len(d.AllowCIDRs) > 0 || len(d.DenyCIDRs) > 0 {
+		cidrs, err := newCIDRFilter(d.AllowCIDRs, d.DenyCIDRs, d.ResolveHostnames, logger)
+		if err != nil {
+			return &ConfigError{Err: err}
+		}
+		d.cidrs = cidrs
+	}
+
+	// 将本模块的指标注册到当前配置的 metrics registry 中
+	if err := metrics.Register(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+
+	entries := d.allProviders()
+	for _, entry := range entries {
+		if su, ok := entry.provider.(providers.StorageUser); ok {
+			su.SetStorage(ctx.Storage())
+		}
+		if cu, ok := entry.provider.(providers.ContextUser); ok {
+			cu.SetContext(ctx)
+		}
+		if uc, ok := entry.provider.(providers.UpdateCoalescer); ok && d.CoalesceWindow > 0 {
+			uc.SetCoalesceWindow(time.Duration(d.CoalesceWindow))
+		}
+	}
+
+	if d.Prewarm {
+		d.prewarmCtx, d.stopPrewarm = context.WithCancel(context.Background())
+	}
+
+	// 必须在 provider 开始刷新之前注册，才能观察到第一次刷新
+	if d.provider != nil {
+		d.provider.OnUpdate(d.onProviderUpdate)
+	}
+	for _, entry := range d.named {
+		entry.provider.OnUpdate(d.onNamedProviderUpdate)
+	}
+	if d.StateFile != "" {
+		d.loadSeed()
+	}
 
 	// 将创建好的 logger 传递给 provider 的 Provision 方法。
 	// 这是依赖注入的关键一步。
-	return d.provider.Provision(logger)
+	// provider 没有标明类型的错误按配置错误处理；nacos、nats 等在 Provision 时就连接注册中心的 provider，
+	// 连接失败时会返回 DiscoveryError
+	for _, entry := range entries {
+		d.provisioned = append(d.provisioned, entry)
+		if err := entry.provider.Provision(providerLogger(logger, entry)); err != nil {
+			if entry.name != "" {
+				err = fmt.Errorf("named_provider '%s': %w", entry.name, err)
+			}
+			if d.requireAllProviders() {
+				return discovery.AsConfigError(err)
+			}
+			d.skipProvider(entry, err)
+			continue
+		}
+		if labels := providerLabels(entry.provider); len(labels) > 0 {
+			d.releaseLabels = append(d.releaseLabels, metrics.SetLabels(entry.typeName, entry.provider.Service(), labels))
+		}
+	}
+
+	if err := d.checkLiveProviders(entries); err != nil {
+		return discovery.AsConfigError(err)
+	}
+
+	d.provisionedAt = time.Now()
+	registerActive(d)
+
+	if d.Selection == selectionLatencyAware {
+		interval := time.Duration(d.ProbeInterval)
+		if interval <= 0 {
+			interval = defaultProbeInterval
+		}
+		var probeCtx context.Context
+		probeCtx, d.stopProbe = context.WithCancel(context.Background())
+		d.latency = newLatencyTracker()
+		discovery.Go(d.logger, "latency probe", func() { d.probeLoop(probeCtx, interval) })
+		if d.RecheckInterval > 0 {
+			concurrency := d.ProbeConcurrency
+			if concurrency <= 0 {
+				concurrency = defaultProbeConcurrency
+			}
+			discovery.Go(d.logger, "latency recheck", func() {
+				d.recheckLoop(probeCtx, time.Duration(d.RecheckInterval), concurrency)
+			})
+		}
+	}
+	return nil
 }
 
-// Validate 确保配置是有效的，它将验证任务委派给提供者。
+// providerLogger 返回传给 provider 的 logger：命名 provider 带有 named_provider 字段，配置了标签的 provider 带有 labels 字段。
+func providerLogger(logger *zap.Logger, entry providerEntry) *zap.Logger {
+	if entry.name != "" {
+		logger = logger.With(zap.String("named_provider", entry.name))
+	}
+	if labels := providerLabels(entry.provider); len(labels) > 0 {
+		logger = logger.With(zap.Any("labels", labels))
+	}
+	return logger
+}
+
+// providerLabels 返回 prov 配置的标签，prov 不支持标签时返回 nil。
+func providerLabels(prov providers.Provider) map[string]string {
+	if l, ok := prov.(providers.Labeler); ok {
+		return l.ProviderLabels()
+	}
+	return nil
+}
+
+// validateConnectivity 在 validate_only 模式下代替 provider 的 Provision 检查连通性。
+func (d *DynamicSD) validateConnectivity(ctx caddy.Context) error {
+	for _, entry := range d.allProviders() {
+		logger := d.logger
+		if entry.name != "" {
+			logger = logger.With(zap.String("named_provider", entry.name))
+		}
+		cv, ok := entry.provider.(providers.ConnectivityValidator)
+		if !ok {
+			logger.Warn("provider does not support connectivity validation, skipping")
+			continue
+		}
+		if su, ok := entry.provider.(providers.StorageUser); ok {
+			su.SetStorage(ctx.Storage())
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, connectivityTimeout)
+		err := cv.ValidateConnectivity(checkCtx)
+		cancel()
+		if err != nil {
+			if entry.name != "" {
+				return &DiscoveryError{Err: fmt.Errorf("named_provider '%s': connectivity check failed: %v", entry.name, err)}
+			}
+			return &DiscoveryError{Err: fmt.Errorf("connectivity check failed: %v", err)}
+		}
+		logger.Info("connectivity check passed")
+	}
+	return nil
+}
+
+// loadSeed 从 StateFile 读取种子上游，文件缺失或损坏时只记录日志。
+func (d *DynamicSD) loadSeed() {
+	instances, err := loadState(d.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.logger.Warn("ignoring unreadable state file", zap.String("state_file", d.StateFile), zap.Error(err))
+		}
+		return
+	}
+	d.seedInstances = instances
+	d.seed = make([]*reverseproxy.Upstream, len(instances))
+	for i, in := range instances {
+		d.seed[i] = in.Upstream
+	}
+	d.logger.Info("loaded upstreams from state file",
+		zap.String("state_file", d.StateFile),
+		zap.Int("count", len(instances)),
+	)
+}
+
+// onProviderUpdate 在默认 provider 每次成功刷新后被调用。
+func (d *DynamicSD) onProviderUpdate(instances []*discovery.Instance) {
+	d.live.Store(true)
+	d.prefetchHostnames()
+	d.exportUpstreams()
+	d.prewarmNew()
+	if d.StateFile == "" || len(instances) == 0 {
+		return
+	}
+	if err := saveState(d.StateFile, instances); err != nil {
+		d.logger.Error("failed to save state file", zap.String("state_file", d.StateFile), zap.Error(err))
+	}
+}
+
+// onNamedProviderUpdate 在命名 provider 每次成功刷新后被调用。state_file 只保存默认 provider 的上游。
+func (d *DynamicSD) onNamedProviderUpdate([]*discovery.Instance) {
+	d.prefetchHostnames()
+	d.exportUpstreams()
+	d.prewarmNew()
+}
+
+// prefetchHostnames 在 resolve_hostnames 时提前解析所有 provider 当前上游（改写之后）中的主机名。
+func (d *DynamicSD) prefetchHostnames() {
+	if d.resolver == nil {
+		return
+	}
+	var dials []string
+	for _, entry := range d.allProviders() {
+		for _, in := range entry.provider.Instances() {
+			dial := in.Upstream.Dial
+			if d.rewriter != nil {
+				dial = d.rewriter.rewriteOne(in.Upstream).Dial
+			}
+			dials = append(dials, dial)
+		}
+	}
+	d.resolver.prefetch(dials)
+}
+
+// Validate 确保配置是有效的，它将验证任务委派给提供者。返回的错误都是 ConfigError。
 func (d *DynamicSD) Validate() error {
-	if d.provider == nil {
-		return fmt.Errorf("no service discovery provider is configured")
+	return discovery.AsConfigError(d.validate())
+}
+
+// validate 执行 Validate 的各项检查。
+func (d *DynamicSD) validate() error {
+	if err := d.loadProviders(); err != nil {
+		return err
+	}
+	if d.provider == nil && len(d.named) == 0 {
+		return noProviderError()
+	}
+	if len(d.named) > 0 {
+		if d.ProviderKey == "" && len(d.PathRoutes) == 0 {
+			return fmt.Errorf("named_provider requires provider_key or path_route")
+		}
+		if err := d.validatePathRoutes(); err != nil {
+			return err
+		}
+		// 选择模式和分组依赖单一 provider 的实例，不支持按请求切换 provider
+		if d.Selection != "" {
+			return fmt.Errorf("selection cannot be used with named_provider")
+		}
+		if d.Split != nil {
+			return fmt.Errorf("split cannot be used with named_provider")
+		}
+		if d.StateFile != "" && d.provider == nil {
+			return fmt.Errorf("state_file requires a default provider")
+		}
+	} else if d.ProviderKey != "" {
+		return fmt.Errorf("provider_key requires at least one named_provider")
+	} else if len(d.PathRoutes) > 0 {
+		return fmt.Errorf("path_route requires at least one named_provider")
+	} else if !d.requireAllProviders() {
+		return fmt.Errorf("require_all_providers requires at least one named_provider")
+	}
+	if d.ExportFile != "" && d.ExportFile == d.StateFile {
+		return fmt.Errorf("export_file must be different from state_file")
+	}
+	switch d.Selection {
+	case "", selectionConsistentHash, selectionLatencyAware, selectionSeeded:
+	default:
+		return fmt.Errorf("unknown selection mode: '%s'", d.Selection)
 	}
-	return d.provider.Validate()
+	if d.CanaryMetaKey != "" && d.CanaryHeader == "" {
+		return fmt.Errorf("canary_meta_key requires canary_header")
+	}
+	if d.Selection == selectionSeeded && d.SeedHeader == "" {
+		return fmt.Errorf("selection seeded requires seed_header")
+	}
+	if d.SeedHeader != "" && d.Selection != selectionSeeded {
+		return fmt.Errorf("seed_header requires selection seeded")
+	}
+	if d.Split != nil {
+		if err := d.Split.Validate(); err != nil {
+			return err
+		}
+	}
+	for i, rule := range d.Rewrites {
+		if rule.Match == "" {
+			return fmt.Errorf("rewrite %d: match is required", i)
+		}
+	}
+	if _, err := parsePrefixes(d.AllowCIDRs); err != nil {
+		return fmt.Errorf("allow_cidrs: %v", err)
+	}
+	if _, err := parsePrefixes(d.DenyCIDRs); err != nil {
+		return fmt.Errorf("deny_cidrs: %v", err)
+	}
+	if d.ProbeConcurrency < 0 {
+		return fmt.Errorf("probe_concurrency must not be negative")
+	}
+	if d.ProbeBudget < 0 {
+		return fmt.Errorf("probe_budget must not be negative")
+	}
+	if d.RecheckInterval < 0 {
+		return fmt.Errorf("recheck_interval must not be negative")
+	}
+	if d.RecheckInterval > 0 && d.Selection != selectionLatencyAware {
+		return fmt.Errorf("recheck_interval requires selection latency_aware")
+	}
+	if d.ResolutionTTL < 0 {
+		return fmt.Errorf("resolution_ttl must not be negative")
+	}
+	if d.CoalesceWindow < 0 {
+		return fmt.Errorf("coalesce_window must not be negative")
+	}
+	if d.ReadyGrace < 0 {
+		return fmt.Errorf("ready_grace must not be negative")
+	}
+	for _, entry := range d.allProviders() {
+		if err := entry.provider.Validate(); err != nil {
+			if entry.name != "" {
+				return fmt.Errorf("named_provider '%s': %w", entry.name, err)
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 // Cleanup 在 Caddy 停止或重载配置时被调用。
-// 它将清理任务委派给具体的提供者。
+// 它将清理任务委派给具体的提供者。provider 停止后 GetUpstreams 仍返回其最后的上游列表，
+// 因此仍在使用旧配置的请求不会失败。
 func (d *DynamicSD) Cleanup() error {
-	if d.provider != nil {
-		return d.provider.Cleanup()
+	unregisterActive(d)
+	for _, release := range d.releaseLabels {
+		release()
+	}
+	if d.stopProbe != nil {
+		d.stopProbe()
+	}
+	if d.stopPrewarm != nil {
+		d.stopPrewarm()
+	}
+	// validate_only 模式下 provider 没有被 Provision，也就没有需要清理的资源
+	if len(d.provisioned) == 0 {
+		return nil
+	}
+	if d.CleanupDrainTimeout > 0 {
+		d.drain(time.Duration(d.CleanupDrainTimeout))
+	}
+	return d.cleanupProviders()
+}
+
+// upstreamRequests 返回发往上游的进行中的请求数，还没有被反向代理使用过的上游为 0。
+// 反向代理只能在内部增加请求计数，测试通过替换这个变量模拟进行中的请求。
+var upstreamRequests = func(up *reverseproxy.Upstream) int {
+	if up.Host == nil {
+		return 0
+	}
+	return up.NumRequests()
+}
+
+// drain 等待发往当前上游的请求全部完成，最多等待 timeout。
+func (d *DynamicSD) drain(timeout time.Duration) {
+	const pollInterval = 100 * time.Millisecond
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inflight := 0
+		for _, entry := range d.provisioned {
+			for _, up := range entry.provider.Instances() {
+				inflight += upstreamRequests(up.Upstream)
+			}
+		}
+		if inflight == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			d.logger.Warn("cleanup drain timed out with requests still in flight",
+				zap.Int("in_flight", inflight),
+				zap.Duration("timeout", timeout),
+			)
+			return
+		}
+		time.Sleep(pollInterval)
 	}
-	return nil
 }
 
 // GetUpstreams 是反向代理的核心调用。
 // 它调用内部 provider 的 GetUpstreams 方法来获取最新的服务列表。
-func (d *DynamicSD) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	if d.provider == nil {
-		return nil, fmt.Errorf("no service discovery provider is configured")
+func (d *DynamicSD) GetUpstreams(r *http.Request) (upstreams []*reverseproxy.Upstream, err error) {
+	if d.provider == nil && len(d.named) == 0 {
+		return nil, noProviderError()
+	}
+	if d.ValidateOnly {
+		return nil, &ConfigError{Err: fmt.Errorf("dynamic_sd is configured with validate_only and serves no upstreams")}
 	}
+	entry, err := d.providerFor(r)
+	if err != nil {
+		return nil, err
+	}
+	prov := entry.provider
+	defer func() { metrics.RecordServed(entry.typeName, prov.Service(), len(upstreams) > 0) }()
+
 	// 将获取上游列表的任务委派给具体的 provider
-	return d.provider.GetUpstreams(r)
+	upstreams, err = prov.GetUpstreams(r)
+	seeding := false
+	if err != nil {
+		// 在第一次实时刷新成功之前，使用从 state_file 读取的种子上游，种子只属于默认 provider
+		if prov != d.provider || len(d.seed) == 0 || d.live.Load() {
+			return nil, d.noUpstreamsError(entry, err)
+		}
+		upstreams, seeding = d.seed, true
+	}
+
+	all := upstreams
+	d.provideUpstreamHost(r, prov)
+
+	// 先在完整的上游列表上排序再丢弃未就绪或正在移除的实例，避免哈希环在每个请求上被重建
+	switch d.Selection {
+	case selectionConsistentHash:
+		upstreams = d.hashUpstreams(r, upstreams)
+	case selectionLatencyAware:
+		// 配合 `lb_policy first` 使用，优先选择延迟最低的上游
+		upstreams = d.latency.dropEjected(d.latency.sorted(upstreams))
+	case selectionSeeded:
+		// 配合 `lb_policy first` 使用，同一个种子总是优先选择同一个上游
+		upstreams = d.seededUpstreams(r, upstreams)
+	}
+	// 灰度分流在排序之后进行，两个桶共用同一个哈希环，请求之间不会反复重建
+	if d.canary != nil {
+		instances := prov.Instances()
+		if seeding {
+			instances = d.seedInstances
+		}
+		upstreams = d.canary.filter(r, all, instances, upstreams)
+	}
+	if d.Split != nil {
+		upstreams = d.splitUpstreams(upstreams)
+	}
+	upstreams = dropUnready(prov, upstreams)
+	upstreams = cordoned.filter(upstreams)
+
+	// 地址改写放在最后，选择策略和权重仍然基于 provider 原始的上游进行
+	if d.rewriter != nil {
+		upstreams = d.rewriter.rewrite(all, upstreams)
+	}
+	// 主机名在改写之后解析，CIDR 检查针对解析得到的实际拨号地址
+	if d.resolver != nil {
+		upstreams = d.resolver.resolve(upstreams)
+	}
+	// CIDR 检查针对实际拨号的地址，因此放在改写之后
+	if d.cidrs != nil {
+		upstreams = d.cidrs.filter(all, upstreams)
+	}
+	if d.self != nil {
+		upstreams = d.self.filter(upstreams)
+	}
+	upstreams = d.dropFailing(prov, upstreams)
+	return upstreams, nil
+}
+
+// dropUnready 按实例的保留比例随机丢弃上游：仍在 warmup_grace 期间的实例总是被丢弃，
+// 正在 scale_in_grace 期间移除的实例被返回给反向代理的概率随时间逐渐降低到 0。
+func dropUnready(prov providers.Provider, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	now := time.Now()
+	var drop map[*reverseproxy.Upstream]struct{}
+	for _, in := range prov.Instances() {
+		if r := in.Retention(now); r < 1 && rand.Float64() >= r {
+			if drop == nil {
+				drop = make(map[*reverseproxy.Upstream]struct{})
+			}
+			drop[in.Upstream] = struct{}{}
+		}
+	}
+	if len(drop) == 0 {
+		return upstreams
+	}
+
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if _, ok := drop[up]; !ok {
+			kept = append(kept, up)
+		}
+	}
+	return kept
+}
+
+// hashUpstreams 按请求 key 在哈希环上的位置对上游重新排序，
+// 同一个 key 总是优先落到同一个上游上。配合 `lb_policy first` 使用，
+// 当首选上游不可用时会按环上的顺序故障转移到下一个上游。
+func (d *DynamicSD) hashUpstreams(r *http.Request, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	key := d.HashKey
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		key = repl.ReplaceAll(key, "")
+	}
+
+	d.ringMu.Lock()
+	if d.ring == nil || !d.ring.builtFrom(upstreams) {
+		d.ring = newHashRing(upstreams, d.instanceWeight())
+	}
+	ring := d.ring
+	d.ringMu.Unlock()
+
+	return ring.lookup(key)
 }
 
 // UnmarshalCaddyfile 解析 Caddyfile 配置块。
 // 这是实现“插件化”和“路由”的核心逻辑。
 func (d *DynamicSD) UnmarshalCaddyfile(disp *caddyfile.Dispenser) error {
+	// check_registry 只在解析时生效，不写入 JSON 配置
+	var checkRegistry time.Duration
 	for disp.Next() { // 消费模块名 "dynamic_sd"
 		if len(disp.RemainingArgs()) > 0 {
 			return disp.ArgErr()
 		}
 
 		for disp.NextBlock(0) {
-			// 期望的唯一指令是 "provider"
-			if disp.Val() != "provider" {
-				return disp.Errf("unrecognized subdirective '%s', expected 'provider'", disp.Val())
-			}
+			switch disp.Val() {
+			case "provider":
+				// "provider" 后面必须跟一个提供者的名字，例如 "nacos", "consul", "mdns"
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				providerName := disp.Val()
 
-			// "provider" 后面必须跟一个提供者的名字，例如 "nacos", "consul", "mdns"
-			if !disp.NextArg() {
-				return disp.ArgErr()
-			}
-			providerName := disp.Val()
+				// 使用我们之前编写的工厂函数，根据名称创建提供者实例
+				prov, err := providers.NewProvider(providerName)
+				if err != nil {
+					return disp.Errf("error creating provider '%s': %v", providerName, err)
+				}
+				d.provider = prov
+				d.providerName = providerName
 
-			// 使用我们之前编写的工厂函数，根据名称创建提供者实例
-			prov, err := providers.NewProvider(providerName)
-			if err != nil {
-				return disp.Errf("error creating provider '%s': %v", providerName, err)
-			}
-			d.provider = prov
-
-			// 将 provider 自己的配置块 (e.g., "nacos { ... }") 交给它自己去解析
-			if err := d.provider.UnmarshalCaddyfile(disp); err != nil {
-				return err
+				// 将 provider 自己的配置块 (e.g., "nacos { ... }") 交给它自己去解析，
+				// 块中的 inherit 会先应用 dynamic_sd_defaults 中的默认配置
+				if err := unmarshalProvider(disp, d.provider); err != nil {
+					return err
+				}
+			case "named_provider":
+				// named_provider <name> <provider> { ... }，按 provider_key 的求值结果选择
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				name := disp.Val()
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				typeName := disp.Val()
+				if _, ok := d.named[name]; ok {
+					return disp.Errf("duplicate named_provider '%s'", name)
+				}
+				prov, err := providers.NewProvider(typeName)
+				if err != nil {
+					return disp.Errf("error creating provider '%s': %v", typeName, err)
+				}
+				if err := unmarshalProvider(disp, prov); err != nil {
+					return err
+				}
+				if d.named == nil {
+					d.named = make(map[string]providerEntry)
+				}
+				d.named[name] = providerEntry{name: name, typeName: typeName, provider: prov}
+			case "provider_key":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.ProviderKey = disp.Val()
+			case "require_all_providers":
+				val := true
+				if disp.NextArg() {
+					var err error
+					if val, err = strconv.ParseBool(disp.Val()); err != nil {
+						return disp.Errf("invalid boolean for require_all_providers: %v", err)
+					}
+				}
+				d.RequireAllProviders = &val
+			case "path_route":
+				// path_route <prefix> <named_provider>
+				args := disp.RemainingArgs()
+				if len(args) != 2 {
+					return disp.ArgErr()
+				}
+				if _, ok := d.PathRoutes[args[0]]; ok {
+					return disp.Errf("duplicate path_route '%s'", args[0])
+				}
+				if d.PathRoutes == nil {
+					d.PathRoutes = make(map[string]string)
+				}
+				d.PathRoutes[args[0]] = args[1]
+			case "selection":
+				// selection <mode> [hash_key]
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.Selection = disp.Val()
+				if disp.NextArg() {
+					d.HashKey = disp.Val()
+				}
+				if disp.NextArg() {
+					return disp.ArgErr()
+				}
+			case "seed_header":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.SeedHeader = disp.Val()
+			case "coalesce_window":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for coalesce_window: %v", err)
+				}
+				d.CoalesceWindow = caddy.Duration(dur)
+			case "cleanup_drain_timeout":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for cleanup_drain_timeout: %v", err)
+				}
+				d.CleanupDrainTimeout = caddy.Duration(dur)
+			case "ready_grace":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for ready_grace: %v", err)
+				}
+				d.ReadyGrace = caddy.Duration(dur)
+			case "probe_interval":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for probe_interval: %v", err)
+				}
+				d.ProbeInterval = caddy.Duration(dur)
+			case "probe_concurrency":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				n, err := strconv.Atoi(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid integer for probe_concurrency: %v", err)
+				}
+				d.ProbeConcurrency = n
+			case "probe_budget":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for probe_budget: %v", err)
+				}
+				d.ProbeBudget = caddy.Duration(dur)
+			case "recheck_interval":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for recheck_interval: %v", err)
+				}
+				d.RecheckInterval = caddy.Duration(dur)
+			case "split":
+				// split <metadata_key> {
+				//     <value> <percentage>
+				//     ramp <value> {
+				//         start     <RFC 3339 时间>
+				//         end       <RFC 3339 时间>
+				//         start_pct <percentage>
+				//         end_pct   <percentage>
+				//     }
+				// }
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.Split = &TrafficSplit{Key: disp.Val(), Percentages: make(map[string]float64)}
+				for nesting := disp.Nesting(); disp.NextBlock(nesting); {
+					if disp.Val() == "ramp" {
+						ramp, err := unmarshalSplitRamp(disp)
+						if err != nil {
+							return err
+						}
+						d.Split.Ramp = ramp
+						continue
+					}
+					value := disp.Val()
+					if !disp.NextArg() {
+						return disp.ArgErr()
+					}
+					pct, err := strconv.ParseFloat(strings.TrimSuffix(disp.Val(), "%"), 64)
+					if err != nil {
+						return disp.Errf("invalid percentage for split value '%s': %v", value, err)
+					}
+					d.Split.Percentages[value] = pct
+				}
+			case "allow_cidrs":
+				args := disp.RemainingArgs()
+				if len(args) == 0 {
+					return disp.ArgErr()
+				}
+				d.AllowCIDRs = append(d.AllowCIDRs, args...)
+			case "deny_cidrs":
+				args := disp.RemainingArgs()
+				if len(args) == 0 {
+					return disp.ArgErr()
+				}
+				d.DenyCIDRs = append(d.DenyCIDRs, args...)
+			case "resolve_hostnames":
+				d.ResolveHostnames = true
+				if disp.NextArg() {
+					val, err := strconv.ParseBool(disp.Val())
+					if err != nil {
+						return disp.Errf("invalid boolean for resolve_hostnames: %v", err)
+					}
+					d.ResolveHostnames = val
+				}
+			case "exclude_self":
+				d.ExcludeSelf = true
+				if disp.NextArg() {
+					val, err := strconv.ParseBool(disp.Val())
+					if err != nil {
+						return disp.Errf("invalid boolean for exclude_self: %v", err)
+					}
+					d.ExcludeSelf = val
+				}
+			case "resolution_ttl":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(disp.Val())
+				if err != nil {
+					return disp.Errf("invalid duration for resolution_ttl: %v", err)
+				}
+				d.ResolutionTTL = caddy.Duration(dur)
+			case "validate_only":
+				d.ValidateOnly = true
+				if disp.NextArg() {
+					val, err := strconv.ParseBool(disp.Val())
+					if err != nil {
+						return disp.Errf("invalid boolean for validate_only: %v", err)
+					}
+					d.ValidateOnly = val
+				}
+			case "state_file":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.StateFile = disp.Val()
+			case "prewarm":
+				d.Prewarm = true
+				if disp.NextArg() {
+					val, err := strconv.ParseBool(disp.Val())
+					if err != nil {
+						return disp.Errf("invalid boolean for prewarm: %v", err)
+					}
+					d.Prewarm = val
+				}
+			case "export_file":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.ExportFile = disp.Val()
+			case "rewrite":
+				// rewrite <match> <replace>
+				args := disp.RemainingArgs()
+				if len(args) != 2 {
+					return disp.ArgErr()
+				}
+				d.Rewrites = append(d.Rewrites, &DialRewrite{Match: args[0], Replace: args[1]})
+			case "canary_header":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.CanaryHeader = disp.Val()
+				if disp.NextArg() {
+					return disp.ArgErr()
+				}
+			case "canary_meta_key":
+				if !disp.NextArg() {
+					return disp.ArgErr()
+				}
+				d.CanaryMetaKey = disp.Val()
+				if disp.NextArg() {
+					return disp.ArgErr()
+				}
+			case "check_registry":
+				// check_registry [timeout]，解析完成后尝试连接各 provider 的注册中心，不可达时只记录警告
+				checkRegistry = defaultRegistryCheckTimeout
+				if disp.NextArg() {
+					dur, err := caddy.ParseDuration(disp.Val())
+					if err != nil || dur <= 0 {
+						return disp.Errf("invalid duration for check_registry: %s", disp.Val())
+					}
+					checkRegistry = dur
+				}
+			default:
+				return disp.Errf("unrecognized subdirective '%s'", disp.Val())
 			}
 		}
 	}
+	if err := d.encodeProviders(); err != nil {
+		return disp.Err(err.Error())
+	}
+	if checkRegistry > 0 {
+		warnUnreachableRegistries(caddy.Log().Named("http.reverse_proxy.upstreams.dynamic_sd"), d.allProviders(), checkRegistry)
+	}
 	return nil
 }
 
+// instanceWeight 返回一个按上游查询实例权重的函数，供选择策略使用。
+func (d *DynamicSD) instanceWeight() func(*reverseproxy.Upstream) float64 {
+	now := time.Now()
+	weights := make(map[*reverseproxy.Upstream]float64)
+	for _, in := range d.provider.Instances() {
+		weights[in.Upstream] = in.WeightAt(now)
+	}
+	// 第一次实时刷新之前返回的是种子上游，它们的权重来自 state_file
+	for _, in := range d.seedInstances {
+		weights[in.Upstream] = in.WeightAt(now)
+	}
+	return func(up *reverseproxy.Upstream) float64 {
+		if w, ok := weights[up]; ok {
+			return w
+		}
+		return 1
+	}
+}
+
 // 接口符合性检查：确保 DynamicSD 实现了所有必要的 Caddy 接口。
 var (
 	_ caddy.Module                = (*DynamicSD)(nil)
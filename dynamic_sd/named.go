@@ -0,0 +1,66 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+// providerEntry 是一个已配置的 provider。name 是 named_provider 指定的名字，默认 provider 的 name 为空；
+// typeName 是 provider 的类型（例如 "consul"）。
+type providerEntry struct {
+	name     string
+	typeName string
+	provider providers.Provider
+}
+
+// allProviders 返回所有已配置的 provider：默认 provider（配置了时）在前，命名 provider 按名字排序。
+func (d *DynamicSD) allProviders() []providerEntry {
+	entries := make([]providerEntry, 0, len(d.named)+1)
+	if d.provider != nil {
+		entries = append(entries, providerEntry{typeName: d.providerName, provider: d.provider})
+	}
+	names := make([]string, 0, len(d.named))
+	for name := range d.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, d.named[name])
+	}
+	return entries
+}
+
+// providerFor 返回处理请求 r 的 provider：请求路径匹配 PathRoutes 时为对应的命名 provider，
+// 否则为 ProviderKey 求值得到的名字对应的命名 provider。
+// key 为空或没有对应的命名 provider 时回退到默认 provider，没有默认 provider 时返回 DiscoveryError。
+func (d *DynamicSD) providerFor(r *http.Request) (providerEntry, error) {
+	def := providerEntry{typeName: d.providerName, provider: d.provider}
+	if len(d.named) == 0 {
+		return def, nil
+	}
+	if entry, ok := d.providerForPath(r.URL.Path); ok && d.isLive(entry) {
+		return entry, nil
+	}
+
+	key := d.ProviderKey
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		key = repl.ReplaceAll(key, "")
+	}
+	if entry, ok := d.named[key]; ok && d.isLive(entry) {
+		return entry, nil
+	}
+	if d.provider != nil {
+		if err, failed := d.failed[""]; failed {
+			return providerEntry{}, &DiscoveryError{Err: fmt.Errorf("no live named provider matches provider key '%s' and the default provider failed to provision: %v", key, err)}
+		}
+		return def, nil
+	}
+	if len(d.PathRoutes) > 0 {
+		return providerEntry{}, &DiscoveryError{Err: fmt.Errorf("no path_route matches path '%s', no named provider matches provider key '%s' and no default provider is configured", r.URL.Path, key)}
+	}
+	return providerEntry{}, &DiscoveryError{Err: fmt.Errorf("no named provider matches provider key '%s' and no default provider is configured", key)}
+}
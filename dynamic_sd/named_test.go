@@ -0,0 +1,114 @@
+package dynamic_sd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// upstreamsFile 写入一个包含 dials 的 file provider 上游文件，返回它的路径。
+func upstreamsFile(t *testing.T, dials ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upstreams")
+	if err := os.WriteFile(path, []byte(strings.Join(dials, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// provisionCaddyfile 解析并 Provision input 中的 dynamic_sd 块，测试结束时 Cleanup。
+func provisionCaddyfile(t *testing.T, input string) *DynamicSD {
+	t.Helper()
+	d := new(DynamicSD)
+	if err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := d.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Cleanup() })
+	return d
+}
+
+// serviceRequest 返回一个像 Caddy 处理中的请求一样带有替换器的请求，service 非空时设置 X-Service 请求头。
+func serviceRequest(service string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if service != "" {
+		r.Header.Set("X-Service", service)
+	}
+	return caddyhttp.PrepareRequest(r, caddy.NewReplacer(), httptest.NewRecorder(), nil)
+}
+
+func TestNamedProviderSelection(t *testing.T) {
+	d := provisionCaddyfile(t, `dynamic_sd {
+		provider file {
+			path `+upstreamsFile(t, "10.0.0.1:80")+`
+		}
+		named_provider users file {
+			path `+upstreamsFile(t, "10.0.1.1:80", "10.0.1.2:80")+`
+		}
+		named_provider orders file {
+			path `+upstreamsFile(t, "10.0.2.1:80")+`
+		}
+		provider_key {http.request.header.X-Service}
+	}`)
+
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		{"users", []string{"10.0.1.1:80", "10.0.1.2:80"}},
+		{"orders", []string{"10.0.2.1:80"}},
+		// 没有对应的命名 provider 或 key 为空时回退到默认 provider
+		{"billing", []string{"10.0.0.1:80"}},
+		{"", []string{"10.0.0.1:80"}},
+	}
+	for _, tt := range tests {
+		assertDials(t, "X-Service: "+tt.service, getUpstreams(t, d, serviceRequest(tt.service)), tt.want)
+	}
+}
+
+func TestNamedProviderMissingKeyWithoutDefault(t *testing.T) {
+	d := provisionCaddyfile(t, `dynamic_sd {
+		named_provider users file {
+			path `+upstreamsFile(t, "10.0.1.1:80")+`
+		}
+		provider_key {http.request.header.X-Service}
+	}`)
+
+	assertDials(t, "users", getUpstreams(t, d, serviceRequest("users")), []string{"10.0.1.1:80"})
+	_, err := d.GetUpstreams(serviceRequest("billing"))
+	var discoveryErr *DiscoveryError
+	if !errors.As(err, &discoveryErr) || !strings.Contains(err.Error(), "'billing'") {
+		t.Fatalf("got %v, want a DiscoveryError naming the provider key", err)
+	}
+}
+
+func TestNamedProviderRequiresKey(t *testing.T) {
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		named_provider users file {
+			path /tmp/upstreams
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Validate(); err == nil {
+		t.Fatal("got nil error for named_provider without provider_key")
+	}
+}
@@ -0,0 +1,44 @@
+package dynamic_sd
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// requireAllProviders 报告是否要求所有 provider 都 Provision 成功，RequireAllProviders 未设置时为 true。
+func (d *DynamicSD) requireAllProviders() bool {
+	return d.RequireAllProviders == nil || *d.RequireAllProviders
+}
+
+// skipProvider 记录 Provision 失败、被跳过的 provider。
+func (d *DynamicSD) skipProvider(entry providerEntry, err error) {
+	d.logger.Error("provider failed to provision, continuing without it",
+		zap.String("provider", entry.typeName),
+		zap.String("named_provider", entry.name),
+		zap.Error(err),
+	)
+	if d.failed == nil {
+		d.failed = make(map[string]error)
+	}
+	d.failed[entry.name] = err
+}
+
+// checkLiveProviders 在所有 provider 都 Provision 失败时返回合并的错误。
+func (d *DynamicSD) checkLiveProviders(entries []providerEntry) error {
+	if len(d.failed) < len(entries) {
+		return nil
+	}
+	errs := make([]error, 0, len(d.failed))
+	for _, entry := range entries {
+		errs = append(errs, d.failed[entry.name])
+	}
+	return fmt.Errorf("all providers failed to provision: %w", errors.Join(errs...))
+}
+
+// isLive 报告 entry 是否 Provision 成功，失败被跳过的 provider 不处理请求。
+func (d *DynamicSD) isLive(entry providerEntry) bool {
+	_, failed := d.failed[entry.name]
+	return !failed
+}
@@ -0,0 +1,71 @@
+package dynamic_sd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// partialConfig 返回一个 dynamic_sd 配置：命名 provider "down" 的文件所在目录不存在，Provision 时失败，
+// 默认 provider 和命名 provider "users" 正常。options 是块中的其余子指令。
+func partialConfig(t *testing.T, options string) string {
+	return `dynamic_sd {
+		provider file {
+			path ` + upstreamsFile(t, "10.0.0.1:80") + `
+		}
+		named_provider users file {
+			path ` + upstreamsFile(t, "10.0.1.1:80") + `
+		}
+		named_provider down file {
+			path ` + filepath.Join(t.TempDir(), "missing", "upstreams") + `
+		}
+		provider_key {http.request.header.X-Service}
+		` + options + `
+	}`
+}
+
+func TestPartialProvisionServesFromLiveProviders(t *testing.T) {
+	d := provisionCaddyfile(t, partialConfig(t, "require_all_providers false"))
+
+	if d.isLive(d.named["down"]) || !d.isLive(d.named["users"]) {
+		t.Fatalf("got failed providers %v, want only down", d.failed)
+	}
+	assertDials(t, "users", getUpstreams(t, d, serviceRequest("users")), []string{"10.0.1.1:80"})
+	// 发往失败的 provider 的请求回退到默认 provider
+	assertDials(t, "down", getUpstreams(t, d, serviceRequest("down")), []string{"10.0.0.1:80"})
+}
+
+func TestPartialProvisionFailures(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing", "upstreams")
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"require all by default", partialConfig(t, ""), "named_provider 'down'"},
+		{"all providers failed", `dynamic_sd {
+			named_provider down file {
+				path ` + missing + `
+			}
+			provider_key {http.request.header.X-Service}
+			require_all_providers false
+		}`, "all providers failed to provision"},
+	}
+	for _, tt := range tests {
+		d := new(DynamicSD)
+		if err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.config)); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		err := d.Provision(ctx)
+		d.Cleanup()
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// providerForPath 返回 PathRoutes 中与 path 匹配的最长前缀对应的命名 provider，没有匹配时返回 false。
+func (d *DynamicSD) providerForPath(path string) (providerEntry, bool) {
+	longest := ""
+	for prefix := range d.PathRoutes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return providerEntry{}, false
+	}
+	entry, ok := d.named[d.PathRoutes[longest]]
+	return entry, ok
+}
+
+// validatePathRoutes 检查每个路径前缀都以 "/" 开头，并且指向已配置的命名 provider。
+func (d *DynamicSD) validatePathRoutes() error {
+	for prefix, name := range d.PathRoutes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path_route prefix '%s' must start with '/'", prefix)
+		}
+		if _, ok := d.named[name]; !ok {
+			return fmt.Errorf("path_route '%s' refers to unknown named_provider '%s'", prefix, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package dynamic_sd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestPathRouteLongestPrefix(t *testing.T) {
+	d := provisionCaddyfile(t, `dynamic_sd {
+		named_provider api file {
+			path `+upstreamsFile(t, "10.0.1.1:80", "10.0.1.2:80")+`
+		}
+		named_provider admin file {
+			path `+upstreamsFile(t, "10.0.2.1:80")+`
+		}
+		path_route /api api
+		path_route /api/admin admin
+	}`)
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/api/users", []string{"10.0.1.1:80", "10.0.1.2:80"}},
+		{"/api/admin/settings", []string{"10.0.2.1:80"}},
+		{"/api/administrators", []string{"10.0.2.1:80"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		assertDials(t, tt.path, getUpstreams(t, d, r), tt.want)
+	}
+
+	_, err := d.GetUpstreams(httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+	var discoveryErr *DiscoveryError
+	if !errors.As(err, &discoveryErr) {
+		t.Fatalf("got %v, want a DiscoveryError for a path without a route", err)
+	}
+}
+
+func TestPathRouteValidate(t *testing.T) {
+	for _, route := range []string{"path_route api api", "path_route /api missing"} {
+		d := new(DynamicSD)
+		err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+			named_provider api file {
+				path /tmp/upstreams
+			}
+			` + route + `
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Validate(); err == nil {
+			t.Errorf("%s: got nil error", route)
+		}
+	}
+
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		named_provider api file {
+			path /tmp/upstreams
+		}
+		path_route /api api
+		path_route /api api
+	}`))
+	if err == nil {
+		t.Fatal("got nil error for a duplicate path_route")
+	}
+}
@@ -0,0 +1,105 @@
+package dynamic_sd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+const (
+	// prewarmConcurrency 是同时进行的预热连接数量上限。
+	prewarmConcurrency = 8
+
+	// prewarmTimeout 是单次预热连接（包括 TLS 握手）的超时时间。
+	prewarmTimeout = 2 * time.Second
+)
+
+// prewarmTarget 是一个需要预热的上游。
+type prewarmTarget struct {
+	dial string
+	sni  string
+}
+
+// prewarmNew 在 provider 更新后找出新加入的上游（改写之后的地址），在后台建立一次连接后立即关闭，
+// 提前完成 DNS 解析、ARP 和 conntrack 等，降低新上游第一个请求的延迟。实例带有 SNI 时同时完成一次 TLS 握手。
+func (d *DynamicSD) prewarmNew() {
+	if !d.Prewarm {
+		return
+	}
+	current := make(map[string]struct{})
+	var targets []prewarmTarget
+	d.prewarmMu.Lock()
+	for _, entry := range d.allProviders() {
+		for _, in := range entry.provider.Instances() {
+			if in.Departing() {
+				continue
+			}
+			dial := in.Upstream.Dial
+			if d.rewriter != nil {
+				dial = d.rewriter.rewriteOne(in.Upstream).Dial
+			}
+			if _, ok := current[dial]; ok {
+				continue
+			}
+			current[dial] = struct{}{}
+			if _, ok := d.prewarmed[dial]; !ok {
+				targets = append(targets, prewarmTarget{dial: dial, sni: in.SNI})
+			}
+		}
+	}
+	d.prewarmed = current
+	d.prewarmMu.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+	// 更新回调不能阻塞，预热在后台进行
+	discovery.Go(d.logger, "upstream prewarm", func() { d.prewarmAll(d.prewarmCtx, targets) })
+}
+
+// prewarmAll 最多同时对 prewarmConcurrency 个上游建立预热连接。
+func (d *DynamicSD) prewarmAll(ctx context.Context, targets []prewarmTarget) {
+	sem := make(chan struct{}, prewarmConcurrency)
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := prewarm(ctx, target); err != nil {
+				d.logger.Debug("failed to prewarm upstream", zap.String("upstream", target.dial), zap.Error(err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// prewarm 与 target 建立一次 TCP 连接（带有 SNI 时再完成 TLS 握手）后立即关闭，不发送任何请求。
+func prewarm(ctx context.Context, target prewarmTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target.dial)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if target.sni == "" {
+		return nil
+	}
+	// 只为预热握手，不发送数据，因此不校验证书
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: target.sni, InsecureSkipVerify: true})
+	return tlsConn.HandshakeContext(ctx)
+}
@@ -0,0 +1,86 @@
+package dynamic_sd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// acceptCounter 是一个记录被连接次数的本地监听地址。
+type acceptCounter struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	count int
+}
+
+func newAcceptCounter(t *testing.T) *acceptCounter {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ac := &acceptCounter{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ac.mu.Lock()
+			ac.count++
+			ac.mu.Unlock()
+			conn.Close()
+		}
+	}()
+	return ac
+}
+
+func (ac *acceptCounter) dial() string { return ac.ln.Addr().String() }
+
+func (ac *acceptCounter) accepted() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.count
+}
+
+func TestPrewarmDialsNewInstances(t *testing.T) {
+	first, second := newAcceptCounter(t), newAcceptCounter(t)
+	prov := &instancesProvider{instances: []*discovery.Instance{discovery.NewInstance(first.dial(), nil, 0)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &DynamicSD{Prewarm: true, logger: zap.NewNop(), prewarmCtx: ctx, provider: prov}
+
+	d.prewarmNew()
+	waitFor(t, func() bool { return first.accepted() == 1 })
+
+	// 只有新加入的上游被预热
+	prov.instances = append(prov.instances, discovery.NewInstance(second.dial(), nil, 0))
+	d.prewarmNew()
+	waitFor(t, func() bool { return second.accepted() == 1 })
+	d.prewarmNew()
+	time.Sleep(50 * time.Millisecond)
+	if first.accepted() != 1 || second.accepted() != 1 {
+		t.Fatalf("got %d and %d prewarm connections, want one per new instance", first.accepted(), second.accepted())
+	}
+}
+
+func TestPrewarmDisabled(t *testing.T) {
+	ac := newAcceptCounter(t)
+	d := &DynamicSD{
+		logger:     zap.NewNop(),
+		prewarmCtx: context.Background(),
+		provider:   &instancesProvider{instances: []*discovery.Instance{discovery.NewInstance(ac.dial(), nil, 0)}},
+	}
+	d.prewarmNew()
+	time.Sleep(50 * time.Millisecond)
+	if n := ac.accepted(); n != 0 {
+		t.Fatalf("got %d connections without prewarm, want 0", n)
+	}
+}
@@ -0,0 +1,113 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+// providerTypeKey 是 JSON 配置中 provider 对象保存 provider 类型的 key，其余的 key 是 provider 自己的配置，例如：
+//
+//	"provider": {"type": "consul", "address": "127.0.0.1:8500", "service_name": "orders"}
+const providerTypeKey = "type"
+
+// encodeProvider 把 provider 的配置编码为带有类型的 JSON 对象，供 ProviderRaw 和 NamedProvidersRaw 使用。
+func encodeProvider(typeName string, prov providers.Provider) (json.RawMessage, error) {
+	raw, err := json.Marshal(prov)
+	if err != nil {
+		return nil, fmt.Errorf("encoding provider '%s': %v", typeName, err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("encoding provider '%s': %v", typeName, err)
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	fields[providerTypeKey], _ = json.Marshal(typeName)
+	return json.Marshal(fields)
+}
+
+// decodeProvider 从 encodeProvider 格式的 JSON 对象创建 provider，返回 provider 的类型和实例。
+// 未知的配置项会返回错误，与 Caddy 解析其他模块的 JSON 配置一致。
+func decodeProvider(raw json.RawMessage) (string, providers.Provider, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return "", nil, fmt.Errorf("provider config must be a JSON object: %v", err)
+	}
+	var typeName string
+	if err := json.Unmarshal(fields[providerTypeKey], &typeName); err != nil || typeName == "" {
+		return "", nil, fmt.Errorf("provider config requires a string '%s' field", providerTypeKey)
+	}
+	delete(fields, providerTypeKey)
+
+	prov, err := providers.NewProvider(typeName)
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating provider '%s': %v", typeName, err)
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := caddy.StrictUnmarshalJSON(rest, prov); err != nil {
+		return "", nil, fmt.Errorf("decoding provider '%s': %v", typeName, err)
+	}
+	return typeName, prov, nil
+}
+
+// encodeProviders 把 Caddyfile 解析得到的 provider 写入 ProviderRaw 和 NamedProvidersRaw，
+// 使 caddy adapt 输出的 JSON 配置包含 provider 的设置。
+func (d *DynamicSD) encodeProviders() error {
+	if d.provider != nil {
+		raw, err := encodeProvider(d.providerName, d.provider)
+		if err != nil {
+			return err
+		}
+		d.ProviderRaw = raw
+	}
+	if len(d.named) > 0 {
+		d.NamedProvidersRaw = make(map[string]json.RawMessage, len(d.named))
+		for name, entry := range d.named {
+			raw, err := encodeProvider(entry.typeName, entry.provider)
+			if err != nil {
+				return fmt.Errorf("named_provider '%s': %v", name, err)
+			}
+			d.NamedProvidersRaw[name] = raw
+		}
+	}
+	return nil
+}
+
+// loadProviders 在 provider 还没有创建时（配置来自 JSON）根据 ProviderRaw 和 NamedProvidersRaw 创建它们。
+// 配置来自 Caddyfile 时 provider 已经由 UnmarshalCaddyfile 创建，不会重复创建。可以重复调用。
+func (d *DynamicSD) loadProviders() error {
+	if d.provider == nil && len(d.ProviderRaw) > 0 {
+		typeName, prov, err := decodeProvider(d.ProviderRaw)
+		if err != nil {
+			return err
+		}
+		d.provider = prov
+		d.providerName = typeName
+	}
+	if d.named == nil && len(d.NamedProvidersRaw) > 0 {
+		names := make([]string, 0, len(d.NamedProvidersRaw))
+		for name := range d.NamedProvidersRaw {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		named := make(map[string]providerEntry, len(names))
+		for _, name := range names {
+			typeName, prov, err := decodeProvider(d.NamedProvidersRaw[name])
+			if err != nil {
+				return fmt.Errorf("named_provider '%s': %v", name, err)
+			}
+			named[name] = providerEntry{name: name, typeName: typeName, provider: prov}
+		}
+		d.named = named
+	}
+	return nil
+}
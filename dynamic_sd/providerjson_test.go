@@ -0,0 +1,113 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers/consul"
+)
+
+const providerCaddyfile = `dynamic_sd {
+	provider consul {
+		address 127.0.0.1:8500
+		service_name orders
+		passing_only false
+	}
+	named_provider users consul {
+		address 127.0.0.1:8500
+		service_name users
+	}
+	provider_key {http.request.header.X-Service}
+}`
+
+// assertConsulProviders 检查 providerCaddyfile 中的 provider 被完整地创建。
+func assertConsulProviders(t *testing.T, d *DynamicSD) {
+	t.Helper()
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	cp, ok := d.provider.(*consul.ConsulProvider)
+	if !ok || d.providerName != "consul" {
+		t.Fatalf("got provider %T named %q, want consul", d.provider, d.providerName)
+	}
+	if cp.Address != "127.0.0.1:8500" || cp.ServiceName != "orders" || cp.PassingOnly {
+		t.Fatalf("got provider address=%s service=%s passing_only=%v, want 127.0.0.1:8500 orders false", cp.Address, cp.ServiceName, cp.PassingOnly)
+	}
+	users, ok := d.named["users"]
+	if !ok || users.typeName != "consul" || users.name != "users" {
+		t.Fatalf("got named providers %v, want users of type consul", d.named)
+	}
+	if ucp := users.provider.(*consul.ConsulProvider); ucp.ServiceName != "users" || !ucp.PassingOnly {
+		t.Fatalf("got users service=%s passing_only=%v, want users true", ucp.ServiceName, ucp.PassingOnly)
+	}
+}
+
+func TestProviderFromCaddyfile(t *testing.T) {
+	d := new(DynamicSD)
+	if err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(providerCaddyfile)); err != nil {
+		t.Fatal(err)
+	}
+	assertConsulProviders(t, d)
+}
+
+func TestProviderFromAdaptedJSON(t *testing.T) {
+	parsed := new(DynamicSD)
+	if err := parsed.UnmarshalCaddyfile(caddyfile.NewTestDispenser(providerCaddyfile)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := new(DynamicSD)
+	if err := json.Unmarshal(raw, d); err != nil {
+		t.Fatal(err)
+	}
+	assertConsulProviders(t, d)
+}
+
+func TestProviderFromJSON(t *testing.T) {
+	d := new(DynamicSD)
+	err := json.Unmarshal([]byte(`{
+		"provider": {"type": "consul", "address": "127.0.0.1:8500", "service_name": "orders", "passing_only": false},
+		"named_providers": {"users": {"type": "consul", "address": "127.0.0.1:8500", "service_name": "users"}},
+		"provider_key": "{http.request.header.X-Service}"
+	}`), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertConsulProviders(t, d)
+}
+
+func TestProviderFromJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"no provider", `{}`, "no service discovery provider"},
+		{"missing type", `{"provider": {"address": "127.0.0.1:8500"}}`, "'type'"},
+		{"unknown type", `{"provider": {"type": "zookeeper"}}`, "zookeeper"},
+		{"unknown field", `{"provider": {"type": "consul", "adress": "127.0.0.1:8500"}}`, "adress"},
+		{"named", `{"named_providers": {"users": {"type": "zookeeper"}}, "provider_key": "x"}`, "named_provider 'users'"},
+	}
+	for _, tt := range tests {
+		d := new(DynamicSD)
+		if err := json.Unmarshal([]byte(tt.json), d); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err := d.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one mentioning %s", tt.name, err, tt.want)
+		}
+		var ce *ConfigError
+		if !errors.As(err, &ce) {
+			t.Errorf("%s: got %T, want a ConfigError", tt.name, err)
+		}
+	}
+}
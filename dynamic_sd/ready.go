@@ -0,0 +1,98 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// readyPolicyAll 要求每个 provider 都已就绪。
+	readyPolicyAll = "all"
+
+	// readyPolicyAny 只要求至少一个 provider 已就绪。
+	readyPolicyAny = "any"
+)
+
+// readiness 是就绪检查端点的响应。
+type readiness struct {
+	Ready     bool            `json:"ready"`
+	Policy    string          `json:"policy"`
+	Providers []providerReady `json:"providers"`
+}
+
+// providerReady 是一个 provider 的就绪状态。
+type providerReady struct {
+	// Name 是命名 provider 的名字，默认 provider 为空。
+	Name      string `json:"name,omitempty"`
+	Provider  string `json:"provider"`
+	Service   string `json:"service"`
+	Upstreams int    `json:"upstreams"`
+	// Seeded 为 true 表示 provider 还没有成功刷新过，dynamic_sd 正在使用 state_file 中的种子上游。
+	Seeded bool `json:"seeded,omitempty"`
+	// GraceExpired 为 true 表示 provider 在 ready_grace 内没有得到上游，不再阻止模块就绪。
+	GraceExpired bool `json:"grace_expired,omitempty"`
+	Ready        bool `json:"ready"`
+	// Error 是 provider Provision 失败的原因，只在 require_all_providers 为 false、provider 被跳过时设置。
+	// 被跳过的 provider 在配置重载之前不会得到上游，policy 为 all 时不计入。
+	Error string `json:"error,omitempty"`
+}
+
+// readinessSnapshot 按 policy 汇总所有 dynamic_sd 的 provider 是否已经得到上游。
+// provider 有上游，或者 dynamic_sd 正在使用 state_file 中的种子上游时视为就绪；没有配置任何 provider 时视为就绪。
+// 超过 ready_grace 仍没有上游的 provider 也视为就绪。Provision 失败被跳过的 provider 不视为就绪，
+// 但 policy 为 all 时不要求它们就绪，模块已经按 require_all_providers 为 false 在没有它们的情况下运行。
+func readinessSnapshot(policy string) (readiness, error) {
+	switch policy {
+	case "":
+		policy = readyPolicyAll
+	case readyPolicyAll, readyPolicyAny:
+	default:
+		return readiness{}, fmt.Errorf("policy must be '%s' or '%s'", readyPolicyAll, readyPolicyAny)
+	}
+
+	result := readiness{Policy: policy, Providers: []providerReady{}}
+	now := time.Now()
+	for _, d := range activeModules() {
+		graceExpired := d.ReadyGrace > 0 && now.Sub(d.provisionedAt) >= time.Duration(d.ReadyGrace)
+		for _, entry := range d.allProviders() {
+			pr := providerReady{
+				Name:      entry.name,
+				Provider:  entry.typeName,
+				Service:   entry.provider.Service(),
+				Upstreams: len(entry.provider.Instances()),
+			}
+			pr.Seeded = entry.provider == d.provider && len(d.seed) > 0 && !d.live.Load()
+			pr.Ready = pr.Upstreams > 0 || pr.Seeded
+			if err, failed := d.failed[entry.name]; failed {
+				pr.Error = err.Error()
+			} else if !pr.Ready && graceExpired {
+				pr.Ready, pr.GraceExpired = true, true
+			}
+			result.Providers = append(result.Providers, pr)
+		}
+	}
+	sort.Slice(result.Providers, func(i, j int) bool {
+		a, b := result.Providers[i], result.Providers[j]
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Name < b.Name
+	})
+
+	result.Ready = policy == readyPolicyAll || len(result.Providers) == 0
+	for _, pr := range result.Providers {
+		if policy == readyPolicyAll && !pr.Ready && pr.Error == "" {
+			result.Ready = false
+			break
+		}
+		if policy == readyPolicyAny && pr.Ready {
+			result.Ready = true
+			break
+		}
+	}
+	return result, nil
+}
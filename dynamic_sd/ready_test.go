@@ -0,0 +1,153 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// readyModule 返回一个已注册的 dynamic_sd：命名 provider "up" 有一个实例，"empty" 还没有实例。
+func readyModule(t *testing.T) *DynamicSD {
+	t.Helper()
+	d := &DynamicSD{
+		ProviderKey:   "{http.request.header.X-Service}",
+		provisionedAt: time.Now(),
+		named: map[string]providerEntry{
+			"up": {name: "up", typeName: "consul", provider: &instancesProvider{
+				stubProvider: stubProvider{service: "ready-up"},
+				instances:    []*discovery.Instance{discovery.NewInstance("10.0.0.1:80", nil, 0)},
+			}},
+			"empty": {name: "empty", typeName: "consul", provider: &instancesProvider{
+				stubProvider: stubProvider{service: "ready-empty"},
+			}},
+		},
+	}
+	registerActive(d)
+	t.Cleanup(func() { unregisterActive(d) })
+	return d
+}
+
+// providerState 返回快照中服务名为 service 的 provider。
+func providerState(t *testing.T, result readiness, service string) providerReady {
+	t.Helper()
+	for _, pr := range result.Providers {
+		if pr.Service == service {
+			return pr
+		}
+	}
+	t.Fatalf("%s missing from %+v", service, result.Providers)
+	return providerReady{}
+}
+
+func TestReadinessPolicy(t *testing.T) {
+	readyModule(t)
+
+	tests := []struct {
+		policy string
+		ready  bool
+	}{
+		{"", false},
+		{readyPolicyAll, false},
+		{readyPolicyAny, true},
+	}
+	for _, tt := range tests {
+		result, err := readinessSnapshot(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Ready != tt.ready {
+			t.Errorf("policy %q: got ready=%v, want %v", tt.policy, result.Ready, tt.ready)
+		}
+	}
+	if _, err := readinessSnapshot("most"); err == nil {
+		t.Fatal("got nil error for an unknown policy")
+	}
+}
+
+func TestReadinessGrace(t *testing.T) {
+	d := readyModule(t)
+	d.ReadyGrace = caddy.Duration(time.Minute)
+
+	result, err := readinessSnapshot(readyPolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Ready || providerState(t, result, "ready-empty").GraceExpired {
+		t.Fatalf("got %+v, want not ready while within ready_grace", result)
+	}
+
+	d.provisionedAt = time.Now().Add(-2 * time.Minute)
+	result, err = readinessSnapshot(readyPolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := providerState(t, result, "ready-empty")
+	if !result.Ready || !empty.Ready || !empty.GraceExpired {
+		t.Fatalf("got %+v, want ready with the empty provider past ready_grace", result)
+	}
+	if up := providerState(t, result, "ready-up"); up.GraceExpired {
+		t.Fatal("provider with upstreams is marked grace_expired")
+	}
+}
+
+func TestReadinessSkipsFailedProvider(t *testing.T) {
+	d := readyModule(t)
+	d.failed = map[string]error{"empty": errors.New("connection refused")}
+	// 失败的 provider 不因 ready_grace 到期而被视为就绪
+	d.ReadyGrace = caddy.Duration(time.Second)
+	d.provisionedAt = time.Now().Add(-time.Minute)
+
+	result, err := readinessSnapshot(readyPolicyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Ready {
+		t.Fatalf("got %+v, want ready without the skipped provider", result)
+	}
+	failed := providerState(t, result, "ready-empty")
+	if failed.Ready || failed.GraceExpired || failed.Error != "connection refused" {
+		t.Fatalf("got %+v, want the skipped provider reported not ready with its error", failed)
+	}
+}
+
+func TestHandleReadyStatus(t *testing.T) {
+	d := readyModule(t)
+
+	serve := func(query string) (*httptest.ResponseRecorder, readiness) {
+		rec := httptest.NewRecorder()
+		if err := (adminAPI{}).handleReady(rec, httptest.NewRequest(http.MethodGet, "/dynamic_sd/ready"+query, nil)); err != nil {
+			t.Fatal(err)
+		}
+		var body readiness
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return rec, body
+	}
+
+	rec, body := serve("")
+	if rec.Code != http.StatusServiceUnavailable || body.Ready || body.Policy != readyPolicyAll {
+		t.Fatalf("got %d %+v, want 503 for policy all", rec.Code, body)
+	}
+	if rec, _ = serve("?policy=any"); rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200 for policy any", rec.Code)
+	}
+
+	d.named["empty"].provider.(*instancesProvider).instances = []*discovery.Instance{discovery.NewInstance("10.0.0.2:80", nil, 0)}
+	if rec, _ = serve(""); rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200 once every provider has upstreams", rec.Code)
+	}
+
+	err := (adminAPI{}).handleReady(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dynamic_sd/ready?policy=most", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400 APIError", err)
+	}
+}
@@ -0,0 +1,126 @@
+package dynamic_sd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// recordProbe 将一次完成的探测计入 EWMA。配置了 recheck_interval 时，探测失败的上游被摘除并进入待重新探测的队列，
+// 探测成功的上游（无论来自常规探测还是重新探测）被重新加入。
+func (d *DynamicSD) recordProbe(dial string, rtt time.Duration, up bool) {
+	d.latency.observe(dial, rtt)
+	if d.RecheckInterval <= 0 {
+		return
+	}
+	if !up {
+		if d.latency.eject(dial) {
+			d.logger.Warn("upstream failed probe, ejecting until it passes a recheck", zap.String("upstream", dial))
+		}
+		return
+	}
+	if d.latency.readmit(dial) {
+		d.logger.Info("ejected upstream passed probe, re-including", zap.String("upstream", dial))
+	}
+}
+
+// recheckLoop 每隔 interval 重新探测被摘除的上游，直到 ctx 被取消。
+// 被摘除的上游通常只是短暂的抖动，不必等到下一轮完整的探测才恢复。
+func (d *DynamicSD) recheckLoop(ctx context.Context, interval time.Duration, concurrency int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		d.recheckPending(ctx, concurrency, interval)
+	}
+}
+
+// recheckPending 对队列中的每个上游探测一次，总耗时不超过 budget。
+func (d *DynamicSD) recheckPending(ctx context.Context, concurrency int, budget time.Duration) {
+	dials := d.latency.pendingDials()
+	if len(dials) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, dial := range dials {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if rtt, up, ok := probe(ctx, dial); ok {
+				d.recordProbe(dial, rtt, up)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// eject 将 dial 加入待重新探测的队列，dial 之前不在队列中时返回 true。
+func (lt *latencyTracker) eject(dial string) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if _, ok := lt.pending[dial]; ok {
+		return false
+	}
+	lt.pending[dial] = struct{}{}
+	return true
+}
+
+// readmit 将 dial 移出待重新探测的队列，dial 之前在队列中时返回 true。
+func (lt *latencyTracker) readmit(dial string) bool {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if _, ok := lt.pending[dial]; !ok {
+		return false
+	}
+	delete(lt.pending, dial)
+	return true
+}
+
+// pendingDials 返回队列中所有地址的副本。
+func (lt *latencyTracker) pendingDials() []string {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	dials := make([]string, 0, len(lt.pending))
+	for dial := range lt.pending {
+		dials = append(dials, dial)
+	}
+	return dials
+}
+
+// dropEjected 丢弃被摘除的上游。所有上游都被摘除时原样返回，
+// 此时更可能是 Caddy 自身的网络出现问题，交给反向代理自己的健康检查处理。
+func (lt *latencyTracker) dropEjected(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	if len(lt.pending) == 0 {
+		return upstreams
+	}
+	kept := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if _, ok := lt.pending[up.Dial]; !ok {
+			kept = append(kept, up)
+		}
+	}
+	if len(kept) == 0 {
+		return upstreams
+	}
+	return kept
+}
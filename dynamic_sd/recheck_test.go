@@ -0,0 +1,90 @@
+package dynamic_sd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// waitFor 等待 cond 成立，超时则失败。
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRecheckReadmitsRecoveredUpstream(t *testing.T) {
+	var mu sync.Mutex
+	down := map[string]bool{"10.0.0.2:80": true}
+	probes := make(map[string]int)
+	fakeProbe(t, func(ctx context.Context, dial string) (time.Duration, bool, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		probes[dial]++
+		if down[dial] {
+			return probeTimeout, false, true
+		}
+		return time.Millisecond, true, true
+	})
+
+	d := &DynamicSD{
+		RecheckInterval: caddy.Duration(10 * time.Millisecond),
+		provider: &instancesProvider{instances: []*discovery.Instance{
+			discovery.NewInstance("10.0.0.1:80", nil, 0),
+			discovery.NewInstance("10.0.0.2:80", nil, 0),
+		}},
+		latency: newLatencyTracker(),
+		logger:  zap.NewNop(),
+	}
+	ups := testUpstreams("10.0.0.1:80", "10.0.0.2:80")
+
+	d.probeAll(context.Background(), defaultProbeConcurrency, time.Second)
+	assertDials(t, "failed probe", d.latency.dropEjected(ups), []string{"10.0.0.1:80"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.recheckLoop(ctx, time.Duration(d.RecheckInterval), defaultProbeConcurrency)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// 重新探测只针对被摘除的上游，仍然失败时继续留在队列中
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return probes["10.0.0.2:80"] >= 3
+	})
+	mu.Lock()
+	if probes["10.0.0.1:80"] != 1 {
+		t.Fatalf("got %d probes of the healthy upstream, want only the regular one", probes["10.0.0.1:80"])
+	}
+	down["10.0.0.2:80"] = false
+	mu.Unlock()
+
+	waitFor(t, func() bool { return len(d.latency.dropEjected(ups)) == 2 })
+	if dials := d.latency.pendingDials(); len(dials) != 0 {
+		t.Fatalf("got pending %v after recovery, want an empty queue", dials)
+	}
+}
+
+func TestDropEjectedKeepsAllWhenEveryUpstreamFails(t *testing.T) {
+	lt := newLatencyTracker()
+	lt.eject("10.0.0.1:80")
+	lt.eject("10.0.0.2:80")
+	assertDials(t, "all ejected", lt.dropEjected(testUpstreams("10.0.0.1:80", "10.0.0.2:80")), []string{"10.0.0.1:80", "10.0.0.2:80"})
+}
@@ -0,0 +1,43 @@
+package dynamic_sd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+	"go.uber.org/zap"
+)
+
+// defaultRegistryCheckTimeout 是 check_registry 连接注册中心的默认超时时间。
+const defaultRegistryCheckTimeout = 2 * time.Second
+
+// warnUnreachableRegistries 并发地与每个 provider 的注册中心建立一次 TCP 连接，失败时记录警告。
+// 它只在解析 Caddyfile 时由 check_registry 触发，不影响解析结果，最多耗时 timeout。
+func warnUnreachableRegistries(logger *zap.Logger, entries []providerEntry, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		ra, ok := entry.provider.(providers.RegistryAddresser)
+		if !ok {
+			continue
+		}
+		for _, addr := range ra.RegistryAddresses() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", addr, timeout)
+				if err != nil {
+					logger.Warn("registry is unreachable, check the provider address",
+						zap.String("provider", entry.typeName),
+						zap.String("named_provider", entry.name),
+						zap.String("address", addr),
+						zap.Error(err),
+					)
+					return
+				}
+				conn.Close()
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,66 @@
+package dynamic_sd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCheckRegistryDoesNotFailParse(t *testing.T) {
+	d := new(DynamicSD)
+	start := time.Now()
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		provider redis {
+			address ` + closedAddr(t) + `
+			key check-registry-test
+		}
+		check_registry 200ms
+	}`))
+	if err != nil {
+		t.Fatalf("unreachable registry failed the parse: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("check_registry took %v, want it bounded by the timeout", elapsed)
+	}
+}
+
+func TestWarnUnreachableRegistries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	unreachable := closedAddr(t)
+
+	d := new(DynamicSD)
+	err = d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		provider redis {
+			address ` + ln.Addr().String() + `
+			key reachable
+		}
+		named_provider down redis {
+			address ` + unreachable + `
+			key unreachable
+		}
+		provider_key {http.request.header.X-Service}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	warnUnreachableRegistries(zap.New(core), d.allProviders(), time.Second)
+
+	if logs.Len() != 1 {
+		t.Fatalf("got %d warnings, want 1 for the unreachable registry: %v", logs.Len(), logs.All())
+	}
+	fields := logs.All()[0].ContextMap()
+	if fields["address"] != unreachable || fields["named_provider"] != "down" || fields["provider"] != "redis" {
+		t.Fatalf("got fields %v, want address %s of named_provider down", fields, unreachable)
+	}
+}
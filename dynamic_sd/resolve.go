@@ -0,0 +1,235 @@
+package dynamic_sd
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultResolutionTTL 是 resolve_hostnames 时解析结果的默认缓存时间。
+	defaultResolutionTTL = time.Minute
+
+	// resolveTimeout 是解析单个主机名的超时时间。
+	resolveTimeout = 2 * time.Second
+
+	// resolveRetryInterval 是解析失败后再次尝试之前的等待时间，期间继续使用上一次的结果。
+	resolveRetryInterval = 5 * time.Second
+)
+
+// lookupNetIP 解析主机名，测试通过替换这个变量模拟 DNS。
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// hostResolver 把主机名形式的上游展开为每个 IP 一个的上游，避免反向代理在每个连接上解析 DNS。
+// 解析结果缓存 ttl，过期后在后台刷新并继续使用旧的结果，因此 DNS 变慢或不可用时不会阻塞请求；
+// 只有从未解析过的主机名会在请求中同步解析一次，provider 刷新时会提前解析新出现的主机名。
+// 解析失败且没有可用结果的主机名保持原样交给反向代理。
+type hostResolver struct {
+	ttl     time.Duration
+	logger  *zap.Logger
+	lookups singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*resolution
+	// resolved 按展开后的 IP 地址记录上游，使反向代理在请求之间看到同一个上游对象。
+	resolved map[string]*resolvedUpstream
+}
+
+// resolution 是一个主机名的解析结果。
+type resolution struct {
+	addrs      []netip.Addr
+	expires    time.Time
+	refreshing bool
+}
+
+// resolvedUpstream 是展开后的上游，origin 是展开前的 "hostname:port"。
+type resolvedUpstream struct {
+	upstream *reverseproxy.Upstream
+	host     string
+	origin   string
+}
+
+// newHostResolver 创建一个缓存 ttl 的解析器。
+func newHostResolver(ttl time.Duration, logger *zap.Logger) *hostResolver {
+	return &hostResolver{
+		ttl:      ttl,
+		logger:   logger,
+		entries:  make(map[string]*resolution),
+		resolved: make(map[string]*resolvedUpstream),
+	}
+}
+
+// hostnameOf 在 dial 是 "hostname:port" 形式时返回主机名和端口，IP 地址或无法解析的 dial 返回 ok 为 false。
+func hostnameOf(dial string) (host, port string, ok bool) {
+	host, port, err := net.SplitHostPort(dial)
+	if err != nil {
+		return "", "", false
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+// resolve 返回展开后的上游列表，顺序保持不变，一个主机名展开出的多个 IP 相邻排列。
+func (hr *hostResolver) resolve(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	for _, up := range upstreams {
+		host, _, ok := hostnameOf(up.Dial)
+		if !ok {
+			continue
+		}
+		// 从未完成过解析的主机名同步解析，并发的请求共享同一次查询
+		hr.mu.Lock()
+		res, ok := hr.entries[host]
+		known := ok && !res.expires.IsZero()
+		hr.mu.Unlock()
+		if known {
+			hr.refreshIfExpired(host)
+		} else {
+			hr.lookups.Do(host, func() (any, error) {
+				hr.lookup(host)
+				return nil, nil
+			})
+		}
+	}
+
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	out := make([]*reverseproxy.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		host, port, ok := hostnameOf(up.Dial)
+		if !ok {
+			out = append(out, up)
+			continue
+		}
+		res := hr.entries[host]
+		if res == nil || len(res.addrs) == 0 {
+			out = append(out, up)
+			continue
+		}
+		for _, addr := range res.addrs {
+			out = append(out, hr.upstreamLocked(up, host, net.JoinHostPort(addr.String(), port)))
+		}
+	}
+	return out
+}
+
+// upstreamLocked 返回 up 展开为 dial 后的上游，已经展开过时沿用同一个对象。调用方必须持有 hr.mu。
+func (hr *hostResolver) upstreamLocked(up *reverseproxy.Upstream, host, dial string) *reverseproxy.Upstream {
+	if r, ok := hr.resolved[dial]; ok && r.origin == up.Dial {
+		return r.upstream
+	}
+	rw := *up
+	rw.Dial = dial
+	hr.resolved[dial] = &resolvedUpstream{upstream: &rw, host: host, origin: up.Dial}
+	return &rw
+}
+
+// origin 返回展开后的地址 dial 对应的 "hostname:port"，dial 不是展开得到的地址时返回 false。
+func (hr *hostResolver) origin(dial string) (string, bool) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	r, ok := hr.resolved[dial]
+	if !ok {
+		return "", false
+	}
+	return r.origin, true
+}
+
+// refreshIfExpired 在 host 的解析结果过期时启动一次后台刷新。
+func (hr *hostResolver) refreshIfExpired(host string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	res, ok := hr.entries[host]
+	if ok && (res.refreshing || time.Now().Before(res.expires)) {
+		return
+	}
+	if !ok {
+		res = &resolution{}
+		hr.entries[host] = res
+	}
+	res.refreshing = true
+	go hr.lookup(host)
+}
+
+// lookup 解析 host 并更新缓存。解析失败时保留上一次的结果，并在 resolveRetryInterval 后重试。
+func (hr *hostResolver) lookup(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := lookupNetIP(ctx, "ip", host)
+
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	res, ok := hr.entries[host]
+	if !ok {
+		res = &resolution{}
+		hr.entries[host] = res
+	}
+	res.refreshing = false
+	if err != nil || len(addrs) == 0 {
+		hr.logger.Warn("failed to resolve upstream hostname, keeping previous addresses",
+			zap.String("host", host),
+			zap.Int("previous", len(res.addrs)),
+			zap.Error(err),
+		)
+		res.expires = time.Now().Add(resolveRetryInterval)
+		return
+	}
+
+	current := make(map[netip.Addr]struct{}, len(addrs))
+	res.addrs = res.addrs[:0:0]
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if _, dup := current[addr]; dup {
+			continue
+		}
+		current[addr] = struct{}{}
+		res.addrs = append(res.addrs, addr)
+	}
+	res.expires = time.Now().Add(hr.ttl)
+
+	// 不再属于该主机名的 IP 不会再被展开出来
+	for dial, r := range hr.resolved {
+		if r.host != host {
+			continue
+		}
+		ipStr, _, _ := net.SplitHostPort(dial)
+		ip, err := netip.ParseAddr(ipStr)
+		if _, ok := current[ip]; err != nil || !ok {
+			delete(hr.resolved, dial)
+		}
+	}
+}
+
+// prefetch 在 provider 刷新后提前解析 dials 中新出现或已过期的主机名，并清理不再出现的主机名。
+func (hr *hostResolver) prefetch(dials []string) {
+	hosts := make(map[string]struct{})
+	for _, dial := range dials {
+		if host, _, ok := hostnameOf(dial); ok {
+			hosts[host] = struct{}{}
+		}
+	}
+
+	hr.mu.Lock()
+	for host := range hr.entries {
+		if _, ok := hosts[host]; !ok {
+			delete(hr.entries, host)
+		}
+	}
+	for dial, r := range hr.resolved {
+		if _, ok := hosts[r.host]; !ok {
+			delete(hr.resolved, dial)
+		}
+	}
+	hr.mu.Unlock()
+
+	for host := range hosts {
+		hr.refreshIfExpired(host)
+	}
+}
@@ -0,0 +1,111 @@
+package dynamic_sd
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeDNS 替换 lookupNetIP，记录每个主机名被查询的次数。
+type fakeDNS struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	lookups map[string]int
+}
+
+func newFakeDNS(t *testing.T, addrs map[string][]string) *fakeDNS {
+	dns := &fakeDNS{addrs: addrs, lookups: make(map[string]int)}
+	orig := lookupNetIP
+	lookupNetIP = dns.lookup
+	t.Cleanup(func() { lookupNetIP = orig })
+	return dns
+}
+
+func (f *fakeDNS) lookup(_ context.Context, _, host string) ([]netip.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups[host]++
+	if len(f.addrs[host]) == 0 {
+		return nil, errors.New("no such host")
+	}
+	var out []netip.Addr
+	for _, a := range f.addrs[host] {
+		out = append(out, netip.MustParseAddr(a))
+	}
+	return out, nil
+}
+
+func (f *fakeDNS) set(host string, addrs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs[host] = addrs
+}
+
+func (f *fakeDNS) count(host string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups[host]
+}
+
+func TestHostResolverResolvesAndCaches(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]string{"backend.internal": {"10.0.0.1", "10.0.0.2", "::ffff:10.0.0.1"}})
+	hr := newHostResolver(time.Hour, zap.NewNop())
+	upstreams := testUpstreams("backend.internal:8080", "10.0.0.9:80")
+
+	first := hr.resolve(upstreams)
+	assertDials(t, "first", first, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.9:80"})
+	if origin, ok := hr.origin("10.0.0.2:8080"); !ok || origin != "backend.internal:8080" {
+		t.Fatalf("got origin %q, %v, want backend.internal:8080", origin, ok)
+	}
+
+	second := hr.resolve(upstreams)
+	if n := dns.count("backend.internal"); n != 1 {
+		t.Fatalf("got %d lookups, want the cached result to be reused", n)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("upstream %d changed between requests, want the same object", i)
+		}
+	}
+}
+
+func TestHostResolverRefreshesAfterTTL(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]string{"backend.internal": {"10.0.0.1"}})
+	hr := newHostResolver(20*time.Millisecond, zap.NewNop())
+	upstreams := testUpstreams("backend.internal:80")
+	assertDials(t, "initial", hr.resolve(upstreams), []string{"10.0.0.1:80"})
+
+	// 过期后的请求继续使用旧的结果，刷新在后台完成
+	dns.set("backend.internal", "10.0.0.3")
+	time.Sleep(30 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := hr.resolve(upstreams)
+		if len(got) == 1 && got[0].Dial == "10.0.0.3:80" {
+			break
+		}
+		if len(got) != 1 || got[0].Dial != "10.0.0.1:80" || time.Now().After(deadline) {
+			t.Fatalf("got %v, want the previous address until the refresh completes", got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := hr.origin("10.0.0.1:80"); ok {
+		t.Fatal("address no longer returned by DNS still maps to the hostname")
+	}
+
+	// 解析失败时保留上一次的结果
+	dns.set("backend.internal")
+	hr.lookup("backend.internal")
+	assertDials(t, "failed lookup", hr.resolve(upstreams), []string{"10.0.0.3:80"})
+}
+
+func TestHostResolverPassesThroughUnresolved(t *testing.T) {
+	newFakeDNS(t, map[string][]string{})
+	hr := newHostResolver(time.Hour, zap.NewNop())
+	assertDials(t, "unresolved", hr.resolve(testUpstreams("missing.internal:80")), []string{"missing.internal:80"})
+}
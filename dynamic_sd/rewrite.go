@@ -0,0 +1,97 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// DialRewrite 描述一条对上游地址的正则改写规则。
+// 例如将集群内部地址映射为 NAT 地址：match "^10\.0\.(\d+)\.(\d+):8080$"，replace "nat.example.com:$2"。
+type DialRewrite struct {
+	// Match 是匹配上游地址（"host:port"）的正则表达式。
+	Match string `json:"match,omitempty"`
+
+	// Replace 是替换内容，支持 $1、${name} 等分组引用。
+	Replace string `json:"replace,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// dialRewriter 按顺序对上游地址应用所有改写规则，并缓存改写后的上游。
+// 改写后的上游是新的对象，只在 provider 的上游列表变化时重建，
+// 这样反向代理在请求之间看到的是同一组上游。
+type dialRewriter struct {
+	rules []*DialRewrite
+
+	mu        sync.Mutex
+	src       []*reverseproxy.Upstream
+	rewritten map[*reverseproxy.Upstream]*reverseproxy.Upstream
+}
+
+// newDialRewriter 编译所有规则，任何一条规则的正则非法都会返回错误。
+func newDialRewriter(rules []*DialRewrite) (*dialRewriter, error) {
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("compiling rewrite %d match '%s': %v", i, rule.Match, err)
+		}
+		rule.re = re
+	}
+	return &dialRewriter{rules: rules}, nil
+}
+
+// rewrite 返回 upstreams 对应的改写后的上游列表，顺序保持不变。
+// all 是 provider 当前的完整上游列表，用于判断缓存是否仍然有效。
+func (dr *dialRewriter) rewrite(all, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.rewritten == nil || !sameUpstreams(dr.src, all) {
+		dr.src = all
+		dr.rewritten = make(map[*reverseproxy.Upstream]*reverseproxy.Upstream, len(all))
+		for _, up := range all {
+			dr.rewritten[up] = dr.rewriteOne(up)
+		}
+	}
+
+	out := make([]*reverseproxy.Upstream, len(upstreams))
+	for i, up := range upstreams {
+		if rw, ok := dr.rewritten[up]; ok {
+			out[i] = rw
+		} else {
+			out[i] = dr.rewriteOne(up)
+		}
+	}
+	return out
+}
+
+// rewriteOne 依次应用所有规则，地址未发生变化时返回原来的上游。
+func (dr *dialRewriter) rewriteOne(up *reverseproxy.Upstream) *reverseproxy.Upstream {
+	dial := up.Dial
+	for _, rule := range dr.rules {
+		dial = rule.re.ReplaceAllString(dial, rule.Replace)
+	}
+	if dial == up.Dial {
+		return up
+	}
+	rw := *up
+	rw.Dial = dial
+	return &rw
+}
+
+// sameUpstreams 报告两个上游切片是否逐个指向相同的上游。
+// provider 在每次刷新时都会替换整个切片，因此比较指针即可判断集合是否变化。
+func sameUpstreams(a, b []*reverseproxy.Upstream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
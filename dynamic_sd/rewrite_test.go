@@ -0,0 +1,77 @@
+package dynamic_sd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+)
+
+// assertDials 检查上游列表的地址与 want 逐个相同。
+func assertDials(t *testing.T, name string, got []*reverseproxy.Upstream, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d upstreams, want %v", name, len(got), want)
+	}
+	for i, up := range got {
+		if up.Dial != want[i] {
+			t.Fatalf("%s: upstream %d = %s, want %s", name, i, up.Dial, want[i])
+		}
+	}
+}
+
+// stubProvider 是一个只实现 Service 的 provider，其余方法不应被调用。
+type stubProvider struct {
+	providers.Provider
+	service string
+}
+
+func (p *stubProvider) Service() string { return p.service }
+
+func TestDialRewriterRewritesInOrder(t *testing.T) {
+	dr, err := newDialRewriter([]*DialRewrite{
+		{Match: `^10\.0\.(\d+)\.(\d+):8080$`, Replace: "nat-$2.example.com:8080"},
+		// 规则按顺序应用，后面的规则看到的是前面改写之后的地址
+		{Match: `:8080$`, Replace: ":443"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := testUpstreams("10.0.1.7:8080", "10.0.2.9:9090", "192.168.0.1:8080")
+	got := dr.rewrite(all, all)
+	assertDials(t, "rewrite", got, []string{"nat-7.example.com:443", "10.0.2.9:9090", "192.168.0.1:443"})
+	// 没有被改写的上游就是原来的对象，provider 的上游不会被修改
+	if got[1] != all[1] || all[0].Dial != "10.0.1.7:8080" {
+		t.Fatal("rewrite modified or copied an upstream it did not change")
+	}
+
+	// 上游集合不变时返回同一组改写后的上游，选择策略过滤之后的子集也一样
+	if again := dr.rewrite(all, all[:1]); again[0] != got[0] {
+		t.Fatal("rewritten upstream rebuilt although the provider's upstreams did not change")
+	}
+	refreshed := testUpstreams("10.0.1.7:8080")
+	if rebuilt := dr.rewrite(refreshed, refreshed); rebuilt[0] == got[0] || rebuilt[0].Dial != "nat-7.example.com:443" {
+		t.Fatal("rewritten upstreams not rebuilt after the provider refreshed")
+	}
+}
+
+func TestInvalidRewriteFailsProvision(t *testing.T) {
+	d := &DynamicSD{
+		provider:     &stubProvider{service: "rewrite-invalid"},
+		providerName: "consul",
+		Rewrites:     []*DialRewrite{{Match: `10\.0\.(\d+`, Replace: "$1"}},
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err := d.Provision(ctx)
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("got %v, want a ConfigError for the invalid regex", err)
+	}
+}
@@ -0,0 +1,56 @@
+package dynamic_sd
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// seededUpstreams 按请求头 SeedHeader 的值对上游做加权的随机排序：每个上游的排序值为 u^(1/w)，
+// u 由种子和上游地址的哈希得到，w 是实例权重，排序值大的在前。同一个种子（例如重放请求时相同的 trace ID）
+// 在上游集合不变时总是得到相同的顺序，且与 provider 返回的顺序无关；请求没有该请求头时 u 取随机数。
+// 配合 `lb_policy first` 使用，每个上游排在第一位的概率与其权重成正比。
+func (d *DynamicSD) seededUpstreams(r *http.Request, upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	seed := r.Header.Get(d.SeedHeader)
+	weight := d.instanceWeight()
+
+	keys := make(map[*reverseproxy.Upstream]float64, len(upstreams))
+	for _, up := range upstreams {
+		var u float64
+		if seed != "" {
+			u = seededUniform(seed, up.Dial)
+		} else {
+			u = rand.Float64()
+		}
+		keys[up] = math.Pow(u, 1/weight(up))
+	}
+
+	sorted := make([]*reverseproxy.Upstream, len(upstreams))
+	copy(sorted, upstreams)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if keys[sorted[i]] != keys[sorted[j]] {
+			return keys[sorted[i]] > keys[sorted[j]]
+		}
+		return sorted[i].Dial < sorted[j].Dial
+	})
+	return sorted
+}
+
+// seededUniform 返回由 seed 和 dial 决定的 (0, 1) 内的伪随机数。
+func seededUniform(seed, dial string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte{0})
+	h.Write([]byte(dial))
+	// FNV 对只差最后几个字符的输入区分度不足，先用 murmur3 的 finalizer 打散
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	// 取高 53 位作为尾数，加 0.5 避免得到 0
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,114 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// traceRequest 返回一个 X-Trace-Id 为 trace 的请求，trace 为空时不设置该请求头。
+func traceRequest(trace string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if trace != "" {
+		r.Header.Set("X-Trace-Id", trace)
+	}
+	return r
+}
+
+// joinDials 以逗号连接上游地址。
+func joinDials(upstreams []*reverseproxy.Upstream) string {
+	dials := make([]string, len(upstreams))
+	for i, up := range upstreams {
+		dials[i] = up.Dial
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestSeededOrderIsReproducible(t *testing.T) {
+	d := fileModule(t, "selection seeded\nseed_header X-Trace-Id",
+		"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.5:80")
+
+	orders := make(map[string]struct{})
+	for i := range 20 {
+		trace := fmt.Sprintf("trace-%d", i)
+		want := joinDials(getUpstreams(t, d, traceRequest(trace)))
+		for range 5 {
+			if got := joinDials(getUpstreams(t, d, traceRequest(trace))); got != want {
+				t.Fatalf("%s: got order %s, want %s as before", trace, got, want)
+			}
+		}
+		orders[want] = struct{}{}
+	}
+	if len(orders) < 5 {
+		t.Fatalf("got %d distinct orders for 20 trace IDs, want the seed to vary the order", len(orders))
+	}
+
+	// 没有请求头时随机排序
+	random := make(map[string]struct{})
+	for range 50 {
+		random[joinDials(getUpstreams(t, d, traceRequest("")))] = struct{}{}
+	}
+	if len(random) < 5 {
+		t.Fatalf("got %d distinct orders without a seed header, want random ordering", len(random))
+	}
+}
+
+func TestSeededOrderIgnoresProviderOrder(t *testing.T) {
+	ups := testUpstreams("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80")
+	d := &DynamicSD{SeedHeader: "X-Trace-Id", provider: &instancesProvider{}}
+	r := traceRequest("replayed")
+
+	want := joinDials(d.seededUpstreams(r, ups))
+	reversed := slices.Clone(ups)
+	slices.Reverse(reversed)
+	if got := joinDials(d.seededUpstreams(r, reversed)); got != want {
+		t.Fatalf("got order %s for reversed input, want %s", got, want)
+	}
+	if joinDials(ups) != "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80,10.0.0.4:80" {
+		t.Fatal("seededUpstreams reordered its input in place")
+	}
+}
+
+func TestSeededOrderFollowsWeight(t *testing.T) {
+	heavy := discovery.NewInstance("10.0.0.1:80", nil, 3)
+	light := discovery.NewInstance("10.0.0.2:80", nil, 1)
+	d := &DynamicSD{SeedHeader: "X-Trace-Id", provider: &instancesProvider{instances: []*discovery.Instance{heavy, light}}}
+	ups := []*reverseproxy.Upstream{heavy.Upstream, light.Upstream}
+
+	const traces = 4000
+	first := 0
+	for i := range traces {
+		if d.seededUpstreams(traceRequest(fmt.Sprintf("trace-%d", i)), ups)[0] == heavy.Upstream {
+			first++
+		}
+	}
+	// 权重 3:1，heavy 排在第一位的概率为 75%
+	if first < traces*70/100 || first > traces*80/100 {
+		t.Fatalf("heavy upstream came first for %d of %d seeds, want about 75%%", first, traces)
+	}
+}
+
+func TestSeededWeightFollowsWarmDuration(t *testing.T) {
+	s := discovery.Store{WarmDuration: caddy.Duration(time.Hour)}
+	s.Setup(zap.NewNop(), "warm-seeded")
+	s.Update([]*discovery.Instance{discovery.NewInstance("10.0.0.1:80", nil, 2)})
+	s.Update([]*discovery.Instance{discovery.NewInstance("10.0.0.1:80", nil, 2), discovery.NewInstance("10.0.0.2:80", nil, 2)})
+	instances := s.Instances()
+
+	// 刚出现的实例按 warm_duration 开始时的权重参与排序
+	d := &DynamicSD{provider: &instancesProvider{instances: instances}}
+	weight := d.instanceWeight()
+	if warm, fresh := weight(instances[0].Upstream), weight(instances[1].Upstream); warm != 2 || fresh > 0.25 {
+		t.Fatalf("got weights %v and %v, want 2 for the warm instance and about 0.2 for the new one", warm, fresh)
+	}
+}
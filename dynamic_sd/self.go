@@ -0,0 +1,102 @@
+package dynamic_sd
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// selfRefreshInterval 是重新读取本机网卡地址的间隔，网卡地址变化（例如 DHCP 续租、新增网卡）后最多经过该时间生效。
+const selfRefreshInterval = time.Minute
+
+// selfFilter 丢弃 IP 为本机地址的上游，避免 Caddy 与后端部署在同一台机器上时把请求转发给自己。
+// 主机名形式的上游不做检查，需要配合 resolve_hostnames 才能排除解析到本机的主机名。
+type selfFilter struct {
+	logger *zap.Logger
+	// interfaceAddrs 返回本机的网卡地址，默认为 net.InterfaceAddrs。
+	interfaceAddrs func() ([]net.Addr, error)
+
+	mu       sync.Mutex
+	local    map[netip.Addr]struct{}
+	loadedAt time.Time
+}
+
+// newSelfFilter 创建一个过滤器并立即读取一次本机地址。
+func newSelfFilter(logger *zap.Logger) *selfFilter {
+	sf := &selfFilter{logger: logger, interfaceAddrs: net.InterfaceAddrs}
+	sf.mu.Lock()
+	sf.loadLocked(time.Now())
+	sf.mu.Unlock()
+	return sf
+}
+
+// loadLocked 重新读取本机地址，失败时保留上一次的结果。调用方必须持有 sf.mu。
+func (sf *selfFilter) loadLocked(now time.Time) {
+	sf.loadedAt = now
+	addrs, err := sf.interfaceAddrs()
+	if err != nil {
+		sf.logger.Warn("failed to read local interface addresses, keeping previous addresses for exclude_self", zap.Error(err))
+		return
+	}
+	local := make(map[netip.Addr]struct{}, len(addrs))
+	for _, addr := range addrs {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		if parsed, ok := netip.AddrFromSlice(ip); ok {
+			local[parsed.Unmap()] = struct{}{}
+		}
+	}
+	sf.local = local
+}
+
+// filter 返回 upstreams 中 IP 不属于本机的上游，顺序保持不变。
+func (sf *selfFilter) filter(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if now := time.Now(); now.Sub(sf.loadedAt) >= selfRefreshInterval {
+		sf.loadLocked(now)
+	}
+
+	var kept []*reverseproxy.Upstream
+	for i, up := range upstreams {
+		if !sf.isLocal(up.Dial) {
+			if kept != nil {
+				kept = append(kept, up)
+			}
+			continue
+		}
+		// 第一次遇到本机地址时才复制，没有本机地址时直接返回原来的切片
+		if kept == nil {
+			kept = make([]*reverseproxy.Upstream, i, len(upstreams))
+			copy(kept, upstreams[:i])
+		}
+	}
+	if kept == nil {
+		return upstreams
+	}
+	return kept
+}
+
+// isLocal 报告 dial 的主机部分是否是本机的 IP 地址。调用方必须持有 sf.mu。
+func (sf *selfFilter) isLocal(dial string) bool {
+	host, _, err := net.SplitHostPort(dial)
+	if err != nil {
+		host = dial
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	_, ok := sf.local[addr.Unmap()]
+	return ok
+}
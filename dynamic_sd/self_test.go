@@ -0,0 +1,51 @@
+package dynamic_sd
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeInterfaceAddrs 返回一个读取 *addrs 作为本机地址的函数，*addrs 为 nil 时返回错误。
+func fakeInterfaceAddrs(addrs *[]string) func() ([]net.Addr, error) {
+	return func() ([]net.Addr, error) {
+		if *addrs == nil {
+			return nil, errors.New("interfaces unavailable")
+		}
+		var out []net.Addr
+		for _, cidr := range *addrs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+		}
+		return out, nil
+	}
+}
+
+func TestSelfFilterExcludesLocalAddresses(t *testing.T) {
+	local := []string{"10.0.0.2/24", "fd00::2/64"}
+	sf := &selfFilter{logger: zap.NewNop(), interfaceAddrs: fakeInterfaceAddrs(&local)}
+	sf.loadLocked(time.Now())
+
+	all := testUpstreams("10.0.0.1:80", "10.0.0.2:80", "[fd00::2]:80", "[::ffff:10.0.0.2]:80", "backend.internal:80")
+	assertDials(t, "local", sf.filter(all), []string{"10.0.0.1:80", "backend.internal:80"})
+
+	remote := testUpstreams("10.0.0.1:80", "10.0.0.3:80")
+	if got := sf.filter(remote); &got[0] != &remote[0] {
+		t.Fatal("filter copied a list without local addresses")
+	}
+
+	// 过了刷新间隔之后重新读取本机地址，读取失败时保留上一次的结果
+	local = []string{"10.0.0.3/24"}
+	sf.loadedAt = time.Now().Add(-selfRefreshInterval)
+	assertDials(t, "refreshed", sf.filter(remote), []string{"10.0.0.1:80"})
+
+	local = nil
+	sf.loadedAt = time.Now().Add(-selfRefreshInterval)
+	assertDials(t, "failed refresh", sf.filter(remote), []string{"10.0.0.1:80"})
+}
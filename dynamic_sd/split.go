@@ -0,0 +1,210 @@
+package dynamic_sd
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// TrafficSplit 按实例 metadata 中某个 key 的取值把实例分组，并按百分比在分组之间分配请求，
+// 例如 key 为 "version"，percentages 为 {"v1": 90, "v2": 10}，用于蓝绿发布或金丝雀发布。
+type TrafficSplit struct {
+	// Key 是用于分组的 metadata key。
+	Key string `json:"key,omitempty"`
+
+	// Percentages 是每个取值分到的请求百分比，总和必须为 100。
+	// 不属于任何取值的实例不会被选中；被选中的分组当前没有可用实例时退回到所有上游。
+	// 配置了 Ramp 时它不包含 Ramp 的取值，其余取值按各自的比例分配 Ramp 之外的请求，总和不必为 100。
+	Percentages map[string]float64 `json:"percentages,omitempty"`
+
+	// Ramp 让一个分组的百分比随时间逐步变化，为 nil 表示不变化。
+	Ramp *SplitRamp `json:"ramp,omitempty"`
+}
+
+// SplitRamp 让取值为 Value 的分组（通常是金丝雀版本）的百分比在 Start 到 End 之间从 StartPct 线性变化到 EndPct，
+// Start 之前保持 StartPct，End 之后保持 EndPct，用于按计划逐步放量而不需要修改配置。
+type SplitRamp struct {
+	Value    string    `json:"value,omitempty"`
+	Start    time.Time `json:"start,omitempty"`
+	End      time.Time `json:"end,omitempty"`
+	StartPct float64   `json:"start_pct,omitempty"`
+	EndPct   float64   `json:"end_pct,omitempty"`
+}
+
+// percentageAt 返回 now 时刻分组的百分比。
+func (sr *SplitRamp) percentageAt(now time.Time) float64 {
+	switch {
+	case !now.After(sr.Start):
+		return sr.StartPct
+	case !now.Before(sr.End):
+		return sr.EndPct
+	}
+	progress := float64(now.Sub(sr.Start)) / float64(sr.End.Sub(sr.Start))
+	return sr.StartPct + (sr.EndPct-sr.StartPct)*progress
+}
+
+// validate 检查 ramp 配置是否有效，others 是 Percentages。
+func (sr *SplitRamp) validate(others map[string]float64) error {
+	if sr.Value == "" {
+		return fmt.Errorf("split: ramp value is required")
+	}
+	if _, ok := others[sr.Value]; ok {
+		return fmt.Errorf("split: ramp value '%s' must not also have a fixed percentage", sr.Value)
+	}
+	if sr.Start.IsZero() || sr.End.IsZero() {
+		return fmt.Errorf("split: ramp start and end are required")
+	}
+	if !sr.End.After(sr.Start) {
+		return fmt.Errorf("split: ramp end must be after start")
+	}
+	for _, pct := range []float64{sr.StartPct, sr.EndPct} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("split: ramp percentages must be between 0 and 100, got %g", pct)
+		}
+	}
+	return nil
+}
+
+// Validate 检查分组配置是否有效。
+func (ts *TrafficSplit) Validate() error {
+	if ts.Key == "" {
+		return fmt.Errorf("split: key is required")
+	}
+	if len(ts.Percentages) == 0 {
+		return fmt.Errorf("split: at least one value is required")
+	}
+	var total float64
+	for value, pct := range ts.Percentages {
+		if pct < 0 {
+			return fmt.Errorf("split: percentage for '%s' must not be negative", value)
+		}
+		total += pct
+	}
+	if ts.Ramp != nil {
+		if err := ts.Ramp.validate(ts.Percentages); err != nil {
+			return err
+		}
+		if total <= 0 {
+			return fmt.Errorf("split: values other than the ramp value must have a positive total percentage")
+		}
+		return nil
+	}
+	if math.Abs(total-100) > 1e-9 {
+		return fmt.Errorf("split: percentages must sum to 100, got %g", total)
+	}
+	return nil
+}
+
+// percentagesAt 返回 now 时刻每个取值的百分比。配置了 Ramp 时 Ramp 的取值使用当前的百分比，
+// 其余取值按 Percentages 的比例分配剩下的百分比。
+func (ts *TrafficSplit) percentagesAt(now time.Time) map[string]float64 {
+	if ts.Ramp == nil {
+		return ts.Percentages
+	}
+	ramp := ts.Ramp.percentageAt(now)
+	var total float64
+	for _, pct := range ts.Percentages {
+		total += pct
+	}
+	out := make(map[string]float64, len(ts.Percentages)+1)
+	for value, pct := range ts.Percentages {
+		out[value] = pct / total * (100 - ramp)
+	}
+	out[ts.Ramp.Value] = ramp
+	return out
+}
+
+// pick 按 now 时刻的百分比随机选择一个取值。
+func (ts *TrafficSplit) pick(now time.Time) string {
+	percentages := ts.percentagesAt(now)
+
+	// 按取值排序，保证相同的随机数总是落到相同的分组
+	values := make([]string, 0, len(percentages))
+	for value := range percentages {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	r := rand.Float64() * 100
+	for _, value := range values {
+		r -= percentages[value]
+		if r < 0 {
+			return value
+		}
+	}
+	return values[len(values)-1]
+}
+
+// splitUpstreams 为本次请求选择一个分组，只返回属于该分组的上游，顺序保持不变。
+func (d *DynamicSD) splitUpstreams(upstreams []*reverseproxy.Upstream) []*reverseproxy.Upstream {
+	value := d.Split.pick(time.Now())
+
+	group := make(map[*reverseproxy.Upstream]struct{})
+	// 第一次实时刷新之前返回的是种子上游，它们的 metadata 来自 state_file
+	for _, instances := range [][]*discovery.Instance{d.provider.Instances(), d.seedInstances} {
+		for _, in := range instances {
+			if v, ok := in.Meta(d.Split.Key); ok && v == value {
+				group[in.Upstream] = struct{}{}
+			}
+		}
+	}
+
+	kept := make([]*reverseproxy.Upstream, 0, len(group))
+	for _, up := range upstreams {
+		if _, ok := group[up]; ok {
+			kept = append(kept, up)
+		}
+	}
+	if len(kept) == 0 {
+		return upstreams
+	}
+	return kept
+}
+
+// unmarshalSplitRamp 解析 split 块中的 `ramp <value> { ... }`，调用时当前 token 是 "ramp"。
+func unmarshalSplitRamp(d *caddyfile.Dispenser) (*SplitRamp, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	ramp := &SplitRamp{Value: d.Val()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "start", "end":
+			t, err := time.Parse(time.RFC3339, d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid time for ramp %s: %v", option, err)
+			}
+			if option == "start" {
+				ramp.Start = t
+			} else {
+				ramp.End = t
+			}
+		case "start_pct", "end_pct":
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+			if err != nil {
+				return nil, d.Errf("invalid percentage for ramp %s: %v", option, err)
+			}
+			if option == "start_pct" {
+				ramp.StartPct = pct
+			} else {
+				ramp.EndPct = pct
+			}
+		default:
+			return nil, d.Errf("unrecognized ramp option '%s'", option)
+		}
+	}
+	return ramp, nil
+}
@@ -0,0 +1,169 @@
+package dynamic_sd
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+func TestTrafficSplitDistribution(t *testing.T) {
+	v1a := discovery.NewInstance("10.0.0.1:80", map[string]string{"version": "v1"}, 0)
+	v1b := discovery.NewInstance("10.0.0.2:80", map[string]string{"version": "v1"}, 0)
+	v2 := discovery.NewInstance("10.0.0.3:80", map[string]string{"version": "v2"}, 0)
+	other := discovery.NewInstance("10.0.0.4:80", nil, 0)
+	all := []*reverseproxy.Upstream{v1a.Upstream, v1b.Upstream, v2.Upstream, other.Upstream}
+
+	d := &DynamicSD{
+		Split:    &TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 90, "v2": 10}},
+		provider: &instancesProvider{instances: []*discovery.Instance{v1a, v1b, v2, other}},
+	}
+	if err := d.Split.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	const calls = 10000
+	counts := make(map[string]int)
+	for range calls {
+		got := d.splitUpstreams(all)
+		switch {
+		case len(got) == 2 && got[0] == v1a.Upstream && got[1] == v1b.Upstream:
+			counts["v1"]++
+		case len(got) == 1 && got[0] == v2.Upstream:
+			counts["v2"]++
+		default:
+			t.Fatalf("got %v, want exactly one version group", got)
+		}
+	}
+	// 10000 次中 v2 的期望是 1000 次，标准差约 30，容差取 5 个标准差
+	if v2 := counts["v2"]; math.Abs(float64(v2)-calls*0.1) > 150 {
+		t.Fatalf("got %d of %d requests routed to v2, want about 10%%", v2, calls)
+	}
+}
+
+func TestTrafficSplitFallsBackWhenGroupEmpty(t *testing.T) {
+	v1 := discovery.NewInstance("10.0.0.1:80", map[string]string{"version": "v1"}, 0)
+	all := []*reverseproxy.Upstream{v1.Upstream}
+	d := &DynamicSD{
+		Split:    &TrafficSplit{Key: "version", Percentages: map[string]float64{"v2": 100}},
+		provider: &instancesProvider{instances: []*discovery.Instance{v1}},
+	}
+	assertDials(t, "empty v2 group", d.splitUpstreams(all), []string{"10.0.0.1:80"})
+}
+
+func TestTrafficSplitValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		split TrafficSplit
+		ok    bool
+	}{
+		{"sums to 100", TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 90, "v2": 10}}, true},
+		{"fractional", TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 66.6, "v2": 33.4}}, true},
+		{"under 100", TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 80, "v2": 10}}, false},
+		{"over 100", TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 95, "v2": 10}}, false},
+		{"negative", TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 110, "v2": -10}}, false},
+		{"no key", TrafficSplit{Percentages: map[string]float64{"v1": 100}}, false},
+		{"no values", TrafficSplit{Key: "version"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.split.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestTrafficSplitRampFollowsClock(t *testing.T) {
+	d := new(DynamicSD)
+	err := d.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`dynamic_sd {
+		provider file {
+			path /tmp/upstreams
+		}
+		split version {
+			v1 80
+			blue 20
+			ramp v2 {
+				start     2026-01-01T00:00:00Z
+				end       2026-01-01T10:00:00Z
+				start_pct 0
+				end_pct   50%
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Split.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now  time.Time
+		want map[string]float64
+	}{
+		{start.Add(-time.Hour), map[string]float64{"v1": 80, "blue": 20, "v2": 0}},
+		{start, map[string]float64{"v1": 80, "blue": 20, "v2": 0}},
+		// 过了 40% 的时间，v2 到 20%，其余 80% 按 80:20 分配
+		{start.Add(4 * time.Hour), map[string]float64{"v1": 64, "blue": 16, "v2": 20}},
+		{start.Add(10 * time.Hour), map[string]float64{"v1": 40, "blue": 10, "v2": 50}},
+		{start.Add(48 * time.Hour), map[string]float64{"v1": 40, "blue": 10, "v2": 50}},
+	}
+	for _, tt := range tests {
+		got := d.Split.percentagesAt(tt.now)
+		if len(got) != len(tt.want) {
+			t.Fatalf("%v: got %v, want %v", tt.now, got, tt.want)
+		}
+		for value, pct := range tt.want {
+			if math.Abs(got[value]-pct) > 1e-9 {
+				t.Fatalf("%v: got %v, want %v", tt.now, got, tt.want)
+			}
+		}
+	}
+
+	// 开始之前不会选中 v2，结束之后大约一半的请求选中 v2
+	var before, after int
+	for range 2000 {
+		if d.Split.pick(start) == "v2" {
+			before++
+		}
+		if d.Split.pick(start.Add(48*time.Hour)) == "v2" {
+			after++
+		}
+	}
+	if before != 0 || after < 850 || after > 1150 {
+		t.Fatalf("picked v2 %d times before the ramp and %d of 2000 after it, want 0 and about 1000", before, after)
+	}
+}
+
+func TestTrafficSplitRampValidate(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	valid := func() *SplitRamp {
+		return &SplitRamp{Value: "v2", Start: start, End: start.Add(time.Hour), EndPct: 50}
+	}
+	tests := []struct {
+		name   string
+		modify func(*TrafficSplit)
+	}{
+		{"no value", func(ts *TrafficSplit) { ts.Ramp.Value = "" }},
+		{"fixed percentage", func(ts *TrafficSplit) { ts.Percentages["v2"] = 10 }},
+		{"no end", func(ts *TrafficSplit) { ts.Ramp.End = time.Time{} }},
+		{"end before start", func(ts *TrafficSplit) { ts.Ramp.End = start.Add(-time.Hour) }},
+		{"over 100", func(ts *TrafficSplit) { ts.Ramp.EndPct = 120 }},
+		{"no other values", func(ts *TrafficSplit) { ts.Percentages = map[string]float64{"v1": 0} }},
+	}
+	ok := TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 100}, Ramp: valid()}
+	if err := ok.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		ts := TrafficSplit{Key: "version", Percentages: map[string]float64{"v1": 100}, Ramp: valid()}
+		tt.modify(&ts)
+		if err := ts.Validate(); err == nil {
+			t.Errorf("%s: got nil error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dynamic_sd
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// srvWeightScale 是实例权重换算为 SRV 权重时的倍数，SRV 权重只能是整数，
+	// 放大后 0.5 这样的小数权重仍能保持相对比例。
+	srvWeightScale = 100
+
+	// srvPriorityDraining 是正在预热或正在移除的实例的 SRV 优先级，数值越大优先级越低。
+	srvPriorityDraining = 1
+)
+
+// active 记录当前已 Provision 的 DynamicSD，供管理接口读取它们的上游。
+var active = struct {
+	mu  sync.Mutex
+	set map[*DynamicSD]struct{}
+}{set: make(map[*DynamicSD]struct{})}
+
+// registerActive 在 Provision 完成时记录 d。
+func registerActive(d *DynamicSD) {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	active.set[d] = struct{}{}
+}
+
+// unregisterActive 在 Cleanup 时移除 d。
+func unregisterActive(d *DynamicSD) {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	delete(active.set, d)
+}
+
+// activeModules 返回当前已 Provision 的 DynamicSD，顺序不固定。
+func activeModules() []*DynamicSD {
+	active.mu.Lock()
+	defer active.mu.Unlock()
+	modules := make([]*DynamicSD, 0, len(active.set))
+	for d := range active.set {
+		modules = append(modules, d)
+	}
+	return modules
+}
+
+// srvGroup 是一个 dynamic_sd 的 SRV 记录集合。
+type srvGroup struct {
+	Provider string      `json:"provider"`
+	Service  string      `json:"service"`
+	Records  []srvRecord `json:"records"`
+}
+
+// srvRecord 是一条 SRV 风格的记录，字段含义与 RFC 2782 相同。
+type srvRecord struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+	// Hostname 是实例的主机名（目前只有 mDNS 提供），不属于 SRV 记录，只便于查看。
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// srvSnapshot 返回所有 dynamic_sd 在 now 时刻的 SRV 记录，按 provider 和服务名排序。
+// 正常实例的优先级为 0，正在预热或移除的实例优先级为 srvPriorityDraining；被隔离的地址不会出现。
+func srvSnapshot(now time.Time) []srvGroup {
+	modules := activeModules()
+	groups := make([]srvGroup, 0, len(modules))
+	for _, d := range modules {
+		for _, entry := range d.allProviders() {
+			groups = append(groups, srvGroupOf(entry, now))
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Provider != groups[j].Provider {
+			return groups[i].Provider < groups[j].Provider
+		}
+		return groups[i].Service < groups[j].Service
+	})
+	return groups
+}
+
+// srvGroupOf 返回一个 provider 在 now 时刻的 SRV 记录。
+func srvGroupOf(entry providerEntry, now time.Time) srvGroup {
+	group := srvGroup{
+		Provider: entry.typeName,
+		Service:  entry.provider.Service(),
+		Records:  []srvRecord{},
+	}
+	for _, in := range entry.provider.Instances() {
+		if cordoned.has(in.Upstream.Dial) {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(in.Upstream.Dial)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		record := srvRecord{
+			Weight:   int(math.Min(math.Max(math.Round(in.WeightAt(now)*srvWeightScale), 1), math.MaxUint16)),
+			Port:     port,
+			Target:   host,
+			Hostname: in.Hostname,
+		}
+		if in.Retention(now) < 1 {
+			record.Priority = srvPriorityDraining
+		}
+		group.Records = append(group.Records, record)
+	}
+	return group
+}
@@ -0,0 +1,85 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+func TestHandleSRVRecords(t *testing.T) {
+	s := discovery.Store{ScaleInGrace: caddy.Duration(time.Minute)}
+	s.Setup(zap.NewNop(), "srv-test")
+	s.Update([]*discovery.Instance{
+		discovery.NewInstance("10.0.0.1:8080", nil, 2),
+		discovery.NewInstance("10.0.0.2:8080", nil, 0.5),
+		discovery.NewInstance("10.0.0.3:8080", nil, 0),
+		discovery.NewInstance("10.0.0.4:9090", nil, 0),
+	})
+	// 10.0.0.2 从注册中心移除后在 scale_in_grace 期间保留，优先级降低
+	s.Update([]*discovery.Instance{
+		discovery.NewInstance("10.0.0.1:8080", nil, 2),
+		discovery.NewInstance("10.0.0.3:8080", nil, 0),
+		discovery.NewInstance("10.0.0.4:9090", nil, 0),
+	})
+
+	d := &DynamicSD{
+		providerName: "consul",
+		provider: &instancesProvider{
+			stubProvider: stubProvider{service: "srv-test"},
+			instances:    s.Instances(),
+		},
+	}
+	registerActive(d)
+	t.Cleanup(func() { unregisterActive(d) })
+	cordoned.add("10.0.0.4:9090")
+	t.Cleanup(func() { cordoned.remove("10.0.0.4:9090") })
+
+	rec := httptest.NewRecorder()
+	if err := (adminAPI{}).handleSRV(rec, httptest.NewRequest(http.MethodGet, "/dynamic_sd/srv", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got Content-Type %q, want application/json", ct)
+	}
+	var groups []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	var group map[string]any
+	for _, g := range groups {
+		if g["service"] == "srv-test" {
+			group = g
+		}
+	}
+	if group == nil || group["provider"] != "consul" {
+		t.Fatalf("got %s, want a consul group for srv-test", rec.Body)
+	}
+
+	records, _ := group["records"].([]any)
+	want := []map[string]any{
+		{"priority": 0.0, "weight": 200.0, "port": 8080.0, "target": "10.0.0.1"},
+		{"priority": 0.0, "weight": 100.0, "port": 8080.0, "target": "10.0.0.3"},
+		{"priority": 1.0, "weight": 50.0, "port": 8080.0, "target": "10.0.0.2"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got records %v, want %v", records, want)
+	}
+	for i, r := range records {
+		record := r.(map[string]any)
+		if len(record) != len(want[i]) {
+			t.Fatalf("record %d: got fields %v, want %v", i, record, want[i])
+		}
+		for k, v := range want[i] {
+			if record[k] != v {
+				t.Fatalf("record %d: got %s=%v, want %v", i, k, record[k], v)
+			}
+		}
+	}
+}
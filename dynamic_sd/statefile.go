@@ -0,0 +1,91 @@
+package dynamic_sd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// stateFile 是持久化到 state_file 中的最近一次可用的上游列表。
+type stateFile struct {
+	UpdatedAt time.Time       `json:"updated_at"`
+	Instances []stateInstance `json:"instances"`
+}
+
+// stateInstance 是 stateFile 中的一个实例。
+type stateInstance struct {
+	Dial     string            `json:"dial"`
+	Weight   float64           `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// saveState 将实例列表原子地写入 path。
+func saveState(path string, instances []*discovery.Instance) error {
+	state := stateFile{
+		UpdatedAt: time.Now(),
+		Instances: make([]stateInstance, 0, len(instances)),
+	}
+	for _, in := range instances {
+		// 正在移除的实例不应在重启后重新出现
+		if in.Departing() {
+			continue
+		}
+		state.Instances = append(state.Instances, stateInstance{
+			Dial:     in.Upstream.Dial,
+			Weight:   in.Weight,
+			Metadata: in.Metadata,
+		})
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding state: %v", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic 将 data 原子地写入 path：先写入同目录下的临时文件，再重命名覆盖，
+// 读取者不会看到写了一半的文件。
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file for '%s': %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing '%s': %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing '%s': %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing '%s': %v", path, err)
+	}
+	return nil
+}
+
+// loadState 从 path 读取之前保存的实例列表，保留保存时的权重和 metadata。
+func loadState(path string) ([]*discovery.Instance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decoding state file '%s': %v", path, err)
+	}
+
+	instances := make([]*discovery.Instance, 0, len(state.Instances))
+	for _, in := range state.Instances {
+		if in.Dial == "" {
+			continue
+		}
+		instances = append(instances, discovery.NewInstance(in.Dial, in.Metadata, in.Weight))
+	}
+	return instances, nil
+}
@@ -0,0 +1,91 @@
+package dynamic_sd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// emptyProvider 是一个还没有任何实例的 provider，例如注册中心暂时不可用时。
+type emptyProvider struct {
+	stubProvider
+}
+
+func (p *emptyProvider) Instances() []*discovery.Instance { return nil }
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	saved := []*discovery.Instance{
+		discovery.NewInstance("10.0.0.1:80", map[string]string{"zone": "a"}, 3),
+		discovery.NewInstance("10.0.0.2:80", nil, 0),
+	}
+	if err := saveState(path, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(saved) {
+		t.Fatalf("got %d instances, want %d", len(loaded), len(saved))
+	}
+	for i, in := range loaded {
+		if in.Upstream.Dial != saved[i].Upstream.Dial || in.Weight != saved[i].Weight {
+			t.Errorf("instance %d = %s weight %v, want %s weight %v", i, in.Upstream.Dial, in.Weight, saved[i].Upstream.Dial, saved[i].Weight)
+		}
+	}
+	if zone, _ := loaded[0].Meta("zone"); zone != "a" {
+		t.Errorf("got zone %q, want a", zone)
+	}
+}
+
+func TestLoadSeedServesSavedWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := saveState(path, []*discovery.Instance{discovery.NewInstance("10.0.0.1:80", nil, 5)}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &DynamicSD{StateFile: path, logger: zap.NewNop(), provider: &emptyProvider{}}
+	d.loadSeed()
+	if len(d.seed) != 1 || d.seed[0].Dial != "10.0.0.1:80" {
+		t.Fatalf("got seed %v, want 10.0.0.1:80", d.seed)
+	}
+	if w := d.instanceWeight()(d.seed[0]); w != 5 {
+		t.Fatalf("got seed weight %v, want 5", w)
+	}
+}
+
+func TestLoadSeedIgnoresMissingAndCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		warns int
+	}{
+		{"missing", filepath.Join(dir, "missing.json"), 0},
+		{"corrupt", corrupt, 1},
+	}
+	for _, tt := range tests {
+		core, logs := observer.New(zapcore.WarnLevel)
+		d := &DynamicSD{StateFile: tt.path, logger: zap.New(core)}
+		d.loadSeed()
+		if len(d.seed) != 0 || len(d.seedInstances) != 0 {
+			t.Errorf("%s: got seed %v, want none", tt.name, d.seed)
+		}
+		if logs.Len() != tt.warns {
+			t.Errorf("%s: got %d warnings, want %d", tt.name, logs.Len(), tt.warns)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package dynamic_sd
+
+import (
+	"time"
+
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/providers"
+	"go.uber.org/zap"
+)
+
+var (
+	// slowCleanupThreshold 是 provider 的 Cleanup 耗时超过后记录警告的阈值。
+	slowCleanupThreshold = 5 * time.Second
+
+	// cleanupTimeout 是等待单个 provider 的 Cleanup 的最长时间，超时后不再等待，继续清理其余的 provider。
+	cleanupTimeout = 30 * time.Second
+)
+
+// cleanupProviders 通过 providers.CleanupAll 依次清理所有已 Provision 的 provider，
+// 并记录每个 provider 的清理耗时以及是否超时。
+func (d *DynamicSD) cleanupProviders() error {
+	children := make([]providers.Provider, len(d.provisioned))
+	for i, entry := range d.provisioned {
+		children[i] = entry.provider
+	}
+	return providers.CleanupAll(cleanupTimeout, func(res providers.CleanupResult) {
+		entry := d.provisioned[res.Index]
+		metrics.ObserveCleanup(entry.typeName, res.Duration, res.TimedOut)
+		fields := []zap.Field{
+			zap.String("provider", entry.typeName),
+			zap.String("named_provider", entry.name),
+			zap.String("service", entry.provider.Service()),
+			zap.Duration("duration", res.Duration),
+		}
+		switch {
+		case res.TimedOut:
+			d.logger.Error("provider cleanup timed out, continuing without waiting for it",
+				append(fields, zap.Duration("timeout", cleanupTimeout))...,
+			)
+		case res.Duration > slowCleanupThreshold:
+			d.logger.Warn("provider cleanup was slow, config reloads wait for it to finish",
+				append(fields, zap.Duration("threshold", slowCleanupThreshold))...,
+			)
+		}
+	}, children...)
+}
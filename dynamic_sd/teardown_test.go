@@ -0,0 +1,68 @@
+package dynamic_sd
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// slowProvider 是一个 Cleanup 需要等待 delay 才返回的 provider。
+type slowProvider struct {
+	stubProvider
+	delay time.Duration
+}
+
+func (p *slowProvider) Cleanup() error {
+	time.Sleep(p.delay)
+	return nil
+}
+
+func TestCleanupProvidersWarnsOnSlowCleanup(t *testing.T) {
+	defer func(threshold time.Duration) { slowCleanupThreshold = threshold }(slowCleanupThreshold)
+	slowCleanupThreshold = 10 * time.Millisecond
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	d := &DynamicSD{
+		logger: zap.New(core),
+		provisioned: []providerEntry{
+			{typeName: "nacos", provider: &slowProvider{stubProvider: stubProvider{service: "teardown-slow"}, delay: 50 * time.Millisecond}},
+			{typeName: "consul", provider: &slowProvider{stubProvider: stubProvider{service: "teardown-fast"}}},
+		},
+	}
+	if err := d.cleanupProviders(); err != nil {
+		t.Fatal(err)
+	}
+
+	if logs.Len() != 1 {
+		t.Fatalf("got %d log entries, want 1", logs.Len())
+	}
+	fields := logs.All()[0].ContextMap()
+	if fields["service"] != "teardown-slow" {
+		t.Fatalf("got service %v, want teardown-slow", fields["service"])
+	}
+	if got, ok := fields["duration"].(time.Duration); !ok || got < 50*time.Millisecond {
+		t.Fatalf("got duration %v, want at least 50ms", fields["duration"])
+	}
+}
+
+func TestCleanupProvidersReportsTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { cleanupTimeout = timeout }(cleanupTimeout)
+	cleanupTimeout = 20 * time.Millisecond
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	d := &DynamicSD{
+		logger: zap.New(core),
+		provisioned: []providerEntry{
+			{typeName: "nacos", provider: &slowProvider{stubProvider: stubProvider{service: "teardown-stuck"}, delay: time.Second}},
+		},
+	}
+	if err := d.cleanupProviders(); err == nil {
+		t.Fatal("got nil error for a timed out cleanup")
+	}
+	if logs.FilterMessageSnippet("timed out").Len() != 1 {
+		t.Fatalf("got logs %v, want one timeout error", logs.All())
+	}
+}
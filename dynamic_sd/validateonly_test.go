@@ -0,0 +1,93 @@
+package dynamic_sd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// checkingProvider 记录 validate_only 模式下的调用。Provision 和 Cleanup 都不应被调用。
+type checkingProvider struct {
+	stubProvider
+	err error
+
+	checks      int
+	checkCtx    context.Context
+	provisioned bool
+	cleaned     bool
+}
+
+func (p *checkingProvider) ValidateConnectivity(ctx context.Context) error {
+	p.checks++
+	p.checkCtx = ctx
+	return p.err
+}
+
+func (p *checkingProvider) Provision(*zap.Logger) error {
+	p.provisioned = true
+	return nil
+}
+
+func (p *checkingProvider) Cleanup() error {
+	p.cleaned = true
+	return nil
+}
+
+func TestValidateOnlyChecksOnceAndCleansUp(t *testing.T) {
+	def := &checkingProvider{stubProvider: stubProvider{service: "validate-only-default"}}
+	named := &checkingProvider{stubProvider: stubProvider{service: "validate-only-named"}}
+	d := &DynamicSD{
+		ValidateOnly: true,
+		ProviderKey:  "{http.request.header.X-Service}",
+		provider:     def,
+		providerName: "consul",
+		named:        map[string]providerEntry{"users": {name: "users", typeName: "consul", provider: named}},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := d.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*checkingProvider{def, named} {
+		if p.checks != 1 {
+			t.Errorf("%s: got %d connectivity checks, want 1", p.service, p.checks)
+		}
+		if p.provisioned {
+			t.Errorf("%s: Provision was called in validate_only mode", p.service)
+		}
+		// 检查使用的 context 在返回后被取消，provider 在其中启动的资源随之释放
+		if p.checkCtx == nil || p.checkCtx.Err() == nil {
+			t.Errorf("%s: connectivity check context was not cancelled", p.service)
+		}
+	}
+	if len(d.provisioned) != 0 {
+		t.Fatalf("got %d provisioned providers, want none", len(d.provisioned))
+	}
+
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if def.cleaned || named.cleaned {
+		t.Fatal("Cleanup reached a provider that was never provisioned")
+	}
+}
+
+func TestValidateOnlyReportsFailure(t *testing.T) {
+	p := &checkingProvider{stubProvider: stubProvider{service: "validate-only-down"}, err: errors.New("connection refused")}
+	d := &DynamicSD{ValidateOnly: true, provider: p, providerName: "consul"}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	err := d.Provision(ctx)
+	var de *DiscoveryError
+	if !errors.As(err, &de) {
+		t.Fatalf("got %v, want a DiscoveryError", err)
+	}
+	if p.checks != 1 || p.provisioned {
+		t.Fatalf("got %d checks and provisioned=%v, want one check and no Provision", p.checks, p.provisioned)
+	}
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// AddressPrivate 和 AddressPublic 是 AddressPreference 的取值。
+	AddressPrivate = "private"
+	AddressPublic  = "public"
+
+	defaultPrivateAddressKey = "private_ip"
+	defaultPublicAddressKey  = "public_ip"
+)
+
+// addressKey 返回 AddressPreference 对应的 metadata key。
+func (s *Store) addressKey() string {
+	if s.AddressPreference == AddressPublic {
+		if s.PublicAddressMetadataKey != "" {
+			return s.PublicAddressMetadataKey
+		}
+		return defaultPublicAddressKey
+	}
+	if s.PrivateAddressMetadataKey != "" {
+		return s.PrivateAddressMetadataKey
+	}
+	return defaultPrivateAddressKey
+}
+
+// selectAddresses 把登记了首选地址的实例替换为指向该地址的新实例，没有登记或地址非法时保留 provider 给出的地址。
+// 调用方必须持有 s.mu。
+func (s *Store) selectAddresses(instances []*Instance) []*Instance {
+	key := s.addressKey()
+	selected := make([]*Instance, len(instances))
+	for i, in := range instances {
+		selected[i] = in
+		value := strings.TrimSpace(in.Metadata[key])
+		if value == "" {
+			continue
+		}
+		dial, ok := preferredDial(in.Upstream.Dial, value)
+		if !ok {
+			s.logger.Warn("invalid preferred address in instance metadata, using primary address",
+				zap.String("service", s.service),
+				zap.String("upstream", in.Upstream.Dial),
+				zap.String("key", key),
+				zap.String("value", value),
+			)
+			continue
+		}
+		if dial != in.Upstream.Dial {
+			selected[i] = in.withDial(dial)
+		}
+	}
+	return selected
+}
+
+// preferredDial 返回使用首选地址 value 的拨号地址。value 可以带端口（"10.0.0.1:8080"），
+// 不带端口时沿用 primary 的端口。value 不是合法的主机时返回 false。
+func preferredDial(primary, value string) (string, bool) {
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		return value, validHost(host) && port != ""
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if !validHost(host) {
+		return "", false
+	}
+	_, port, err := net.SplitHostPort(primary)
+	if err != nil {
+		return host, true
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// validHost 报告 host 是否是 IP 地址或看起来合法的主机名。
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	return !strings.ContainsAny(host, " \t/:[]@")
+}
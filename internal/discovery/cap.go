@@ -0,0 +1,31 @@
+package discovery
+
+import (
+	"go.uber.org/zap"
+)
+
+// capInstances 按 HardInstanceCap 截断实例列表，被丢弃的实例数变化时记录日志。调用方必须持有 s.mu。
+func (s *Store) capInstances(instances []*Instance) []*Instance {
+	dropped := max(len(instances)-s.HardInstanceCap, 0)
+	if dropped != s.capped {
+		if dropped > 0 {
+			s.logger.Warn("refresh exceeds hard_instance_cap, dropping extra instances",
+				zap.String("service", s.service),
+				zap.Int("count", len(instances)),
+				zap.Int("hard_instance_cap", s.HardInstanceCap),
+				zap.Int("dropped", dropped),
+			)
+		} else {
+			s.logger.Info("refresh is back within hard_instance_cap",
+				zap.String("service", s.service),
+				zap.Int("count", len(instances)),
+			)
+		}
+		s.capped = dropped
+	}
+	if dropped == 0 {
+		return instances
+	}
+	// 复制一份，不让被截断的大数组继续占用内存
+	return append([]*Instance(nil), instances[:s.HardInstanceCap]...)
+}
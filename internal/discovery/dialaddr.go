@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DialAddresses 把以逗号分隔的注册中心地址规范为 "host:port" 列表，用于检查注册中心的连通性。
+// 每个地址可以是 URL（如 "http://consul:8500"）或 "host[:port]"。没有端口时，http 和 https 的 URL
+// 使用 80 和 443，其余使用 defaultPort。无法解析的地址（包括 unix 套接字）被忽略。
+func DialAddresses(raw, defaultPort string) []string {
+	var addrs []string
+	for _, item := range strings.Split(raw, ",") {
+		if addr := dialAddress(strings.TrimSpace(item), defaultPort); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// dialAddress 把单个地址规范为 "host:port"，无法解析时返回空字符串。
+func dialAddress(raw, defaultPort string) string {
+	if raw == "" {
+		return ""
+	}
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			return ""
+		}
+		if u.Port() != "" {
+			return u.Host
+		}
+		switch u.Scheme {
+		case "http", "ws":
+			defaultPort = "80"
+		case "https", "wss":
+			defaultPort = "443"
+		}
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if _, _, err := net.SplitHostPort(raw); err == nil {
+		return raw
+	}
+	return net.JoinHostPort(strings.Trim(raw, "[]"), defaultPort)
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ConfigError 表示配置无效。重试不会成功，调用方应该直接失败并提示修正配置。
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// DiscoveryError 表示运行时无法从注册中心得到可用的实例，例如注册中心暂时不可用或服务没有实例。
+// 它通常是暂时性的，调用方可以稍后重试。
+type DiscoveryError struct {
+	Err error
+}
+
+func (e *DiscoveryError) Error() string { return e.Err.Error() }
+
+func (e *DiscoveryError) Unwrap() error { return e.Err }
+
+// NoUpstreamsError 表示 provider 当前没有可用的上游，附带 provider 最近一次刷新的状态，
+// 使反向代理因此返回 502/503 时记录的错误日志可以直接说明原因。它总是包装在 DiscoveryError 中返回。
+type NoUpstreamsError struct {
+	Provider string
+	Service  string
+	// LastRefresh 是最近一次刷新的时间，从未刷新过时为零值；LastError 是最近一次刷新的错误。
+	LastRefresh time.Time
+	LastError   string
+	Err         error
+}
+
+func (e *NoUpstreamsError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v (provider=%s service=%s", e.Err, e.Provider, e.Service)
+	if e.LastRefresh.IsZero() {
+		b.WriteString(" last_refresh=never")
+	} else {
+		fmt.Fprintf(&b, " last_refresh=%s", e.LastRefresh.Format(time.RFC3339))
+	}
+	if e.LastError != "" {
+		fmt.Fprintf(&b, " last_error=%q", e.LastError)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func (e *NoUpstreamsError) Unwrap() error { return e.Err }
+
+// MarshalLogObject 实现 zapcore.ObjectMarshaler，以 zap.Object 记录时各项状态是独立的字段。
+func (e *NoUpstreamsError) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("provider", e.Provider)
+	enc.AddString("service", e.Service)
+	if !e.LastRefresh.IsZero() {
+		enc.AddTime("last_refresh", e.LastRefresh)
+	}
+	if e.LastError != "" {
+		enc.AddString("last_error", e.LastError)
+	}
+	enc.AddString("error", e.Err.Error())
+	return nil
+}
+
+// AsConfigError 将尚未分类的 err 包装为 ConfigError，err 为 nil 或已经是上述两种错误之一时原样返回。
+func AsConfigError(err error) error {
+	if err == nil || classified(err) {
+		return err
+	}
+	return &ConfigError{Err: err}
+}
+
+// AsDiscoveryError 将尚未分类的 err 包装为 DiscoveryError，err 为 nil 或已经是上述两种错误之一时原样返回。
+func AsDiscoveryError(err error) error {
+	if err == nil || classified(err) {
+		return err
+	}
+	return &DiscoveryError{Err: err}
+}
+
+// classified 报告 err 的错误链中是否已经包含 ConfigError 或 DiscoveryError。
+func classified(err error) bool {
+	var ce *ConfigError
+	var de *DiscoveryError
+	return errors.As(err, &ce) || errors.As(err, &de)
+}
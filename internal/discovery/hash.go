@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HashInstances 计算实例列表的内容哈希，包括地址、ID、主机名、权重、metadata、标签和 SNI，与实例的顺序无关。
+func HashInstances(instances []*Instance) uint64 {
+	entries := make([]string, 0, len(instances))
+	for _, in := range instances {
+		keys := make([]string, 0, len(in.Metadata))
+		for k := range in.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString(in.Upstream.Dial)
+		b.WriteString("|" + in.ID + "|" + in.Hostname + "|")
+		b.WriteString(strconv.FormatFloat(in.Weight, 'g', -1, 64))
+		for _, k := range keys {
+			b.WriteString("|" + k + "=" + in.Metadata[k])
+		}
+		b.WriteString("|tags=" + strings.Join(in.Tags, ","))
+		b.WriteString("|sni=" + in.SNI)
+		entries = append(entries, b.String())
+	}
+	sort.Strings(entries)
+
+	h := fnv.New64a()
+	for _, e := range entries {
+		h.Write([]byte(e))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// Unchanged 报告 instances 与上一次应用的实例列表内容相同（按 HashInstances 比较）。provider 据此跳过
+// 整个更新流程：保护策略、变化日志和 OnUpdate 的监听者都不会执行。有等待合并的更新或正在 scale_in_grace
+// 期间移除的实例时总是返回 false，以便等待的更新被替换、过期的实例被清理。
+func (s *Store) Unchanged(instances []*Instance) bool {
+	s.pendingMu.Lock()
+	pending := s.pendingCount > 0
+	s.pendingMu.Unlock()
+	if pending {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hashed && len(s.departing) == 0 && s.hash == HashInstances(instances)
+}
@@ -0,0 +1,254 @@
+package discovery
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// Instance 包装了一个上游及其在注册中心中携带的属性。
+// 无论实例来自 Consul 的 Meta、Nacos 的 metadata 还是 mDNS 的 TXT 记录，
+// 都统一以 Metadata 的形式传递给选择策略和管理接口。
+//
+// Instance 一旦通过 Store.Update 发布就不能再被修改，因此可以被并发读取。
+type Instance struct {
+	Upstream *reverseproxy.Upstream
+
+	// ID 是实例在注册中心中的标识（Consul 的 Service.ID、Nacos 的 InstanceId、mDNS 的实例名），为空表示 provider 没有提供。
+	// 与地址不同，实例的 IP 变化（例如 Pod 重建后保留名字）时 ID 保持不变，可以用于按实例身份跟踪状态，
+	// 通过 {dynamic_sd.upstream.id} 占位符取得。
+	ID string
+
+	// Hostname 是实例的主机名，只用于日志和管理接口，不影响路由。目前只有 mDNS 提供（通告的 HostName 或反向解析的结果）。
+	Hostname string
+
+	// Metadata 是实例的属性集合，由 provider 从注册中心复制而来。
+	Metadata map[string]string
+
+	// Weight 是实例的权重，0 表示未指定，按 1 处理。
+	Weight float64
+
+	// SNI 是与该实例建立 TLS 连接时应使用的服务器名称，为空表示未指定。
+	// 反向代理本身不会读取它，需要由配套的 transport 或主动探测在拨号时使用。
+	SNI string
+
+	// Host 是向该实例转发请求时应使用的 Host 头，为空表示未指定。
+	// 由 host_metadata_key 从 metadata 中取得，通过 {dynamic_sd.upstream.host} 占位符交给 header_up 使用。
+	Host string
+
+	// PathPrefix 是实例在同一个域名下对应的路径前缀（如 "/orders"），为空表示未指定。
+	// 由 path_prefix_metadata_key 从 metadata 中取得，通过 {dynamic_sd.upstream.path_prefix} 占位符使用。
+	PathPrefix string
+
+	// FailThreshold 是实例自己的被动健康检查失败阈值，0 表示未指定，只使用反向代理的 max_fails。
+	// 由 fail_threshold_metadata_key 从 metadata 中取得，dynamic_sd 不再返回失败次数达到该值的实例。
+	FailThreshold int
+
+	// Tags 是实例在注册中心中的标签，目前只有 Consul 提供（Service.Tags）。
+	// 与 Metadata 一起供 upstream_tag 匹配器和 {dynamic_sd.upstream.tags} 占位符使用。
+	Tags []string
+
+	// Protocols 是实例声明支持的应用层协议（ALPN 标识，如 "h3"、"h2"），为空表示未声明。
+	// 由 protocol_metadata_key 从 metadata 中取得，反向代理本身不会读取它，供配套的 transport 选择 HTTP/3 等协议。
+	Protocols []string
+
+	// removedAt 和 grace 仅在实例已从注册中心移除、处于 scale_in_grace 期间时设置。
+	removedAt time.Time
+	grace     time.Duration
+
+	// readyAt 是新实例结束 warmup_grace 的时间，在此之前实例不接收流量。
+	readyAt time.Time
+
+	// warmFrom 和 warm 仅在新实例处于 warm_duration 期间时设置，权重从 warmFrom 开始在 warm 内增加到完整的权重。
+	warmFrom time.Time
+	warm     time.Duration
+}
+
+// minWarmRatio 是 warm_duration 开始时实例权重占完整权重的比例，避免权重为 0 的实例完全不被选中。
+const minWarmRatio = 0.1
+
+// NewInstance 创建一个指向 dial 的实例，并复制 metadata，
+// 避免与注册中心客户端共享同一个 map。
+func NewInstance(dial string, metadata map[string]string, weight float64) *Instance {
+	return &Instance{
+		Upstream: &reverseproxy.Upstream{Dial: dial},
+		Metadata: CopyMetadata(metadata),
+		Weight:   weight,
+	}
+}
+
+// Clone 返回实例的一个副本，使用新的 Upstream 并复制 metadata。
+// 同一份查询结果需要交给多个 Store 时使用，每个 Store 都会修改自己发布的实例。
+func (in *Instance) Clone() *Instance {
+	return &Instance{
+		Upstream:      &reverseproxy.Upstream{Dial: in.Upstream.Dial},
+		ID:            in.ID,
+		Hostname:      in.Hostname,
+		Metadata:      CopyMetadata(in.Metadata),
+		Weight:        in.Weight,
+		SNI:           in.SNI,
+		Host:          in.Host,
+		PathPrefix:    in.PathPrefix,
+		FailThreshold: in.FailThreshold,
+		Tags:          append([]string(nil), in.Tags...),
+		Protocols:     append([]string(nil), in.Protocols...),
+	}
+}
+
+// Meta 返回指定 key 的属性值。
+func (in *Instance) Meta(key string) (string, bool) {
+	v, ok := in.Metadata[key]
+	return v, ok
+}
+
+// HasTag 报告实例是否带有标签 tag。
+func (in *Instance) HasTag(tag string) bool {
+	for _, t := range in.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsProtocol 报告实例是否声明支持协议 proto（如 "h2"）。
+func (in *Instance) SupportsProtocol(proto string) bool {
+	for _, p := range in.Protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsHTTP3 报告实例是否声明支持 HTTP/3，草案版本（如 "h3-29"）也视为支持。
+func (in *Instance) SupportsHTTP3() bool {
+	for _, p := range in.Protocols {
+		if p == "h3" || strings.HasPrefix(p, "h3-") {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveWeight 返回用于选择策略的权重，未指定或非法的权重按 1 处理。
+func (in *Instance) EffectiveWeight() float64 {
+	if in.Weight <= 0 {
+		return 1
+	}
+	return in.Weight
+}
+
+// WeightAt 返回实例在 now 时刻用于选择策略的权重。处于 warm_duration 期间的实例的权重
+// 从完整权重的 minWarmRatio 线性增加到完整权重，其余实例与 EffectiveWeight 相同。
+func (in *Instance) WeightAt(now time.Time) float64 {
+	w := in.EffectiveWeight()
+	if in.warm <= 0 {
+		return w
+	}
+	ratio := float64(now.Sub(in.warmFrom)) / float64(in.warm)
+	if ratio >= 1 {
+		return w
+	}
+	return w * math.Max(minWarmRatio, ratio)
+}
+
+// Departing 报告实例是否已从注册中心移除、正处于 scale_in_grace 期间。
+func (in *Instance) Departing() bool {
+	return !in.removedAt.IsZero()
+}
+
+// Retention 返回实例在 now 时刻应保留的流量比例。
+// 正常实例为 1，处于 warmup_grace 期间的实例为 0，
+// 处于 scale_in_grace 期间的实例从 1 线性衰减到 0。
+func (in *Instance) Retention(now time.Time) float64 {
+	if now.Before(in.readyAt) {
+		return 0
+	}
+	if !in.Departing() {
+		return 1
+	}
+	r := 1 - float64(now.Sub(in.removedAt))/float64(in.grace)
+	return math.Max(0, math.Min(1, r))
+}
+
+// depart 返回实例的一个副本，标记其从 now 开始进入持续 grace 的移除过程。
+// 副本共享同一个 Upstream，因此反向代理记录的健康状态和连接数不会丢失。
+func (in *Instance) depart(now time.Time, grace time.Duration) *Instance {
+	cp := *in
+	cp.removedAt = now
+	cp.grace = grace
+	return &cp
+}
+
+// CopyMetadata 返回 metadata 的一个浅拷贝。
+func CopyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	cp := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		cp[k] = v
+	}
+	return cp
+}
+
+// ParseTXT 将 DNS-SD 风格的 "key=value" TXT 记录解析为 metadata。
+// 没有 "=" 的记录被视为值为空的布尔属性。
+func ParseTXT(records []string) map[string]string {
+	if len(records) == 0 {
+		return nil
+	}
+	metadata := make(map[string]string, len(records))
+	for _, rec := range records {
+		k, v, _ := strings.Cut(rec, "=")
+		if k == "" {
+			continue
+		}
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// ParseWeight 从 metadata 的指定 key 中解析权重，缺失或非法时返回 0。
+func ParseWeight(metadata map[string]string, key string) float64 {
+	v, ok := metadata[key]
+	if !ok {
+		return 0
+	}
+	w, err := strconv.ParseFloat(v, 64)
+	if err != nil || w < 0 {
+		return 0
+	}
+	return w
+}
+
+// ParseProtocols 解析以逗号分隔的协议列表，例如 "h3,h2"。也接受 Alt-Svc 头的格式
+// （如 `h3=":443"; ma=86400, h2=":443"`），只取每一项的协议标识。协议标识转为小写，重复的只保留一个。
+func ParseProtocols(value string) []string {
+	var protocols []string
+	for _, item := range strings.Split(value, ",") {
+		proto, _, _ := strings.Cut(item, "=")
+		proto, _, _ = strings.Cut(proto, ";")
+		proto = strings.ToLower(strings.TrimSpace(proto))
+		if proto == "" || slices.Contains(protocols, proto) {
+			continue
+		}
+		protocols = append(protocols, proto)
+	}
+	return protocols
+}
+
+// NormalizePathPrefix 把路径前缀规范为以 "/" 开头、不以 "/" 结尾的形式，例如 "orders/" 变为 "/orders"。
+// 空值和 "/" 返回空字符串。
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// expandPorts 为每个实例在 AdditionalPortsMetadataKey 中登记的每个端口追加一个实例，紧跟在原实例之后。
+// 地址与列表中已有的地址重复时跳过，非法的端口记录警告后跳过。调用方必须持有 s.mu。
+func (s *Store) expandPorts(instances []*Instance) []*Instance {
+	seen := make(map[string]struct{}, len(instances))
+	for _, in := range instances {
+		seen[in.Upstream.Dial] = struct{}{}
+	}
+
+	expanded := make([]*Instance, 0, len(instances))
+	for _, in := range instances {
+		expanded = append(expanded, in)
+		value := in.Metadata[s.AdditionalPortsMetadataKey]
+		if value == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(in.Upstream.Dial)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			port, err := strconv.ParseUint(field, 10, 16)
+			if err != nil || port == 0 {
+				s.logger.Warn("invalid additional port in instance metadata, ignoring",
+					zap.String("service", s.service),
+					zap.String("upstream", in.Upstream.Dial),
+					zap.String("key", s.AdditionalPortsMetadataKey),
+					zap.String("value", field),
+				)
+				continue
+			}
+			dial := net.JoinHostPort(host, strconv.FormatUint(port, 10))
+			if _, ok := seen[dial]; ok {
+				continue
+			}
+			seen[dial] = struct{}{}
+			expanded = append(expanded, in.withDial(dial))
+		}
+	}
+	return expanded
+}
+
+// withDial 返回一个地址为 dial、其余属性与 in 相同的新实例。metadata 和标签在发布后不会被修改，因此可以共享。
+func (in *Instance) withDial(dial string) *Instance {
+	return &Instance{
+		Upstream:      &reverseproxy.Upstream{Dial: dial},
+		ID:            in.ID,
+		Hostname:      in.Hostname,
+		Metadata:      in.Metadata,
+		Weight:        in.Weight,
+		SNI:           in.SNI,
+		Host:          in.Host,
+		PathPrefix:    in.PathPrefix,
+		FailThreshold: in.FailThreshold,
+		Tags:          in.Tags,
+		Protocols:     in.Protocols,
+	}
+}
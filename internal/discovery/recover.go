@@ -0,0 +1,40 @@
+package discovery
+
+import (
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// restartDelay 是后台循环 panic 后重新运行之前的等待时间，避免持续 panic 时占满 CPU。
+const restartDelay = time.Second
+
+// Recover 捕获当前 goroutine 中的 panic 并连同调用栈记录下来，必须直接通过 defer 调用。
+// 用于处理单个事件（例如注册中心的回调）的函数，panic 时丢弃该事件，避免整个 Caddy 进程崩溃。
+func Recover(logger *zap.Logger, what string) {
+	if v := recover(); v != nil {
+		logger.Error("recovered from panic",
+			zap.String("in", what),
+			zap.Any("panic", v),
+			zap.ByteString("stack", debug.Stack()),
+		)
+	}
+}
+
+// Go 在新的 goroutine 中运行长期循环 fn。fn panic 时记录 panic 和调用栈，等待 restartDelay 后重新运行；
+// fn 正常返回时 goroutine 结束。fn 必须自己响应停止信号，重新运行时仍能观察到已经发出的停止信号。
+func Go(logger *zap.Logger, what string, fn func()) {
+	go func() {
+		for !runRecovered(logger, what, fn) {
+			time.Sleep(restartDelay)
+		}
+	}()
+}
+
+// runRecovered 运行 fn，fn 正常返回时返回 true，panic 时返回 false。
+func runRecovered(logger *zap.Logger, what string, fn func()) (ok bool) {
+	defer Recover(logger, what)
+	fn()
+	return true
+}
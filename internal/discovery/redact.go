@@ -0,0 +1,48 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Redacted 是管理接口中替代敏感配置值的字符串。
+const Redacted = "REDACTED"
+
+// RedactConfig 把 provider 的配置（包括嵌入的 Store 的配置）编码为 JSON 对象，
+// 并把 secretKeys 中取值非空的字段替换为 Redacted，用于在管理接口中展示实际解析得到的配置。
+// v 应当是指向 provider 的指针，内部状态都是未导出的字段，不会出现在结果中。
+func RedactConfig(v any, secretKeys ...string) map[string]any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	config := make(map[string]any)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	for _, key := range secretKeys {
+		if _, ok := config[key]; ok {
+			config[key] = Redacted
+		}
+	}
+	return config
+}
+
+// RedactURL 隐藏 URL 中 userinfo 部分的密码，raw 可以是以逗号分隔的多个 URL。
+// 无法解析的 URL 整个被替换为 Redacted，因为无法判断其中是否包含密码。
+func RedactURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	parts := strings.Split(raw, ",")
+	for i, part := range parts {
+		u, err := url.Parse(strings.TrimSpace(part))
+		if err != nil {
+			parts[i] = Redacted
+			continue
+		}
+		parts[i] = u.Redacted()
+	}
+	return strings.Join(parts, ",")
+}
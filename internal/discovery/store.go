@@ -0,0 +1,719 @@
+// package discovery 提供各服务发现提供者共用的上游列表存储与刷新保护逻辑。
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+// Store 保存一个 provider 当前的上游列表，并在每次刷新时应用通用的保护策略。
+// 它被嵌入到各个 provider 中，其配置字段会随 provider 一起出现在 JSON 配置中。
+type Store struct {
+	// MinUpstreams 是一次刷新后允许的最少上游数量。
+	// 如果刷新会使上游数量降到该值以下，则拒绝本次更新并保留之前的列表，0 表示不限制。
+	MinUpstreams int `json:"min_upstreams,omitempty"`
+
+	// MinZones 大于 0 时，一次刷新得到的实例必须来自至少这么多个不同的可用区（由 ZoneMetadataKey 给出），
+	// 否则拒绝本次更新、保留之前的列表并记录警告，避免部分故障时把流量全部转发到仅剩的一个可用区。
+	// 与 MinUpstreams 一样，只在可用区数量下降并跌破下限时拒绝，启动阶段逐步增长的列表仍然可以被应用。
+	MinZones int `json:"min_zones,omitempty"`
+
+	// ZoneMetadataKey 是 metadata 中保存实例所在可用区的 key，默认为 "zone"。没有该 key 的实例不计入任何可用区。
+	ZoneMetadataKey string `json:"zone_metadata_key,omitempty"`
+
+	// HardInstanceCap 大于 0 时，一次刷新最多保留这么多实例（按 provider 返回的顺序，在 additional_ports_metadata_key
+	// 展开之后），其余的实例被丢弃并记录警告。用于防止注册中心的缺陷返回海量的实例耗尽内存，正常情况下不应触发；
+	// 需要按服务规模限制实例数时应使用 provider 自己的选项（如 nacos 的 max_instances）。
+	// 正在 scale_in_grace 期间移除的实例不计入。
+	HardInstanceCap int `json:"hard_instance_cap,omitempty"`
+
+	// SNI 是为每个实例计算 TLS 服务器名称的模板。
+	// 支持占位符 {service}（服务名）和 {host}（实例的主机部分），例如 "{service}.svc.internal"。
+	SNI string `json:"sni,omitempty"`
+
+	// HostMetadataKey 是 metadata 中保存实例目标 Host 的 key，用于按虚拟主机区分的后端。
+	// 设置后每个实例的 Host 取该 key 的值，缺失时为空。
+	HostMetadataKey string `json:"host_metadata_key,omitempty"`
+
+	// PathPrefixMetadataKey 是 metadata 中保存实例路径前缀的 key，用于同一个域名下按路径区分多个服务的场景。
+	// 设置后每个实例的 PathPrefix 取该 key 的值，缺失时为空。
+	PathPrefixMetadataKey string `json:"path_prefix_metadata_key,omitempty"`
+
+	// ProtocolMetadataKey 是 metadata 中保存实例支持协议的 key，值是以逗号分隔的协议列表（如 "h3,h2"），
+	// 也可以是 Alt-Svc 格式（如 `h3=":443"`）。设置后每个实例的 Protocols 取该 key 解析后的值，缺失时为空。
+	ProtocolMetadataKey string `json:"protocol_metadata_key,omitempty"`
+
+	// FailThresholdMetadataKey 是 metadata 中保存实例被动健康检查失败阈值的 key，
+	// 设置后每个实例的 FailThreshold 取该 key 的值（正整数），缺失或非法时为 0。
+	FailThresholdMetadataKey string `json:"fail_threshold_metadata_key,omitempty"`
+
+	// AdditionalPortsMetadataKey 是 metadata 中保存实例额外端口的 key，值是以逗号分隔的端口列表（如 "8081,9090"）。
+	// 设置后每个实例除了自身的地址，还为每个额外端口产生一个相同主机的上游，属性与原实例相同，重复的地址只保留一个。
+	// 用于一个实例暴露多个端口、需要把请求分散到所有端口的场景。
+	AdditionalPortsMetadataKey string `json:"additional_ports_metadata_key,omitempty"`
+
+	// AddressPreference 为 "private" 或 "public" 时，实例的 metadata 中登记了对应的地址（IP 或主机名，可以带端口）
+	// 时使用该地址代替 provider 给出的地址，没有登记时仍使用原来的地址。用于注册中心同时登记私有和公网地址、
+	// 需要确保 Caddy 经由预期网络访问上游的场景。地址在 additional_ports_metadata_key 展开之前替换。
+	AddressPreference string `json:"address_preference,omitempty"`
+
+	// PrivateAddressMetadataKey 和 PublicAddressMetadataKey 是 metadata 中保存私有地址和公网地址的 key，
+	// 默认分别为 "private_ip" 和 "public_ip"。
+	PrivateAddressMetadataKey string `json:"private_address_metadata_key,omitempty"`
+	PublicAddressMetadataKey  string `json:"public_address_metadata_key,omitempty"`
+
+	// ScaleInGrace 是实例从注册中心移除后继续保留的时间。
+	// 在此期间实例被选中的概率从 1 线性衰减到 0，使缩容时流量逐步迁移而不是瞬间切断，0 表示立即移除。
+	ScaleInGrace caddy.Duration `json:"scale_in_grace,omitempty"`
+
+	// WarmupGrace 是新出现的实例在开始接收流量之前需要等待的时间，
+	// 用于避免刚注册、尚未完成预热的实例立即承接流量，0 表示不等待。
+	// 第一次刷新得到的实例不受影响，以免启动时没有可用的上游。
+	WarmupGrace caddy.Duration `json:"warmup_grace,omitempty"`
+
+	// WarmDuration 大于 0 时，新出现的实例的权重在该时间内从 10% 线性增加到完整的权重（在 WarmupGrace 结束之后开始），
+	// 避免刚启动、尚未预热的实例一开始就承接与其他实例相同的流量。按权重选择的 seeded 模式和 SRV 记录使用随时间增加的权重；
+	// consistent_hash 的哈希环只在上游集合变化时重建，使用重建时的权重。第一次刷新得到的实例不受影响。
+	WarmDuration caddy.Duration `json:"warm_duration,omitempty"`
+
+	// AllowAggressivePolling 为 true 时允许轮询间隔低于 MinInterval，仅用于明确需要高频轮询的场景。
+	AllowAggressivePolling bool `json:"allow_aggressive_polling,omitempty"`
+
+	// LogChanges 为 true 时，每次刷新使上游集合发生变化都会记录一行包含增删实例的日志。
+	LogChanges bool `json:"log_changes,omitempty"`
+
+	// SkipLoopback 和 SkipUnspecified 为 true（默认，nil 视为 true）时，丢弃 IP 为回环地址（127.0.0.0/8、::1）
+	// 或未指定地址（0.0.0.0、::）的实例。注册中心因为误配置返回这样的地址时，Caddy 无法访问它们，
+	// 直接使用会让请求被悄悄地发往错误的地方。被丢弃的地址在变化时记录警告。
+	// 上游确实运行在本机（例如 sidecar）时需要关闭 SkipLoopback。只检查 IP 形式的地址。
+	SkipLoopback    *bool `json:"skip_loopback,omitempty"`
+	SkipUnspecified *bool `json:"skip_unspecified,omitempty"`
+
+	// LoggerName 是 provider 日志使用的子 logger 名称，追加在 dynamic_sd 模块的 logger 名称之后，
+	// 便于在 Caddy 的 logging 配置中按 provider 过滤或路由日志。为空时使用服务名。
+	LoggerName string `json:"logger_name,omitempty"`
+
+	// Labels 是用户为 provider 附加的标签，用于在大量相似的 provider 之间区分。
+	// 它们作为 labels 字段出现在 provider 的所有日志中，并通过 provider_labels 指标导出。
+	// key 必须是合法的 Prometheus 标签名，最多 MaxLabels 个。
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// --- 内部状态 ---
+	logger    *zap.Logger
+	service   string
+	instances []*Instance
+	upstreams []*reverseproxy.Upstream
+	departing map[string]*Instance
+	firstSeen map[string]time.Time
+	listeners []func([]*Instance)
+	mu        sync.RWMutex
+	// unroutable 是上一次因 SkipLoopback 或 SkipUnspecified 丢弃的地址，只在变化时记录警告。
+	unroutable []string
+	// capped 是上一次因 HardInstanceCap 丢弃的实例数，只在变化时记录日志。
+	capped int
+	// hash 是上一次应用的实例列表（provider 提交的原始列表）的内容哈希，hashed 表示已经应用过，见 Unchanged。
+	hash   uint64
+	hashed bool
+
+	// coalesceWindow 大于 0 时 Update 先缓存实例列表，在窗口结束时只应用最后一次，见 SetCoalesceWindow。
+	// pendingMu 保护下面的缓存状态，并保证各次应用按顺序进行。
+	coalesceWindow time.Duration
+	pendingMu      sync.Mutex
+	pending        []*Instance
+	pendingCount   int
+	applied        bool
+	flushTimer     *time.Timer
+	flushGen       uint64
+}
+
+// maxCoalescedUpdates 是合并窗口内最多缓存的更新次数，达到后立即应用，避免持续的变更使列表一直得不到更新。
+const maxCoalescedUpdates = 64
+
+// MaxLabels 是一个 provider 最多可以配置的标签数量，限制 provider_labels 指标的基数。
+const MaxLabels = 8
+
+// labelKeyPattern 是合法的标签 key，与 Prometheus 的标签名规则相同。
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// MinInterval 是轮询间隔、浏览超时等时间配置的默认下限，避免误配置导致对注册中心的高频请求。
+const MinInterval = time.Second
+
+// ValidateInterval 检查名为 name 的时间配置是否为正数且不低于 MinInterval，
+// 开启 allow_aggressive_polling 后只要求为正数。
+func (s *Store) ValidateInterval(name string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("%s must be positive", name)
+	}
+	if interval < MinInterval && !s.AllowAggressivePolling {
+		return fmt.Errorf("%s %s is below the minimum of %s; set allow_aggressive_polling to override", name, interval, MinInterval)
+	}
+	return nil
+}
+
+// Setup 为 Store 注入 logger 和服务名，必须在第一次 Update 之前调用。
+// 它返回以 LoggerName（为空时为服务名）命名的子 logger，provider 应当使用它记录日志。
+func (s *Store) Setup(logger *zap.Logger, service string) *zap.Logger {
+	name := s.LoggerName
+	if name == "" {
+		name = service
+	}
+	if name != "" {
+		logger = logger.Named(name)
+	}
+	s.logger = logger
+	s.service = service
+	return logger
+}
+
+// Service 返回 Setup 时设置的服务名，用于日志和管理接口。
+func (s *Store) Service() string {
+	return s.service
+}
+
+// ProviderLabels 返回配置的标签，没有配置时为 nil。
+func (s *Store) ProviderLabels() map[string]string {
+	return s.Labels
+}
+
+// OnUpdate 注册一个在每次成功更新后调用的函数，参数为更新后的实例列表。
+// 函数在 provider 的刷新 goroutine（开启合并窗口时为窗口结束的定时器）中同步调用，不能阻塞，也不能修改实例列表。
+func (s *Store) OnUpdate(fn func(instances []*Instance)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// SetCoalesceWindow 设置合并窗口：窗口内的多次 Update 被缓存，窗口结束或缓存达到 maxCoalescedUpdates 次时
+// 只应用最后一次的实例列表，减少注册中心频繁变更时上游列表的替换次数。第一次更新总是立即应用，以免启动时没有上游。
+// 必须在第一次 Update 之前调用，0 表示不合并。
+func (s *Store) SetCoalesceWindow(window time.Duration) {
+	s.coalesceWindow = window
+}
+
+// Update 使用一次刷新得到的实例列表替换当前列表。
+// 如果新列表被保护策略拒绝，则返回 false，当前列表保持不变。
+// 开启合并窗口时，被缓存的更新总是返回 true，保护策略在应用时才生效。
+func (s *Store) Update(instances []*Instance) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if s.coalesceWindow <= 0 || !s.applied {
+		s.applied = true
+		return s.apply(instances)
+	}
+
+	s.pending = instances
+	s.pendingCount++
+	if s.pendingCount >= maxCoalescedUpdates {
+		if s.flushTimer != nil {
+			s.flushTimer.Stop()
+		}
+		s.flushLocked()
+		return true
+	}
+	if s.flushTimer == nil {
+		gen := s.flushGen
+		s.flushTimer = time.AfterFunc(s.coalesceWindow, func() { s.flush(gen) })
+	}
+	return true
+}
+
+// flush 在合并窗口结束时应用缓存的更新。gen 与当前不一致说明这一批已经因为缓存已满被应用过。
+func (s *Store) flush(gen uint64) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if gen != s.flushGen {
+		return
+	}
+	s.flushLocked()
+}
+
+// flushLocked 应用缓存中最后一次的实例列表。调用方必须持有 s.pendingMu。
+func (s *Store) flushLocked() {
+	instances, count := s.pending, s.pendingCount
+	s.pending, s.pendingCount = nil, 0
+	s.flushTimer = nil
+	s.flushGen++
+	if count == 0 {
+		return
+	}
+	if s.apply(instances) && count > 1 {
+		s.logger.Debug("applied coalesced upstream updates",
+			zap.String("service", s.service),
+			zap.Int("updates", count),
+		)
+	}
+}
+
+// apply 应用实例列表并通知所有监听者。调用方必须持有 s.pendingMu。
+func (s *Store) apply(instances []*Instance) bool {
+	if !s.update(instances) {
+		return false
+	}
+
+	s.mu.RLock()
+	current, listeners := s.instances, s.listeners
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(current)
+	}
+	return true
+}
+
+// update 在持有锁的情况下应用保护策略并替换当前列表。
+func (s *Store) update(instances []*Instance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := HashInstances(instances)
+	if s.AddressPreference != "" {
+		instances = s.selectAddresses(instances)
+	}
+	if s.AdditionalPortsMetadataKey != "" {
+		instances = s.expandPorts(instances)
+	}
+	if s.HardInstanceCap > 0 {
+		instances = s.capInstances(instances)
+	}
+	instances = s.dropUnroutable(instances)
+
+	// 只在数量下降并跌破下限时拒绝，这样启动阶段逐步增长的列表仍然可以被应用
+	if current := s.activeCount(); s.MinUpstreams > 0 && len(instances) < s.MinUpstreams && len(instances) < current {
+		s.logger.Warn("rejecting upstream refresh below min_upstreams, keeping previous upstreams",
+			zap.String("service", s.service),
+			zap.Int("min_upstreams", s.MinUpstreams),
+			zap.Int("refreshed", len(instances)),
+			zap.Int("current", current),
+		)
+		return false
+	}
+	if s.MinZones > 0 && !s.enoughZones(instances) {
+		return false
+	}
+
+	s.reuseUpstreams(instances)
+
+	if s.LogChanges {
+		s.logChanges(instances)
+	}
+
+	now := time.Now()
+	if s.WarmupGrace > 0 || s.WarmDuration > 0 {
+		s.holdNew(instances, now)
+	}
+	if s.ScaleInGrace > 0 {
+		instances = s.withDeparting(instances, now)
+	}
+
+	upstreams := make([]*reverseproxy.Upstream, len(instances))
+	for i, in := range instances {
+		// provider 可能会重复提交已经发布过的实例，只在第一次提交时计算，避免修改已发布的实例
+		if s.SNI != "" && in.SNI == "" {
+			in.SNI = s.serverName(in)
+		}
+		if s.HostMetadataKey != "" && in.Host == "" {
+			in.Host = in.Metadata[s.HostMetadataKey]
+		}
+		if s.PathPrefixMetadataKey != "" && in.PathPrefix == "" {
+			in.PathPrefix = NormalizePathPrefix(in.Metadata[s.PathPrefixMetadataKey])
+		}
+		if s.ProtocolMetadataKey != "" && in.Protocols == nil {
+			in.Protocols = ParseProtocols(in.Metadata[s.ProtocolMetadataKey])
+		}
+		if s.FailThresholdMetadataKey != "" && in.FailThreshold == 0 {
+			in.FailThreshold = s.failThreshold(in)
+		}
+		upstreams[i] = in.Upstream
+	}
+	s.instances = instances
+	s.upstreams = upstreams
+	s.hash, s.hashed = hash, true
+	return true
+}
+
+// reuseUpstreams 让地址未变化的实例沿用上一次列表中的 *reverseproxy.Upstream。
+// 反向代理按上游对象记录失败次数和活跃连接数，每次刷新都创建新对象会丢失这些状态。
+func (s *Store) reuseUpstreams(instances []*Instance) {
+	if len(s.instances) == 0 {
+		return
+	}
+	existing := make(map[string]*reverseproxy.Upstream, len(s.instances))
+	for _, in := range s.instances {
+		existing[in.Upstream.Dial] = in.Upstream
+	}
+	for _, in := range instances {
+		// 重复提交的已发布实例本来就指向同一个对象，只在不同时替换，避免修改已发布的实例
+		if up, ok := existing[in.Upstream.Dial]; ok && in.Upstream != up {
+			in.Upstream = up
+		}
+	}
+}
+
+// activeCount 返回当前列表中未处于移除过程的实例数量。
+func (s *Store) activeCount() int {
+	return len(s.instances) - len(s.departing)
+}
+
+// logChanges 比较刷新前后的实例地址集合，如果有变化则记录一行形如 "+a -b" 的日志。
+// 正在 scale_in_grace 期间的实例不计入刷新前的集合。
+func (s *Store) logChanges(instances []*Instance) {
+	old := make(map[string]struct{}, len(s.instances))
+	for _, in := range s.instances {
+		if !in.Departing() {
+			old[in.Upstream.Dial] = struct{}{}
+		}
+	}
+	cur := make(map[string]struct{}, len(instances))
+	for _, in := range instances {
+		cur[in.Upstream.Dial] = struct{}{}
+	}
+
+	added, removed := diffDials(cur, old), diffDials(old, cur)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	changes := make([]string, 0, len(added)+len(removed))
+	for _, dial := range added {
+		changes = append(changes, "+"+dial)
+	}
+	for _, dial := range removed {
+		changes = append(changes, "-"+dial)
+	}
+	s.logger.Info("upstreams changed",
+		zap.String("service", s.service),
+		zap.String("diff", strings.Join(changes, " ")),
+		zap.Int("count", len(instances)),
+	)
+}
+
+// diffDials 返回在 a 中但不在 b 中的地址，按字典序排序。
+func diffDials(a, b map[string]struct{}) []string {
+	var diff []string
+	for dial := range a {
+		if _, ok := b[dial]; !ok {
+			diff = append(diff, dial)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// holdNew 记录每个地址第一次出现的时间，为仍在 warmup_grace 期间的实例设置就绪时间，
+// 并为仍在 warm_duration 期间的实例设置权重增长的起点。已经不在列表中的地址会被遗忘，重新出现时需要再次预热。
+func (s *Store) holdNew(instances []*Instance, now time.Time) {
+	initial := s.firstSeen == nil
+	seen := make(map[string]time.Time, len(instances))
+	for _, in := range instances {
+		first, ok := s.firstSeen[in.Upstream.Dial]
+		if !ok && !initial {
+			first = now
+		}
+		seen[in.Upstream.Dial] = first
+
+		// 只在实例仍需预热且尚未设置时写入，避免修改已经发布并可能被并发读取的实例
+		readyAt := first.Add(time.Duration(s.WarmupGrace))
+		if !first.IsZero() && in.readyAt.IsZero() && readyAt.After(now) {
+			in.readyAt = readyAt
+		}
+		if !first.IsZero() && in.warm == 0 && readyAt.Add(time.Duration(s.WarmDuration)).After(now) {
+			in.warmFrom = readyAt
+			in.warm = time.Duration(s.WarmDuration)
+		}
+	}
+	s.firstSeen = seen
+}
+
+// withDeparting 将上一次列表中被移除的实例以 departing 副本的形式追加到新列表末尾，
+// 并丢弃已经超过 scale_in_grace 或重新出现的实例。
+func (s *Store) withDeparting(instances []*Instance, now time.Time) []*Instance {
+	if s.departing == nil {
+		s.departing = make(map[string]*Instance)
+	}
+
+	present := make(map[string]struct{}, len(instances))
+	for _, in := range instances {
+		present[in.Upstream.Dial] = struct{}{}
+	}
+
+	for _, in := range s.instances {
+		if _, ok := present[in.Upstream.Dial]; ok || in.Departing() {
+			continue
+		}
+		s.departing[in.Upstream.Dial] = in.depart(now, time.Duration(s.ScaleInGrace))
+	}
+
+	dials := make([]string, 0, len(s.departing))
+	for dial, in := range s.departing {
+		_, back := present[dial]
+		if back || in.Retention(now) <= 0 {
+			delete(s.departing, dial)
+			continue
+		}
+		dials = append(dials, dial)
+	}
+	sort.Strings(dials)
+
+	merged := make([]*Instance, 0, len(instances)+len(dials))
+	merged = append(merged, instances...)
+	for _, dial := range dials {
+		merged = append(merged, s.departing[dial])
+	}
+	return merged
+}
+
+// Upstreams 返回当前的上游列表。返回的切片不能被修改。
+func (s *Store) Upstreams() []*reverseproxy.Upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.upstreams
+}
+
+// Instances 返回当前的实例列表，其顺序与 Upstreams 一致。
+// 返回的切片和实例都不能被修改。
+func (s *Store) Instances() []*Instance {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.instances
+}
+
+// serverName 根据 SNI 模板计算实例的 TLS 服务器名称。
+func (s *Store) serverName(in *Instance) string {
+	host, _, err := net.SplitHostPort(in.Upstream.Dial)
+	if err != nil {
+		host = in.Upstream.Dial
+	}
+	repl := caddy.NewEmptyReplacer()
+	repl.Set("service", s.service)
+	repl.Set("host", host)
+	return repl.ReplaceAll(s.SNI, "")
+}
+
+// failThreshold 从实例 metadata 中解析失败阈值，缺失时返回 0，非法时记录警告并返回 0。
+func (s *Store) failThreshold(in *Instance) int {
+	value, ok := in.Metadata[s.FailThresholdMetadataKey]
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		s.logger.Warn("invalid fail threshold in instance metadata, ignoring",
+			zap.String("service", s.service),
+			zap.String("upstream", in.Upstream.Dial),
+			zap.String("key", s.FailThresholdMetadataKey),
+			zap.String("value", value),
+		)
+		return 0
+	}
+	return n
+}
+
+// Validate 检查通用配置是否有效。
+func (s *Store) Validate() error {
+	if s.MinUpstreams < 0 {
+		return fmt.Errorf("min_upstreams must not be negative")
+	}
+	if s.MinZones < 0 {
+		return fmt.Errorf("min_zones must not be negative")
+	}
+	switch s.AddressPreference {
+	case "", AddressPrivate, AddressPublic:
+	default:
+		return fmt.Errorf("address_preference must be '%s' or '%s', got '%s'", AddressPrivate, AddressPublic, s.AddressPreference)
+	}
+	if s.HardInstanceCap < 0 {
+		return fmt.Errorf("hard_instance_cap must not be negative")
+	}
+	if s.HardInstanceCap > 0 && s.MinUpstreams > s.HardInstanceCap {
+		return fmt.Errorf("min_upstreams %d exceeds hard_instance_cap %d", s.MinUpstreams, s.HardInstanceCap)
+	}
+	if s.ScaleInGrace < 0 {
+		return fmt.Errorf("scale_in_grace must not be negative")
+	}
+	if s.WarmupGrace < 0 {
+		return fmt.Errorf("warmup_grace must not be negative")
+	}
+	if s.WarmDuration < 0 {
+		return fmt.Errorf("warm_duration must not be negative")
+	}
+	if len(s.Labels) > MaxLabels {
+		return fmt.Errorf("at most %d labels are allowed, got %d", MaxLabels, len(s.Labels))
+	}
+	for key := range s.Labels {
+		if !labelKeyPattern.MatchString(key) || strings.HasPrefix(key, "__") {
+			return fmt.Errorf("invalid label key '%s': must match %s and must not start with '__'", key, labelKeyPattern)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfileOption 尝试解析当前 token 所在的通用子指令。
+// 如果该子指令不属于 Store，则返回 false，由 provider 自己继续处理。
+func (s *Store) UnmarshalCaddyfileOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "min_upstreams":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid integer for min_upstreams: %v", err)
+		}
+		s.MinUpstreams = n
+	case "min_zones":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid integer for min_zones: %v", err)
+		}
+		s.MinZones = n
+	case "zone_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.ZoneMetadataKey = d.Val()
+	case "hard_instance_cap":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid integer for hard_instance_cap: %v", err)
+		}
+		s.HardInstanceCap = n
+	case "sni":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.SNI = d.Val()
+	case "host_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.HostMetadataKey = d.Val()
+	case "path_prefix_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.PathPrefixMetadataKey = d.Val()
+	case "protocol_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.ProtocolMetadataKey = d.Val()
+	case "address_preference":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.AddressPreference = d.Val()
+	case "private_address_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.PrivateAddressMetadataKey = d.Val()
+	case "public_address_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.PublicAddressMetadataKey = d.Val()
+	case "additional_ports_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.AdditionalPortsMetadataKey = d.Val()
+	case "fail_threshold_metadata_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.FailThresholdMetadataKey = d.Val()
+	case "scale_in_grace":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid duration for scale_in_grace: %v", err)
+		}
+		s.ScaleInGrace = caddy.Duration(dur)
+	case "warmup_grace":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid duration for warmup_grace: %v", err)
+		}
+		s.WarmupGrace = caddy.Duration(dur)
+	case "warm_duration":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid duration for warm_duration: %v", err)
+		}
+		s.WarmDuration = caddy.Duration(dur)
+	case "allow_aggressive_polling":
+		s.AllowAggressivePolling = true
+		if d.NextArg() {
+			val, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return true, d.Errf("invalid boolean for allow_aggressive_polling: %v", err)
+			}
+			s.AllowAggressivePolling = val
+		}
+	case "log_changes":
+		s.LogChanges = true
+		if d.NextArg() {
+			val, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return true, d.Errf("invalid boolean for log_changes: %v", err)
+			}
+			s.LogChanges = val
+		}
+	case "skip_loopback", "skip_unspecified":
+		name := d.Val()
+		val := true
+		if d.NextArg() {
+			var err error
+			if val, err = strconv.ParseBool(d.Val()); err != nil {
+				return true, d.Errf("invalid boolean for %s: %v", name, err)
+			}
+		}
+		if name == "skip_loopback" {
+			s.SkipLoopback = &val
+		} else {
+			s.SkipUnspecified = &val
+		}
+	case "logger_name":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.LoggerName = d.Val()
+	case "label":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return true, d.ArgErr()
+		}
+		if s.Labels == nil {
+			s.Labels = make(map[string]string)
+		}
+		s.Labels[args[0]] = args[1]
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,638 @@
+package discovery
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestValidateInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		aggressive bool
+		want       string
+	}{
+		{"at the floor", MinInterval, false, ""},
+		{"above the floor", 10 * time.Second, false, ""},
+		{"below the floor", 100 * time.Millisecond, false, "allow_aggressive_polling"},
+		{"below the floor with override", 100 * time.Millisecond, true, ""},
+		{"zero", 0, false, "must be positive"},
+		{"zero with override", 0, true, "must be positive"},
+		{"negative with override", -time.Second, true, "must be positive"},
+	}
+	for _, tt := range tests {
+		s := &Store{AllowAggressivePolling: tt.aggressive}
+		err := s.ValidateInterval("poll_interval", tt.interval)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error mentioning %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFailThresholdFromMetadata(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := &Store{FailThresholdMetadataKey: "max_fails"}
+	s.Setup(zap.New(core), "fail-threshold-test")
+
+	s.Update([]*Instance{
+		NewInstance("10.0.0.1:80", map[string]string{"max_fails": "1"}, 0),
+		NewInstance("10.0.0.2:80", map[string]string{"max_fails": "many"}, 0),
+		NewInstance("10.0.0.3:80", map[string]string{"max_fails": "0"}, 0),
+		NewInstance("10.0.0.4:80", nil, 0),
+	})
+
+	want := map[string]int{"10.0.0.1:80": 1, "10.0.0.2:80": 0, "10.0.0.3:80": 0, "10.0.0.4:80": 0}
+	for _, in := range s.Instances() {
+		if in.FailThreshold != want[in.Upstream.Dial] {
+			t.Errorf("%s: got fail threshold %d, want %d", in.Upstream.Dial, in.FailThreshold, want[in.Upstream.Dial])
+		}
+	}
+	if n := logs.FilterMessageSnippet("invalid fail threshold").Len(); n != 2 {
+		t.Fatalf("got %d invalid threshold warnings, want 2", n)
+	}
+}
+
+func TestSetupLoggerName(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"default", "provider {\n}", "dynamic_sd.orders"},
+		{"logger_name", "provider {\n\tlogger_name orders-primary\n}", "dynamic_sd.orders-primary"},
+	}
+	for _, tt := range tests {
+		s := new(Store)
+		d := caddyfile.NewTestDispenser(tt.config)
+		d.Next()
+		for d.NextBlock(0) {
+			if ok, err := s.UnmarshalCaddyfileOption(d); !ok || err != nil {
+				t.Fatalf("%s: option %s: ok=%v err=%v", tt.name, d.Val(), ok, err)
+			}
+		}
+
+		core, logs := observer.New(zapcore.InfoLevel)
+		s.Setup(zap.New(core).Named("dynamic_sd"), "orders").Info("refreshed")
+		if got := logs.All()[0].LoggerName; got != tt.want {
+			t.Errorf("%s: got logger %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnchangedIgnoresOrder(t *testing.T) {
+	s := new(Store)
+	s.Setup(zap.NewNop(), "unchanged-test")
+	if s.Unchanged(nil) {
+		t.Fatal("Unchanged before the first update")
+	}
+
+	s.Update([]*Instance{
+		NewInstance("10.0.0.1:80", map[string]string{"zone": "a"}, 1),
+		NewInstance("10.0.0.2:80", nil, 2),
+	})
+	same := []*Instance{
+		NewInstance("10.0.0.2:80", nil, 2),
+		NewInstance("10.0.0.1:80", map[string]string{"zone": "a"}, 1),
+	}
+	if !s.Unchanged(same) {
+		t.Fatal("identical instances in a different order reported as changed")
+	}
+	reweighted := []*Instance{
+		NewInstance("10.0.0.1:80", map[string]string{"zone": "a"}, 1),
+		NewInstance("10.0.0.2:80", nil, 3),
+	}
+	if s.Unchanged(reweighted) {
+		t.Fatal("a weight change reported as unchanged")
+	}
+}
+
+// testInstances 返回地址为 dials、没有 metadata 的实例。
+func testInstances(dials ...string) []*Instance {
+	instances := make([]*Instance, len(dials))
+	for i, dial := range dials {
+		instances[i] = NewInstance(dial, nil, 0)
+	}
+	return instances
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(s *Store) string {
+	dials := make([]string, 0, len(s.Upstreams()))
+	for _, up := range s.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestMinUpstreams(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := &Store{MinUpstreams: 2}
+	s.Setup(zap.New(core), "min-upstreams-test")
+
+	steps := []struct {
+		name    string
+		dials   []string
+		applied bool
+		want    string
+	}{
+		// 启动阶段逐步增长的列表即使低于下限也会被应用
+		{"growing below the floor", []string{"10.0.0.1:80"}, true, "10.0.0.1:80"},
+		{"growing above the floor", []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, true, "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80"},
+		{"shrinking below the floor", []string{"10.0.0.1:80"}, false, "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80"},
+		{"empty refresh", nil, false, "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80"},
+		{"shrinking to the floor", []string{"10.0.0.2:80", "10.0.0.3:80"}, true, "10.0.0.2:80,10.0.0.3:80"},
+	}
+	for _, step := range steps {
+		if got := s.Update(testInstances(step.dials...)); got != step.applied {
+			t.Fatalf("%s: Update returned %v, want %v", step.name, got, step.applied)
+		}
+		if got := upstreamDials(s); got != step.want {
+			t.Fatalf("%s: got upstreams %s, want %s", step.name, got, step.want)
+		}
+	}
+	if n := logs.FilterMessageSnippet("below min_upstreams").Len(); n != 2 {
+		t.Fatalf("got %d min_upstreams warnings, want 2", n)
+	}
+}
+
+func TestScaleInGraceDecay(t *testing.T) {
+	grace := 10 * time.Second
+	s := &Store{ScaleInGrace: caddy.Duration(grace)}
+	s.Setup(zap.NewNop(), "scale-in-test")
+
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	removed := s.Upstreams()[1]
+	s.Update(testInstances("10.0.0.1:80"))
+
+	if got := upstreamDials(s); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %s, want the removed instance kept at the end", got)
+	}
+	departing := s.Instances()[1]
+	if !departing.Departing() || s.Instances()[0].Departing() {
+		t.Fatal("departing flags do not match the removed instance")
+	}
+	if departing.Upstream != removed {
+		t.Fatal("departing instance does not share the published upstream")
+	}
+	tests := []struct {
+		after time.Duration
+		want  float64
+	}{
+		{0, 1},
+		{grace / 4, 0.75},
+		{grace / 2, 0.5},
+		{grace, 0},
+		{2 * grace, 0},
+	}
+	for _, tt := range tests {
+		if got := departing.Retention(departing.removedAt.Add(tt.after)); got != tt.want {
+			t.Errorf("retention after %v = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+
+	// 宽限期结束后的下一次刷新丢弃该实例
+	departing.removedAt = time.Now().Add(-grace)
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.3:80"))
+	if got := upstreamDials(s); got != "10.0.0.1:80,10.0.0.3:80" {
+		t.Fatalf("got upstreams %s after the grace period, want the removed instance dropped", got)
+	}
+}
+
+func TestScaleInGraceReturningInstance(t *testing.T) {
+	s := &Store{ScaleInGrace: caddy.Duration(time.Minute)}
+	s.Setup(zap.NewNop(), "scale-in-return-test")
+
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	s.Update(testInstances("10.0.0.1:80"))
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+
+	if got := upstreamDials(s); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %s, want each instance once", got)
+	}
+	for _, in := range s.Instances() {
+		if in.Departing() {
+			t.Fatalf("%s is still departing after it came back", in.Upstream.Dial)
+		}
+	}
+}
+
+func TestLogChanges(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	s := &Store{LogChanges: true, ScaleInGrace: caddy.Duration(time.Minute)}
+	s.Setup(zap.New(core), "log-changes-test")
+
+	steps := []struct {
+		dials []string
+		diff  string
+	}{
+		{[]string{"10.0.0.2:80", "10.0.0.1:80"}, "+10.0.0.1:80 +10.0.0.2:80"},
+		{[]string{"10.0.0.1:80", "10.0.0.2:80"}, ""},
+		// 正在 scale_in_grace 期间的 10.0.0.2:80 不再计入刷新前的集合
+		{[]string{"10.0.0.1:80", "10.0.0.3:80"}, "+10.0.0.3:80 -10.0.0.2:80"},
+		{[]string{"10.0.0.1:80", "10.0.0.3:80"}, ""},
+		{[]string{"10.0.0.2:80"}, "+10.0.0.2:80 -10.0.0.1:80 -10.0.0.3:80"},
+	}
+	for i, step := range steps {
+		logs.TakeAll()
+		s.Update(testInstances(step.dials...))
+		changes := logs.FilterMessage("upstreams changed").All()
+		if step.diff == "" {
+			if len(changes) != 0 {
+				t.Fatalf("step %d: got %v, want no change logged", i, changes)
+			}
+			continue
+		}
+		if len(changes) != 1 {
+			t.Fatalf("step %d: got %d change logs, want 1", i, len(changes))
+		}
+		fields := changes[0].ContextMap()
+		if fields["diff"] != step.diff || fields["service"] != "log-changes-test" {
+			t.Fatalf("step %d: got fields %v, want diff %q", i, fields, step.diff)
+		}
+	}
+}
+
+func TestWarmupGrace(t *testing.T) {
+	grace := time.Minute
+	s := &Store{WarmupGrace: caddy.Duration(grace)}
+	s.Setup(zap.NewNop(), "warmup-test")
+
+	// 第一次刷新得到的实例不需要预热
+	s.Update(testInstances("10.0.0.1:80"))
+	now := time.Now()
+	if got := s.Instances()[0].Retention(now); got != 1 {
+		t.Fatalf("initial instance has retention %v, want 1", got)
+	}
+
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	now = time.Now()
+	held := s.Instances()[1]
+	if got := held.Retention(now); got != 0 {
+		t.Fatalf("new instance has retention %v, want 0 during warmup_grace", got)
+	}
+	if got := held.Retention(now.Add(grace)); got != 1 {
+		t.Fatalf("new instance has retention %v after warmup_grace, want 1", got)
+	}
+	if got := s.Instances()[0].Retention(now); got != 1 {
+		t.Fatalf("known instance has retention %v, want 1", got)
+	}
+
+	// 重复提交不会推迟就绪时间
+	readyAt := held.readyAt
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	if got := s.Instances()[1].readyAt; !got.Equal(readyAt) {
+		t.Fatalf("resubmitted instance ready at %v, want %v", got, readyAt)
+	}
+
+	// 移除后重新出现的实例需要再次预热
+	s.Update(testInstances("10.0.0.2:80"))
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	if got := s.Instances()[0].Retention(time.Now()); got != 0 {
+		t.Fatalf("returning instance has retention %v, want 0 during warmup_grace", got)
+	}
+}
+
+func TestWarmDuration(t *testing.T) {
+	warm := 10 * time.Minute
+	s := &Store{WarmupGrace: caddy.Duration(time.Minute), WarmDuration: caddy.Duration(warm)}
+	s.Setup(zap.NewNop(), "warm-test")
+
+	// 第一次刷新得到的实例直接使用完整的权重
+	s.Update([]*Instance{NewInstance("10.0.0.1:80", nil, 4)})
+	if got := s.Instances()[0].WeightAt(time.Now()); got != 4 {
+		t.Fatalf("initial instance has weight %v, want 4", got)
+	}
+
+	s.Update([]*Instance{NewInstance("10.0.0.1:80", nil, 4), NewInstance("10.0.0.2:80", nil, 4)})
+	fresh := s.Instances()[1]
+	start := fresh.readyAt
+	tests := []struct {
+		at   time.Duration
+		want float64
+	}{
+		// 预热期间和 warm_duration 开始时为完整权重的 minWarmRatio
+		{-30 * time.Second, 4 * minWarmRatio},
+		{0, 4 * minWarmRatio},
+		{warm / 4, 1},
+		{warm / 2, 2},
+		{warm, 4},
+		{2 * warm, 4},
+	}
+	prev := 0.0
+	for _, tt := range tests {
+		got := fresh.WeightAt(start.Add(tt.at))
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Fatalf("weight %v after warmup_grace: got %v, want %v", tt.at, got, tt.want)
+		}
+		if got < prev {
+			t.Fatalf("weight decreased from %v to %v at %v", prev, got, tt.at)
+		}
+		prev = got
+	}
+
+	// 重复提交不会重新开始增长
+	s.Update([]*Instance{NewInstance("10.0.0.1:80", nil, 4), NewInstance("10.0.0.2:80", nil, 4)})
+	if got := s.Instances()[1].WeightAt(start.Add(warm / 2)); math.Abs(got-2) > 1e-9 {
+		t.Fatalf("resubmitted instance has weight %v half way through warm_duration, want 2", got)
+	}
+}
+
+func TestReuseUpstreams(t *testing.T) {
+	s := new(Store)
+	s.Setup(zap.NewNop(), "reuse-test")
+
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80"))
+	first := s.Upstreams()
+	kept, dropped := first[0], first[1]
+
+	s.Update(testInstances("10.0.0.3:80", "10.0.0.1:80"))
+	second := s.Upstreams()
+	if second[1] != kept {
+		t.Fatal("unchanged dial got a new upstream object")
+	}
+	if second[0] == dropped || second[0].Dial != "10.0.0.3:80" {
+		t.Fatal("new dial reused an unrelated upstream object")
+	}
+	if s.Instances()[1].Upstream != kept {
+		t.Fatal("instance and published upstream differ")
+	}
+
+	// 移除后重新出现的地址不会复用已经丢弃的对象
+	s.Update(testInstances("10.0.0.2:80", "10.0.0.1:80"))
+	if got := s.Upstreams()[0]; got == dropped {
+		t.Fatal("dial removed in an earlier refresh got its old upstream object back")
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	s := new(Store)
+	s.Setup(zap.New(core), "coalesce-test")
+	s.SetCoalesceWindow(50 * time.Millisecond)
+	applied := make(chan string, 10)
+	s.OnUpdate(func(instances []*Instance) {
+		applied <- upstreamDials(s)
+	})
+
+	// 第一次更新立即应用
+	s.Update(testInstances("10.0.0.1:80"))
+	if got := <-applied; got != "10.0.0.1:80" {
+		t.Fatalf("got first update %s, want 10.0.0.1:80", got)
+	}
+
+	for _, dial := range []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"} {
+		if !s.Update(testInstances(dial)) {
+			t.Fatal("buffered update reported as rejected")
+		}
+	}
+	if got := upstreamDials(s); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %s before the window ended, want the first list", got)
+	}
+	select {
+	case got := <-applied:
+		if got != "10.0.0.4:80" {
+			t.Fatalf("got coalesced update %s, want the last list", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("coalesced update was never applied")
+	}
+	select {
+	case got := <-applied:
+		t.Fatalf("got an extra update %s, want one per window", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	entries := logs.FilterMessage("applied coalesced upstream updates").All()
+	if len(entries) != 1 || entries[0].ContextMap()["updates"] != int64(3) {
+		t.Fatalf("got %v, want one log of 3 coalesced updates", entries)
+	}
+}
+
+func TestCoalesceWindowFlushesWhenFull(t *testing.T) {
+	s := new(Store)
+	s.Setup(zap.NewNop(), "coalesce-full-test")
+	s.SetCoalesceWindow(time.Hour)
+
+	s.Update(testInstances("10.0.0.1:80"))
+	for i := 0; i < maxCoalescedUpdates; i++ {
+		s.Update(testInstances(fmt.Sprintf("10.0.1.%d:80", i)))
+	}
+	want := fmt.Sprintf("10.0.1.%d:80", maxCoalescedUpdates-1)
+	if got := upstreamDials(s); got != want {
+		t.Fatalf("got upstreams %s, want %s applied once the buffer was full", got, want)
+	}
+}
+
+func TestHardInstanceCap(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	s := &Store{HardInstanceCap: 2}
+	s.Setup(zap.New(core), "hard-cap-test")
+
+	oversized := testInstances("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80")
+	s.Update(oversized)
+	if got := upstreamDials(s); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %s, want the first two instances", got)
+	}
+	warnings := logs.FilterMessageSnippet("exceeds hard_instance_cap").All()
+	if len(warnings) != 1 || warnings[0].ContextMap()["dropped"] != int64(2) {
+		t.Fatalf("got %v, want one warning dropping 2 instances", warnings)
+	}
+
+	// 丢弃的数量不变时不再重复记录
+	s.Update(testInstances("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.5:80"))
+	if n := logs.FilterMessageSnippet("exceeds hard_instance_cap").Len(); n != 1 {
+		t.Fatalf("got %d cap warnings, want the unchanged overflow logged once", n)
+	}
+
+	s.Update(testInstances("10.0.0.1:80"))
+	if n := logs.FilterMessageSnippet("back within hard_instance_cap").Len(); n != 1 {
+		t.Fatalf("got %d recovery logs, want 1", n)
+	}
+	if got := upstreamDials(s); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %s, want 10.0.0.1:80", got)
+	}
+}
+
+func TestHardInstanceCapValidate(t *testing.T) {
+	tests := []struct {
+		hardCap, minUpstreams int
+		want                  string
+	}{
+		{10, 10, ""},
+		{-1, 0, "must not be negative"},
+		{2, 3, "exceeds hard_instance_cap"},
+	}
+	for _, tt := range tests {
+		s := &Store{HardInstanceCap: tt.hardCap, MinUpstreams: tt.minUpstreams}
+		err := s.Validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("cap %d min %d: got %v, want nil", tt.hardCap, tt.minUpstreams, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("cap %d min %d: got %v, want an error mentioning %s", tt.hardCap, tt.minUpstreams, err, tt.want)
+		}
+	}
+}
+
+// zonedInstances 返回按 "dial=zone" 描述的实例，可用区保存在 metadata 的 key 中，zone 为空时不设置。
+func zonedInstances(key string, specs ...string) []*Instance {
+	instances := make([]*Instance, len(specs))
+	for i, spec := range specs {
+		dial, zone, _ := strings.Cut(spec, "=")
+		var metadata map[string]string
+		if zone != "" {
+			metadata = map[string]string{key: zone}
+		}
+		instances[i] = NewInstance(dial, metadata, 0)
+	}
+	return instances
+}
+
+func TestMinZones(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := &Store{MinZones: 2}
+	s.Setup(zap.New(core), "min-zones-test")
+
+	steps := []struct {
+		name    string
+		specs   []string
+		applied bool
+	}{
+		{"growing from one zone", []string{"10.0.0.1:80=a"}, true},
+		{"three zones", []string{"10.0.0.1:80=a", "10.0.0.2:80=b", "10.0.0.3:80=c"}, true},
+		{"collapsing to one zone", []string{"10.0.0.1:80=a", "10.0.0.4:80=a"}, false},
+		{"instances without a zone", []string{"10.0.0.1:80=a", "10.0.0.5:80", "10.0.0.6:80"}, false},
+		{"two zones", []string{"10.0.0.1:80=a", "10.0.0.2:80=b"}, true},
+	}
+	for _, step := range steps {
+		if got := s.Update(zonedInstances("zone", step.specs...)); got != step.applied {
+			t.Fatalf("%s: Update returned %v, want %v", step.name, got, step.applied)
+		}
+	}
+	if got := upstreamDials(s); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %s, want the last accepted refresh", got)
+	}
+	if n := logs.FilterMessageSnippet("below min_zones").Len(); n != 2 {
+		t.Fatalf("got %d min_zones warnings, want 2", n)
+	}
+}
+
+func TestMinZonesMetadataKey(t *testing.T) {
+	s := &Store{MinZones: 2, ZoneMetadataKey: "topology.kubernetes.io/zone"}
+	s.Setup(zap.NewNop(), "zone-key-test")
+
+	s.Update(zonedInstances("topology.kubernetes.io/zone", "10.0.0.1:80=a", "10.0.0.2:80=b"))
+	if s.Update(zonedInstances("zone", "10.0.0.1:80=a", "10.0.0.2:80=b")) {
+		t.Fatal("refresh using the default zone key was accepted")
+	}
+}
+
+func TestSNITemplate(t *testing.T) {
+	s := &Store{SNI: "{service}.{host}.internal"}
+	s.Setup(zap.NewNop(), "api")
+
+	preset := NewInstance("10.0.0.2:443", nil, 0)
+	preset.SNI = "custom.example.com"
+	s.Update([]*Instance{NewInstance("10.0.0.1:443", nil, 0), preset, NewInstance("backend.local", nil, 0)})
+
+	want := []string{"api.10.0.0.1.internal", "custom.example.com", "api.backend.local.internal"}
+	for i, in := range s.Instances() {
+		if in.SNI != want[i] {
+			t.Errorf("%s: got SNI %q, want %q", in.Upstream.Dial, in.SNI, want[i])
+		}
+	}
+}
+
+func TestSkipUnroutableAddresses(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := &Store{}
+	s.Setup(zap.New(core), "unroutable-test")
+
+	s.Update(testInstances("127.0.0.1:80", "10.0.0.1:80", "0.0.0.0:80", "[::1]:80", "[::]:80", "localhost:80"))
+	if got := upstreamDials(s); got != "10.0.0.1:80,localhost:80" {
+		t.Fatalf("got upstreams %s, want loopback and unspecified IPs dropped", got)
+	}
+	warnings := logs.FilterMessageSnippet("loopback or unspecified")
+	if warnings.Len() != 1 || warnings.All()[0].ContextMap()["service"] != "unroutable-test" {
+		t.Fatalf("got warnings %v, want one naming the service", warnings.All())
+	}
+	// 被丢弃的地址没有变化时不重复记录
+	s.Update(testInstances("127.0.0.1:80", "0.0.0.0:80", "[::1]:80", "[::]:80", "10.0.0.2:80"))
+	if n := logs.FilterMessageSnippet("loopback or unspecified").Len(); n != 1 {
+		t.Fatalf("got %d warnings for the same dropped address, want 1", n)
+	}
+
+	off := false
+	s = &Store{SkipLoopback: &off}
+	s.Setup(zap.NewNop(), "sidecar-test")
+	s.Update(testInstances("127.0.0.1:80", "0.0.0.0:80"))
+	if got := upstreamDials(s); got != "127.0.0.1:80" {
+		t.Fatalf("got upstreams %s with skip_loopback off, want only the unspecified address dropped", got)
+	}
+}
+
+func TestAdditionalPortsExpandInstances(t *testing.T) {
+	s := &Store{AdditionalPortsMetadataKey: "ports"}
+	s.Setup(zap.NewNop(), "ports-test")
+
+	s.Update([]*Instance{
+		NewInstance("10.0.0.1:8080", map[string]string{"ports": "9090"}, 2),
+		// 重复和非法的端口被跳过
+		NewInstance("10.0.0.2:8080", map[string]string{"ports": "8080, 9090,admin,0"}, 0),
+	})
+	if got := upstreamDials(s); got != "10.0.0.1:8080,10.0.0.1:9090,10.0.0.2:8080,10.0.0.2:9090" {
+		t.Fatalf("got upstreams %s, want one upstream per port", got)
+	}
+	if extra := s.Instances()[1]; extra.Weight != 2 || extra.Metadata["ports"] != "9090" {
+		t.Fatalf("got %+v, want the expanded upstream to keep the instance's weight and metadata", extra)
+	}
+}
+
+func TestAddressPreference(t *testing.T) {
+	both := func(dial string) *Instance {
+		return NewInstance(dial, map[string]string{"private_ip": "10.0.0.1", "public_ip": "203.0.113.1:8443"}, 0)
+	}
+	tests := []struct {
+		preference string
+		instances  []*Instance
+		want       string
+	}{
+		{AddressPrivate, []*Instance{both("192.0.2.1:8080")}, "10.0.0.1:8080"},
+		{AddressPublic, []*Instance{both("192.0.2.1:8080")}, "203.0.113.1:8443"},
+		// 没有登记或登记了非法地址时使用 provider 给出的地址
+		{AddressPublic, testInstances("192.0.2.2:8080"), "192.0.2.2:8080"},
+		{AddressPrivate, []*Instance{NewInstance("192.0.2.3:8080", map[string]string{"private_ip": "not an address"}, 0)}, "192.0.2.3:8080"},
+	}
+	for _, tt := range tests {
+		s := &Store{AddressPreference: tt.preference}
+		s.Setup(zap.NewNop(), "address-test")
+		s.Update(tt.instances)
+		if got := upstreamDials(s); got != tt.want {
+			t.Errorf("%s: got upstreams %s, want %s", tt.preference, got, tt.want)
+		}
+	}
+
+	s := &Store{AddressPreference: AddressPrivate, PrivateAddressMetadataKey: "lan"}
+	s.Setup(zap.NewNop(), "address-key-test")
+	s.Update([]*Instance{NewInstance("192.0.2.1:8080", map[string]string{"lan": "[fd00::1]", "private_ip": "10.0.0.1"}, 0)})
+	if got := upstreamDials(s); got != "[fd00::1]:8080" {
+		t.Fatalf("got upstreams %s, want the address under the configured key", got)
+	}
+}
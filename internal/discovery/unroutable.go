@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// dropUnroutable 按 SkipLoopback 和 SkipUnspecified 丢弃 Caddy 无法访问的实例，被丢弃的地址集合变化时记录警告。
+// 调用方必须持有 s.mu。
+func (s *Store) dropUnroutable(instances []*Instance) []*Instance {
+	skipLoopback := s.SkipLoopback == nil || *s.SkipLoopback
+	skipUnspecified := s.SkipUnspecified == nil || *s.SkipUnspecified
+	if !skipLoopback && !skipUnspecified {
+		return instances
+	}
+
+	var dropped []string
+	kept := make([]*Instance, 0, len(instances))
+	for _, in := range instances {
+		if ip := dialIP(in.Upstream.Dial); ip != nil &&
+			(skipLoopback && ip.IsLoopback() || skipUnspecified && ip.IsUnspecified()) {
+			dropped = append(dropped, in.Upstream.Dial)
+			continue
+		}
+		kept = append(kept, in)
+	}
+
+	slices.Sort(dropped)
+	if !slices.Equal(dropped, s.unroutable) && len(dropped) > 0 {
+		s.logger.Warn("dropping upstreams with loopback or unspecified addresses from registry",
+			zap.String("service", s.service),
+			zap.Strings("upstreams", dropped),
+		)
+	}
+	s.unroutable = dropped
+	if len(dropped) == 0 {
+		return instances
+	}
+	return kept
+}
+
+// dialIP 返回 "host:port" 中的 IP，主机部分不是 IP 时返回 nil。
+func dialIP(dial string) net.IP {
+	host, _, err := net.SplitHostPort(dial)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
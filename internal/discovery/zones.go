@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"go.uber.org/zap"
+)
+
+// defaultZoneMetadataKey 是未配置 ZoneMetadataKey 时使用的 key。
+const defaultZoneMetadataKey = "zone"
+
+// enoughZones 报告 instances 是否满足 MinZones。可用区数量低于 MinZones 且少于当前列表时记录警告并返回 false。
+// 调用方必须持有 s.mu。
+func (s *Store) enoughZones(instances []*Instance) bool {
+	zones := s.countZones(instances)
+	if zones >= s.MinZones {
+		return true
+	}
+	active := make([]*Instance, 0, len(s.instances))
+	for _, in := range s.instances {
+		if !in.Departing() {
+			active = append(active, in)
+		}
+	}
+	current := s.countZones(active)
+	if zones >= current {
+		return true
+	}
+	s.logger.Warn("rejecting upstream refresh below min_zones, keeping previous upstreams",
+		zap.String("service", s.service),
+		zap.Int("min_zones", s.MinZones),
+		zap.Int("refreshed_zones", zones),
+		zap.Int("current_zones", current),
+	)
+	return false
+}
+
+// countZones 返回 instances 覆盖的不同可用区的数量。
+func (s *Store) countZones(instances []*Instance) int {
+	key := s.ZoneMetadataKey
+	if key == "" {
+		key = defaultZoneMetadataKey
+	}
+	zones := make(map[string]struct{})
+	for _, in := range instances {
+		if zone := in.Metadata[key]; zone != "" {
+			zones[zone] = struct{}{}
+		}
+	}
+	return len(zones)
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import "sync"
+
+var (
+	labelsMu sync.Mutex
+	// labelRefs 是每个 provider_labels 序列的引用计数。配置重载时新配置先于旧配置的清理完成 Provision，
+	// 相同的序列只在最后一个引用释放时才被删除。
+	labelRefs = make(map[[4]string]int)
+)
+
+// SetLabels 为 provider 的每个 label 设置一个 provider_labels 序列，返回释放这些序列的函数，
+// 应当在 provider 被清理时调用。label 的数量由配置校验限制，因此基数是有界的。
+func SetLabels(provider, service string, labels map[string]string) (release func()) {
+	initMetrics()
+	keys := make([][4]string, 0, len(labels))
+	for label, value := range labels {
+		keys = append(keys, [4]string{provider, service, label, value})
+	}
+
+	labelsMu.Lock()
+	for _, key := range keys {
+		labelRefs[key]++
+		providerLabels.WithLabelValues(key[:]...).Set(1)
+	}
+	labelsMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			labelsMu.Lock()
+			defer labelsMu.Unlock()
+			for _, key := range keys {
+				if labelRefs[key]--; labelRefs[key] <= 0 {
+					delete(labelRefs, key)
+					providerLabels.DeleteLabelValues(key[:]...)
+				}
+			}
+		})
+	}
+}
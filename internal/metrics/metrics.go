@@ -0,0 +1,129 @@
+// package metrics 定义了动态服务发现模块导出的 Prometheus 指标。
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namespace 是本模块所有指标名称的前缀。
+const namespace = "caddy_plus"
+
+var (
+	initOnce sync.Once
+
+	// refreshDuration 记录各 provider 每次刷新的耗时。
+	refreshDuration *prometheus.HistogramVec
+
+	// upstreamsEmpty 统计刷新后没有任何上游的次数。
+	upstreamsEmpty *prometheus.CounterVec
+
+	// upstreamsServed 按结果统计 GetUpstreams 的调用次数，outcome 为 "ok" 或 "empty"，
+	// 两者之比可以直接作为可用性 SLO 的指标。
+	upstreamsServed *prometheus.CounterVec
+
+	// providerLabels 是值恒为 1 的信息指标，每个 provider 配置的每个 label 一个序列，
+	// 在看板中通过 provider 和 service 与其它指标关联，见 SetLabels。
+	providerLabels *prometheus.GaugeVec
+
+	// trackedInstances 是各 provider 当前保存的实例数量（包括正在 scale_in_grace 期间移除的实例），
+	// 配合 hard_instance_cap 观察注册中心返回的实例规模。
+	trackedInstances *prometheus.GaugeVec
+
+	// cleanupDuration 累计各 provider Cleanup 的耗时（秒）。Caddy 重载配置时要等待旧配置清理完成，
+	// 清理缓慢（例如 Nacos 取消订阅卡住）会直接表现为重载卡顿。
+	cleanupDuration *prometheus.CounterVec
+
+	// cleanupTimeouts 统计 provider 的 Cleanup 超时、主模块不再等待它完成的次数。
+	cleanupTimeouts *prometheus.CounterVec
+)
+
+// initMetrics 创建所有指标，只会执行一次。
+func initMetrics() {
+	initOnce.Do(func() {
+		refreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "refresh_duration_seconds",
+			Help:      "Duration of service discovery refreshes.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"provider", "service"})
+		upstreamsEmpty = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstreams_empty_total",
+			Help:      "Number of service discovery refreshes that left no upstreams.",
+		}, []string{"provider", "service"})
+		upstreamsServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstreams_served_total",
+			Help:      "Number of upstream lookups by the reverse proxy, by outcome.",
+		}, []string{"provider", "service", "outcome"})
+		providerLabels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "provider_labels",
+			Help:      "User-defined labels of service discovery providers, always 1.",
+		}, []string{"provider", "service", "label", "value"})
+		trackedInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tracked_instances",
+			Help:      "Number of instances currently held by each service discovery provider.",
+		}, []string{"provider", "service"})
+		cleanupDuration = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleanup_duration_seconds",
+			Help:      "Total time spent in service discovery provider cleanups.",
+		}, []string{"provider"})
+		cleanupTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleanup_timeouts_total",
+			Help:      "Number of service discovery provider cleanups that timed out.",
+		}, []string{"provider"})
+	})
+}
+
+// Register 将指标注册到给定的 registry 中。
+// Caddy 每次加载配置都会创建新的 registry，同一个 registry 上的重复注册会被忽略。
+func Register(registry prometheus.Registerer) error {
+	initMetrics()
+	for _, c := range []prometheus.Collector{refreshDuration, upstreamsEmpty, upstreamsServed, providerLabels, trackedInstances, cleanupDuration, cleanupTimeouts} {
+		var are prometheus.AlreadyRegisteredError
+		if err := registry.Register(c); err != nil && !errors.As(err, &are) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObserveRefresh 记录一次从 start 开始的刷新耗时，通常以 defer 的方式调用。
+func ObserveRefresh(provider, service string, start time.Time) {
+	initMetrics()
+	refreshDuration.WithLabelValues(provider, service).Observe(time.Since(start).Seconds())
+}
+
+// ObserveCleanup 记录 provider 一次 Cleanup 的耗时，timedOut 表示主模块等待超时、没有等到它完成。
+func ObserveCleanup(provider string, duration time.Duration, timedOut bool) {
+	initMetrics()
+	cleanupDuration.WithLabelValues(provider).Add(duration.Seconds())
+	if timedOut {
+		cleanupTimeouts.WithLabelValues(provider).Inc()
+	}
+}
+
+// observeEmpty 记录一次没有留下任何上游的刷新。
+func observeEmpty(provider, service string) {
+	initMetrics()
+	upstreamsEmpty.WithLabelValues(provider, service).Inc()
+}
+
+// RecordServed 记录一次反向代理获取上游列表的结果，ok 为 false 表示没有返回任何上游。
+// 标签只包含配置中的 provider 类型和服务名，不包含请求相关的值，因此基数是有界的。
+func RecordServed(provider, service string, ok bool) {
+	initMetrics()
+	outcome := "ok"
+	if !ok {
+		outcome = "empty"
+	}
+	upstreamsServed.WithLabelValues(provider, service, outcome).Inc()
+}
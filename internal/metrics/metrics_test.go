@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// refreshSamples 返回 refresh_duration_seconds 中 provider 和 service 对应序列的样本数和样本总和。
+func refreshSamples(t *testing.T, provider, service string) (uint64, float64) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != namespace+"_refresh_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["provider"] == provider && labels["service"] == service {
+				return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return 0, 0
+}
+
+// trackedValue 返回 tracked_instances 中 provider 和 service 对应序列的值。
+func trackedValue(t *testing.T, provider, service string) float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != namespace+"_tracked_instances" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["provider"] == provider && labels["service"] == service {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	t.Fatalf("no tracked_instances series for %s/%s", provider, service)
+	return 0
+}
+
+func TestObserveRefresh(t *testing.T) {
+	ObserveRefresh("refresh-test", "orders", time.Now().Add(-2*time.Second))
+	ObserveRefresh("refresh-test", "orders", time.Now().Add(-time.Second))
+
+	count, sum := refreshSamples(t, "refresh-test", "orders")
+	if count != 2 {
+		t.Fatalf("got %d refresh samples, want 2", count)
+	}
+	if sum < 3 {
+		t.Fatalf("got refresh duration sum %v, want at least 3", sum)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	// Caddy 在同一个 registry 上重复加载模块时不应报错
+	if err := Register(reg); err != nil {
+		t.Fatalf("second Register: %v", err)
+	}
+}
+
+func TestObserveCleanup(t *testing.T) {
+	ObserveCleanup("cleanup-test", 2*time.Second, false)
+	ObserveCleanup("cleanup-test", 3*time.Second, true)
+
+	if got := testutil.ToFloat64(cleanupDuration.WithLabelValues("cleanup-test")); got != 5 {
+		t.Fatalf("got cleanup duration %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(cleanupTimeouts.WithLabelValues("cleanup-test")); got != 1 {
+		t.Fatalf("got %v cleanup timeouts, want 1", got)
+	}
+}
+
+func TestRecordResultTracksInstances(t *testing.T) {
+	RecordResult("tracked-test", "orders", 5, nil)
+	if got := trackedValue(t, "tracked-test", "orders"); got != 5 {
+		t.Fatalf("got %v tracked instances, want 5", got)
+	}
+	RecordResult("tracked-test", "orders", 0, errors.New("connection refused"))
+	if got := trackedValue(t, "tracked-test", "orders"); got != 0 {
+		t.Fatalf("got %v tracked instances after an empty refresh, want 0", got)
+	}
+}
+
+// counterValue 返回计数器 name 中标签与 labels 完全一致的序列的值，序列不存在时返回 0。
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != namespace+"_"+name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			got := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				got[lp.GetName()] = lp.GetValue()
+			}
+			if maps.Equal(got, labels) {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestEmptyRefreshesAreCounted(t *testing.T) {
+	labels := map[string]string{"provider": "empty-test", "service": "orders"}
+	RecordResult("empty-test", "orders", 3, nil)
+	if got := counterValue(t, "upstreams_empty_total", labels); got != 0 {
+		t.Fatalf("got %v empty refreshes after a refresh with upstreams, want 0", got)
+	}
+	RecordResult("empty-test", "orders", 0, nil)
+	RecordResult("empty-test", "orders", 0, errors.New("connection refused"))
+	if got := counterValue(t, "upstreams_empty_total", labels); got != 2 {
+		t.Fatalf("got %v empty refreshes, want 2", got)
+	}
+}
+
+func TestRecordServed(t *testing.T) {
+	RecordServed("served-test", "orders", true)
+	RecordServed("served-test", "orders", true)
+	RecordServed("served-test", "orders", false)
+
+	for outcome, want := range map[string]float64{"ok": 2, "empty": 1} {
+		labels := map[string]string{"provider": "served-test", "service": "orders", "outcome": outcome}
+		if got := counterValue(t, "upstreams_served_total", labels); got != want {
+			t.Errorf("got %v %s lookups, want %v", got, outcome, want)
+		}
+	}
+}
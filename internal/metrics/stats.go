@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// errorRateWindow 是计算刷新错误率时使用的滑动窗口长度。
+const errorRateWindow = 5 * time.Minute
+
+// ProviderStats 是一个 provider 的刷新统计快照，由管理接口以 JSON 返回。
+type ProviderStats struct {
+	Provider    string    `json:"provider"`
+	Service     string    `json:"service"`
+	Count       int       `json:"count"`
+	LastRefresh time.Time `json:"last_refresh"`
+	LastError   string    `json:"last_error,omitempty"`
+	// ErrorRate 是最近 errorRateWindow 内失败的刷新所占的比例。
+	ErrorRate float64 `json:"error_rate"`
+	Refreshes int     `json:"refreshes"`
+}
+
+// refreshResult 是滑动窗口中的一次刷新记录。
+type refreshResult struct {
+	at     time.Time
+	failed bool
+}
+
+// providerStats 保存一个 provider 的统计状态。
+type providerStats struct {
+	count       int
+	lastRefresh time.Time
+	lastError   string
+	window      []refreshResult
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[[2]string]*providerStats)
+)
+
+// RecordResult 记录一次刷新的结果，count 为刷新后的实例数量。
+// count 为 0 时（无论刷新是否失败）同时增加 upstreams_empty_total；tracked_instances 被设置为 count。
+func RecordResult(provider, service string, count int, err error) {
+	initMetrics()
+	now := time.Now()
+	if count == 0 {
+		observeEmpty(provider, service)
+	}
+	trackedInstances.WithLabelValues(provider, service).Set(float64(count))
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	key := [2]string{provider, service}
+	ps, ok := stats[key]
+	if !ok {
+		ps = &providerStats{}
+		stats[key] = ps
+	}
+	ps.count = count
+	ps.lastRefresh = now
+	ps.lastError = ""
+	if err != nil {
+		ps.lastError = err.Error()
+	}
+	ps.window = append(prune(ps.window, now), refreshResult{at: now, failed: err != nil})
+}
+
+// Stats 返回所有 provider 的统计快照，按 provider 和服务名排序。
+func Stats() []ProviderStats {
+	now := time.Now()
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	out := make([]ProviderStats, 0, len(stats))
+	for key, ps := range stats {
+		out = append(out, ps.snapshot(key, now))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Provider != out[j].Provider {
+			return out[i].Provider < out[j].Provider
+		}
+		return out[i].Service < out[j].Service
+	})
+	return out
+}
+
+// Lookup 返回一个 provider 的统计快照，还没有记录过刷新时返回 false。
+func Lookup(provider, service string) (ProviderStats, bool) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	key := [2]string{provider, service}
+	ps, ok := stats[key]
+	if !ok {
+		return ProviderStats{}, false
+	}
+	return ps.snapshot(key, time.Now()), true
+}
+
+// snapshot 清理滑动窗口并返回统计快照。调用方必须持有 statsMu。
+func (ps *providerStats) snapshot(key [2]string, now time.Time) ProviderStats {
+	ps.window = prune(ps.window, now)
+	failed := 0
+	for _, r := range ps.window {
+		if r.failed {
+			failed++
+		}
+	}
+	var rate float64
+	if len(ps.window) > 0 {
+		rate = float64(failed) / float64(len(ps.window))
+	}
+	return ProviderStats{
+		Provider:    key[0],
+		Service:     key[1],
+		Count:       ps.count,
+		LastRefresh: ps.lastRefresh,
+		LastError:   ps.lastError,
+		ErrorRate:   rate,
+		Refreshes:   len(ps.window),
+	}
+}
+
+// prune 丢弃滑动窗口之外的记录。
+func prune(window []refreshResult, now time.Time) []refreshResult {
+	i := 0
+	for i < len(window) && now.Sub(window[i].at) > errorRateWindow {
+		i++
+	}
+	return window[i:]
+}
@@ -0,0 +1,412 @@
+// package apollo 实现了从 Apollo 配置中心读取上游列表的服务发现提供者。
+package apollo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// requestTimeout 是读取配置的请求超时时间。
+	requestTimeout = 10 * time.Second
+
+	// longPollTimeout 是通知长轮询的请求超时时间。Apollo 在没有变化时最多挂起 60 秒后返回 304。
+	longPollTimeout = 90 * time.Second
+
+	// minRetryDelay 和 maxRetryDelay 是长轮询失败后重连等待时间的范围，每次连续失败翻倍。
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// ApolloProvider 实现了 providers.Provider 接口，
+// 从 Apollo 的某个 namespace 中读取一个 key 作为上游列表，并通过通知长轮询接口监听变化。
+// key 的值可以是 JSON 字符串数组，也可以是以逗号或换行分隔的 "host:port" 列表。
+type ApolloProvider struct {
+	// --- 配置字段 ---
+	ConfigServer string `json:"config_server,omitempty"`
+	AppID        string `json:"app_id,omitempty"`
+	Cluster      string `json:"cluster,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	Key          string `json:"key,omitempty"`
+
+	// Secret 是应用开启访问密钥后使用的密钥，设置后每个请求都带上 Apollo 要求的签名。
+	Secret string `json:"secret,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	client     *http.Client
+	releaseKey string
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 ApolloProvider 的新实例。
+func New() *ApolloProvider {
+	return &ApolloProvider{
+		// 设置合理的默认值
+		ConfigServer: "http://127.0.0.1:8080",
+		Cluster:      "default",
+		Namespace:    "application",
+	}
+}
+
+// target 返回用于日志和指标的服务标识。
+func (ap *ApolloProvider) target() string {
+	return ap.AppID + "/" + ap.Namespace + "/" + ap.Key
+}
+
+// Provision 读取一次配置并启动后台的通知长轮询。
+func (ap *ApolloProvider) Provision(logger *zap.Logger) error {
+	ap.logger = ap.Store.Setup(logger, ap.target())
+	ap.logger.Info("provisioning apollo service discovery provider",
+		zap.String("config_server", ap.ConfigServer),
+		zap.String("target", ap.target()),
+	)
+	ap.client = &http.Client{}
+
+	var ctx context.Context
+	ctx, ap.cancelFunc = context.WithCancel(context.Background())
+
+	// 立即读取一次，以确保在 Caddy 启动时就有上游可用
+	if err := ap.updateUpstreams(ctx); err != nil {
+		ap.logger.Error("initial fetch from apollo failed", zap.Error(err))
+		// 配置中心可能暂时不可用，通知长轮询恢复后会重新读取
+	}
+
+	discovery.Go(ap.logger, "apollo notification watcher", func() { ap.watchNotifications(ctx) })
+
+	return nil
+}
+
+// apolloConfig 是 Apollo 配置接口的响应。
+type apolloConfig struct {
+	Configurations map[string]string `json:"configurations"`
+	ReleaseKey     string            `json:"releaseKey"`
+}
+
+// apolloNotification 是通知接口请求和响应中的一项。
+type apolloNotification struct {
+	NamespaceName  string `json:"namespaceName"`
+	NotificationID int64  `json:"notificationId"`
+}
+
+// updateUpstreams 读取 namespace 的最新配置并更新上游列表。配置没有变化时 Apollo 返回 304，不做任何处理。
+// key 不存在时被视为空列表。
+func (ap *ApolloProvider) updateUpstreams(ctx context.Context) (err error) {
+	defer metrics.ObserveRefresh("apollo", ap.target(), time.Now())
+	endSpan := tracing.StartRefresh("apollo", ap.target())
+	defer func() {
+		count := len(ap.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("apollo", ap.target(), count, err)
+	}()
+
+	config, err := ap.fetchConfig(ctx, ap.client, ap.releaseKey)
+	if err != nil || config == nil {
+		return err
+	}
+
+	var instances []*discovery.Instance
+	for _, dial := range parseEndpoints(config.Configurations[ap.Key]) {
+		if _, _, err := net.SplitHostPort(dial); err != nil {
+			ap.logger.Warn("skipping invalid upstream in apollo",
+				zap.String("key", ap.Key),
+				zap.String("upstream", dial),
+				zap.Error(err),
+			)
+			continue
+		}
+		instances = append(instances, discovery.NewInstance(dial, nil, 0))
+	}
+	ap.releaseKey = config.ReleaseKey
+
+	if !ap.Store.Update(instances) {
+		return nil
+	}
+
+	ap.logger.Debug("updated upstreams from apollo",
+		zap.String("target", ap.target()),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// fetchConfig 读取 namespace 的配置，releaseKey 与服务端一致（配置没有变化）时返回 nil。
+func (ap *ApolloProvider) fetchConfig(ctx context.Context, client *http.Client, releaseKey string) (*apolloConfig, error) {
+	query := url.Values{}
+	if releaseKey != "" {
+		query.Set("releaseKey", releaseKey)
+	}
+	path := "/configs/" + url.PathEscape(ap.AppID) + "/" + url.PathEscape(ap.Cluster) + "/" + url.PathEscape(ap.Namespace)
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := ap.get(ctx, client, path, query)
+	if err != nil {
+		return nil, fmt.Errorf("fetching apollo config '%s': %v", ap.target(), err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("fetching apollo config '%s': unexpected status %d: %s", ap.target(), resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var config apolloConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("parsing apollo config '%s': %v", ap.target(), err)
+	}
+	return &config, nil
+}
+
+// watchNotifications 通过长轮询等待 namespace 的变更通知，收到通知后重新读取配置，直到 ctx 被取消。
+// 请求失败时按指数退避重连。
+func (ap *ApolloProvider) watchNotifications(ctx context.Context) {
+	notificationID := int64(-1)
+	delay := minRetryDelay
+	for {
+		id, changed, err := ap.pollNotification(ctx, notificationID)
+		if ctx.Err() != nil {
+			ap.logger.Info("stopping apollo notification watcher", zap.String("target", ap.target()))
+			return
+		}
+		if err != nil {
+			ap.logger.Error("apollo notification long poll failed, reconnecting",
+				zap.Duration("delay", delay),
+				zap.Error(err),
+			)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				ap.logger.Info("stopping apollo notification watcher", zap.String("target", ap.target()))
+				return
+			}
+			delay = min(delay*2, maxRetryDelay)
+			continue
+		}
+		delay = minRetryDelay
+		if !changed {
+			continue
+		}
+
+		// 第一次通知返回当前的通知 ID；此时仍然读取一次配置，以免错过 Provision 之后发生的变更
+		notificationID = id
+		if err := ap.updateUpstreams(ctx); err != nil {
+			ap.logger.Error("failed to update upstreams from apollo", zap.Error(err))
+		}
+	}
+}
+
+// pollNotification 发起一次通知长轮询。namespace 有新的通知时返回新的通知 ID 和 changed 为 true，
+// 服务端在超时前没有变化（304）时 changed 为 false。
+func (ap *ApolloProvider) pollNotification(ctx context.Context, notificationID int64) (int64, bool, error) {
+	notifications, err := json.Marshal([]apolloNotification{{NamespaceName: ap.Namespace, NotificationID: notificationID}})
+	if err != nil {
+		return 0, false, err
+	}
+	query := url.Values{}
+	query.Set("appId", ap.AppID)
+	query.Set("cluster", ap.Cluster)
+	query.Set("notifications", string(notifications))
+
+	ctx, cancel := context.WithTimeout(ctx, longPollTimeout)
+	defer cancel()
+	resp, err := ap.get(ctx, ap.client, "/notifications/v2", query)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var result []apolloNotification
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, false, fmt.Errorf("parsing apollo notifications: %v", err)
+	}
+	for _, n := range result {
+		if n.NamespaceName == ap.Namespace {
+			return n.NotificationID, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// get 向配置中心发起 GET 请求，配置了 Secret 时附加签名。
+func (ap *ApolloProvider) get(ctx context.Context, client *http.Client, path string, query url.Values) (*http.Response, error) {
+	pathWithQuery := path
+	if len(query) > 0 {
+		pathWithQuery += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(ap.ConfigServer, "/")+pathWithQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ap.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		req.Header.Set("Authorization", "Apollo "+ap.AppID+":"+sign(ap.Secret, timestamp, pathWithQuery))
+		req.Header.Set("Timestamp", timestamp)
+	}
+	return client.Do(req)
+}
+
+// sign 计算 Apollo 访问密钥的签名：对 "timestamp\npathWithQuery" 做 HMAC-SHA1 后进行 Base64 编码。
+func sign(secret, timestamp, pathWithQuery string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + pathWithQuery))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseEndpoints 解析 key 的值：以 "[" 开头时按 JSON 字符串数组解析，否则按逗号或换行分隔。
+// 无法解析的 JSON 被视为空列表。
+func parseEndpoints(value string) []string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		var dials []string
+		if err := json.Unmarshal([]byte(value), &dials); err != nil {
+			return nil
+		}
+		return dials
+	}
+
+	var dials []string
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if field = strings.TrimSpace(field); field != "" {
+			dials = append(dials, field)
+		}
+	}
+	return dials
+}
+
+// ValidateConnectivity 读取一次配置，不启动后台长轮询。
+func (ap *ApolloProvider) ValidateConnectivity(ctx context.Context) error {
+	_, err := ap.fetchConfig(ctx, &http.Client{}, "")
+	return err
+}
+
+// RegistryAddresses 返回 Apollo 配置服务的地址。
+func (ap *ApolloProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(ap.ConfigServer, "8080")
+}
+
+// MarshalConfig 返回用于管理接口的配置，Secret 被替换。
+func (ap *ApolloProvider) MarshalConfig() any {
+	return discovery.RedactConfig(ap, "secret")
+}
+
+// Validate 检查必要的配置是否已提供。
+func (ap *ApolloProvider) Validate() error {
+	if ap.ConfigServer == "" {
+		return fmt.Errorf("apollo provider: config_server is required")
+	}
+	if u, err := url.Parse(ap.ConfigServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("apollo provider: config_server must be an http or https URL")
+	}
+	if ap.AppID == "" {
+		return fmt.Errorf("apollo provider: app_id is required")
+	}
+	if ap.Cluster == "" || ap.Namespace == "" {
+		return fmt.Errorf("apollo provider: cluster and namespace must not be empty")
+	}
+	if ap.Key == "" {
+		return fmt.Errorf("apollo provider: key is required")
+	}
+	if err := ap.Store.Validate(); err != nil {
+		return fmt.Errorf("apollo provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine。
+func (ap *ApolloProvider) Cleanup() error {
+	ap.logger.Info("cleaning up apollo provider", zap.String("target", ap.target()))
+	if ap.cancelFunc != nil {
+		ap.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (ap *ApolloProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := ap.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available in apollo: %s", ap.target())
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 apollo 提供者特有的 Caddyfile 配置块。
+func (ap *ApolloProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "config_server":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.ConfigServer = d.Val()
+		case "app_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.AppID = d.Val()
+		case "cluster":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.Cluster = d.Val()
+		case "namespace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.Namespace = d.Val()
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.Key = d.Val()
+		case "secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ap.Secret = d.Val()
+		default:
+			ok, err := ap.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized apollo subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeApollo 是一个 Apollo 配置服务：/configs 返回当前的配置，releaseKey 与当前一致时返回 304；
+// /notifications/v2 在请求的通知 ID 与当前一致时挂起，直到有新的发布或请求被取消。requireAuth 时拒绝没有签名的请求。
+type fakeApollo struct {
+	mu             sync.Mutex
+	value          string
+	release        int
+	notificationID int64
+	published      chan struct{}
+	releaseKeys    []string
+	requireAuth    bool
+}
+
+func newFakeApollo(t *testing.T, value string) (*fakeApollo, *httptest.Server) {
+	t.Helper()
+	f := &fakeApollo{value: value, release: 1, notificationID: 100, published: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// publish 发布 key 的新值并唤醒挂起的长轮询。
+func (f *fakeApollo) publish(value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.value = value
+	f.release++
+	f.notificationID++
+	close(f.published)
+	f.published = make(chan struct{})
+}
+
+// fetches 返回每次读取配置时带的 releaseKey。
+func (f *fakeApollo) fetches() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.releaseKeys...)
+}
+
+func (f *fakeApollo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	if r.Header.Get("Authorization") == "" && f.requireAuth {
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/configs/app/default/application":
+		releaseKey := "release-" + strconv.Itoa(f.release)
+		f.releaseKeys = append(f.releaseKeys, r.URL.Query().Get("releaseKey"))
+		value := f.value
+		f.mu.Unlock()
+		if r.URL.Query().Get("releaseKey") == releaseKey {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(apolloConfig{Configurations: map[string]string{"upstreams": value}, ReleaseKey: releaseKey})
+	case "/notifications/v2":
+		var notifications []apolloNotification
+		json.Unmarshal([]byte(r.URL.Query().Get("notifications")), &notifications)
+		for len(notifications) == 1 && notifications[0].NotificationID == f.notificationID {
+			published := f.published
+			f.mu.Unlock()
+			select {
+			case <-published:
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+		}
+		id := f.notificationID
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode([]apolloNotification{{NamespaceName: "application", NotificationID: id}})
+	default:
+		f.mu.Unlock()
+		http.NotFound(w, r)
+	}
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(ap *ApolloProvider) string {
+	var dials []string
+	for _, up := range ap.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+// provision 返回一个连接 srv 的 provider，测试结束时 Cleanup。
+func provision(t *testing.T, srv *httptest.Server, configure func(*ApolloProvider)) *ApolloProvider {
+	t.Helper()
+	ap := New()
+	ap.ConfigServer = srv.URL
+	ap.AppID = "app"
+	ap.Key = "upstreams"
+	if configure != nil {
+		configure(ap)
+	}
+	if err := ap.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ap.Cleanup() })
+	return ap
+}
+
+func TestInitialFetch(t *testing.T) {
+	_, srv := newFakeApollo(t, `["10.0.0.1:80", "invalid", "10.0.0.2:80"]`)
+	ap := provision(t, srv, nil)
+
+	// 无效的地址被跳过
+	if got := upstreamDials(ap); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %q after Provision, want the valid addresses from the key", got)
+	}
+	if ap.releaseKey != "release-1" {
+		t.Fatalf("got release key %q, want release-1", ap.releaseKey)
+	}
+}
+
+func TestNotificationTriggersRefresh(t *testing.T) {
+	f, srv := newFakeApollo(t, "10.0.0.1:80")
+	ap := provision(t, srv, nil)
+
+	f.publish("10.0.0.1:80\n10.0.0.3:80")
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(ap) != "10.0.0.1:80,10.0.0.3:80" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q after a notification, want the published list", upstreamDials(ap))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 每次读取都带上一次的 releaseKey，配置没有变化时服务端返回 304
+	fetches := f.fetches()
+	if fetches[0] != "" || fetches[len(fetches)-1] != "release-1" {
+		t.Fatalf("got release keys %q, want the first fetch without one and the refresh with release-1", fetches)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	f, srv := newFakeApollo(t, "10.0.0.1:80")
+	f.requireAuth = true
+	ap := provision(t, srv, func(ap *ApolloProvider) { ap.Secret = "secret" })
+	if got := upstreamDials(ap); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %q with a secret, want the signed fetch to succeed", got)
+	}
+
+	unsigned := New()
+	unsigned.ConfigServer = srv.URL
+	unsigned.AppID = "app"
+	unsigned.Key = "upstreams"
+	if err := unsigned.ValidateConnectivity(t.Context()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want the 401 status", err)
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`["10.0.0.1:80","10.0.0.2:80"]`, "10.0.0.1:80,10.0.0.2:80"},
+		{"10.0.0.1:80, 10.0.0.2:80\n10.0.0.3:80\n", "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80"},
+		{"[not json", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(parseEndpoints(tt.value), ","); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CleanupResult 是一个子 provider 的清理结果。
+type CleanupResult struct {
+	// Index 是子 provider 在 CleanupAll 参数中的下标。
+	Index    int
+	Duration time.Duration
+	// TimedOut 表示 Cleanup 在超时前没有返回，CleanupAll 没有等待它完成。
+	TimedOut bool
+	Err      error
+}
+
+// CleanupAll 按给定顺序清理所有子 provider，供聚合或故障转移等组合型 provider 以及主模块使用。
+// 某个子 provider 清理失败时仍会继续清理其余的子 provider，避免泄露它们的 goroutine，
+// 所有错误通过 errors.Join 合并后返回。observe 不为 nil 时，每个子 provider 清理结束后以其结果调用一次。
+//
+// timeout 大于 0 时，每个子 provider 最多等待 timeout，超时后记为错误并继续清理下一个，
+// 超时的 Cleanup 在后台继续执行，不会让配置重载一直卡住。
+func CleanupAll(timeout time.Duration, observe func(CleanupResult), children ...Provider) error {
+	var errs []error
+	for i, child := range children {
+		if child == nil {
+			continue
+		}
+		start := time.Now()
+		timedOut, err := cleanupWithTimeout(child, timeout)
+		if observe != nil {
+			observe(CleanupResult{Index: i, Duration: time.Since(start), TimedOut: timedOut, Err: err})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cleaning up provider %d (%s): %v", i, child.Service(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cleanupWithTimeout 调用 p.Cleanup，最多等待 timeout，timeout 不大于 0 时一直等待。
+func cleanupWithTimeout(p Provider, timeout time.Duration) (timedOut bool, err error) {
+	if timeout <= 0 {
+		return false, p.Cleanup()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// 超时后没有人等待这个 goroutine，panic 不能导致进程崩溃
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("cleanup panicked: %v", r)
+			}
+		}()
+		done <- p.Cleanup()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		return true, fmt.Errorf("cleanup did not finish within %v", timeout)
+	}
+}
@@ -0,0 +1,175 @@
+package providers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/providers/consul"
+)
+
+// cleanupProvider 记录 Cleanup 是否被调用，等待 delay 后返回 err。其余方法不应被调用。
+type cleanupProvider struct {
+	Provider
+	delay   time.Duration
+	err     error
+	cleaned bool
+}
+
+func (p *cleanupProvider) Cleanup() error {
+	time.Sleep(p.delay)
+	p.cleaned = true
+	return p.err
+}
+
+func (p *cleanupProvider) Service() string { return "svc" }
+
+func TestCleanupAllContinuesAfterError(t *testing.T) {
+	first := &cleanupProvider{}
+	failing := &cleanupProvider{err: errors.New("unsubscribe failed")}
+	last := &cleanupProvider{}
+
+	var order []int
+	err := CleanupAll(0, func(res CleanupResult) {
+		order = append(order, res.Index)
+	}, first, failing, last)
+
+	if !first.cleaned || !failing.cleaned || !last.cleaned {
+		t.Fatalf("cleaned = %v, %v, %v, want all", first.cleaned, failing.cleaned, last.cleaned)
+	}
+	if err == nil || !strings.Contains(err.Error(), "unsubscribe failed") {
+		t.Fatalf("got %v, want the failing child's error", err)
+	}
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Fatalf("got cleanup order %v, want [0 1 2]", order)
+	}
+}
+
+func TestCleanupAllJoinsErrors(t *testing.T) {
+	a := &cleanupProvider{err: errors.New("a failed")}
+	b := &cleanupProvider{err: errors.New("b failed")}
+
+	err := CleanupAll(0, nil, a, nil, b)
+	if err == nil || !strings.Contains(err.Error(), "a failed") || !strings.Contains(err.Error(), "b failed") {
+		t.Fatalf("got %v, want both errors", err)
+	}
+}
+
+func TestCleanupAllMeasuresSlowCleanup(t *testing.T) {
+	slow := &cleanupProvider{delay: 50 * time.Millisecond}
+
+	var res CleanupResult
+	if err := CleanupAll(time.Second, func(r CleanupResult) { res = r }, slow); err != nil {
+		t.Fatal(err)
+	}
+	if res.Duration < slow.delay {
+		t.Fatalf("got duration %v, want at least %v", res.Duration, slow.delay)
+	}
+	if res.TimedOut {
+		t.Fatal("cleanup finishing within the timeout reported as timed out")
+	}
+}
+
+func TestCleanupAllTimesOut(t *testing.T) {
+	stuck := &cleanupProvider{delay: time.Second}
+	next := &cleanupProvider{}
+
+	var results []CleanupResult
+	start := time.Now()
+	err := CleanupAll(20*time.Millisecond, func(r CleanupResult) { results = append(results, r) }, stuck, next)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("CleanupAll waited %v for a stuck cleanup", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Fatalf("got %v, want a timeout error", err)
+	}
+	if len(results) != 2 || !results[0].TimedOut || results[1].TimedOut {
+		t.Fatalf("got %+v, want only the first cleanup timed out", results)
+	}
+	if !next.cleaned {
+		t.Fatal("provider after a timed out cleanup was not cleaned up")
+	}
+}
+
+// connCounter 记录 httptest 服务器上打开过和仍然打开的连接数。
+type connCounter struct {
+	mu     sync.Mutex
+	opened int
+	open   map[net.Conn]struct{}
+}
+
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		c.opened++
+		c.open[conn] = struct{}{}
+	case http.StateClosed, http.StateHijacked:
+		delete(c.open, conn)
+	}
+}
+
+func (c *connCounter) counts() (opened, open int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened, len(c.open)
+}
+
+func TestConsulProvidersShareClient(t *testing.T) {
+	conns := &connCounter{open: make(map[net.Conn]struct{})}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	srv.Config.ConnState = conns.track
+	srv.Start()
+	defer srv.Close()
+
+	// 服务名不同，不共享 watch，但连接同一个 Consul，应当共享一个客户端
+	var users []*consul.ConsulProvider
+	for _, service := range []string{"shared-client-a", "shared-client-b"} {
+		cp := consul.New()
+		cp.Address = srv.URL
+		cp.ServiceName = service
+		if err := cp.Provision(zap.NewNop()); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, cp)
+	}
+	// 共享的客户端复用同一个 keep-alive 连接
+	if opened, _ := conns.counts(); opened != 1 {
+		t.Fatalf("got %d connections for two providers, want one shared client", opened)
+	}
+
+	if err := users[0].Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, open := conns.counts(); open != 1 {
+		t.Fatal("shared client released while another provider still uses it")
+	}
+
+	if err := users[1].Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, open := conns.counts()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d open connections after the last Cleanup, want the client released", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,10 +2,17 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,143 +20,952 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	consulApi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
 	"go.uber.org/zap"
 )
 
+const (
+	// onEmptyError 在没有健康实例时清空上游，请求将返回错误。
+	onEmptyError = "error"
+	// onEmptyServeAll 在没有健康实例时退而使用所有实例，包括健康检查未通过的实例。
+	onEmptyServeAll = "serve_all"
+	// onEmptyKeepLast 在没有健康实例时保留上一次的上游列表。
+	onEmptyKeepLast = "keep_last"
+)
+
+const (
+	// consistencyDefault、consistencyStale 和 consistencyConsistent 是 Consistency 的取值，见 Consistency。
+	consistencyDefault    = "default"
+	consistencyStale      = "stale"
+	consistencyConsistent = "consistent"
+)
+
 // ConsulProvider 实现了 providers.Provider 接口，
 // 用于从 Consul 动态获取上游服务实例。
 type ConsulProvider struct {
 	// --- 配置字段 ---
-	Address      string        `json:"address,omitempty"`
-	ServiceName  string        `json:"service_name,omitempty"`
-	Tags         []string      `json:"tags,omitempty"`
-	PassingOnly  bool          `json:"passing_only,omitempty"`
+	Address     string   `json:"address,omitempty"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+
+	// ServicePrefix 用于发现所有名称以该前缀开头的服务并合并其实例，与 ServiceName 互斥。
+	ServicePrefix string `json:"service_prefix,omitempty"`
+	// MaxServices 是 ServicePrefix 模式下最多合并的服务数量，防止前缀匹配到过多服务。
+	MaxServices int `json:"max_services,omitempty"`
+
+	// AddressTag 指定使用 Service.TaggedAddresses 中的哪个地址（如 "wan"、"lan_ipv6"），
+	// 实例没有该标签地址时回退到 Service.Address。
+	AddressTag string `json:"address_tag,omitempty"`
+
+	// Datacenter 指定查询的 Consul 数据中心，为空时使用 agent 所在的数据中心。
+	Datacenter string `json:"datacenter,omitempty"`
+
+	// Consistency 是查询的一致性模式：
+	//   - "default"（或为空）：由 leader 响应，但 leader 在极少数情况下（例如网络分区）可能返回过时的数据。
+	//   - "stale"：任何 server 都可以响应（AllowStale），减轻 leader 的负载、在没有 leader 时仍然可用，
+	//     代价是结果可能落后于 leader，通常不超过几十毫秒，间隔由 Consul 的 raft 复制决定。
+	//   - "consistent"：leader 在响应前与多数派确认自己仍是 leader（RequireConsistent），保证读到最新的数据，
+	//     每次查询多一次往返，且不能与 use_watch_plan 同时使用。
+	Consistency string `json:"consistency,omitempty"`
+
+	// Namespaces 和 Partitions 是要查询的命名空间和分区（Consul Enterprise），为空时使用 agent 的默认值。
+	// 每个组合都单独查询服务并合并结果，组合的数量不能超过 maxScopes；不能与 mesh_gateway 或 KV 模式同时使用。
+	Namespaces []string `json:"namespaces,omitempty"`
+	Partitions []string `json:"partitions,omitempty"`
+
+	// MeshGateway 是本地 mesh gateway 的服务名。设置后上游为本地的 gateway 实例，
+	// 请求经由 gateway 转发到 Datacenter 中的 ServiceName，要求 Consul 1.8 及以上版本。
+	// 限制：gateway 只转发 Connect mTLS 流量，需要配套的 transport 使用 Consul 签发的证书
+	// 并以实例的 SNI 发起 TLS 连接；只支持 default 命名空间，且不能与 service_prefix 同时使用。
+	MeshGateway string `json:"mesh_gateway,omitempty"`
+
+	// KVKey 是保存上游列表的 KV 键，设置后不再查询服务目录，而是通过阻塞查询监听该键。
+	// 值是 JSON 字符串数组或每行一个 "host:port"，键被删除时视为空列表。与 ServiceName 等互斥。
+	KVKey string `json:"kv_key,omitempty"`
+	// KVPrefix 与 KVKey 类似，但监听该前缀下的所有键并合并它们的值。
+	KVPrefix string `json:"kv_prefix,omitempty"`
+
+	// ProxyURL 是访问 Consul 时使用的代理地址，支持 http、https 和 socks5 协议。
+	ProxyURL string `json:"proxy_url,omitempty"`
+
+	// Filter 是传给 Consul 健康检查查询的过滤表达式，例如 `Service.Meta.version == "2"`，
+	// 由 Consul 在服务端完成过滤，需要 Consul 1.5 及以上版本。
+	Filter string `json:"filter,omitempty"`
+
+	// OnEmpty 决定 passing_only 下没有任何健康实例时的行为：
+	// "error"（默认，清空上游）、"serve_all"（退而使用所有实例）或 "keep_last"（保留上一次的列表）。
+	OnEmpty string `json:"on_empty,omitempty"`
+
+	// PortFromCheck 是一个健康检查的名称或 ID。设置后从该检查的 HTTP/TCP/gRPC 目标中解析流量端口，
+	// 用于检查端口与注册的服务端口不一致的场景，解析失败时回退到服务端口。
+	PortFromCheck string `json:"port_from_check,omitempty"`
+
+	// WeightMetadataKey 指定从 Service.Meta 的哪个 key 中读取实例权重（如 "weight"），设置后优先于 Consul 原生的 Weights。
+	// key 不存在时回退到 Weights.Passing，值不是正数时记录警告并按权重 1 处理。
+	WeightMetadataKey string `json:"weight_metadata_key,omitempty"`
+
+	// PassingOnly 默认为 true，JSON 中不使用 omitempty，否则 false 在 caddy adapt 之后会被丢弃并恢复为默认值。
+	PassingOnly  bool          `json:"passing_only"`
 	PollInterval time.Duration `json:"poll_interval,omitempty"`
 
+	// PollJitter 为 true 时，后台轮询在启动后先等待一个 [0, PollInterval) 内的随机时间再开始，
+	// 避免同时启动的大量 Caddy 节点按相同的节奏轮询 Consul，造成周期性的负载尖峰。
+	PollJitter bool `json:"poll_jitter,omitempty"`
+
+	// InitialFetchTimeout 是 Provision 等待第一次查询得到上游的最长时间。第一次查询失败或没有实例时，
+	// 在该时间内按退避间隔重试，使路由开始时更有可能已经有可用的上游；0（默认）表示不等待，交给后台轮询。
+	InitialFetchTimeout time.Duration `json:"initial_fetch_timeout,omitempty"`
+
+	// IncludeWarning 为 true 时，passing_only 也接受健康检查汇总状态为 warning 的实例，
+	// 只排除 critical 和处于维护模式的实例。
+	IncludeWarning bool `json:"include_warning,omitempty"`
+
+	// IncludeMaintenance 为 true 时，passing_only 忽略维护模式的检查（_node_maintenance、_service_maintenance:<id>），
+	// 处于维护模式但其余检查通过的实例仍然被使用。无论是否开启，实例进入和离开维护模式都会单独记录日志。
+	IncludeMaintenance bool `json:"include_maintenance,omitempty"`
+
+	// MinPassingChecks 大于 0 时，passing_only 不再看健康检查的汇总状态，而是要求实例至少有这么多个检查为 passing
+	// （include_warning 时 warning 也计入），用于注册了多个检查、只要部分通过即可服务的实例。
+	// 节点级的检查（如 serfHealth）也计入，维护模式的检查不计入。
+	MinPassingChecks int `json:"min_passing_checks,omitempty"`
+
+	// UseWatchPlan 为 true 时不再定期轮询，而是运行 Consul 官方的 watch plan（api/watch 包）监听 ServiceName，
+	// 由它管理阻塞查询的索引、失败退避和重连，服务变化时立即更新上游。watch plan 不与其他 provider 共享，
+	// 只支持 service_name，不能与 mesh_gateway、namespace、partition 或 KV 模式同时使用，poll_interval 不再生效。
+	UseWatchPlan bool `json:"use_watch_plan,omitempty"`
+
+	// TagHealth 按实例的标签覆盖 passing_only 和 include_warning，实例带有的第一个（按配置顺序）匹配的标签生效，
+	// 例如 canary 实例不要求健康检查通过，其余实例仍然要求通过。不能与 mesh_gateway 或 KV 模式同时使用。
+	TagHealth []TagHealth `json:"tag_health,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
 	// --- 内部状态 ---
 	client    *consulApi.Client
+	clientKey string
 	logger    *zap.Logger
-	upstreams []*reverseproxy.Upstream
-	mu        sync.RWMutex
-	stopChan  chan struct{}
+	watch     *sharedWatch
+	watchKey  string
+	kvCancel  context.CancelFunc
+	// plan 是 UseWatchPlan 时运行的 watch plan，planTransport 是它专用客户端的 transport。
+	plan          *watch.Plan
+	planTransport *http.Transport
+	// maintenance 是上一次查询中处于维护模式的实例 ID，用于在变化时记录日志。
+	maintenance map[string]struct{}
+	maintMu     sync.Mutex
+	// ctx 是主模块通过 SetContext 注入的配置生命周期 context，为 nil 时使用 context.Background()。
+	ctx context.Context
 }
 
+const (
+	// initialRetryDelay 和 maxInitialRetryDelay 是 InitialFetchTimeout 内重试第一次查询的等待时间范围。
+	initialRetryDelay    = 200 * time.Millisecond
+	maxInitialRetryDelay = 2 * time.Second
+)
+
 // New 是一个构造函数，返回一个 ConsulProvider 的新实例。
 func New() *ConsulProvider {
 	return &ConsulProvider{
 		// 设置合理的默认值
 		PassingOnly:  true,
 		PollInterval: 10 * time.Second, // 默认每 10 秒轮询一次
+		MaxServices:  32,
+		OnEmpty:      onEmptyError,
 	}
 }
 
 // Provision 初始化 Consul 客户端并启动后台轮询 goroutine。
 func (cp *ConsulProvider) Provision(logger *zap.Logger) error {
-	cp.logger = logger
+	cp.logger = cp.Store.Setup(logger, cp.target())
 	cp.logger.Info("provisioning consul service discovery provider",
-		zap.String("service", cp.ServiceName),
+		zap.String("service", cp.target()),
 		zap.String("address", cp.Address),
 	)
-	cp.stopChan = make(chan struct{})
 
-	// 创建 Consul 客户端
-	config := consulApi.DefaultConfig()
-	if cp.Address != "" {
-		config.Address = cp.Address
+	// 获取 Consul 客户端，连接同一个 Consul 的 provider 共享一个客户端
+	if cp.ProxyURL != "" {
+		if _, err := parseProxyURL(cp.ProxyURL); err != nil {
+			return err
+		}
 	}
-	var err error
-	cp.client, err = consulApi.NewClient(config)
+	cp.clientKey = cp.Address + "|" + cp.ProxyURL
+	val, _, err := clientPool.LoadOrNew(cp.clientKey, cp.newSharedClient)
 	if err != nil {
-		return fmt.Errorf("creating consul client: %v", err)
+		return err
 	}
+	cp.client = val.(*sharedClient).Client
 
-	// 立即执行一次服务获取，以确保在 Caddy 启动时就有上游可用
-	if err := cp.updateUpstreams(); err != nil {
-		cp.logger.Error("initial fetch from consul failed", zap.Error(err))
-		// 我们不在这里返回错误，因为网络可能是暂时问题，后台轮询可能会恢复
+	if cp.kvMode() {
+		return cp.provisionKV()
+	}
+	if cp.UseWatchPlan {
+		return cp.provisionWatchPlan()
 	}
 
-	// 启动后台 goroutine 定期更新服务列表
-	go cp.watchServiceChanges()
+	// 查询条件完全相同的 provider 共享一个后台轮询，避免对 Consul 重复查询。
+	// 订阅时会立即得到一次结果，以确保在 Caddy 启动时就有上游可用
+	cp.watchKey = cp.subscriptionKey()
+	val, _, err = watchPool.LoadOrNew(cp.watchKey, func() (caddy.Destructor, error) {
+		return newSharedWatch(cp, cp.watchKey), nil
+	})
+	if err != nil {
+		return err
+	}
+	cp.watch = val.(*sharedWatch)
+	cp.watch.subscribe(cp)
 
+	cp.awaitInitialFetch(func() {
+		cp.watch.refreshes.Do("", func() (any, error) {
+			cp.watch.refresh()
+			return nil, nil
+		})
+	})
 	return nil
 }
 
-// updateUpstreams 从 Consul 获取服务实例并更新内部列表。
-func (cp *ConsulProvider) updateUpstreams() error {
-	serviceEntries, _, err := cp.client.Health().Service(cp.ServiceName, "", cp.PassingOnly, nil)
+// SetContext 实现 providers.ContextUser。
+func (cp *ConsulProvider) SetContext(ctx context.Context) {
+	cp.ctx = ctx
+}
+
+// awaitInitialFetch 在第一次查询没有得到上游时，在 InitialFetchTimeout 内以指数退避调用 fetch 重试，
+// 直到得到上游、超时或配置被卸载。超时后不返回错误，后台轮询会继续尝试。
+func (cp *ConsulProvider) awaitInitialFetch(fetch func()) {
+	if cp.InitialFetchTimeout <= 0 || len(cp.Store.Instances()) > 0 {
+		return
+	}
+	parent := cp.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, cp.InitialFetchTimeout)
+	defer cancel()
+
+	delay := initialRetryDelay
+	for len(cp.Store.Instances()) == 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			cp.logger.Warn("no upstreams from consul within initial_fetch_timeout, continuing in background",
+				zap.String("service", cp.target()),
+				zap.Duration("initial_fetch_timeout", cp.InitialFetchTimeout),
+			)
+			return
+		}
+		fetch()
+		delay = min(delay*2, maxInitialRetryDelay)
+	}
+}
+
+// clientPool 按 Consul 地址和代理配置共享客户端，最后一个使用者 Cleanup 时才释放。
+var clientPool = caddy.NewUsagePool()
+
+// sharedClient 是 clientPool 中保存的客户端。
+type sharedClient struct {
+	*consulApi.Client
+	transport *http.Transport
+}
+
+// Destruct 在最后一个使用者释放客户端时关闭空闲连接。
+func (c *sharedClient) Destruct() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// newSharedClient 按当前配置创建一个新的 Consul 客户端。
+func (cp *ConsulProvider) newSharedClient() (caddy.Destructor, error) {
+	config, err := cp.clientConfig()
 	if err != nil {
-		return fmt.Errorf("querying consul for service '%s': %v", cp.ServiceName, err)
+		return nil, err
 	}
+	client, err := consulApi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating consul client: %v", err)
+	}
+	return &sharedClient{Client: client, transport: config.Transport}, nil
+}
 
-	var newUpstreams []*reverseproxy.Upstream
-	for _, entry := range serviceEntries {
-		// 地址优先使用 Service.Address，如果为空则回退到 Node.Address
-		addr := entry.Service.Address
-		if addr == "" {
-			addr = entry.Node.Address
+// clientConfig 按 Address 和 ProxyURL 返回 Consul 客户端的配置。
+func (cp *ConsulProvider) clientConfig() (*consulApi.Config, error) {
+	config := consulApi.DefaultConfig()
+	if cp.Address != "" {
+		config.Address = cp.Address
+	}
+	if cp.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(cp.ProxyURL)
+		if err != nil {
+			return nil, err
 		}
+		config.Transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return config, nil
+}
 
-		newUpstreams = append(newUpstreams, &reverseproxy.Upstream{
-			Dial: net.JoinHostPort(addr, strconv.Itoa(entry.Service.Port)),
-		})
+// fetch 从 Consul 查询当前的服务实例。keep 为 true 表示按 on_empty keep_last 保留之前的列表。
+// 共享同一个 watch 的 provider 配置相同，因此 fetch 的结果对它们都适用。
+func (cp *ConsulProvider) fetch() (instances []*discovery.Instance, keep bool, err error) {
+	services, err := cp.serviceNames()
+	if err != nil {
+		return nil, false, err
 	}
 
-	cp.mu.Lock()
-	cp.upstreams = newUpstreams
-	cp.mu.Unlock()
+	if cp.MeshGateway != "" {
+		instances, err = cp.gatewayInstances(services[0].name)
+		return instances, false, err
+	}
+	if instances, err = cp.serviceInstances(services, true); err != nil {
+		return nil, false, err
+	}
+	return cp.applyOnEmpty(instances, func() ([]*discovery.Instance, error) {
+		return cp.serviceInstances(services, false)
+	})
+}
+
+// applyOnEmpty 在 passing_only 下没有任何健康实例时按 OnEmpty 处理：keep 为 true 表示保留之前的列表，
+// serve_all 时通过 all 取得不按健康检查过滤的实例。
+func (cp *ConsulProvider) applyOnEmpty(instances []*discovery.Instance, all func() ([]*discovery.Instance, error)) (_ []*discovery.Instance, keep bool, err error) {
+	if len(instances) > 0 || !cp.PassingOnly {
+		return instances, false, nil
+	}
+	switch cp.OnEmpty {
+	case onEmptyKeepLast:
+		cp.logger.Warn("no passing instances in consul, keeping previous upstreams",
+			zap.String("service", cp.target()),
+		)
+		return nil, true, nil
+	case onEmptyServeAll:
+		cp.logger.Warn("no passing instances in consul, serving all instances as a last resort",
+			zap.String("service", cp.target()),
+		)
+		if instances, err = all(); err != nil {
+			return nil, false, err
+		}
+	}
+	return instances, false, nil
+}
+
+// updateUpstreams 将一次查询的结果写入内部列表。fetchErr 不为 nil 时只记录失败。
+func (cp *ConsulProvider) updateUpstreams(instances []*discovery.Instance, keep bool, fetchErr error) (err error) {
+	defer metrics.ObserveRefresh("consul", cp.target(), time.Now())
+	endSpan := tracing.StartRefresh("consul", cp.target())
+	defer func() {
+		count := len(cp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("consul", cp.target(), count, err)
+	}()
+
+	if fetchErr != nil || keep {
+		return fetchErr
+	}
+	// 阻塞查询超时或其他服务变化时 Consul 常常返回相同的实例，此时跳过整个更新流程
+	if cp.Store.Unchanged(instances) {
+		return nil
+	}
+	if !cp.Store.Update(instances) {
+		return nil
+	}
 
 	cp.logger.Debug("updated upstreams from consul",
-		zap.String("service", cp.ServiceName),
-		zap.Int("count", len(newUpstreams)),
+		zap.String("service", cp.target()),
+		zap.Int("count", len(instances)),
 	)
 	return nil
 }
 
-// watchServiceChanges 是一个在后台运行的循环，定期从 Consul 拉取更新。
-func (cp *ConsulProvider) watchServiceChanges() {
-	ticker := time.NewTicker(cp.PollInterval)
-	defer ticker.Stop()
+// serviceInstances 查询所有服务的实例，filter 的含义见 entryCollector。
+// 配置了多个命名空间或分区时，不同范围中地址相同的实例只保留第一个。
+func (cp *ConsulProvider) serviceInstances(services []serviceTarget, filter bool) ([]*discovery.Instance, error) {
+	c := cp.newEntryCollector(filter)
+	for _, target := range services {
+		entries, _, err := cp.client.Health().Service(target.name, "", false, target.scope.apply(cp.serviceQueryOptions()))
+		if err != nil {
+			if target.scope != (consulScope{}) {
+				return nil, fmt.Errorf("querying consul for service '%s' in '%s': %v", target.name, target.scope, err)
+			}
+			return nil, fmt.Errorf("querying consul for service '%s': %v", target.name, err)
+		}
+		c.add(target, entries)
+	}
+	return c.finish(), nil
+}
+
+// entryCollector 把一次刷新中查询到的服务条目转换并合并为实例列表。filter 为 true 时按每个实例的 passing_only
+// （见 healthPolicy）只保留健康检查通过的实例，为 false 时（on_empty serve_all）保留所有实例。
+// Consul 返回所有实例，再按各检查的汇总状态过滤，以便区分处于维护模式的实例和普通的不健康实例。
+type entryCollector struct {
+	cp          *ConsulProvider
+	filter      bool
+	instances   []*discovery.Instance
+	seen        map[string]struct{}
+	maintenance map[string]struct{}
+	unhealthy   int
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			if err := cp.updateUpstreams(); err != nil {
-				cp.logger.Error("failed to update upstreams from consul", zap.Error(err))
+func (cp *ConsulProvider) newEntryCollector(filter bool) *entryCollector {
+	return &entryCollector{
+		cp:          cp,
+		filter:      filter,
+		seen:        make(map[string]struct{}),
+		maintenance: make(map[string]struct{}),
+	}
+}
+
+// add 过滤并转换 target 的服务条目，地址与已有实例重复的条目被忽略。
+func (c *entryCollector) add(target serviceTarget, entries []*consulApi.ServiceEntry) {
+	cp := c.cp
+	for _, entry := range entries {
+		passingOnly, includeWarning := cp.healthPolicy(entry.Service.Tags)
+		if c.filter && passingOnly {
+			inMaintenance, checks := splitMaintenance(entry.Checks)
+			if inMaintenance {
+				id := entry.Service.ID
+				if target.scope != (consulScope{}) {
+					id = target.scope.String() + "/" + id
+				}
+				c.maintenance[id] = struct{}{}
+				if !cp.IncludeMaintenance {
+					continue
+				}
 			}
-		case <-cp.stopChan:
-			cp.logger.Info("stopping consul service watcher", zap.String("service", cp.ServiceName))
-			return
+			if !cp.acceptChecks(checks, includeWarning) {
+				c.unhealthy++
+				continue
+			}
+		}
+		in := cp.entryInstance(entry)
+		if in == nil {
+			continue
+		}
+		if _, ok := c.seen[in.Upstream.Dial]; ok {
+			continue
+		}
+		c.seen[in.Upstream.Dial] = struct{}{}
+		c.instances = append(c.instances, in)
+	}
+}
+
+// finish 记录维护模式和不健康实例的日志，并返回合并后的实例列表。
+func (c *entryCollector) finish() []*discovery.Instance {
+	cp := c.cp
+	if c.filter {
+		cp.logMaintenance(c.maintenance)
+		if c.unhealthy > 0 {
+			cp.logger.Debug("excluded unhealthy consul instances",
+				zap.String("service", cp.target()),
+				zap.Int("count", c.unhealthy),
+			)
+		}
+	}
+	return c.instances
+}
+
+// acceptChecks 报告 passing_only 时是否接受健康检查为 checks 的实例：
+// 配置了 MinPassingChecks 时按通过的检查数量判断，否则按汇总状态判断。includeWarning 为 true 时 warning 也视为通过。
+func (cp *ConsulProvider) acceptChecks(checks consulApi.HealthChecks, includeWarning bool) bool {
+	if cp.MinPassingChecks <= 0 {
+		return acceptStatus(checks.AggregatedStatus(), includeWarning)
+	}
+	passing := 0
+	for _, check := range checks {
+		if acceptStatus(check.Status, includeWarning) {
+			passing++
+		}
+	}
+	return passing >= cp.MinPassingChecks
+}
+
+// acceptStatus 报告 passing_only 时是否接受健康检查汇总状态为 status 的实例。
+func acceptStatus(status string, includeWarning bool) bool {
+	switch status {
+	case consulApi.HealthPassing:
+		return true
+	case consulApi.HealthWarning:
+		return includeWarning
+	}
+	return false
+}
+
+// splitMaintenance 报告检查中是否有节点或服务的维护模式检查，并返回其余的检查。
+func splitMaintenance(checks consulApi.HealthChecks) (bool, consulApi.HealthChecks) {
+	inMaintenance := false
+	rest := make(consulApi.HealthChecks, 0, len(checks))
+	for _, check := range checks {
+		if check.CheckID == consulApi.NodeMaint || strings.HasPrefix(check.CheckID, consulApi.ServiceMaintPrefix) {
+			inMaintenance = true
+			continue
+		}
+		rest = append(rest, check)
+	}
+	return inMaintenance, rest
+}
+
+// logMaintenance 在处于维护模式的实例集合变化时记录日志，与普通的不健康实例分开，便于区分计划内的下线。
+func (cp *ConsulProvider) logMaintenance(current map[string]struct{}) {
+	cp.maintMu.Lock()
+	defer cp.maintMu.Unlock()
+
+	var entered, left []string
+	for id := range current {
+		if _, ok := cp.maintenance[id]; !ok {
+			entered = append(entered, id)
+		}
+	}
+	for id := range cp.maintenance {
+		if _, ok := current[id]; !ok {
+			left = append(left, id)
+		}
+	}
+	cp.maintenance = current
+	if len(entered) > 0 {
+		sort.Strings(entered)
+		cp.logger.Info("consul instances entered maintenance mode",
+			zap.String("service", cp.target()),
+			zap.Strings("instances", entered),
+			zap.Bool("serving", cp.IncludeMaintenance),
+		)
+	}
+	if len(left) > 0 {
+		sort.Strings(left)
+		cp.logger.Info("consul instances left maintenance mode",
+			zap.String("service", cp.target()),
+			zap.Strings("instances", left),
+		)
+	}
+}
+
+// entryInstance 将一个 Consul 服务条目转换为实例，地址非法时返回 nil。
+func (cp *ConsulProvider) entryInstance(entry *consulApi.ServiceEntry) *discovery.Instance {
+	// 地址优先使用 Service.Address，如果为空则回退到 Node.Address
+	addr, port := entry.Service.Address, entry.Service.Port
+	if addr == "" {
+		addr = entry.Node.Address
+	}
+	if tagged, ok := entry.Service.TaggedAddresses[cp.AddressTag]; ok && cp.AddressTag != "" && tagged.Address != "" {
+		addr = tagged.Address
+		if tagged.Port != 0 {
+			port = tagged.Port
+		}
+	}
+	if cp.PortFromCheck != "" {
+		if checkPort, ok := portFromChecks(entry.Checks, cp.PortFromCheck); ok {
+			port = checkPort
+		}
+	}
+
+	host, err := normalizeHost(addr)
+	if err != nil {
+		cp.logger.Warn("skipping consul instance with invalid address",
+			zap.String("service", entry.Service.Service),
+			zap.String("address", addr),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	in := discovery.NewInstance(
+		net.JoinHostPort(host, strconv.Itoa(port)),
+		entry.Service.Meta,
+		cp.entryWeight(entry),
+	)
+	in.ID = entry.Service.ID
+	in.Tags = append([]string(nil), entry.Service.Tags...)
+	return in
+}
+
+// entryWeight 返回实例的权重，配置了 WeightMetadataKey 且 Meta 中有该 key 时优先使用它。
+func (cp *ConsulProvider) entryWeight(entry *consulApi.ServiceEntry) float64 {
+	if cp.WeightMetadataKey != "" {
+		if value, ok := entry.Service.Meta[cp.WeightMetadataKey]; ok {
+			weight, err := strconv.ParseFloat(value, 64)
+			if err != nil || weight <= 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+				cp.logger.Warn("invalid weight in consul service meta, using weight 1",
+					zap.String("service", entry.Service.Service),
+					zap.String("id", entry.Service.ID),
+					zap.String("key", cp.WeightMetadataKey),
+					zap.String("value", value),
+				)
+				return 1
+			}
+			return weight
+		}
+	}
+	return float64(entry.Service.Weights.Passing)
+}
+
+// portFromChecks 在实例的健康检查中查找名称或 ID 为 name 的检查，
+// 并从其 HTTP、TCP 或 gRPC 检查目标中解析端口。
+func portFromChecks(checks consulApi.HealthChecks, name string) (int, bool) {
+	for _, check := range checks {
+		if check.Name != name && check.CheckID != name {
+			continue
+		}
+		def := check.Definition
+		var hostPort string
+		switch {
+		case def.HTTP != "":
+			u, err := url.Parse(def.HTTP)
+			if err != nil {
+				return 0, false
+			}
+			hostPort = u.Host
+		case def.TCP != "":
+			hostPort = def.TCP
+		case def.GRPC != "":
+			// gRPC 检查的目标形如 "host:port/service"
+			hostPort, _, _ = strings.Cut(def.GRPC, "/")
+		}
+		_, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return 0, false
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 {
+			return 0, false
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+// queryOptions 返回查询 Consul 时使用的选项，指定了 Datacenter 时查询该数据中心，并按 Consistency 设置一致性模式。
+func (cp *ConsulProvider) queryOptions() *consulApi.QueryOptions {
+	stale, consistent := cp.Consistency == consistencyStale, cp.Consistency == consistencyConsistent
+	if cp.Datacenter == "" && !stale && !consistent {
+		return nil
+	}
+	return &consulApi.QueryOptions{Datacenter: cp.Datacenter, AllowStale: stale, RequireConsistent: consistent}
+}
+
+// serviceQueryOptions 返回查询服务实例时使用的选项，在 queryOptions 的基础上附加 Filter。
+func (cp *ConsulProvider) serviceQueryOptions() *consulApi.QueryOptions {
+	opts := cp.queryOptions()
+	if cp.Filter == "" {
+		return opts
+	}
+	if opts == nil {
+		opts = &consulApi.QueryOptions{}
+	}
+	opts.Filter = cp.Filter
+	return opts
+}
+
+// gatewayInstances 返回经由本地 mesh gateway 访问目标数据中心中 service 的实例。
+// 上游地址是本地数据中心中健康的 gateway 实例，每个实例的 SNI 被设置为 Consul 用于
+// 跨数据中心路由的名称 "<service>.default.<datacenter>.internal.<trust-domain>"。
+// 目标数据中心中没有健康实例时返回空列表。
+func (cp *ConsulProvider) gatewayInstances(service string) ([]*discovery.Instance, error) {
+	targets, _, err := cp.client.Health().Service(service, "", true, cp.serviceQueryOptions())
+	if err != nil {
+		return nil, fmt.Errorf("querying consul for service '%s' in datacenter '%s': %v", service, cp.Datacenter, err)
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	roots, _, err := cp.client.Connect().CARoots(nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading consul connect trust domain: %v", err)
+	}
+	sni := fmt.Sprintf("%s.default.%s.internal.%s", service, cp.Datacenter, roots.TrustDomain)
+
+	gateways, _, err := cp.client.Health().Service(cp.MeshGateway, "", true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("querying consul for mesh gateway '%s': %v", cp.MeshGateway, err)
+	}
+
+	var instances []*discovery.Instance
+	for _, entry := range gateways {
+		if in := cp.entryInstance(entry); in != nil {
+			in.SNI = sni
+			instances = append(instances, in)
+		}
+	}
+	return instances, nil
+}
+
+// target 返回用于日志和指标的服务标识，前缀模式下为 "<prefix>*"。
+func (cp *ConsulProvider) target() string {
+	if cp.KVPrefix != "" {
+		return "kv:" + cp.KVPrefix + "*"
+	}
+	if cp.KVKey != "" {
+		return "kv:" + cp.KVKey
+	}
+	if cp.ServicePrefix != "" {
+		return cp.ServicePrefix + "*"
+	}
+	return cp.ServiceName
+}
+
+// serviceNames 返回本次刷新需要查询的服务列表，每个命名空间和分区的组合各查询一次。
+// 前缀模式下通过 Catalog 列出每个范围中的所有服务并按名称排序，合计最多保留 MaxServices 个。
+func (cp *ConsulProvider) serviceNames() ([]serviceTarget, error) {
+	var names []serviceTarget
+	for _, scope := range cp.scopes() {
+		if cp.ServicePrefix == "" {
+			names = append(names, serviceTarget{scope: scope, name: cp.ServiceName})
+			continue
+		}
+
+		catalog, _, err := cp.client.Catalog().Services(scope.apply(cp.queryOptions()))
+		if err != nil {
+			return nil, fmt.Errorf("listing consul services with prefix '%s': %v", cp.ServicePrefix, err)
+		}
+		var matched []string
+		for name := range catalog {
+			if strings.HasPrefix(name, cp.ServicePrefix) {
+				matched = append(matched, name)
+			}
+		}
+		sort.Strings(matched)
+		for _, name := range matched {
+			names = append(names, serviceTarget{scope: scope, name: name})
+		}
+	}
+
+	// 只有前缀匹配的结果需要截断，固定服务名在每个命名空间和分区中各查询一次
+	if cp.ServicePrefix != "" && len(names) > cp.MaxServices {
+		cp.logger.Warn("too many consul services match prefix, truncating",
+			zap.String("service_prefix", cp.ServicePrefix),
+			zap.Int("matched", len(names)),
+			zap.Int("max_services", cp.MaxServices),
+		)
+		names = names[:cp.MaxServices]
+	}
+	return names, nil
+}
+
+// parseProxyURL 解析并校验代理地址，只接受 http、https 和 socks5 协议。
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy_url '%s': %v", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy_url scheme '%s': must be http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy_url '%s' has no host", raw)
+	}
+	return u, nil
+}
+
+// normalizeHost 规范化 Consul 返回的地址，使其可以安全地传给 net.JoinHostPort。
+// Consul 中注册的 IPv6 地址可能已经带有方括号（如 "[::1]"）或 zone（如 "fe80::1%eth0"），
+// 这里去掉多余的方括号并校验 IP 地址，主机名则原样返回。
+func normalizeHost(addr string) (string, error) {
+	host := strings.TrimSpace(addr)
+	if strings.HasPrefix(host, "[") || strings.HasSuffix(host, "]") {
+		if !strings.HasPrefix(host, "[") || !strings.HasSuffix(host, "]") {
+			return "", fmt.Errorf("unbalanced brackets in address '%s'", addr)
 		}
+		host = host[1 : len(host)-1]
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid IPv6 address '%s': %v", addr, err)
+		}
+	}
+	if host == "" {
+		return "", fmt.Errorf("empty address")
 	}
+	if strings.Contains(host, ":") {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid IPv6 address '%s': %v", addr, err)
+		}
+		return ip.String(), nil
+	}
+	return host, nil
+}
+
+// ValidateConnectivity 创建一个独立的 Consul 客户端并执行一次服务查询，不启动后台轮询。
+func (cp *ConsulProvider) ValidateConnectivity(ctx context.Context) error {
+	val, err := cp.newSharedClient()
+	if err != nil {
+		return err
+	}
+	client := val.(*sharedClient)
+	defer client.Destruct()
+
+	if cp.kvMode() {
+		if _, _, err := cp.queryKV(client.Client, cp.kvQueryOptions(ctx, 0)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for _, scope := range cp.scopes() {
+		if cp.ServicePrefix != "" {
+			opts := scope.apply(cp.queryOptions())
+			if opts == nil {
+				opts = &consulApi.QueryOptions{}
+			}
+			if _, _, err := client.Catalog().Services(opts.WithContext(ctx)); err != nil {
+				return fmt.Errorf("listing consul services: %v", err)
+			}
+			continue
+		}
+
+		opts := scope.apply(cp.serviceQueryOptions())
+		if opts == nil {
+			opts = &consulApi.QueryOptions{}
+		}
+		if _, _, err := client.Health().Service(cp.ServiceName, "", cp.PassingOnly, opts.WithContext(ctx)); err != nil {
+			return fmt.Errorf("querying consul for service '%s': %v", cp.ServiceName, err)
+		}
+	}
+	return nil
+}
+
+// RegistryAddresses 返回 Consul agent 的地址，配置了 proxy_url 时不直接连接 agent，返回 nil。
+func (cp *ConsulProvider) RegistryAddresses() []string {
+	if cp.ProxyURL != "" {
+		return nil
+	}
+	config, err := cp.clientConfig()
+	if err != nil {
+		return nil
+	}
+	addr := config.Address
+	if !strings.Contains(addr, "://") {
+		addr = config.Scheme + "://" + addr
+	}
+	return discovery.DialAddresses(addr, "8500")
+}
+
+// MarshalConfig 返回用于管理接口的配置，ProxyURL 中的密码被隐藏。
+func (cp *ConsulProvider) MarshalConfig() any {
+	config := discovery.RedactConfig(cp)
+	if cp.ProxyURL != "" {
+		config["proxy_url"] = discovery.RedactURL(cp.ProxyURL)
+	}
+	return config
 }
 
 // Validate 检查必要的配置是否已提供。
 func (cp *ConsulProvider) Validate() error {
-	if cp.ServiceName == "" {
-		return fmt.Errorf("consul provider: service_name is required")
+	modes := 0
+	for _, v := range []string{cp.ServiceName, cp.ServicePrefix, cp.KVKey, cp.KVPrefix} {
+		if v != "" {
+			modes++
+		}
+	}
+	if modes == 0 {
+		return fmt.Errorf("consul provider: one of service_name, service_prefix, kv_key or kv_prefix is required")
+	}
+	if modes > 1 {
+		return fmt.Errorf("consul provider: service_name, service_prefix, kv_key and kv_prefix are mutually exclusive")
+	}
+	if cp.MeshGateway != "" && cp.ServiceName == "" {
+		return fmt.Errorf("consul provider: mesh_gateway requires service_name")
+	}
+	if cp.MeshGateway != "" && cp.Datacenter == "" {
+		return fmt.Errorf("consul provider: mesh_gateway requires datacenter")
+	}
+	if len(cp.Namespaces) > 0 || len(cp.Partitions) > 0 {
+		if cp.MeshGateway != "" {
+			return fmt.Errorf("consul provider: namespace and partition cannot be used with mesh_gateway")
+		}
+		if cp.kvMode() {
+			return fmt.Errorf("consul provider: namespace and partition cannot be used with kv_key or kv_prefix")
+		}
+		if n := max(len(cp.Namespaces), 1) * max(len(cp.Partitions), 1); n > maxScopes {
+			return fmt.Errorf("consul provider: %d namespace and partition combinations exceed the limit of %d", n, maxScopes)
+		}
+	}
+	if cp.ServicePrefix != "" && cp.MaxServices <= 0 {
+		return fmt.Errorf("consul provider: max_services must be positive")
+	}
+	switch cp.OnEmpty {
+	case "", onEmptyError, onEmptyServeAll, onEmptyKeepLast:
+	default:
+		return fmt.Errorf("consul provider: on_empty must be '%s', '%s' or '%s'", onEmptyError, onEmptyServeAll, onEmptyKeepLast)
+	}
+	switch cp.Consistency {
+	case "", consistencyDefault, consistencyStale, consistencyConsistent:
+	default:
+		return fmt.Errorf("consul provider: consistency must be '%s', '%s' or '%s'", consistencyDefault, consistencyStale, consistencyConsistent)
+	}
+	if cp.ProxyURL != "" {
+		if _, err := parseProxyURL(cp.ProxyURL); err != nil {
+			return fmt.Errorf("consul provider: %v", err)
+		}
+	}
+	if err := cp.Store.ValidateInterval("poll_interval", cp.PollInterval); err != nil {
+		return fmt.Errorf("consul provider: %v", err)
+	}
+	if cp.MinPassingChecks < 0 {
+		return fmt.Errorf("consul provider: min_passing_checks must not be negative")
+	}
+	if cp.MinPassingChecks > 0 && !cp.PassingOnly {
+		return fmt.Errorf("consul provider: min_passing_checks requires passing_only")
+	}
+	if cp.InitialFetchTimeout < 0 {
+		return fmt.Errorf("consul provider: initial_fetch_timeout must not be negative")
+	}
+	if cp.UseWatchPlan {
+		if cp.ServiceName == "" || cp.kvMode() {
+			return fmt.Errorf("consul provider: use_watch_plan requires service_name")
+		}
+		if cp.MeshGateway != "" || len(cp.Namespaces) > 0 || len(cp.Partitions) > 0 {
+			return fmt.Errorf("consul provider: use_watch_plan cannot be used with mesh_gateway, namespace or partition")
+		}
+		if cp.Consistency == consistencyConsistent {
+			return fmt.Errorf("consul provider: use_watch_plan does not support consistency '%s'", consistencyConsistent)
+		}
+	}
+	if len(cp.TagHealth) > 0 {
+		if cp.MeshGateway != "" || cp.kvMode() {
+			return fmt.Errorf("consul provider: tag cannot be used with mesh_gateway, kv_key or kv_prefix")
+		}
+		if err := cp.validateTagHealth(); err != nil {
+			return fmt.Errorf("consul provider: %v", err)
+		}
+	}
+	if err := cp.Store.Validate(); err != nil {
+		return fmt.Errorf("consul provider: %v", err)
 	}
 	return nil
 }
 
 // Cleanup 停止后台 goroutine 并清理资源。
 func (cp *ConsulProvider) Cleanup() error {
-	cp.logger.Info("cleaning up consul provider", zap.String("service", cp.ServiceName))
-	if cp.stopChan != nil {
-		close(cp.stopChan)
+	cp.logger.Info("cleaning up consul provider", zap.String("service", cp.target()))
+	if cp.kvCancel != nil {
+		cp.kvCancel()
 	}
-	return nil
+	if cp.plan != nil {
+		cp.plan.Stop()
+		cp.planTransport.CloseIdleConnections()
+	}
+	// watch 释放失败时仍然释放客户端，两个错误一起返回
+	var errs []error
+	if cp.watch != nil {
+		cp.watch.unsubscribe(cp)
+		if _, err := watchPool.Delete(cp.watchKey); err != nil {
+			errs = append(errs, fmt.Errorf("releasing consul watch: %v", err))
+		}
+	}
+	if cp.client != nil {
+		if _, err := clientPool.Delete(cp.clientKey); err != nil {
+			errs = append(errs, fmt.Errorf("releasing consul client: %v", err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
 func (cp *ConsulProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-
-	if len(cp.upstreams) == 0 {
-		return nil, fmt.Errorf("no healthy upstreams available for service: %s", cp.ServiceName)
+	upstreams := cp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no healthy upstreams available for service: %s", cp.target())
 	}
-	return cp.upstreams, nil
+	return upstreams, nil
 }
 
 // UnmarshalCaddyfile 解析 Consul 提供者特有的 Caddyfile 配置块。
@@ -166,8 +982,108 @@ func (cp *ConsulProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			cp.ServiceName = d.Val()
+		case "service_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.ServicePrefix = d.Val()
+		case "max_services":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for max_services: %v", err)
+			}
+			if n <= 0 {
+				return d.Errf("max_services must be positive")
+			}
+			cp.MaxServices = n
+		case "min_passing_checks":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid integer for min_passing_checks: %v", err)
+			}
+			cp.MinPassingChecks = n
+		case "namespace":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			cp.Namespaces = append(cp.Namespaces, args...)
+		case "partition":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			cp.Partitions = append(cp.Partitions, args...)
+		case "address_tag":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.AddressTag = d.Val()
+		case "datacenter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.Datacenter = d.Val()
+		case "consistency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.Consistency = d.Val()
+		case "mesh_gateway":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.MeshGateway = d.Val()
+		case "kv_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.KVKey = d.Val()
+		case "kv_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.KVPrefix = d.Val()
+		case "proxy_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.ProxyURL = d.Val()
+		case "filter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.Filter = d.Val()
+		case "on_empty":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.OnEmpty = d.Val()
+		case "port_from_check":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.PortFromCheck = d.Val()
+		case "weight_metadata_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cp.WeightMetadataKey = d.Val()
 		case "tags":
 			cp.Tags = d.RemainingArgs()
+		case "tag":
+			// tag <name> passing_only=<bool> [include_warning=<bool>]
+			th, err := unmarshalTagHealth(d)
+			if err != nil {
+				return err
+			}
+			cp.TagHealth = append(cp.TagHealth, th)
 		case "passing_only":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -177,6 +1093,24 @@ func (cp *ConsulProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("invalid boolean for passing_only: %v", err)
 			}
 			cp.PassingOnly = val
+		case "include_warning":
+			cp.IncludeWarning = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid boolean for include_warning: %v", err)
+				}
+				cp.IncludeWarning = val
+			}
+		case "include_maintenance":
+			cp.IncludeMaintenance = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid boolean for include_maintenance: %v", err)
+				}
+				cp.IncludeMaintenance = val
+			}
 		case "poll_interval":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -186,8 +1120,41 @@ func (cp *ConsulProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("invalid duration for poll_interval: %v", err)
 			}
 			cp.PollInterval = dur
+		case "initial_fetch_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for initial_fetch_timeout: %v", err)
+			}
+			cp.InitialFetchTimeout = dur
+		case "use_watch_plan":
+			cp.UseWatchPlan = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid boolean for use_watch_plan: %v", err)
+				}
+				cp.UseWatchPlan = val
+			}
+		case "poll_jitter":
+			cp.PollJitter = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid boolean for poll_jitter: %v", err)
+				}
+				cp.PollJitter = val
+			}
 		default:
-			return d.Errf("unrecognized consul subdirective '%s'", d.Val())
+			ok, err := cp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized consul subdirective '%s'", d.Val())
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"go.uber.org/zap"
+)
+
+// kvWaitTime 是 KV 阻塞查询的最长等待时间，超时后 Consul 返回未变化的结果并重新发起查询。
+const kvWaitTime = 5 * time.Minute
+
+// kvMode 报告是否从 KV 而不是服务目录读取上游列表。
+func (cp *ConsulProvider) kvMode() bool {
+	return cp.KVKey != "" || cp.KVPrefix != ""
+}
+
+// provisionKV 同步读取一次 KV，然后在后台通过阻塞查询监听变化。
+// KV 模式不与其他 provider 共享 watch，阻塞查询本身只在值变化时才返回，不会对 Consul 造成轮询压力。
+func (cp *ConsulProvider) provisionKV() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cp.kvCancel = cancel
+
+	instances, index, err := cp.queryKV(cp.client, cp.kvQueryOptions(ctx, 0))
+	if err := cp.updateUpstreams(instances, false, err); err != nil {
+		cp.logger.Error("initial fetch from consul kv failed", zap.Error(err))
+	}
+	cp.awaitInitialFetch(func() {
+		instances, lastIndex, err := cp.queryKV(cp.client, cp.kvQueryOptions(ctx, 0))
+		if err == nil {
+			index = lastIndex
+		}
+		if err := cp.updateUpstreams(instances, false, err); err != nil {
+			cp.logger.Error("initial fetch from consul kv failed", zap.Error(err))
+		}
+	})
+
+	discovery.Go(cp.logger, "consul kv watcher", func() { cp.watchKV(ctx, index) })
+	return nil
+}
+
+// watchKV 循环发起阻塞查询，直到 ctx 被取消。查询失败时等待 PollInterval 后重试。
+func (cp *ConsulProvider) watchKV(ctx context.Context, index uint64) {
+	for {
+		instances, lastIndex, err := cp.queryKV(cp.client, cp.kvQueryOptions(ctx, index))
+		if ctx.Err() != nil {
+			cp.logger.Info("stopping consul kv watcher", zap.String("service", cp.target()))
+			return
+		}
+		if err != nil {
+			if err := cp.updateUpstreams(nil, false, err); err != nil {
+				cp.logger.Error("failed to update upstreams from consul kv", zap.Error(err))
+			}
+			select {
+			case <-time.After(cp.PollInterval):
+			case <-ctx.Done():
+				cp.logger.Info("stopping consul kv watcher", zap.String("service", cp.target()))
+				return
+			}
+			continue
+		}
+
+		// 等待超时时索引不变，值没有变化
+		if lastIndex == index {
+			continue
+		}
+		// 索引回退（例如 Consul 恢复了快照）时从头开始，见 Consul 阻塞查询文档
+		if lastIndex < index {
+			lastIndex = 0
+		}
+		index = lastIndex
+
+		if err := cp.updateUpstreams(instances, false, nil); err != nil {
+			cp.logger.Error("failed to update upstreams from consul kv", zap.Error(err))
+		}
+	}
+}
+
+// kvQueryOptions 返回索引 index 之后的阻塞查询选项，index 为 0 时立即返回。
+func (cp *ConsulProvider) kvQueryOptions(ctx context.Context, index uint64) *consulApi.QueryOptions {
+	opts := cp.queryOptions()
+	if opts == nil {
+		opts = &consulApi.QueryOptions{}
+	}
+	opts.WaitIndex = index
+	opts.WaitTime = kvWaitTime
+	return opts.WithContext(ctx)
+}
+
+// queryKV 读取 KVKey 或 KVPrefix 下的所有值并解析为实例，同时返回查询的索引。
+// 键不存在（包括被删除）时返回空列表。
+func (cp *ConsulProvider) queryKV(client *consulApi.Client, opts *consulApi.QueryOptions) ([]*discovery.Instance, uint64, error) {
+	var pairs consulApi.KVPairs
+	var meta *consulApi.QueryMeta
+	var err error
+	if cp.KVPrefix != "" {
+		pairs, meta, err = client.KV().List(cp.KVPrefix, opts)
+	} else {
+		var pair *consulApi.KVPair
+		pair, meta, err = client.KV().Get(cp.KVKey, opts)
+		if pair != nil {
+			pairs = consulApi.KVPairs{pair}
+		}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading consul kv '%s': %v", cp.target(), err)
+	}
+
+	var instances []*discovery.Instance
+	for _, pair := range pairs {
+		dials, err := parseKVValue(pair.Value)
+		if err != nil {
+			cp.logger.Warn("skipping unparsable consul kv value",
+				zap.String("key", pair.Key),
+				zap.Error(err),
+			)
+			continue
+		}
+		for _, dial := range dials {
+			if _, _, err := net.SplitHostPort(dial); err != nil {
+				cp.logger.Warn("skipping invalid upstream in consul kv",
+					zap.String("key", pair.Key),
+					zap.String("upstream", dial),
+					zap.Error(err),
+				)
+				continue
+			}
+			instances = append(instances, discovery.NewInstance(dial, nil, 0))
+		}
+	}
+	return instances, meta.LastIndex, nil
+}
+
+// parseKVValue 解析一个 KV 值：以 "[" 开头时按 JSON 字符串数组解析，
+// 否则每行一个地址，忽略空行和以 "#" 开头的注释。
+func parseKVValue(value []byte) ([]string, error) {
+	text := strings.TrimSpace(string(value))
+	if strings.HasPrefix(text, "[") {
+		var dials []string
+		if err := json.Unmarshal([]byte(text), &dials); err != nil {
+			return nil, fmt.Errorf("parsing value as json: %v", err)
+		}
+		return dials, nil
+	}
+
+	var dials []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dials = append(dials, line)
+	}
+	return dials, nil
+}
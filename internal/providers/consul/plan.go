@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"fmt"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+	"github.com/hashicorp/go-hclog"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"go.uber.org/zap"
+)
+
+// provisionWatchPlan 同步查询一次服务，然后在后台运行监听 ServiceName 的 watch plan。
+func (cp *ConsulProvider) provisionWatchPlan() error {
+	plan, err := cp.newWatchPlan()
+	if err != nil {
+		return err
+	}
+	// RunWithClientAndHclog 忽略 plan 的 Datacenter，因此使用一个默认查询 Datacenter 的专用客户端
+	config, err := cp.clientConfig()
+	if err != nil {
+		return err
+	}
+	config.Datacenter = cp.Datacenter
+	client, err := consulApi.NewClient(config)
+	if err != nil {
+		return fmt.Errorf("creating consul client: %v", err)
+	}
+	cp.plan, cp.planTransport = plan, config.Transport
+
+	if err := cp.updateUpstreams(cp.fetch()); err != nil {
+		cp.logger.Error("initial fetch from consul failed", zap.Error(err))
+	}
+	cp.awaitInitialFetch(func() {
+		if err := cp.updateUpstreams(cp.fetch()); err != nil {
+			cp.logger.Error("initial fetch from consul failed", zap.Error(err))
+		}
+	})
+
+	discovery.Go(cp.logger, "consul watch plan", func() {
+		// 查询错误由 newWatchPlan 包装的 Watcher 记录，watch plan 自己的日志不再输出
+		if err := plan.RunWithClientAndHclog(client, hclog.NewNullLogger()); err != nil {
+			cp.logger.Error("consul watch plan exited", zap.String("service", cp.target()), zap.Error(err))
+			return
+		}
+		cp.logger.Info("stopping consul watch plan", zap.String("service", cp.target()))
+	})
+	return nil
+}
+
+// newWatchPlan 创建监听 ServiceName 的 service 类型 watch plan。Consul 返回所有实例，
+// 与轮询模式一样由 entryCollector 按健康检查过滤，并按 on_empty 处理没有健康实例的情况。
+func (cp *ConsulProvider) newWatchPlan() (*watch.Plan, error) {
+	params := map[string]any{
+		"type":    "service",
+		"service": cp.ServiceName,
+	}
+	if cp.Filter != "" {
+		params["filter"] = cp.Filter
+	}
+	if cp.Consistency == consistencyStale {
+		params["stale"] = true
+	}
+	plan, err := watch.Parse(params)
+	if err != nil {
+		return nil, fmt.Errorf("creating consul watch plan: %v", err)
+	}
+
+	// watch plan 只在结果变化时调用 handler，查询失败时只记录自己的日志。包装 Watcher 以便记录失败，
+	// 并在恢复后重新应用一次结果，使刷新状态不停留在失败上
+	watcher := plan.Watcher
+	failed := false
+	plan.Watcher = func(p *watch.Plan) (watch.BlockingParamVal, any, error) {
+		index, result, err := watcher(p)
+		if p.IsStopped() {
+			return index, result, err
+		}
+		if err != nil {
+			failed = true
+			err := fmt.Errorf("watching consul service '%s': %v", cp.ServiceName, err)
+			if err := cp.updateUpstreams(nil, false, err); err != nil {
+				cp.logger.Error("failed to update upstreams from consul", zap.Error(err))
+			}
+		} else if failed {
+			failed = false
+			cp.handleWatch(result)
+		}
+		return index, result, err
+	}
+	plan.HybridHandler = func(_ watch.BlockingParamVal, result any) {
+		cp.handleWatch(result)
+	}
+	return plan, nil
+}
+
+// handleWatch 把 watch plan 返回的服务条目转换为实例并更新上游。
+func (cp *ConsulProvider) handleWatch(result any) {
+	entries, ok := result.([]*consulApi.ServiceEntry)
+	if !ok {
+		cp.logger.Error("unexpected consul watch plan result", zap.String("type", fmt.Sprintf("%T", result)))
+		return
+	}
+	target := serviceTarget{name: cp.ServiceName}
+	collect := func(filter bool) []*discovery.Instance {
+		c := cp.newEntryCollector(filter)
+		c.add(target, entries)
+		return c.finish()
+	}
+	instances, keep, err := cp.applyOnEmpty(collect(true), func() ([]*discovery.Instance, error) {
+		return collect(false), nil
+	})
+	if err := cp.updateUpstreams(instances, keep, err); err != nil {
+		cp.logger.Error("failed to update upstreams from consul", zap.Error(err))
+	}
+}
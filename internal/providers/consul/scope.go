@@ -0,0 +1,56 @@
+package consul
+
+import (
+	consulApi "github.com/hashicorp/consul/api"
+)
+
+// maxScopes 是 Namespaces 和 Partitions 组合的数量上限，每个组合在每次刷新时都要单独查询。
+const maxScopes = 16
+
+// consulScope 是一次查询所在的命名空间和分区（Consul Enterprise），为空表示使用 agent 的默认值。
+type consulScope struct {
+	namespace string
+	partition string
+}
+
+// String 返回 "partition/namespace" 形式的标识，用于日志和区分不同范围中 ID 相同的实例。
+func (sc consulScope) String() string {
+	return sc.partition + "/" + sc.namespace
+}
+
+// apply 在 opts 上设置命名空间和分区，opts 为 nil 时按需创建。
+func (sc consulScope) apply(opts *consulApi.QueryOptions) *consulApi.QueryOptions {
+	if sc == (consulScope{}) {
+		return opts
+	}
+	if opts == nil {
+		opts = &consulApi.QueryOptions{}
+	}
+	opts.Namespace = sc.namespace
+	opts.Partition = sc.partition
+	return opts
+}
+
+// serviceTarget 是一次刷新中需要查询的一个服务。
+type serviceTarget struct {
+	scope consulScope
+	name  string
+}
+
+// scopes 返回 Partitions 和 Namespaces 的所有组合，都未配置时只有默认的范围。
+func (cp *ConsulProvider) scopes() []consulScope {
+	namespaces, partitions := cp.Namespaces, cp.Partitions
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	if len(partitions) == 0 {
+		partitions = []string{""}
+	}
+	scopes := make([]consulScope, 0, len(namespaces)*len(partitions))
+	for _, partition := range partitions {
+		for _, namespace := range namespaces {
+			scopes = append(scopes, consulScope{namespace: namespace, partition: partition})
+		}
+	}
+	return scopes
+}
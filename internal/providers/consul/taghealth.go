@@ -0,0 +1,76 @@
+package consul
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// TagHealth 为带有 Tag 的实例单独设置健康检查的严格程度，覆盖 provider 的 passing_only 和 include_warning，
+// 例如让 canary 实例在健康检查为 warning 甚至 critical 时也被使用，其余实例仍然要求通过。
+type TagHealth struct {
+	Tag            string `json:"tag"`
+	PassingOnly    bool   `json:"passing_only"`
+	IncludeWarning bool   `json:"include_warning,omitempty"`
+}
+
+// healthPolicy 返回实例应使用的 passing_only 和 include_warning：
+// 实例带有的第一个（按配置顺序）配置了 TagHealth 的标签决定，没有时使用 provider 的配置。
+func (cp *ConsulProvider) healthPolicy(tags []string) (passingOnly, includeWarning bool) {
+	for _, th := range cp.TagHealth {
+		if slices.Contains(tags, th.Tag) {
+			return th.PassingOnly, th.IncludeWarning
+		}
+	}
+	return cp.PassingOnly, cp.IncludeWarning
+}
+
+// validateTagHealth 检查 TagHealth 中的标签不为空且不重复。
+func (cp *ConsulProvider) validateTagHealth() error {
+	seen := make(map[string]struct{}, len(cp.TagHealth))
+	for _, th := range cp.TagHealth {
+		if th.Tag == "" {
+			return fmt.Errorf("tag health override requires a tag")
+		}
+		if _, ok := seen[th.Tag]; ok {
+			return fmt.Errorf("duplicate tag health override for tag '%s'", th.Tag)
+		}
+		seen[th.Tag] = struct{}{}
+	}
+	return nil
+}
+
+// unmarshalTagHealth 解析 `tag <name> passing_only=<bool> [include_warning=<bool>]`，
+// 未给出的 passing_only 为 true，include_warning 为 false。
+func unmarshalTagHealth(d *caddyfile.Dispenser) (TagHealth, error) {
+	if !d.NextArg() {
+		return TagHealth{}, d.ArgErr()
+	}
+	th := TagHealth{Tag: d.Val(), PassingOnly: true}
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return TagHealth{}, d.ArgErr()
+	}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return TagHealth{}, d.Errf("invalid tag health option '%s', expected key=value", arg)
+		}
+		val, err := strconv.ParseBool(value)
+		if err != nil {
+			return TagHealth{}, d.Errf("invalid boolean for %s: %v", key, err)
+		}
+		switch key {
+		case "passing_only":
+			th.PassingOnly = val
+		case "include_warning":
+			th.IncludeWarning = val
+		default:
+			return TagHealth{}, d.Errf("unrecognized tag health option '%s'", key)
+		}
+	}
+	return th, nil
+}
@@ -0,0 +1,202 @@
+package consul
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// watchPool 按查询条件共享后台轮询，最后一个订阅者 Cleanup 时才停止。
+// 多个 dynamic_sd 引用同一个服务时（例如不同路由指向同一个后端），只有一个 goroutine 查询 Consul。
+var watchPool = caddy.NewUsagePool()
+
+// sharedWatch 定期从 Consul 查询一次，并把结果分发给所有订阅者。
+// 每个订阅者得到实例的独立副本，各自的 Store 仍然独立应用 min_upstreams、scale_in_grace 等保护策略。
+type sharedWatch struct {
+	// fetcher 负责实际的查询，它复制了订阅者共同的查询条件，但不是任何一个订阅者，
+	// 日志使用 watch 自己的 logger，不会沿用最先订阅、之后可能已被 Cleanup 的 provider 的名字和标签。
+	fetcher *ConsulProvider
+
+	mu          sync.Mutex
+	subscribers map[*ConsulProvider]struct{}
+	// fetched 表示已经查询过至少一次，err 是最近一次查询的错误。
+	// instances 是最近一次成功得到的实例列表，hasInstances 表示是否成功得到过。
+	fetched      bool
+	err          error
+	instances    []*discovery.Instance
+	hasInstances bool
+
+	// refreshes 合并并发的刷新，同时 Provision 的多个订阅者只触发一次查询。
+	refreshes singleflight.Group
+	stopChan  chan struct{}
+}
+
+// newSharedWatch 为查询条件与 cp 相同、subscriptionKey 为 key 的 provider 创建一个 watch 并启动后台轮询。
+func newSharedWatch(cp *ConsulProvider, key string) *sharedWatch {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	logger := caddy.Log().Named("dynamic_sd.consul.watch").With(
+		zap.String("service", cp.target()),
+		zap.String("watch", strconv.FormatUint(h.Sum64(), 16)),
+	)
+
+	w := &sharedWatch{
+		fetcher:     cp.newWatchFetcher(logger),
+		subscribers: make(map[*ConsulProvider]struct{}),
+		stopChan:    make(chan struct{}),
+	}
+	discovery.Go(logger, "consul service watcher", w.run)
+	return w
+}
+
+// newWatchFetcher 返回一个只用于 watch 查询的 provider，它复制 cp 中决定查询结果的配置（与 subscriptionKey 相同）
+// 和客户端，使用 logger 记录日志。共享 watch 的 provider 连接同一个 Consul（Address 和 ProxyURL 属于 subscriptionKey），
+// 客户端在最后一个订阅者释放 watch 之后才会被释放。
+func (cp *ConsulProvider) newWatchFetcher(logger *zap.Logger) *ConsulProvider {
+	return &ConsulProvider{
+		Address:            cp.Address,
+		ProxyURL:           cp.ProxyURL,
+		Datacenter:         cp.Datacenter,
+		Consistency:        cp.Consistency,
+		ServiceName:        cp.ServiceName,
+		ServicePrefix:      cp.ServicePrefix,
+		MaxServices:        cp.MaxServices,
+		Tags:               cp.Tags,
+		Namespaces:         cp.Namespaces,
+		Partitions:         cp.Partitions,
+		AddressTag:         cp.AddressTag,
+		MeshGateway:        cp.MeshGateway,
+		Filter:             cp.Filter,
+		OnEmpty:            cp.OnEmpty,
+		PortFromCheck:      cp.PortFromCheck,
+		WeightMetadataKey:  cp.WeightMetadataKey,
+		PassingOnly:        cp.PassingOnly,
+		IncludeWarning:     cp.IncludeWarning,
+		IncludeMaintenance: cp.IncludeMaintenance,
+		MinPassingChecks:   cp.MinPassingChecks,
+		TagHealth:          cp.TagHealth,
+		PollInterval:       cp.PollInterval,
+		PollJitter:         cp.PollJitter,
+		client:             cp.client,
+		clientKey:          cp.clientKey,
+		logger:             logger,
+	}
+}
+
+// subscriptionKey 返回决定查询结果的所有配置，相同 key 的 provider 共享一个 watch。
+// 新增查询相关的配置时，需要同时加入 newWatchFetcher。
+func (cp *ConsulProvider) subscriptionKey() string {
+	return fmt.Sprintf("%#v", []any{
+		cp.Address, cp.ProxyURL, cp.Datacenter, cp.Consistency,
+		cp.ServiceName, cp.ServicePrefix, cp.MaxServices, cp.Tags, cp.Namespaces, cp.Partitions,
+		cp.AddressTag, cp.MeshGateway, cp.Filter, cp.OnEmpty, cp.PortFromCheck, cp.WeightMetadataKey,
+		cp.PassingOnly, cp.IncludeWarning, cp.IncludeMaintenance, cp.MinPassingChecks, cp.TagHealth, cp.PollInterval, cp.PollJitter,
+	})
+}
+
+// subscribe 将 cp 加入订阅者。watch 已经查询过时立即把最近一次成功的结果（没有时为最近一次的错误）交给 cp，
+// 否则触发一次查询。
+func (w *sharedWatch) subscribe(cp *ConsulProvider) {
+	w.mu.Lock()
+	w.subscribers[cp] = struct{}{}
+	fetched, hasInstances := w.fetched, w.hasInstances
+	instances, err := w.instances, w.err
+	w.mu.Unlock()
+
+	if !fetched {
+		w.refreshes.Do("", func() (any, error) {
+			w.refresh()
+			return nil, nil
+		})
+		return
+	}
+	if hasInstances {
+		err = nil
+	}
+	if err := cp.updateUpstreams(cloneInstances(instances), false, err); err != nil {
+		cp.logger.Error("initial fetch from consul failed", zap.Error(err))
+	}
+}
+
+// unsubscribe 将 cp 移出订阅者，此后它不再收到更新。
+func (w *sharedWatch) unsubscribe(cp *ConsulProvider) {
+	w.mu.Lock()
+	delete(w.subscribers, cp)
+	w.mu.Unlock()
+}
+
+// run 每隔 PollInterval 查询一次，直到 watch 被销毁。开启 PollJitter 时先等待一个随机的初始偏移。
+func (w *sharedWatch) run() {
+	if w.fetcher.PollJitter {
+		select {
+		case <-time.After(rand.N(w.fetcher.PollInterval)):
+			w.refresh()
+		case <-w.stopChan:
+			w.fetcher.logger.Info("stopping consul service watcher")
+			return
+		}
+	}
+
+	ticker := time.NewTicker(w.fetcher.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.refresh()
+		case <-w.stopChan:
+			w.fetcher.logger.Info("stopping consul service watcher")
+			return
+		}
+	}
+}
+
+// refresh 查询一次 Consul 并把结果分发给当前所有的订阅者。
+func (w *sharedWatch) refresh() {
+	instances, keep, err := w.fetcher.fetch()
+
+	w.mu.Lock()
+	w.fetched = true
+	w.err = err
+	// keep_last 时保留上一次的结果，新订阅者仍能得到可用的列表
+	if err == nil && !keep {
+		w.instances, w.hasInstances = instances, true
+	}
+	subscribers := make([]*ConsulProvider, 0, len(w.subscribers))
+	for cp := range w.subscribers {
+		subscribers = append(subscribers, cp)
+	}
+	w.mu.Unlock()
+
+	for _, cp := range subscribers {
+		if err := cp.updateUpstreams(cloneInstances(instances), keep, err); err != nil {
+			cp.logger.Error("failed to update upstreams from consul", zap.Error(err))
+		}
+	}
+}
+
+// Destruct 在最后一个订阅者释放 watch 时停止后台轮询。
+func (w *sharedWatch) Destruct() error {
+	close(w.stopChan)
+	return nil
+}
+
+// cloneInstances 复制实例列表，Store 会修改发布的实例，订阅者之间不能共享同一个实例。
+func cloneInstances(instances []*discovery.Instance) []*discovery.Instance {
+	if instances == nil {
+		return nil
+	}
+	cloned := make([]*discovery.Instance, len(instances))
+	for i, in := range instances {
+		cloned[i] = in.Clone()
+	}
+	return cloned
+}
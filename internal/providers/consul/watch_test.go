@@ -0,0 +1,208 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	consulApi "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSubscriptionKeyIncludesWeightMetadataKey(t *testing.T) {
+	a, b := New(), New()
+	a.ServiceName, b.ServiceName = "web", "web"
+	if a.subscriptionKey() != b.subscriptionKey() {
+		t.Fatal("identical providers must share a subscription key")
+	}
+
+	b.WeightMetadataKey = "weight"
+	if a.subscriptionKey() == b.subscriptionKey() {
+		t.Fatal("providers reading weights from different metadata keys must not share a watch")
+	}
+}
+
+// fakeDestructor 记录是否被销毁，并返回 err。
+type fakeDestructor struct {
+	err       error
+	destroyed bool
+}
+
+func (f *fakeDestructor) Destruct() error {
+	f.destroyed = true
+	return f.err
+}
+
+func TestCleanupReleasesClientWhenWatchFails(t *testing.T) {
+	cp := New()
+	cp.ServiceName = "cleanup-test"
+	cp.logger = zap.NewNop()
+	cp.watchKey = cp.subscriptionKey()
+	cp.clientKey = "cleanup-test|"
+	cp.watch = &sharedWatch{subscribers: make(map[*ConsulProvider]struct{})}
+	cp.client = &consulApi.Client{}
+
+	watch := &fakeDestructor{err: errors.New("watch failed")}
+	client := &fakeDestructor{err: errors.New("client failed")}
+	watchPool.LoadOrStore(cp.watchKey, watch)
+	clientPool.LoadOrStore(cp.clientKey, client)
+
+	err := cp.Cleanup()
+	if !watch.destroyed || !client.destroyed {
+		t.Fatalf("watch destroyed=%v client destroyed=%v, want both", watch.destroyed, client.destroyed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "watch failed") || !strings.Contains(err.Error(), "client failed") {
+		t.Fatalf("got %v, want both errors", err)
+	}
+}
+
+func TestWatchFetcherIsIndependentOfSubscribers(t *testing.T) {
+	cp := New()
+	cp.ServiceName = "web"
+	cp.Tags = []string{"v1"}
+	cp.PassingOnly = false
+	cp.WeightMetadataKey = "weight"
+	cp.TagHealth = []TagHealth{{Tag: "canary", PassingOnly: true}}
+	subscriberCore, subscriberLogs := observer.New(zapcore.InfoLevel)
+	cp.logger = zap.New(subscriberCore)
+
+	watchCore, watchLogs := observer.New(zapcore.InfoLevel)
+	fetcher := cp.newWatchFetcher(zap.New(watchCore))
+	if fetcher == cp {
+		t.Fatal("watch fetcher must not be one of its subscribers")
+	}
+	if fetcher.subscriptionKey() != cp.subscriptionKey() {
+		t.Fatal("watch fetcher must run the same query as its subscribers")
+	}
+
+	fetcher.logMaintenance(map[string]struct{}{"web-1": {}})
+	if watchLogs.Len() != 1 || subscriberLogs.Len() != 0 {
+		t.Fatalf("got %d watch logs and %d subscriber logs, want the watch's own logger only", watchLogs.Len(), subscriberLogs.Len())
+	}
+}
+
+func TestPollJitterSpreadsFirstPoll(t *testing.T) {
+	const interval = time.Second
+	fake, _, client := newFakeConsul(t)
+
+	start := func(service string, jitter bool) {
+		fake.set("/v1/health/service/"+service, entriesJSON(t))
+		cp := New()
+		cp.ServiceName = service
+		cp.PollInterval = interval
+		cp.PollJitter = jitter
+		cp.client = client
+		w := &sharedWatch{
+			fetcher:     cp.newWatchFetcher(zap.NewNop()),
+			subscribers: make(map[*ConsulProvider]struct{}),
+			stopChan:    make(chan struct{}),
+		}
+		go w.run()
+		t.Cleanup(func() { w.Destruct() })
+	}
+	begin := time.Now()
+	const jittered = 8
+	for i := range jittered {
+		start(fmt.Sprintf("jitter-%d", i), true)
+	}
+	start("no-jitter", false)
+	time.Sleep(interval + 200*time.Millisecond)
+
+	// 开启 poll_jitter 时第一次轮询落在 [0, poll_interval) 内，且各个 watch 的时间不同
+	var earliest, latest time.Duration
+	for i := range jittered {
+		at := fake.firstRequest(fmt.Sprintf("/v1/health/service/jitter-%d", i))
+		if at.IsZero() {
+			t.Fatalf("jitter-%d: no poll within poll_interval", i)
+		}
+		offset := at.Sub(begin)
+		if offset >= interval+50*time.Millisecond {
+			t.Fatalf("jitter-%d: first poll after %v, want within %v", i, offset, interval)
+		}
+		if i == 0 || offset < earliest {
+			earliest = offset
+		}
+		latest = max(latest, offset)
+	}
+	if latest-earliest < 10*time.Millisecond {
+		t.Fatalf("first polls between %v and %v, want them spread over the interval", earliest, latest)
+	}
+	// 未开启时第一次轮询在一个完整的 poll_interval 之后
+	if at := fake.firstRequest("/v1/health/service/no-jitter"); at.IsZero() || at.Sub(begin) < interval {
+		t.Fatalf("first poll without jitter at %v, want %v after start", at.Sub(begin), interval)
+	}
+}
+
+func TestWatchPlanUpdatesAndStops(t *testing.T) {
+	fake, addr, _ := newFakeConsul(t)
+	passing := map[string]string{"serfHealth": consulApi.HealthPassing}
+	fake.set("/v1/health/service/watch-plan", entriesJSON(t, testEntry("web-1", "10.0.0.1", passing)))
+
+	cp := New()
+	cp.Address = addr
+	cp.ServiceName = "watch-plan"
+	cp.UseWatchPlan = true
+	if err := cp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpstreams(t, cp, "10.0.0.1:8080")
+
+	// watch plan 的阻塞查询在服务变化时返回，不健康的实例按 passing_only 过滤
+	fake.set("/v1/health/service/watch-plan", entriesJSON(t,
+		testEntry("web-1", "10.0.0.1", passing),
+		testEntry("web-2", "10.0.0.2", passing),
+		testEntry("web-3", "10.0.0.3", map[string]string{"serfHealth": consulApi.HealthCritical}),
+	))
+	waitForUpstreams(t, cp, "10.0.0.1:8080,10.0.0.2:8080")
+
+	if err := cp.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if !cp.plan.IsStopped() {
+		t.Fatal("watch plan still running after Cleanup")
+	}
+	fake.set("/v1/health/service/watch-plan", entriesJSON(t, testEntry("web-4", "10.0.0.4", passing)))
+	time.Sleep(2 * blockTimeout)
+	if got := instanceDials(cp.Store.Instances()); got != "10.0.0.1:8080,10.0.0.2:8080" {
+		t.Fatalf("got upstreams %s after Cleanup, want no further updates", got)
+	}
+}
+
+func TestHandleWatchAppliesOnEmpty(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	cp := New()
+	cp.ServiceName = "watch-plan-handler"
+	cp.OnEmpty = onEmptyKeepLast
+	cp.logger = cp.Store.Setup(zap.New(core), cp.ServiceName)
+
+	cp.handleWatch([]*consulApi.ServiceEntry{
+		testEntry("web-1", "10.0.0.1", map[string]string{"serfHealth": consulApi.HealthPassing}),
+		testEntry("web-2", "10.0.0.2", map[string]string{"serfHealth": consulApi.HealthWarning}),
+	})
+	if got := instanceDials(cp.Store.Instances()); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %s, want only the passing instance", got)
+	}
+
+	// 没有健康实例时按 on_empty keep_last 保留之前的列表
+	cp.handleWatch([]*consulApi.ServiceEntry{
+		testEntry("web-1", "10.0.0.1", map[string]string{"serfHealth": consulApi.HealthCritical}),
+	})
+	if got := instanceDials(cp.Store.Instances()); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %s, want the previous list kept", got)
+	}
+
+	cp.handleWatch(map[string]string{})
+	if logs.FilterMessage("unexpected consul watch plan result").Len() != 1 {
+		t.Fatalf("got logs %v, want an unexpected result error", logs.All())
+	}
+	if got := instanceDials(cp.Store.Instances()); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %s after an unexpected result, want them unchanged", got)
+	}
+}
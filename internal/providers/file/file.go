@@ -0,0 +1,271 @@
+// package file 实现了用于 Caddy 的文件服务发现提供者，
+// 它从本地文件中读取上游地址列表，并在文件变更时自动重新加载。
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/fsnotify/fsnotify"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// formatLines 表示文件中每行一个 "host:port"，空行和以 "#" 开头的行会被忽略。
+	formatLines = "lines"
+	// formatJSON 表示文件内容是一个 "host:port" 字符串组成的 JSON 数组。
+	formatJSON = "json"
+
+	// readRetries 和 readRetryDelay 控制读取失败时的重试。
+	// 编辑器保存文件时常常先写临时文件再重命名，期间文件可能短暂不存在或为空。
+	// 没有任何上游的文件也视为读取失败，重试仍为空时保留之前的列表，而不是发布一个空列表。
+	readRetries    = 5
+	readRetryDelay = 100 * time.Millisecond
+)
+
+// FileProvider 实现了 providers.Provider 接口，
+// 用于从本地文件动态获取上游服务实例。
+type FileProvider struct {
+	// --- 配置字段 ---
+	Path   string `json:"path,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	watcher    *fsnotify.Watcher
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 FileProvider 的新实例。
+func New() *FileProvider {
+	return &FileProvider{
+		// 设置合理的默认值
+		Format: formatLines,
+	}
+}
+
+// Provision 读取文件并启动后台的文件监听 goroutine。
+func (fp *FileProvider) Provision(logger *zap.Logger) error {
+	fp.logger = fp.Store.Setup(logger, fp.Path)
+	fp.logger.Info("provisioning file service discovery provider",
+		zap.String("path", fp.Path),
+		zap.String("format", fp.Format),
+	)
+
+	// 监听文件所在的目录而不是文件本身，这样文件被重命名替换后仍能收到事件
+	var err error
+	fp.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating file watcher: %v", err)
+	}
+	if err := fp.watcher.Add(filepath.Dir(fp.Path)); err != nil {
+		fp.watcher.Close()
+		return fmt.Errorf("watching directory of '%s': %v", fp.Path, err)
+	}
+
+	var ctx context.Context
+	ctx, fp.cancelFunc = context.WithCancel(context.Background())
+
+	// 立即读取一次文件，以确保在 Caddy 启动时就有上游可用
+	if err := fp.updateUpstreams(ctx); err != nil {
+		fp.logger.Error("initial read of upstream file failed", zap.Error(err))
+		// 文件可能稍后才会被创建，后续的文件事件会触发重新读取
+	}
+
+	discovery.Go(fp.logger, "file watcher", func() { fp.watchFileChanges(ctx) })
+
+	return nil
+}
+
+// updateUpstreams 读取文件内容并更新内部列表，读取或解析失败时短暂重试。
+func (fp *FileProvider) updateUpstreams(ctx context.Context) (err error) {
+	defer metrics.ObserveRefresh("file", fp.Path, time.Now())
+	endSpan := tracing.StartRefresh("file", fp.Path)
+	defer func() {
+		count := len(fp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("file", fp.Path, count, err)
+	}()
+
+	var dials []string
+	for i := 0; i < readRetries; i++ {
+		if dials, err = fp.readFile(); err == nil {
+			break
+		}
+		select {
+		case <-time.After(readRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var instances []*discovery.Instance
+	for _, dial := range dials {
+		if _, _, err := net.SplitHostPort(dial); err != nil {
+			fp.logger.Warn("skipping invalid upstream in file",
+				zap.String("path", fp.Path),
+				zap.String("upstream", dial),
+				zap.Error(err),
+			)
+			continue
+		}
+		instances = append(instances, discovery.NewInstance(dial, nil, 0))
+	}
+
+	if !fp.Store.Update(instances) {
+		return nil
+	}
+
+	fp.logger.Debug("updated upstreams from file",
+		zap.String("path", fp.Path),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// readFile 按配置的格式读取并解析文件，文件中没有任何上游时返回错误。
+func (fp *FileProvider) readFile() ([]string, error) {
+	data, err := os.ReadFile(fp.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading upstream file '%s': %v", fp.Path, err)
+	}
+
+	var dials []string
+	if fp.Format == formatJSON {
+		if err := json.Unmarshal(data, &dials); err != nil {
+			return nil, fmt.Errorf("parsing upstream file '%s' as json: %v", fp.Path, err)
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			dials = append(dials, line)
+		}
+	}
+	if len(dials) == 0 {
+		return nil, fmt.Errorf("upstream file '%s' contains no upstreams", fp.Path)
+	}
+	return dials, nil
+}
+
+// watchFileChanges 是一个在后台运行的循环，在文件发生变化时重新读取。
+func (fp *FileProvider) watchFileChanges(ctx context.Context) {
+	target := filepath.Clean(fp.Path)
+	for {
+		select {
+		case event, ok := <-fp.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != target || event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if err := fp.updateUpstreams(ctx); err != nil {
+				fp.logger.Error("failed to update upstreams from file", zap.Error(err))
+			}
+		case err, ok := <-fp.watcher.Errors:
+			if !ok {
+				return
+			}
+			fp.logger.Error("file watcher error", zap.String("path", fp.Path), zap.Error(err))
+		case <-ctx.Done():
+			fp.logger.Info("stopping file watcher", zap.String("path", fp.Path))
+			return
+		}
+	}
+}
+
+// ValidateConnectivity 读取并解析一次文件，不启动文件监听。
+func (fp *FileProvider) ValidateConnectivity(ctx context.Context) error {
+	_, err := fp.readFile()
+	return err
+}
+
+// MarshalConfig 返回用于管理接口的配置，文件提供者没有敏感配置。
+func (fp *FileProvider) MarshalConfig() any {
+	return discovery.RedactConfig(fp)
+}
+
+// Validate 检查必要的配置是否已提供。
+func (fp *FileProvider) Validate() error {
+	if fp.Path == "" {
+		return fmt.Errorf("file provider: path is required")
+	}
+	if fp.Format != formatLines && fp.Format != formatJSON {
+		return fmt.Errorf("file provider: format must be '%s' or '%s'", formatLines, formatJSON)
+	}
+	if err := fp.Store.Validate(); err != nil {
+		return fmt.Errorf("file provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine 并关闭文件监听。
+func (fp *FileProvider) Cleanup() error {
+	fp.logger.Info("cleaning up file provider", zap.String("path", fp.Path))
+	if fp.cancelFunc != nil {
+		fp.cancelFunc()
+	}
+	if fp.watcher != nil {
+		if err := fp.watcher.Close(); err != nil {
+			return fmt.Errorf("closing file watcher: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (fp *FileProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := fp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available in file: %s", fp.Path)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析文件提供者特有的 Caddyfile 配置块。
+func (fp *FileProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.Path = d.Val()
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fp.Format = d.Val()
+		default:
+			ok, err := fp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized file subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
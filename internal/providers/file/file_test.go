@@ -0,0 +1,96 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeAtomic 像编辑器保存文件一样先写临时文件再重命名替换。
+func writeAtomic(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dials 返回当前发布的上游地址。
+func dials(fp *FileProvider) []string {
+	var out []string
+	for _, up := range fp.Store.Upstreams() {
+		out = append(out, up.Dial)
+	}
+	return out
+}
+
+// waitForDials 等待发布的上游变为 want，超时则失败。
+func waitForDials(t *testing.T, fp *FileProvider, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Join(dials(fp), ",") == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got upstreams %v, want %s", dials(fp), want)
+}
+
+func TestLiveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams")
+	writeAtomic(t, path, "# backends\n10.0.0.1:80\n\n10.0.0.2:80\n")
+
+	fp := New()
+	fp.Path = path
+	if err := fp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Cleanup()
+	waitForDials(t, fp, "10.0.0.1:80,10.0.0.2:80")
+
+	writeAtomic(t, path, "10.0.0.3:80\n")
+	waitForDials(t, fp, "10.0.0.3:80")
+
+	// 编辑器保存到一半时文件可能为空，不能因此发布一个空列表
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(readRetries*readRetryDelay + 200*time.Millisecond)
+	if got := dials(fp); len(got) != 1 || got[0] != "10.0.0.3:80" {
+		t.Fatalf("got upstreams %v after the file was emptied, want the last good list", got)
+	}
+
+	writeAtomic(t, path, "10.0.0.4:80\n")
+	waitForDials(t, fp, "10.0.0.4:80")
+}
+
+func TestReadFileRejectsEmptyContent(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+	}{
+		{formatLines, ""},
+		{formatLines, "# no backends yet\n\n"},
+		{formatJSON, "[]"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "upstreams")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fp := New()
+		fp.Path = path
+		fp.Format = tt.format
+		if _, err := fp.readFile(); err == nil || !strings.Contains(err.Error(), "no upstreams") {
+			t.Errorf("%s %q: got %v, want an error for the empty file", tt.format, tt.content, err)
+		}
+	}
+}
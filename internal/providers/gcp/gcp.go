@@ -0,0 +1,324 @@
+// package gcp 实现了从 Google Cloud 托管实例组（MIG）发现上游的服务发现提供者。
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// requestTimeout 是一次刷新中所有 Compute API 请求的总超时时间。
+const requestTimeout = 30 * time.Second
+
+// GCPProvider 实现了 providers.Provider 接口，
+// 定期通过 Compute API 列出托管实例组中运行中且健康的实例，以实例的内网 IP 和配置的端口作为上游。
+// 凭据使用应用默认凭据（Application Default Credentials）：GOOGLE_APPLICATION_CREDENTIALS、
+// gcloud 的用户凭据或 GCE/GKE 的元数据服务器，需要 compute.instanceGroupManagers.get 和 compute.instances.list 权限。
+type GCPProvider struct {
+	// --- 配置字段 ---
+	Project       string        `json:"project,omitempty"`
+	Zone          string        `json:"zone,omitempty"`
+	InstanceGroup string        `json:"instance_group,omitempty"`
+	Port          int           `json:"port,omitempty"`
+	PollInterval  time.Duration `json:"poll_interval,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	client     computeClient
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// computeClient 是 provider 用到的 Compute API：分页列出托管实例组的成员和区域中的实例。
+type computeClient interface {
+	ListManagedInstances(ctx context.Context, project, zone, group string, page func(*compute.InstanceGroupManagersListManagedInstancesResponse) error) error
+	ListInstances(ctx context.Context, project, zone, filter string, page func(*compute.InstanceList) error) error
+}
+
+// computeService 通过 Compute API 客户端实现 computeClient。
+type computeService struct {
+	service *compute.Service
+}
+
+func (cs computeService) ListManagedInstances(ctx context.Context, project, zone, group string, page func(*compute.InstanceGroupManagersListManagedInstancesResponse) error) error {
+	return cs.service.InstanceGroupManagers.ListManagedInstances(project, zone, group).Pages(ctx, page)
+}
+
+func (cs computeService) ListInstances(ctx context.Context, project, zone, filter string, page func(*compute.InstanceList) error) error {
+	return cs.service.Instances.List(project, zone).Filter(filter).Pages(ctx, page)
+}
+
+// newComputeClient 使用应用默认凭据创建 Compute API 客户端，测试通过替换这个变量模拟 Compute API。
+var newComputeClient = func(ctx context.Context) (computeClient, error) {
+	service, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcp compute client: %v", err)
+	}
+	return computeService{service: service}, nil
+}
+
+// New 是一个构造函数，返回一个 GCPProvider 的新实例。
+func New() *GCPProvider {
+	return &GCPProvider{
+		// 设置合理的默认值，Compute API 有配额限制，轮询间隔不宜过短
+		PollInterval: 30 * time.Second,
+	}
+}
+
+// target 返回用于日志和指标的服务标识。
+func (gp *GCPProvider) target() string {
+	return gp.Project + "/" + gp.Zone + "/" + gp.InstanceGroup
+}
+
+// Provision 创建 Compute API 客户端并启动后台轮询。
+func (gp *GCPProvider) Provision(logger *zap.Logger) error {
+	gp.logger = gp.Store.Setup(logger, gp.target())
+	gp.logger.Info("provisioning gcp service discovery provider",
+		zap.String("target", gp.target()),
+		zap.Int("port", gp.Port),
+	)
+
+	var ctx context.Context
+	ctx, gp.cancelFunc = context.WithCancel(context.Background())
+
+	client, err := newComputeClient(ctx)
+	if err != nil {
+		return err
+	}
+	gp.client = client
+
+	// 立即刷新一次，以确保在 Caddy 启动时就有上游可用
+	if err := gp.updateUpstreams(ctx); err != nil {
+		gp.logger.Error("initial fetch from gcp failed", zap.Error(err))
+		// API 可能暂时不可用，后台轮询会继续尝试
+	}
+
+	discovery.Go(gp.logger, "gcp poller", func() { gp.pollForChanges(ctx) })
+
+	return nil
+}
+
+// pollForChanges 按 PollInterval 定期刷新，直到 ctx 被取消。
+func (gp *GCPProvider) pollForChanges(ctx context.Context) {
+	ticker := time.NewTicker(gp.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := gp.updateUpstreams(ctx); err != nil {
+				gp.logger.Error("failed to update upstreams from gcp", zap.Error(err))
+			}
+		case <-ctx.Done():
+			gp.logger.Info("stopping gcp poller", zap.String("target", gp.target()))
+			return
+		}
+	}
+}
+
+// updateUpstreams 列出实例组中的健康实例并更新上游列表。
+func (gp *GCPProvider) updateUpstreams(ctx context.Context) (err error) {
+	defer metrics.ObserveRefresh("gcp", gp.target(), time.Now())
+	endSpan := tracing.StartRefresh("gcp", gp.target())
+	defer func() {
+		count := len(gp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("gcp", gp.target(), count, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	instances, err := gp.list(ctx, gp.client)
+	if err != nil {
+		return err
+	}
+
+	if !gp.Store.Update(instances) {
+		return nil
+	}
+
+	gp.logger.Debug("updated upstreams from gcp",
+		zap.String("target", gp.target()),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// list 返回实例组中运行中、没有进行中的操作且通过了所有健康检查的实例。
+// 实例组没有配置自动修复健康检查时，运行中的实例都被视为健康。
+// 托管实例列表不包含 IP 地址，因此再列出一次区域中运行中的实例，按实例的 URL 取得第一个网卡的内网 IP。
+func (gp *GCPProvider) list(ctx context.Context, client computeClient) ([]*discovery.Instance, error) {
+	members := make(map[string]*compute.ManagedInstance)
+	err := client.ListManagedInstances(ctx, gp.Project, gp.Zone, gp.InstanceGroup,
+		func(resp *compute.InstanceGroupManagersListManagedInstancesResponse) error {
+			for _, mi := range resp.ManagedInstances {
+				if healthy(mi) {
+					members[mi.Instance] = mi
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("listing gcp instance group '%s': %v", gp.target(), err)
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	var instances []*discovery.Instance
+	err = client.ListInstances(ctx, gp.Project, gp.Zone, `status = "RUNNING"`,
+		func(list *compute.InstanceList) error {
+			for _, vm := range list.Items {
+				if _, ok := members[vm.SelfLink]; !ok {
+					continue
+				}
+				if len(vm.NetworkInterfaces) == 0 || vm.NetworkInterfaces[0].NetworkIP == "" {
+					gp.logger.Warn("skipping gcp instance without internal ip", zap.String("instance", vm.Name))
+					continue
+				}
+				instances = append(instances, discovery.NewInstance(
+					net.JoinHostPort(vm.NetworkInterfaces[0].NetworkIP, strconv.Itoa(gp.Port)),
+					vm.Labels,
+					0,
+				))
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("listing gcp instances in '%s/%s': %v", gp.Project, gp.Zone, err)
+	}
+	return instances, nil
+}
+
+// healthy 报告托管实例是否运行中、没有进行中的操作，且所有健康检查都为 HEALTHY。
+func healthy(mi *compute.ManagedInstance) bool {
+	if mi.InstanceStatus != "RUNNING" || mi.CurrentAction != "NONE" {
+		return false
+	}
+	for _, h := range mi.InstanceHealth {
+		if h.DetailedHealthState != "HEALTHY" {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateConnectivity 创建一个独立的客户端并列出一次实例组，不启动后台轮询。
+func (gp *GCPProvider) ValidateConnectivity(ctx context.Context) error {
+	client, err := newComputeClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = gp.list(ctx, client)
+	return err
+}
+
+// MarshalConfig 返回用于管理接口的配置，凭据来自应用默认凭据，不在配置中。
+func (gp *GCPProvider) MarshalConfig() any {
+	return discovery.RedactConfig(gp)
+}
+
+// Validate 检查必要的配置是否已提供。
+func (gp *GCPProvider) Validate() error {
+	if gp.Project == "" {
+		return fmt.Errorf("gcp provider: project is required")
+	}
+	if gp.Zone == "" {
+		return fmt.Errorf("gcp provider: zone is required")
+	}
+	if gp.InstanceGroup == "" {
+		return fmt.Errorf("gcp provider: instance_group is required")
+	}
+	if gp.Port <= 0 || gp.Port > 65535 {
+		return fmt.Errorf("gcp provider: port must be between 1 and 65535")
+	}
+	if err := gp.Store.ValidateInterval("poll_interval", gp.PollInterval); err != nil {
+		return fmt.Errorf("gcp provider: %v", err)
+	}
+	if err := gp.Store.Validate(); err != nil {
+		return fmt.Errorf("gcp provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine。
+func (gp *GCPProvider) Cleanup() error {
+	gp.logger.Info("cleaning up gcp provider", zap.String("target", gp.target()))
+	if gp.cancelFunc != nil {
+		gp.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (gp *GCPProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := gp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no healthy upstreams available in gcp instance group: %s", gp.target())
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 gcp 提供者特有的 Caddyfile 配置块。
+func (gp *GCPProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "project":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			gp.Project = d.Val()
+		case "zone":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			gp.Zone = d.Val()
+		case "instance_group":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			gp.InstanceGroup = d.Val()
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			port, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid port '%s': %v", d.Val(), err)
+			}
+			gp.Port = port
+		case "poll_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for poll_interval: %v", err)
+			}
+			gp.PollInterval = dur
+		default:
+			ok, err := gp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized gcp subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
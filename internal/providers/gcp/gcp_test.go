@@ -0,0 +1,187 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// mockCompute 是一个内存中的 computeClient，每个切片元素是一页结果。
+type mockCompute struct {
+	mu        sync.Mutex
+	members   [][]*compute.ManagedInstance
+	instances [][]*compute.Instance
+	err       error
+	filters   []string
+}
+
+func (m *mockCompute) ListManagedInstances(ctx context.Context, project, zone, group string, page func(*compute.InstanceGroupManagersListManagedInstancesResponse) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if project != "proj" || zone != "us-east1-b" || group != "web" {
+		return errors.New("unknown instance group " + project + "/" + zone + "/" + group)
+	}
+	for _, members := range m.members {
+		if err := page(&compute.InstanceGroupManagersListManagedInstancesResponse{ManagedInstances: members}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockCompute) ListInstances(ctx context.Context, project, zone, filter string, page func(*compute.InstanceList) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filters = append(m.filters, filter)
+	for _, items := range m.instances {
+		if err := page(&compute.InstanceList{Items: items}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set 替换实例组成员和区域中的实例，各自作为一页。
+func (m *mockCompute) set(members []*compute.ManagedInstance, instances []*compute.Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.members = [][]*compute.ManagedInstance{members}
+	m.instances = [][]*compute.Instance{instances}
+}
+
+// member 返回一个运行中、没有进行中的操作的托管实例，health 是各健康检查的状态。
+func member(name string, health ...string) *compute.ManagedInstance {
+	mi := &compute.ManagedInstance{Instance: selfLink(name), InstanceStatus: "RUNNING", CurrentAction: "NONE"}
+	for _, h := range health {
+		mi.InstanceHealth = append(mi.InstanceHealth, &compute.ManagedInstanceInstanceHealth{DetailedHealthState: h})
+	}
+	return mi
+}
+
+// vm 返回一个内网 IP 为 ip 的实例，ip 为空时没有网卡。
+func vm(name, ip string, labels map[string]string) *compute.Instance {
+	in := &compute.Instance{Name: name, SelfLink: selfLink(name), Status: "RUNNING", Labels: labels}
+	if ip != "" {
+		in.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: ip}}
+	}
+	return in
+}
+
+func selfLink(name string) string {
+	return "https://www.googleapis.com/compute/v1/projects/proj/zones/us-east1-b/instances/" + name
+}
+
+// newTestProvider 返回一个使用 client 的 provider，还没有 Provision。
+func newTestProvider(t *testing.T, client computeClient) *GCPProvider {
+	t.Helper()
+	old := newComputeClient
+	newComputeClient = func(context.Context) (computeClient, error) { return client, nil }
+	t.Cleanup(func() { newComputeClient = old })
+
+	gp := New()
+	gp.Project, gp.Zone, gp.InstanceGroup, gp.Port = "proj", "us-east1-b", "web", 8080
+	gp.logger = zap.NewNop()
+	return gp
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(gp *GCPProvider) string {
+	var dials []string
+	for _, up := range gp.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestInstancesFromHealthyMembers(t *testing.T) {
+	stopping := member("web-stopping")
+	stopping.InstanceStatus = "STOPPING"
+	recreating := member("web-recreating")
+	recreating.CurrentAction = "RECREATING"
+	m := &mockCompute{
+		members: [][]*compute.ManagedInstance{
+			{member("web-1", "HEALTHY"), member("web-2"), stopping},
+			{recreating, member("web-3", "HEALTHY", "UNHEALTHY"), member("web-4", "HEALTHY")},
+		},
+		instances: [][]*compute.Instance{
+			{vm("web-1", "10.0.0.1", map[string]string{"version": "v2"}), vm("web-2", "10.0.0.2", nil), vm("web-stopping", "10.0.0.9", nil)},
+			{vm("web-recreating", "10.0.0.8", nil), vm("web-3", "10.0.0.3", nil), vm("web-4", "", nil), vm("other", "10.0.1.1", nil)},
+		},
+	}
+	gp := newTestProvider(t, m)
+
+	instances, err := gp.list(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只保留通过了所有健康检查的成员；没有内网 IP 的实例和不属于实例组的实例被跳过
+	var dials []string
+	for _, in := range instances {
+		dials = append(dials, in.Upstream.Dial)
+	}
+	if got := strings.Join(dials, ","); got != "10.0.0.1:8080,10.0.0.2:8080" {
+		t.Fatalf("got %q, want the healthy members with an internal ip", got)
+	}
+	if instances[0].Metadata["version"] != "v2" {
+		t.Fatalf("got metadata %v, want the instance labels", instances[0].Metadata)
+	}
+	if len(m.filters) != 1 || m.filters[0] != `status = "RUNNING"` {
+		t.Fatalf("got filters %q, want only running instances listed", m.filters)
+	}
+}
+
+func TestEmptyGroupSkipsInstanceList(t *testing.T) {
+	m := &mockCompute{members: [][]*compute.ManagedInstance{{}}}
+	gp := newTestProvider(t, m)
+	instances, err := gp.list(context.Background(), m)
+	if err != nil || len(instances) != 0 || len(m.filters) != 0 {
+		t.Fatalf("got %v, %v after %d instance lists, want no instances without listing", instances, err, len(m.filters))
+	}
+}
+
+func TestPollingKeepsUpstreamsOnError(t *testing.T) {
+	m := new(mockCompute)
+	m.set([]*compute.ManagedInstance{member("web-1")}, []*compute.Instance{vm("web-1", "10.0.0.1", nil)})
+	gp := newTestProvider(t, m)
+	gp.PollInterval = 10 * time.Millisecond
+	if err := gp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gp.Cleanup() })
+	if got := upstreamDials(gp); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %q after Provision, want the group's instance", got)
+	}
+
+	// 请求失败时保留当前的上游列表
+	m.mu.Lock()
+	m.err = errors.New("quota exceeded")
+	m.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if got := upstreamDials(gp); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %q while the api fails, want the previous list", got)
+	}
+	if err := gp.ValidateConnectivity(context.Background()); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("got %v, want the api error", err)
+	}
+
+	m.mu.Lock()
+	m.err = nil
+	m.mu.Unlock()
+	m.set([]*compute.ManagedInstance{member("web-1"), member("web-2")}, []*compute.Instance{vm("web-1", "10.0.0.1", nil), vm("web-2", "10.0.0.2", nil)})
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(gp) != "10.0.0.1:8080,10.0.0.2:8080" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q, want the new member after polling", upstreamDials(gp))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
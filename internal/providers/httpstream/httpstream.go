@@ -0,0 +1,425 @@
+// package httpstream 实现了通过长连接 HTTP 接收上游变更（JSON Lines 或 Server-Sent Events）的服务发现提供者。
+package httpstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// formatJSONLines 表示响应体的每一行是一个 JSON 事件。
+	formatJSONLines = "jsonlines"
+
+	// formatSSE 表示响应体是 Server-Sent Events，每个事件的 data 是一个 JSON 事件。
+	formatSSE = "sse"
+
+	// responseHeaderTimeout 是建立连接并收到响应头的超时时间，之后的响应体可以无限期地保持打开。
+	responseHeaderTimeout = 10 * time.Second
+
+	// minRetryDelay 和 maxRetryDelay 是连接断开或失败后重连等待时间的范围，每次连续失败翻倍。
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+
+	// maxEventSize 是一个事件的最大长度，sync 一次携带整个上游列表，因此比默认的 64KB 大。
+	maxEventSize = 1 << 20
+)
+
+// HTTPStreamProvider 实现了 providers.Provider 接口，
+// 向 URL 发起一个长连接的 GET 请求，从响应体中逐个读取 JSON 事件并增量地更新上游列表：
+//
+//	{"op": "add",    "endpoints": [{"address": "10.0.0.1:8080", "weight": 2, "metadata": {"zone": "a"}}]}
+//	{"op": "remove", "endpoints": [{"address": "10.0.0.1:8080"}]}
+//	{"op": "sync",   "endpoints": [...]}  用给出的列表替换整个上游列表
+//
+// Format 为 "jsonlines"（默认）时每一行是一个事件，为 "sse" 时每个 Server-Sent Event 的 data 是一个事件。
+// 无法解析的事件记录警告后忽略。连接断开后保留当前的上游列表并按退避间隔重连，
+// 服务端应当在每次连接建立后先发送一次 sync。这是轮询类 provider 的推送版本。
+type HTTPStreamProvider struct {
+	// --- 配置字段 ---
+	URL    string `json:"url,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	// Token 不为空时作为 "Authorization: Bearer" 发送；Username 不为空时使用 HTTP Basic 认证。
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	// instances 是按事件流维护的实例，按地址索引，只在后台 goroutine 中访问。
+	instances  map[string]*discovery.Instance
+	client     *http.Client
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// event 是事件流中的一个事件。
+type event struct {
+	Op        string     `json:"op"`
+	Endpoints []endpoint `json:"endpoints"`
+}
+
+// endpoint 是事件中的一个上游。
+type endpoint struct {
+	Address  string            `json:"address"`
+	Weight   float64           `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// New 是一个构造函数，返回一个带有默认值的 HTTPStreamProvider 新实例。
+func New() *HTTPStreamProvider {
+	return &HTTPStreamProvider{
+		Format: formatJSONLines,
+	}
+}
+
+// Provision 在后台连接 URL 并读取事件流。
+func (hp *HTTPStreamProvider) Provision(logger *zap.Logger) error {
+	hp.logger = hp.Store.Setup(logger, discovery.RedactURL(hp.URL))
+	hp.logger.Info("provisioning http stream service discovery provider",
+		zap.String("url", discovery.RedactURL(hp.URL)),
+		zap.String("format", hp.Format),
+	)
+	hp.instances = make(map[string]*discovery.Instance)
+	hp.client = newClient()
+
+	var ctx context.Context
+	ctx, hp.cancelFunc = context.WithCancel(context.Background())
+
+	discovery.Go(hp.logger, "http stream reader", func() { hp.run(ctx) })
+
+	return nil
+}
+
+// newClient 返回读取事件流使用的 HTTP 客户端，它没有整体超时，只限制等待响应头的时间。
+func newClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	return &http.Client{Transport: transport}
+}
+
+// run 连接 URL 并读取事件，连接失败或断开时按指数退避重连，直到 ctx 被取消。
+func (hp *HTTPStreamProvider) run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		connected, err := hp.serve(ctx)
+		if ctx.Err() != nil {
+			hp.logger.Info("stopping http stream reader", zap.String("url", hp.Service()))
+			return
+		}
+		if connected {
+			delay = minRetryDelay
+		}
+		hp.updateUpstreams(err)
+		hp.logger.Error("http stream lost, reconnecting",
+			zap.String("url", hp.Service()),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			hp.logger.Info("stopping http stream reader", zap.String("url", hp.Service()))
+			return
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// serve 建立一次连接并应用其中的事件，直到连接断开或 ctx 被取消。connected 报告是否成功收到了响应。
+func (hp *HTTPStreamProvider) serve(ctx context.Context) (connected bool, err error) {
+	body, err := hp.open(ctx, hp.client)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	hp.logger.Info("connected to http stream", zap.String("url", hp.Service()))
+
+	handle := func(data []byte) {
+		if hp.apply(data) {
+			hp.updateUpstreams(nil)
+		}
+	}
+	if hp.Format == formatSSE {
+		err = readSSE(body, handle)
+	} else {
+		err = readJSONLines(body, handle)
+	}
+	if err != nil {
+		return true, fmt.Errorf("reading http stream: %v", err)
+	}
+	return true, fmt.Errorf("http stream closed by server")
+}
+
+// open 发起请求并返回响应体，响应状态不是 200 时返回错误。
+func (hp *HTTPStreamProvider) open(ctx context.Context, client *http.Client) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hp.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating http stream request: %v", err)
+	}
+	if hp.Format == formatSSE {
+		req.Header.Set("Accept", "text/event-stream")
+	} else {
+		req.Header.Set("Accept", "application/x-ndjson")
+	}
+	if hp.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+hp.Token)
+	}
+	if hp.Username != "" {
+		req.SetBasicAuth(hp.Username, hp.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to http stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("http stream returned status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// readJSONLines 对 r 中的每个非空行调用 handle。
+func readJSONLines(r io.Reader, handle func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		handle(line)
+	}
+	return scanner.Err()
+}
+
+// readSSE 对 r 中每个带有 data 的 Server-Sent Event 调用 handle，多行 data 以换行连接。
+// event、id、retry 字段和注释行被忽略。
+func readSSE(r io.Reader, handle func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				handle([]byte(strings.Join(data, "\n")))
+				data = data[:0]
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		if field == "data" {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	return scanner.Err()
+}
+
+// apply 把一个事件应用到 instances，返回是否需要更新上游列表。
+func (hp *HTTPStreamProvider) apply(data []byte) bool {
+	var ev event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		hp.logger.Warn("ignoring malformed http stream event", zap.ByteString("event", data), zap.Error(err))
+		return false
+	}
+
+	switch strings.ToLower(ev.Op) {
+	case "add":
+		for _, ep := range ev.Endpoints {
+			if hp.validDial(ep.Address) {
+				hp.instances[ep.Address] = discovery.NewInstance(ep.Address, ep.Metadata, ep.Weight)
+			}
+		}
+	case "remove":
+		for _, ep := range ev.Endpoints {
+			delete(hp.instances, ep.Address)
+		}
+	case "sync":
+		instances := make(map[string]*discovery.Instance, len(ev.Endpoints))
+		for _, ep := range ev.Endpoints {
+			if hp.validDial(ep.Address) {
+				instances[ep.Address] = discovery.NewInstance(ep.Address, ep.Metadata, ep.Weight)
+			}
+		}
+		hp.instances = instances
+	default:
+		hp.logger.Warn("ignoring http stream event with unrecognized op", zap.String("op", ev.Op))
+		return false
+	}
+	return true
+}
+
+// validDial 报告 dial 是否为合法的 "host:port"，不合法时记录警告。
+func (hp *HTTPStreamProvider) validDial(dial string) bool {
+	if _, _, err := net.SplitHostPort(dial); err != nil {
+		hp.logger.Warn("skipping invalid upstream from http stream",
+			zap.String("upstream", dial),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// updateUpstreams 把当前的 instances 按地址排序后写入 Store；err 不为空时只记录这次失败，保留当前的上游列表。
+func (hp *HTTPStreamProvider) updateUpstreams(err error) error {
+	service := hp.Service()
+	defer metrics.ObserveRefresh("http_stream", service, time.Now())
+	endSpan := tracing.StartRefresh("http_stream", service)
+	defer func() {
+		count := len(hp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("http_stream", service, count, err)
+	}()
+	if err != nil {
+		return err
+	}
+
+	instances := make([]*discovery.Instance, 0, len(hp.instances))
+	for _, in := range hp.instances {
+		instances = append(instances, in)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Upstream.Dial < instances[j].Upstream.Dial })
+
+	if !hp.Store.Update(instances) {
+		return nil
+	}
+
+	hp.logger.Debug("updated upstreams from http stream",
+		zap.String("url", service),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// ValidateConnectivity 发起一次请求并确认收到 200 响应后立即断开，不读取事件。
+func (hp *HTTPStreamProvider) ValidateConnectivity(ctx context.Context) error {
+	body, err := hp.open(ctx, newClient())
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// RegistryAddresses 返回事件流服务器的地址。
+func (hp *HTTPStreamProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(hp.URL, "80")
+}
+
+// MarshalConfig 返回用于管理接口的配置，Token、Password 以及 URL 中的密码被替换。
+func (hp *HTTPStreamProvider) MarshalConfig() any {
+	config := discovery.RedactConfig(hp, "token", "password")
+	if hp.URL != "" {
+		config["url"] = discovery.RedactURL(hp.URL)
+	}
+	return config
+}
+
+// Validate 检查必要的配置是否已提供。
+func (hp *HTTPStreamProvider) Validate() error {
+	if hp.URL == "" {
+		return fmt.Errorf("http_stream provider: url is required")
+	}
+	u, err := url.Parse(hp.URL)
+	if err != nil {
+		return fmt.Errorf("http_stream provider: invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("http_stream provider: url scheme must be 'http' or 'https'")
+	}
+	switch hp.Format {
+	case formatJSONLines, formatSSE:
+	default:
+		return fmt.Errorf("http_stream provider: format must be '%s' or '%s'", formatJSONLines, formatSSE)
+	}
+	if hp.Token != "" && hp.Username != "" {
+		return fmt.Errorf("http_stream provider: token and basic_auth cannot be used together")
+	}
+	if err := hp.Store.Validate(); err != nil {
+		return fmt.Errorf("http_stream provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine 并关闭连接。
+func (hp *HTTPStreamProvider) Cleanup() error {
+	hp.logger.Info("cleaning up http stream provider", zap.String("url", hp.Service()))
+	if hp.cancelFunc != nil {
+		hp.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (hp *HTTPStreamProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := hp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available from http stream: %s", hp.Service())
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 http_stream 提供者特有的 Caddyfile 配置块。
+func (hp *HTTPStreamProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			hp.URL = d.Val()
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			hp.Format = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			hp.Token = d.Val()
+		case "basic_auth":
+			// basic_auth <username> [password]
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			hp.Username = d.Val()
+			if d.NextArg() {
+				hp.Password = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			ok, err := hp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized http_stream subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
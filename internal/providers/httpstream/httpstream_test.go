@@ -0,0 +1,169 @@
+package httpstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stream 是假服务器上的一个事件流连接，写入 events 的内容原样发送给 provider，关闭 done 结束响应。
+type stream struct {
+	header http.Header
+	events chan string
+	done   chan struct{}
+}
+
+// send 发送一段响应体。
+func (s *stream) send(body string) { s.events <- body }
+
+// newStreamServer 返回一个事件流服务器，每个请求作为一个 stream 交给测试。
+func newStreamServer(t *testing.T) (*httptest.Server, chan *stream) {
+	t.Helper()
+	streams := make(chan *stream, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &stream{header: r.Header.Clone(), events: make(chan string), done: make(chan struct{})}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		streams <- s
+		for {
+			select {
+			case body := <-s.events:
+				fmt.Fprint(w, body)
+				w.(http.Flusher).Flush()
+			case <-s.done:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, streams
+}
+
+// nextStream 等待 provider 建立下一个连接。
+func nextStream(t *testing.T, streams chan *stream) *stream {
+	t.Helper()
+	select {
+	case s := <-streams:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider did not connect to the stream")
+		return nil
+	}
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(hp *HTTPStreamProvider) string {
+	var dials []string
+	for _, up := range hp.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+// waitForDials 等待发布的上游变为 want。
+func waitForDials(t *testing.T, hp *HTTPStreamProvider, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(hp) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q, want %q", upstreamDials(hp), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// provision 返回一个连接 url 的 provider，测试结束时 Cleanup。
+func provision(t *testing.T, url, format string) *HTTPStreamProvider {
+	t.Helper()
+	hp := New()
+	hp.URL = url
+	hp.Format = format
+	hp.Token = "secret"
+	if err := hp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hp.Cleanup() })
+	return hp
+}
+
+func TestJSONLinesIncrementalUpdates(t *testing.T) {
+	srv, streams := newStreamServer(t)
+	hp := provision(t, srv.URL, formatJSONLines)
+	s := nextStream(t, streams)
+	if s.header.Get("Authorization") != "Bearer secret" || s.header.Get("Accept") != "application/x-ndjson" {
+		t.Fatalf("got request headers %v, want the bearer token and the ndjson Accept header", s.header)
+	}
+
+	s.send(`{"op": "sync", "endpoints": [{"address": "10.0.0.2:80"}, {"address": "10.0.0.1:80"}]}` + "\n")
+	waitForDials(t, hp, "10.0.0.1:80,10.0.0.2:80")
+
+	s.send(`{"op": "add", "endpoints": [{"address": "10.0.0.3:80", "weight": 2, "metadata": {"zone": "a"}}, {"address": "bad"}]}` + "\n")
+	waitForDials(t, hp, "10.0.0.1:80,10.0.0.2:80,10.0.0.3:80")
+	added := hp.Store.Instances()[2]
+	if added.Weight != 2 || added.Metadata["zone"] != "a" {
+		t.Fatalf("got %+v, want the endpoint's weight and metadata", added)
+	}
+
+	// 无法解析的事件和未知的 op 被忽略，不影响后续事件
+	s.send("{not json\n" + `{"op": "replace", "endpoints": []}` + "\n\n" + `{"op": "remove", "endpoints": [{"address": "10.0.0.1:80"}]}` + "\n")
+	waitForDials(t, hp, "10.0.0.2:80,10.0.0.3:80")
+}
+
+func TestSSEEvents(t *testing.T) {
+	srv, streams := newStreamServer(t)
+	hp := provision(t, srv.URL, formatSSE)
+	s := nextStream(t, streams)
+	if s.header.Get("Accept") != "text/event-stream" {
+		t.Fatalf("got Accept %q, want text/event-stream", s.header.Get("Accept"))
+	}
+
+	// data 可以分成多行，注释和其他字段被忽略
+	s.send(": keepalive\nevent: update\nid: 1\ndata: {\"op\": \"sync\",\ndata: \"endpoints\": [{\"address\": \"10.0.0.1:80\"}]}\n\n")
+	waitForDials(t, hp, "10.0.0.1:80")
+	s.send("data: {\"op\": \"add\", \"endpoints\": [{\"address\": \"10.0.0.2:80\"}]}\n\n")
+	waitForDials(t, hp, "10.0.0.1:80,10.0.0.2:80")
+}
+
+func TestReconnectAfterStreamCloses(t *testing.T) {
+	srv, streams := newStreamServer(t)
+	hp := provision(t, srv.URL, formatJSONLines)
+	s := nextStream(t, streams)
+	s.send(`{"op": "sync", "endpoints": [{"address": "10.0.0.1:80"}]}` + "\n")
+	waitForDials(t, hp, "10.0.0.1:80")
+
+	// 服务端结束响应后保留当前的上游列表，重连后由新的 sync 替换
+	close(s.done)
+	s = nextStream(t, streams)
+	if got := upstreamDials(hp); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %q after the stream closed, want the previous list", got)
+	}
+	s.send(`{"op": "sync", "endpoints": [{"address": "10.0.0.9:80"}]}` + "\n")
+	waitForDials(t, hp, "10.0.0.9:80")
+}
+
+func TestValidateConnectivityStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	hp := New()
+	hp.URL = srv.URL
+	if err := hp.ValidateConnectivity(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want the 401 status", err)
+	}
+	hp.Token = "secret"
+	if err := hp.ValidateConnectivity(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package mdns
+
+import (
+	"bytes"
+	"net"
+)
+
+// preferredAddr 从实例通告的地址中确定地选择一个。多宿主的主机在每个网络接口上通告不同的地址，
+// zeroconf 每次给出的地址及其顺序都不固定，逐个接口使用会为同一个实例产生重复或来回变化的上游。
+// 上一次选择的地址 previous 仍被通告时继续使用；否则优先 IPv4，其次非链路本地的地址，同类地址中取最小的一个。
+// 没有可用的地址时返回空字符串。
+func preferredAddr(ipv4, ipv6 []net.IP, previous string) string {
+	var best net.IP
+	bestRank := 0
+	for _, ip := range append(append([]net.IP(nil), ipv4...), ipv6...) {
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		if previous != "" && ip.String() == previous {
+			return previous
+		}
+		rank := addrRank(ip)
+		if best == nil || rank < bestRank || rank == bestRank && bytes.Compare(ip.To16(), best.To16()) < 0 {
+			best, bestRank = ip, rank
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.String()
+}
+
+// addrRank 返回地址的优先级，越小越优先。IPv6 的链路本地地址需要指定接口才能拨号，因此排在最后。
+func addrRank(ip net.IP) int {
+	rank := 0
+	if ip.To4() == nil {
+		rank += 2
+	}
+	if ip.IsLinkLocalUnicast() {
+		rank++
+	}
+	return rank
+}
@@ -0,0 +1,110 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+const (
+	// reverseLookupTimeout 是反向解析实例主机名的超时时间。
+	reverseLookupTimeout = time.Second
+
+	// hostnameTTL 和 failedHostnameTTL 是解析成功和失败的结果在缓存中保留的时间，过期后在下一次查询时重新解析。
+	hostnameTTL       = 10 * time.Minute
+	failedHostnameTTL = time.Minute
+
+	// maxHostnames 是缓存的最大条目数。超过时先清除已过期的条目，仍然超过时不再解析新的地址。
+	maxHostnames = 1024
+)
+
+// hostnameCache 缓存按 IP 反向解析得到的主机名。解析在后台进行，不阻塞 mDNS 记录的处理：
+// 第一次查询某个 IP 时返回空字符串，实例下一次通告时即可带上解析结果。
+type hostnameCache struct {
+	logger *zap.Logger
+	// lookup 执行一次反向解析，解析失败时返回空字符串。
+	lookup func(ctx context.Context, ip string) string
+
+	mu      sync.Mutex
+	entries map[string]hostnameEntry
+}
+
+// hostnameEntry 是一个 IP 的解析结果，pending 表示正在解析。
+type hostnameEntry struct {
+	name    string
+	expires time.Time
+	pending bool
+}
+
+// newHostnameCache 返回一个使用系统解析器的 hostnameCache。
+func newHostnameCache(logger *zap.Logger) *hostnameCache {
+	return &hostnameCache{
+		logger:  logger,
+		lookup:  lookupAddr,
+		entries: make(map[string]hostnameEntry),
+	}
+}
+
+// lookupAddr 通过系统解析器反向解析 ip，返回第一个主机名。
+func lookupAddr(ctx context.Context, ip string) string {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// get 返回 ip 缓存的主机名。没有缓存或已经过期时在后台发起一次解析，并返回之前的结果（没有时为空字符串）。
+// ctx 被取消时（provider 被清理）后台解析随之结束。
+func (c *hostnameCache) get(ctx context.Context, ip string) string {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[ip]
+	if ok && (e.pending || now.Before(e.expires)) {
+		return e.name
+	}
+	if !ok && len(c.entries) >= maxHostnames {
+		c.prune(now)
+		if len(c.entries) >= maxHostnames {
+			return ""
+		}
+	}
+	e.pending = true
+	c.entries[ip] = e
+	go func() {
+		defer discovery.Recover(c.logger, "mDNS hostname lookup")
+		c.resolve(ctx, ip)
+	}()
+	return e.name
+}
+
+// resolve 反向解析 ip 并写入缓存。
+func (c *hostnameCache) resolve(ctx context.Context, ip string) {
+	ctx, cancel := context.WithTimeout(ctx, reverseLookupTimeout)
+	defer cancel()
+	name := c.lookup(ctx, ip)
+
+	ttl := hostnameTTL
+	if name == "" {
+		ttl = failedHostnameTTL
+	}
+	c.mu.Lock()
+	c.entries[ip] = hostnameEntry{name: name, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+// prune 清除已经过期的条目。调用方必须持有 c.mu。
+func (c *hostnameCache) prune(now time.Time) {
+	for ip, e := range c.entries {
+		if !e.pending && !now.Before(e.expires) {
+			delete(c.entries, ip)
+		}
+	}
+}
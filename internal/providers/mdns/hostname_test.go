@@ -0,0 +1,123 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHandleEntryLogsHostname(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	mp := newTestProvider(zap.New(core))
+
+	e := zeroconf.NewServiceEntry("printer", "_http._tcp", "local.")
+	e.HostName = "printer.local."
+	e.Port = 8080
+	e.TTL = 120
+	e.AddrIPv4 = []net.IP{net.IPv4(10, 0, 0, 1)}
+	mp.handleEntry(context.Background(), mp.Domain, e)
+	mp.flushRebuild()
+
+	found := logs.FilterMessage("mDNS service instance found/updated").All()
+	if len(found) != 1 {
+		t.Fatalf("got %d found/updated logs, want 1", len(found))
+	}
+	fields := found[0].ContextMap()
+	if fields["hostname"] != "printer.local." || fields["address"] != "10.0.0.1:8080" {
+		t.Fatalf("got fields %v, want hostname printer.local. and address 10.0.0.1:8080", fields)
+	}
+
+	instances := mp.Store.Instances()
+	if len(instances) != 1 || instances[0].Hostname != "printer.local." {
+		t.Fatalf("got instances %v, want one with hostname printer.local.", instances)
+	}
+}
+
+func TestHostnameCacheResolvesInBackground(t *testing.T) {
+	release := make(chan struct{})
+	var lookups atomic.Int32
+	c := newHostnameCache(zap.NewNop())
+	c.lookup = func(ctx context.Context, ip string) string {
+		lookups.Add(1)
+		<-release
+		return "host.example."
+	}
+
+	// 解析还没有完成时不阻塞，也不重复发起解析
+	if name := c.get(context.Background(), "10.0.0.1"); name != "" {
+		t.Fatalf("got %q before the lookup finished, want empty", name)
+	}
+	c.get(context.Background(), "10.0.0.1")
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.get(context.Background(), "10.0.0.1") != "host.example." {
+		if time.Now().After(deadline) {
+			t.Fatal("hostname was never resolved")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("got %d lookups, want 1", n)
+	}
+}
+
+func TestHostnameCacheRetriesExpiredFailures(t *testing.T) {
+	var lookups atomic.Int32
+	c := newHostnameCache(zap.NewNop())
+	c.lookup = func(ctx context.Context, ip string) string {
+		lookups.Add(1)
+		return ""
+	}
+
+	// 失败的结果在 failedHostnameTTL 后过期，过期后重新解析
+	c.entries["10.0.0.1"] = hostnameEntry{expires: time.Now().Add(-time.Second)}
+	c.get(context.Background(), "10.0.0.1")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lookups.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired failure was not looked up again")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHostnameCacheIsBounded(t *testing.T) {
+	var lookups atomic.Int32
+	c := newHostnameCache(zap.NewNop())
+	c.lookup = func(ctx context.Context, ip string) string {
+		lookups.Add(1)
+		return ""
+	}
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < maxHostnames; i++ {
+		c.entries["10.1.0."+strconv.Itoa(i)] = hostnameEntry{expires: expires}
+	}
+	// 已过期的条目被清除后为新的地址腾出空间
+	c.entries["10.1.0.0"] = hostnameEntry{expires: time.Now().Add(-time.Second)}
+
+	c.get(context.Background(), "10.0.0.1")
+	c.get(context.Background(), "10.0.0.2")
+
+	c.mu.Lock()
+	size := len(c.entries)
+	_, first := c.entries["10.0.0.1"]
+	_, second := c.entries["10.0.0.2"]
+	c.mu.Unlock()
+	if size > maxHostnames {
+		t.Fatalf("cache grew to %d entries, want at most %d", size, maxHostnames)
+	}
+	if !first || second {
+		t.Fatalf("cached 10.0.0.1=%v 10.0.0.2=%v, want only the first after pruning", first, second)
+	}
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/grandcat/zeroconf"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
 	"go.uber.org/zap"
 )
 
@@ -23,15 +26,36 @@ type MdnsProvider struct {
 	// --- 配置字段 ---
 	ServiceName   string        `json:"service_name,omitempty"` // 例如 "_http._tcp"
 	Domain        string        `json:"domain,omitempty"`
+	Domains       []string      `json:"domains,omitempty"` // 同时浏览多个域，设置后忽略 Domain
 	BrowseTimeout time.Duration `json:"browse_timeout,omitempty"`
 
+	// Subtype 是服务子类型（如 "_printer"），设置后只发现注册在 "_printer._sub.<service_name>" 下的实例，
+	// 用于在繁忙的网络中缩小发现范围。子类型成员每 30 秒查询一次，每次等待 BrowseTimeout 收集响应。
+	Subtype string `json:"subtype,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
 	// --- 内部状态 ---
 	logger     *zap.Logger
-	upstreams  []*reverseproxy.Upstream
-	mu         sync.RWMutex
 	cancelFunc context.CancelFunc
+
+	// domainServices 按域记录当前活跃的服务实例，实例离开时只影响其所在的域。
+	domainServices map[string]map[string]*discovery.Instance
+	// subtypeMembers 按域记录属于 Subtype 的实例名，还没有查询到的域不发布任何实例。
+	subtypeMembers map[string]map[string]struct{}
+	// rebuildTimer 不为 nil 表示已经安排了一次上游列表的重建，
+	// 在此期间到达的事件只修改 domainServices，由同一次重建一并发布。
+	rebuildTimer *time.Timer
+	mu           sync.Mutex
+
+	// hostnames 缓存按 IP 反向解析得到的主机名，用于实例没有通告 HostName 时。
+	hostnames *hostnameCache
 }
 
+// rebuildDelay 是合并 mDNS 事件的时间窗口。网络繁忙时一批事件只触发一次上游列表重建。
+const rebuildDelay = 100 * time.Millisecond
+
 // New 是一个构造函数，返回一个 MdnsProvider 的新实例。
 func New() *MdnsProvider {
 	return &MdnsProvider{
@@ -43,93 +67,211 @@ func New() *MdnsProvider {
 
 // Provision 初始化 mDNS 发现 goroutine。
 func (mp *MdnsProvider) Provision(logger *zap.Logger) error {
-	mp.logger = logger
+	mp.logger = mp.Store.Setup(logger, mp.ServiceName)
 	mp.logger.Info("provisioning mDNS service discovery provider",
 		zap.String("service", mp.ServiceName),
-		zap.String("domain", mp.Domain),
+		zap.String("subtype", mp.Subtype),
+		zap.Strings("domains", mp.domains()),
 	)
+	mp.domainServices = make(map[string]map[string]*discovery.Instance)
+	mp.subtypeMembers = make(map[string]map[string]struct{})
+	mp.hostnames = newHostnameCache(mp.logger)
 
 	// 创建一个可取消的 context，用于在 Cleanup 时停止 mDNS 浏览器
 	var ctx context.Context
 	ctx, mp.cancelFunc = context.WithCancel(context.Background())
 
-	// 启动后台 goroutine 来发现和更新服务
-	go mp.runDiscovery(ctx)
+	// 为每个域启动一个后台 goroutine 来发现和更新服务
+	for _, domain := range mp.domains() {
+		discovery.Go(mp.logger, "mDNS browser", func() { mp.runDiscovery(ctx, domain) })
+		if mp.Subtype != "" {
+			discovery.Go(mp.logger, "mDNS subtype query", func() { mp.runSubtypeQueries(ctx, domain) })
+		}
+	}
 
 	return nil
 }
 
-// runDiscovery 启动 zeroconf 浏览器并监听服务实例。
-func (mp *MdnsProvider) runDiscovery(ctx context.Context) {
+// domains 返回需要浏览的域列表，未配置 Domains 时使用 Domain。
+func (mp *MdnsProvider) domains() []string {
+	if len(mp.Domains) > 0 {
+		return mp.Domains
+	}
+	return []string{mp.Domain}
+}
+
+// runDiscovery 在指定的域中启动 zeroconf 浏览器并监听服务实例。
+func (mp *MdnsProvider) runDiscovery(ctx context.Context, domain string) {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
-		mp.logger.Error("failed to initialize mDNS resolver", zap.Error(err))
+		mp.logger.Error("failed to initialize mDNS resolver", zap.String("domain", domain), zap.Error(err))
 		return
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
 
-	// activeServices 用于跟踪当前所有活跃的服务实例
-	activeServices := make(map[string]*reverseproxy.Upstream)
-
 	go func() {
-		// 这个内部 goroutine 负责从 channel 读取并更新上游列表
+		// 这个内部 goroutine 负责从 channel 读取并更新该域的实例
 		for entry := range entries {
-			// 当 TTL 为 0 时，表示服务实例已离开网络
-			if entry.TTL == 0 {
-				if _, ok := activeServices[entry.Instance]; ok {
-					delete(activeServices, entry.Instance)
-					mp.logger.Info("mDNS service instance left", zap.String("instance", entry.Instance))
-					mp.updateUpstreams(activeServices)
-				}
-				continue
-			}
+			mp.handleEntry(ctx, domain, entry)
+		}
+	}()
 
-			// 优先使用 IPv4 地址
-			addr := entry.AddrIPv4[0].String()
-			if addr == "" && len(entry.AddrIPv6) > 0 {
-				addr = entry.AddrIPv6[0].String()
-			}
-			if addr == "" {
-				continue
-			}
+	mp.logger.Info("starting mDNS browser...", zap.String("domain", domain))
+	err = resolver.Browse(ctx, mp.ServiceName, domain, entries)
+	if err != nil {
+		mp.logger.Error("mDNS browse failed to start", zap.String("domain", domain), zap.Error(err))
+	}
 
-			upstream := &reverseproxy.Upstream{
-				Dial: net.JoinHostPort(addr, strconv.Itoa(entry.Port)),
-			}
+	// Browse 会阻塞直到 context 被取消，当它返回后，我们关闭 channel 来终止上面的 for-range 循环
+	close(entries)
+	mp.logger.Info("mDNS browser stopped.", zap.String("domain", domain))
+}
+
+// handleEntry 根据一条 mDNS 记录更新该域的实例。格式异常的记录导致 panic 时丢弃该记录，继续处理后续记录。
+func (mp *MdnsProvider) handleEntry(ctx context.Context, domain string, entry *zeroconf.ServiceEntry) {
+	defer discovery.Recover(mp.logger, "mDNS entry handler")
 
-			activeServices[entry.Instance] = upstream
-			mp.logger.Info("mDNS service instance found/updated",
+	// 当 TTL 为 0 时，表示服务实例已离开网络
+	if entry.TTL == 0 {
+		if mp.removeInstance(domain, entry.Instance) {
+			mp.logger.Info("mDNS service instance left",
 				zap.String("instance", entry.Instance),
-				zap.String("address", upstream.Dial),
+				zap.String("domain", domain),
 			)
-			mp.updateUpstreams(activeServices)
 		}
-	}()
+		return
+	}
+
+	// 同一个实例在多个网络接口上被发现时只使用一个地址，见 preferredAddr
+	addr := preferredAddr(entry.AddrIPv4, entry.AddrIPv6, mp.instanceAddr(domain, entry.Instance))
+	if addr == "" {
+		return
+	}
+
+	// TXT 记录中的 "key=value" 对作为实例的 metadata，其中 "weight" 作为权重
+	metadata := discovery.ParseTXT(entry.Text)
+	instance := discovery.NewInstance(
+		net.JoinHostPort(addr, strconv.Itoa(entry.Port)),
+		metadata,
+		discovery.ParseWeight(metadata, "weight"),
+	)
+	instance.ID = entry.Instance
+	instance.Hostname = mp.hostname(ctx, entry.HostName, addr)
+
+	mp.setInstance(domain, entry.Instance, instance)
+	mp.logger.Info("mDNS service instance found/updated",
+		zap.String("instance", entry.Instance),
+		zap.String("address", instance.Upstream.Dial),
+		zap.String("hostname", instance.Hostname),
+		zap.String("domain", domain),
+	)
+}
+
+// hostname 返回实例的主机名：优先使用 mDNS 记录中的 HostName，没有时使用按 IP 反向解析的缓存结果，
+// 还没有解析结果时返回空字符串。
+func (mp *MdnsProvider) hostname(ctx context.Context, advertised, ip string) string {
+	if advertised != "" {
+		return advertised
+	}
+	return mp.hostnames.get(ctx, ip)
+}
+
+// setInstance 记录某个域中新发现或更新的实例，并安排一次上游列表重建。
+func (mp *MdnsProvider) setInstance(domain, name string, in *discovery.Instance) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	services, ok := mp.domainServices[domain]
+	if !ok {
+		services = make(map[string]*discovery.Instance)
+		mp.domainServices[domain] = services
+	}
+	services[name] = in
+	mp.scheduleRebuild()
+}
+
+// instanceAddr 返回某个域中实例当前使用的地址（不含端口），实例不存在时返回空字符串。
+func (mp *MdnsProvider) instanceAddr(domain, name string) string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
 
-	mp.logger.Info("starting mDNS browser...")
-	err = resolver.Browse(ctx, mp.ServiceName, mp.Domain, entries)
+	in, ok := mp.domainServices[domain][name]
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(in.Upstream.Dial)
 	if err != nil {
-		mp.logger.Error("mDNS browse failed to start", zap.Error(err))
+		return ""
 	}
+	return host
+}
 
-	// Browse 会阻塞直到 context 被取消，当它返回后，我们关闭 channel 来终止上面的 for-range 循环
-	close(entries)
-	mp.logger.Info("mDNS browser stopped.")
+// removeInstance 删除某个域中已离开的实例，实例存在时安排一次上游列表重建并返回 true。
+func (mp *MdnsProvider) removeInstance(domain, name string) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if _, ok := mp.domainServices[domain][name]; !ok {
+		return false
+	}
+	delete(mp.domainServices[domain], name)
+	mp.scheduleRebuild()
+	return true
 }
 
-// updateUpstreams 是一个线程安全的辅助函数，用于用 map 中的数据更新上游切片。
-func (mp *MdnsProvider) updateUpstreams(activeServices map[string]*reverseproxy.Upstream) {
-	newUpstreams := make([]*reverseproxy.Upstream, 0, len(activeServices))
-	for _, up := range activeServices {
-		newUpstreams = append(newUpstreams, up)
+// scheduleRebuild 在 rebuildDelay 之后重建上游列表，已经安排过时不重复安排。
+// 调用方必须持有 mp.mu。
+func (mp *MdnsProvider) scheduleRebuild() {
+	if mp.rebuildTimer == nil {
+		mp.rebuildTimer = time.AfterFunc(rebuildDelay, mp.updateUpstreams)
 	}
+}
 
+// updateUpstreams 将所有域的实例合并后更新上游切片，同一地址在多个域中出现时只保留一个。
+func (mp *MdnsProvider) updateUpstreams() {
+	defer metrics.ObserveRefresh("mdns", mp.ServiceName, time.Now())
+	endSpan := tracing.StartRefresh("mdns", mp.ServiceName)
+	defer func() {
+		count := len(mp.Store.Instances())
+		endSpan(count, nil)
+		metrics.RecordResult("mdns", mp.ServiceName, count, nil)
+	}()
+
+	// 持有锁直到 Store 更新完成，保证先后两次重建按顺序发布
 	mp.mu.Lock()
-	mp.upstreams = newUpstreams
-	mp.mu.Unlock()
+	defer mp.mu.Unlock()
 
-	mp.logger.Debug("updated upstreams from mDNS", zap.Int("count", len(newUpstreams)))
+	mp.rebuildTimer = nil
+	var instances []*discovery.Instance
+	seen := make(map[string]struct{})
+	for _, d := range mp.domains() {
+		for name, in := range mp.domainServices[d] {
+			if _, ok := mp.subtypeMembers[d][name]; mp.Subtype != "" && !ok {
+				continue
+			}
+			if _, ok := seen[in.Upstream.Dial]; ok {
+				continue
+			}
+			seen[in.Upstream.Dial] = struct{}{}
+			instances = append(instances, in)
+		}
+	}
+
+	// 实例重新通告（例如 TTL 刷新）时内容往往没有变化，此时跳过整个更新流程
+	if mp.Store.Unchanged(instances) {
+		return
+	}
+	if !mp.Store.Update(instances) {
+		return
+	}
+
+	mp.logger.Debug("updated upstreams from mDNS", zap.Int("count", len(instances)))
+}
+
+// MarshalConfig 返回用于管理接口的配置，mDNS 提供者没有敏感配置。
+func (mp *MdnsProvider) MarshalConfig() any {
+	return discovery.RedactConfig(mp)
 }
 
 // Validate 检查必要的配置是否已提供。
@@ -137,6 +279,17 @@ func (mp *MdnsProvider) Validate() error {
 	if mp.ServiceName == "" {
 		return fmt.Errorf("mdns provider: service_name is required (e.g., '_http._tcp')")
 	}
+	if err := mp.Store.ValidateInterval("browse_timeout", mp.BrowseTimeout); err != nil {
+		return fmt.Errorf("mdns provider: %v", err)
+	}
+	if mp.Subtype != "" {
+		if err := validateSubtype(mp.Subtype); err != nil {
+			return fmt.Errorf("mdns provider: %v", err)
+		}
+	}
+	if err := mp.Store.Validate(); err != nil {
+		return fmt.Errorf("mdns provider: %v", err)
+	}
 	return nil
 }
 
@@ -146,18 +299,23 @@ func (mp *MdnsProvider) Cleanup() error {
 	if mp.cancelFunc != nil {
 		mp.cancelFunc()
 	}
+
+	mp.mu.Lock()
+	if mp.rebuildTimer != nil {
+		mp.rebuildTimer.Stop()
+		mp.rebuildTimer = nil
+	}
+	mp.mu.Unlock()
 	return nil
 }
 
 // GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
 func (mp *MdnsProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	mp.mu.RLock()
-	defer mp.mu.RUnlock()
-
-	if len(mp.upstreams) == 0 {
+	upstreams := mp.Store.Upstreams()
+	if len(upstreams) == 0 {
 		return nil, fmt.Errorf("no mDNS instances available for service: %s", mp.ServiceName)
 	}
-	return mp.upstreams, nil
+	return upstreams, nil
 }
 
 // UnmarshalCaddyfile 解析 mDNS 提供者特有的 Caddyfile 配置块。
@@ -170,10 +328,21 @@ func (mp *MdnsProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			mp.ServiceName = d.Val()
 		case "domain":
+			// domain <domain...>，指定多个域时会同时浏览并合并结果
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			if len(args) == 1 {
+				mp.Domain = args[0]
+			} else {
+				mp.Domains = args
+			}
+		case "subtype":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			mp.Domain = d.Val()
+			mp.Subtype = d.Val()
 		case "browse_timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -184,7 +353,13 @@ func (mp *MdnsProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			mp.BrowseTimeout = dur
 		default:
-			return d.Errf("unrecognized mdns subdirective '%s'", d.Val())
+			ok, err := mp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized mdns subdirective '%s'", d.Val())
+			}
 		}
 	}
 	return nil
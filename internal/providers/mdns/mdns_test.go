@@ -0,0 +1,403 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// newTestProvider 返回一个不启动浏览器、只用于驱动 handleEntry 的 provider。
+func newTestProvider(logger *zap.Logger) *MdnsProvider {
+	mp := New()
+	mp.ServiceName = "_http._tcp"
+	mp.logger = mp.Store.Setup(logger, mp.ServiceName)
+	mp.domainServices = make(map[string]map[string]*discovery.Instance)
+	mp.subtypeMembers = make(map[string]map[string]struct{})
+	mp.hostnames = newHostnameCache(mp.logger)
+	return mp
+}
+
+// testEntries 返回 n 条不同实例的 mDNS 记录，每条都带有 HostName，不会触发反向解析。
+func testEntries(n int) []*zeroconf.ServiceEntry {
+	entries := make([]*zeroconf.ServiceEntry, n)
+	for i := range entries {
+		e := zeroconf.NewServiceEntry(fmt.Sprintf("instance-%d", i), "_http._tcp", "local.")
+		e.HostName = fmt.Sprintf("host-%d.local.", i)
+		e.Port = 8080
+		e.TTL = 120
+		e.AddrIPv4 = []net.IP{net.IPv4(10, 0, byte(i/256), byte(i%256))}
+		entries[i] = e
+	}
+	return entries
+}
+
+// flushRebuild 立即执行已安排的重建，代替等待 rebuildDelay。定时器已经触发时等待那次重建完成。
+func (mp *MdnsProvider) flushRebuild() {
+	mp.mu.Lock()
+	timer := mp.rebuildTimer
+	mp.mu.Unlock()
+	if timer == nil {
+		return
+	}
+	if timer.Stop() {
+		mp.updateUpstreams()
+		return
+	}
+	for {
+		mp.mu.Lock()
+		done := mp.rebuildTimer == nil
+		mp.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// assertMatchesServices 检查发布的上游与 domainServices 中的实例完全一致。
+func assertMatchesServices(tb testing.TB, mp *MdnsProvider) {
+	tb.Helper()
+	want := make(map[string]struct{})
+	for _, in := range mp.domainServices[mp.Domain] {
+		want[in.Upstream.Dial] = struct{}{}
+	}
+	ups := mp.Store.Upstreams()
+	if len(ups) != len(want) {
+		tb.Fatalf("got %d upstreams, want %d", len(ups), len(want))
+	}
+	for _, up := range ups {
+		if _, ok := want[up.Dial]; !ok {
+			tb.Fatalf("upstream %s is not in the instance map", up.Dial)
+		}
+	}
+}
+
+func TestHandleEntryBurstPublishesFinalSet(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	entries := testEntries(100)
+	for _, e := range entries {
+		mp.handleEntry(context.Background(), mp.Domain, e)
+	}
+	// 一部分实例在同一批事件中离开
+	for _, e := range entries[:10] {
+		left := *e
+		left.TTL = 0
+		mp.handleEntry(context.Background(), mp.Domain, &left)
+	}
+	mp.flushRebuild()
+
+	if got := len(mp.Store.Upstreams()); got != 90 {
+		t.Fatalf("got %d upstreams, want 90", got)
+	}
+	assertMatchesServices(t, mp)
+}
+
+// BenchmarkHandleEntryBurst 比较 1000 条 mDNS 记录合并为一次重建（coalesced）与每条记录都重建一次（per_event）的开销。
+func BenchmarkHandleEntryBurst(b *testing.B) {
+	entries := testEntries(1000)
+	ctx := context.Background()
+
+	b.Run("coalesced", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			mp := newTestProvider(zap.NewNop())
+			b.StartTimer()
+
+			for _, e := range entries {
+				mp.handleEntry(ctx, mp.Domain, e)
+			}
+			mp.flushRebuild()
+
+			b.StopTimer()
+			assertMatchesServices(b, mp)
+			b.StartTimer()
+		}
+	})
+
+	b.Run("per_event", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			mp := newTestProvider(zap.NewNop())
+			b.StartTimer()
+
+			for _, e := range entries {
+				mp.handleEntry(ctx, mp.Domain, e)
+				mp.flushRebuild()
+			}
+
+			b.StopTimer()
+			assertMatchesServices(b, mp)
+			b.StartTimer()
+		}
+	})
+}
+
+func TestRepeatedAnnouncementsSkipUpdate(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	updates := 0
+	mp.Store.OnUpdate(func([]*discovery.Instance) { updates++ })
+
+	entries := testEntries(3)
+	for _, e := range entries {
+		mp.handleEntry(context.Background(), mp.Domain, e)
+	}
+	mp.flushRebuild()
+	first := mp.Store.Upstreams()
+
+	// TTL 刷新时实例以相同的内容重新通告
+	for _, e := range entries {
+		mp.handleEntry(context.Background(), mp.Domain, e)
+	}
+	mp.flushRebuild()
+	second := mp.Store.Upstreams()
+	if updates != 1 || &first[0] != &second[0] {
+		t.Fatalf("got %d updates, swapped=%v; want 1 update and no swap", updates, &first[0] != &second[0])
+	}
+}
+
+// upstreamDials 返回当前发布的上游地址，按字典序排列。
+func upstreamDials(mp *MdnsProvider) []string {
+	var dials []string
+	for _, up := range mp.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	slices.Sort(dials)
+	return dials
+}
+
+func TestMultipleDomainsMerge(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	mp.Domains = []string{"local.", "corp.example."}
+	ctx := context.Background()
+
+	entries := testEntries(3)
+	mp.handleEntry(ctx, "local.", entries[0])
+	mp.handleEntry(ctx, "local.", entries[1])
+	// 另一个域中有一个同名实例和一个与 local. 中地址相同的实例
+	corp := testEntries(3)
+	corp[0].AddrIPv4 = []net.IP{net.IPv4(10, 1, 0, 1)}
+	mp.handleEntry(ctx, "corp.example.", corp[0])
+	mp.handleEntry(ctx, "corp.example.", corp[2])
+	dup := *corp[1]
+	dup.Instance = "instance-dup"
+	mp.handleEntry(ctx, "corp.example.", &dup)
+	mp.flushRebuild()
+
+	want := []string{"10.0.0.0:8080", "10.0.0.1:8080", "10.0.0.2:8080", "10.1.0.1:8080"}
+	if got := upstreamDials(mp); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want the merged and deduplicated domains %v", got, want)
+	}
+
+	// 实例离开只影响其所在的域
+	left := *entries[0]
+	left.TTL = 0
+	mp.handleEntry(ctx, "local.", &left)
+	mp.flushRebuild()
+	want = []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.1.0.1:8080"}
+	if got := upstreamDials(mp); !slices.Equal(got, want) {
+		t.Fatalf("got %v after instance-0 left local., want %v", got, want)
+	}
+}
+
+func TestSubtypeBrowseService(t *testing.T) {
+	mp := New()
+	mp.ServiceName = "_http._tcp."
+	if got := mp.browseService(); got != "_http._tcp" {
+		t.Fatalf("got %q without a subtype, want the plain service", got)
+	}
+	mp.Subtype = "_printer"
+	if got := mp.browseService(); got != "_printer._sub._http._tcp" {
+		t.Fatalf("got %q, want the subtype-qualified service", got)
+	}
+	if got := fqdn(mp.browseService(), "local"); got != "_printer._sub._http._tcp.local." {
+		t.Fatalf("got query name %q", got)
+	}
+
+	for _, subtype := range []string{"_printer", "_ipp-2", "_a_b"} {
+		if err := validateSubtype(subtype); err != nil {
+			t.Errorf("%s: %v", subtype, err)
+		}
+	}
+	for _, subtype := range []string{"printer", "_", "_printer._sub", "_prin ter", "_" + strings.Repeat("a", 63)} {
+		if err := validateSubtype(subtype); err == nil {
+			t.Errorf("%s: got nil error", subtype)
+		}
+	}
+}
+
+func TestSubtypePublishesOnlyMembers(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	mp.Subtype = "_printer"
+	ctx := context.Background()
+	for _, e := range testEntries(3) {
+		mp.handleEntry(ctx, mp.Domain, e)
+	}
+	mp.flushRebuild()
+	// 还没有查询到子类型成员时不发布任何实例
+	if got := upstreamDials(mp); len(got) != 0 {
+		t.Fatalf("got %v before the subtype query, want none", got)
+	}
+
+	mp.setSubtypeMembers(mp.Domain, map[string]struct{}{"instance-0": {}, "instance-2": {}})
+	mp.flushRebuild()
+	if got, want := upstreamDials(mp), []string{"10.0.0.0:8080", "10.0.0.2:8080"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want the subtype members %v", got, want)
+	}
+}
+
+func TestQuerySubtype(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	// 查询改为发往本地的假响应者
+	group := mdnsGroup
+	mdnsGroup = responder.LocalAddr().(*net.UDPAddr)
+	defer func() { mdnsGroup = group }()
+
+	const qname, base = "_printer._sub._http._tcp.local.", "_http._tcp.local."
+	go func() {
+		buf := make([]byte, 65536)
+		n, from, err := responder.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+		ptr := func(name, target string, ttl uint32) dns.RR {
+			return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: target}
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(&query)
+		resp.Answer = []dns.RR{
+			ptr(qname, "office._http._tcp.local.", 120),
+			ptr(qname, "gone._http._tcp.local.", 0),
+			ptr("_other._sub._http._tcp.local.", "scanner._http._tcp.local.", 120),
+		}
+		resp.Extra = []dns.RR{ptr(qname, "lobby._http._tcp.local.", 120)}
+		packed, _ := resp.Pack()
+		responder.WriteTo(packed, from)
+		// 其他查询的响应被忽略
+		other := new(dns.Msg)
+		other.SetQuestion(qname, dns.TypePTR)
+		other.Id = query.Id + 1
+		other.Answer = []dns.RR{ptr(qname, "stale._http._tcp.local.", 120)}
+		packed, _ = other.Pack()
+		responder.WriteTo(packed, from)
+	}()
+
+	members, err := querySubtype(context.Background(), qname, base, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct{}{"office": {}, "lobby": {}}
+	if !maps.Equal(members, want) {
+		t.Fatalf("got members %v, want %v", members, want)
+	}
+}
+
+func TestMultiInterfaceSightingsKeepOneAddress(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	ctx := context.Background()
+	sighting := func(addrs ...string) *zeroconf.ServiceEntry {
+		e := testEntries(1)[0]
+		e.AddrIPv4, e.AddrIPv6 = nil, nil
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip.To4() != nil {
+				e.AddrIPv4 = append(e.AddrIPv4, ip)
+			} else {
+				e.AddrIPv6 = append(e.AddrIPv6, ip)
+			}
+		}
+		return e
+	}
+
+	// 同一个实例先后从多个网络接口被发现：IPv4 优先于 IPv6，之后继续使用仍被通告的地址
+	mp.handleEntry(ctx, mp.Domain, sighting("fe80::1", "192.168.1.5"))
+	mp.handleEntry(ctx, mp.Domain, sighting("10.0.2.5", "192.168.1.5"))
+	mp.handleEntry(ctx, mp.Domain, sighting("2001:db8::5", "192.168.1.5", "10.0.2.5"))
+	mp.flushRebuild()
+	if got, want := upstreamDials(mp), []string{"192.168.1.5:8080"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want one upstream for the instance %v", got, want)
+	}
+
+	// 上一次使用的地址不再被通告时才切换
+	mp.handleEntry(ctx, mp.Domain, sighting("2001:db8::5", "fe80::1"))
+	mp.flushRebuild()
+	if got, want := upstreamDials(mp), []string{"[2001:db8::5]:8080"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestPreferredAddr(t *testing.T) {
+	ips := func(addrs ...string) []net.IP {
+		var out []net.IP
+		for _, a := range addrs {
+			out = append(out, net.ParseIP(a))
+		}
+		return out
+	}
+	tests := []struct {
+		ipv4, ipv6 []net.IP
+		previous   string
+		want       string
+	}{
+		{ips("192.168.1.5", "10.0.2.5"), nil, "", "10.0.2.5"},
+		{ips("192.168.1.5", "10.0.2.5"), nil, "192.168.1.5", "192.168.1.5"},
+		{ips("10.0.2.5"), ips("2001:db8::5"), "2001:db8::5", "2001:db8::5"},
+		{nil, ips("fe80::1", "2001:db8::5"), "", "2001:db8::5"},
+		{nil, ips("fe80::1"), "10.0.2.5", "fe80::1"},
+		{ips("0.0.0.0"), nil, "", ""},
+	}
+	for _, tt := range tests {
+		if got := preferredAddr(tt.ipv4, tt.ipv6, tt.previous); got != tt.want {
+			t.Errorf("preferredAddr(%v, %v, %q) = %q, want %q", tt.ipv4, tt.ipv6, tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestTXTRecordsBecomeMetadata(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	e := testEntries(1)[0]
+	e.Text = []string{"version=v2", "weight=3", "secure"}
+	mp.handleEntry(context.Background(), mp.Domain, e)
+	mp.flushRebuild()
+
+	instances := mp.Store.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("got %d instances, want 1", len(instances))
+	}
+	in := instances[0]
+	if in.Metadata["version"] != "v2" || in.Weight != 3 {
+		t.Fatalf("got metadata %v and weight %v, want version=v2 and weight 3", in.Metadata, in.Weight)
+	}
+	if v, ok := in.Meta("secure"); !ok || v != "" {
+		t.Fatalf("got %q, %v for a key without a value, want an empty value", v, ok)
+	}
+}
+
+func TestInstanceNameBecomesID(t *testing.T) {
+	mp := newTestProvider(zap.NewNop())
+	mp.handleEntry(context.Background(), mp.Domain, testEntries(1)[0])
+	mp.flushRebuild()
+
+	if instances := mp.Store.Instances(); len(instances) != 1 || instances[0].ID != "instance-0" {
+		t.Fatalf("got %v, want one instance with ID instance-0", instances)
+	}
+}
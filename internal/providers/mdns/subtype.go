@@ -0,0 +1,142 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// subtypeRefreshInterval 是重新查询子类型成员的间隔，成员变化时重建上游列表。
+const subtypeRefreshInterval = 30 * time.Second
+
+// mdnsGroup 是 mDNS 的 IPv4 组播地址。
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// validateSubtype 检查子类型是否为 "_printer" 形式的单个 DNS 标签。
+func validateSubtype(subtype string) error {
+	label, ok := strings.CutPrefix(subtype, "_")
+	if !ok || label == "" || len(subtype) > 63 {
+		return fmt.Errorf("subtype must be a single DNS label starting with '_' (e.g., '_printer'), got '%s'", subtype)
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("subtype '%s' contains invalid character %q", subtype, c)
+		}
+	}
+	return nil
+}
+
+// browseService 返回按子类型浏览的服务类型，例如 "_printer._sub._http._tcp"，没有设置 Subtype 时为 ServiceName。
+func (mp *MdnsProvider) browseService() string {
+	service := strings.Trim(mp.ServiceName, ".")
+	if mp.Subtype == "" {
+		return service
+	}
+	return mp.Subtype + "._sub." + service
+}
+
+// fqdn 返回服务类型 service 在 domain 中的完整名称，例如 "_http._tcp.local."。
+func fqdn(service, domain string) string {
+	return fmt.Sprintf("%s.%s.", strings.Trim(service, "."), strings.Trim(domain, "."))
+}
+
+// runSubtypeQueries 定期查询 domain 中属于 Subtype 的实例，直到 ctx 被取消。
+//
+// zeroconf 浏览子类型时会丢弃实例的 SRV 和 TXT 记录，因此仍由 zeroconf 浏览完整的服务类型，
+// 这里只按子类型查询成员，updateUpstreams 只发布成员实例。查询失败时保留上一次的成员。
+func (mp *MdnsProvider) runSubtypeQueries(ctx context.Context, domain string) {
+	qname := fqdn(mp.browseService(), domain)
+	for {
+		members, err := querySubtype(ctx, qname, fqdn(mp.ServiceName, domain), mp.BrowseTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			mp.logger.Warn("mDNS subtype query failed, keeping previous members",
+				zap.String("query", qname),
+				zap.Error(err),
+			)
+		} else {
+			mp.setSubtypeMembers(domain, members)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(subtypeRefreshInterval):
+		}
+	}
+}
+
+// setSubtypeMembers 记录某个域中属于 Subtype 的实例，成员变化时安排一次上游列表重建。
+func (mp *MdnsProvider) setSubtypeMembers(domain string, members map[string]struct{}) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if previous, ok := mp.subtypeMembers[domain]; ok && maps.Equal(previous, members) {
+		return
+	}
+	mp.subtypeMembers[domain] = members
+	mp.logger.Debug("mDNS subtype members changed", zap.String("domain", domain), zap.Int("count", len(members)))
+	mp.scheduleRebuild()
+}
+
+// querySubtype 以传统单播的方式（源端口不是 5353，见 RFC 6762 6.7 节）向组播地址发送 qname 的 PTR 查询，
+// 响应者直接单播回复。在 timeout 内收集所有响应，返回 PTR 记录指向的实例名（去掉 base 后缀，与 zeroconf 的
+// ServiceEntry.Instance 一致）。查询从系统默认的组播接口发出。
+func querySubtype(ctx context.Context, qname, base string, timeout time.Duration) (map[string]struct{}, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("opening socket: %v", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	query := new(dns.Msg)
+	query.SetQuestion(qname, dns.TypePTR)
+	query.RecursionDesired = false
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing query: %v", err)
+	}
+	if _, err := conn.WriteTo(packed, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("sending query: %v", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	members := make(map[string]struct{})
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return members, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading responses: %v", err)
+		}
+		var resp dns.Msg
+		if err := resp.Unpack(buf[:n]); err != nil || resp.Id != query.Id {
+			continue
+		}
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			ptr, ok := rr.(*dns.PTR)
+			if !ok || !strings.EqualFold(ptr.Hdr.Name, qname) || ptr.Hdr.Ttl == 0 {
+				continue
+			}
+			if instance, ok := strings.CutSuffix(ptr.Ptr, base); ok {
+				members[strings.Trim(instance, ".")] = struct{}{}
+			}
+		}
+	}
+}
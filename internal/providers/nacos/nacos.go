@@ -2,14 +2,22 @@
 package nacos
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
 	"github.com/nacos-group/nacos-sdk-go/v2/clients"
 	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
 	"github.com/nacos-group/nacos-sdk-go/v2/common/constant"
@@ -27,13 +35,36 @@ type NacosProvider struct {
 	NamespaceID string   `json:"namespace_id,omitempty"`
 	ServiceName string   `json:"service_name,omitempty"`
 	GroupName   string   `json:"group_name,omitempty"`
+	Groups      []string `json:"groups,omitempty"` // 同时订阅的多个分组，设置后优先于 GroupName
 	Clusters    []string `json:"clusters,omitempty"`
 
+	// PortMetadataKey 指定从实例 metadata 的哪个 key 中读取流量端口（如 "http_port"），
+	// 用于一个实例在 metadata 中登记了多个端口的场景。key 不存在或非法时回退到实例的端口。
+	PortMetadataKey string `json:"port_metadata_key,omitempty"`
+
+	// MaxInstances 限制服务的实例数，超过时按地址的哈希值保留固定的一部分实例，
+	// 使超大服务不会占用过多的内存和处理时间。0 表示不限制。
+	MaxInstances int `json:"max_instances,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
 	// --- 内部状态 ---
 	client    naming_client.INamingClient
+	clientKey string
 	logger    *zap.Logger
-	upstreams []*reverseproxy.Upstream
-	mu        sync.RWMutex
+	// subscriptions 和 subscriptionKeys 是本 provider 加入的共享订阅及其在 subscriptionPool 中的 key。
+	subscriptions    []*sharedSubscription
+	subscriptionKeys []string
+	// groupInstances 按分组记录各自的实例列表，每次回调后合并写入 Store。
+	groupInstances map[string][]*discovery.Instance
+	// groupSeq 和 groupHash 记录每个分组最后一次应用的推送编号（由共享订阅按到达顺序编号）和内容哈希，
+	// 用于丢弃晚到的旧推送和内容没有变化的重复推送。SDK 的回调不带版本号，只能依据到达顺序判断新旧。
+	groupSeq  map[string]uint64
+	groupHash map[string]uint64
+	// truncated 是上一次合并时因 MaxInstances 丢弃的实例数，只在变化时记录日志。
+	truncated int
+	mu        sync.Mutex
 }
 
 // New 是一个构造函数，返回一个 NacosProvider 的新实例。
@@ -47,13 +78,45 @@ func New() *NacosProvider {
 
 // Provision 初始化 Nacos 客户端并订阅服务。
 func (np *NacosProvider) Provision(logger *zap.Logger) error {
-	// 1. 直接将传入的 logger 赋值给结构体字段。
-	np.logger = logger
+	// 1. 以服务名（或 logger_name）为名创建子 logger 并赋值给结构体字段。
+	np.logger = np.Store.Setup(logger, np.ServiceName)
 	np.logger.Info("provisioning nacos service discovery provider",
 		zap.String("service", np.ServiceName),
-		zap.String("group", np.GroupName),
+		zap.Strings("groups", np.groups()),
 	)
+	np.groupInstances = make(map[string][]*discovery.Instance)
+	np.groupSeq = make(map[string]uint64)
+	np.groupHash = make(map[string]uint64)
+
+	// 获取 Nacos 客户端，连接同一个 Nacos 服务器和命名空间的 provider 共享一个客户端
+	np.clientKey = fmt.Sprintf("%s:%d/%s", np.ServerAddr, np.ServerPort, np.NamespaceID)
+	// 创建客户端和订阅都需要连接 Nacos 服务器，失败时按 DiscoveryError 返回
+	val, _, err := clientPool.LoadOrNew(np.clientKey, np.newSharedClient)
+	if err != nil {
+		return discovery.AsDiscoveryError(err)
+	}
+	np.client = val.(*sharedClient).INamingClient
 
+	// 订阅服务变更
+	return np.subscribeToServiceChanges()
+}
+
+// clientPool 按服务器地址和命名空间共享 Nacos 客户端，最后一个使用者 Cleanup 时才关闭。
+var clientPool = caddy.NewUsagePool()
+
+// sharedClient 是 clientPool 中保存的客户端。
+type sharedClient struct {
+	naming_client.INamingClient
+}
+
+// Destruct 在最后一个使用者释放客户端时关闭它。
+func (c *sharedClient) Destruct() error {
+	c.CloseClient()
+	return nil
+}
+
+// newSharedClient 按当前配置创建一个新的 Nacos 客户端。
+func (np *NacosProvider) newSharedClient() (caddy.Destructor, error) {
 	sc := []constant.ServerConfig{
 		*constant.NewServerConfig(np.ServerAddr, np.ServerPort),
 	}
@@ -67,61 +130,243 @@ func (np *NacosProvider) Provision(logger *zap.Logger) error {
 		constant.WithLogLevel("warn"),
 	)
 
-	var err error
-	np.client, err = clients.NewNamingClient(
+	client, err := clients.NewNamingClient(
 		vo.NacosClientParam{
 			ClientConfig:  cc,
 			ServerConfigs: sc,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("creating nacos naming client: %v", err)
+		return nil, fmt.Errorf("creating nacos naming client: %v", err)
 	}
+	return &sharedClient{INamingClient: client}, nil
+}
 
-	// 订阅服务变更
-	return np.subscribeToServiceChanges()
+// groups 返回需要订阅的分组列表。
+func (np *NacosProvider) groups() []string {
+	if len(np.Groups) > 0 {
+		return np.Groups
+	}
+	return []string{np.GroupName}
 }
 
-// subscribeToServiceChanges 设置对 Nacos 服务的订阅。
+// subscribeToServiceChanges 为每个分组加入对 Nacos 服务的共享订阅，
+// 订阅条件完全相同的 provider 共享一个订阅，避免对 Nacos 重复订阅。
 func (np *NacosProvider) subscribeToServiceChanges() error {
-	subscribeParam := &vo.SubscribeParam{
-		ServiceName: np.ServiceName,
-		GroupName:   np.GroupName,
-		Clusters:    np.Clusters,
-		SubscribeCallback: func(services []model.Instance, err error) {
-			if err != nil {
-				np.logger.Error("nacos subscription callback error", zap.Error(err))
-				return
-			}
+	for _, group := range np.groups() {
+		key := np.subscriptionKey(group)
+		val, _, err := subscriptionPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return np.newSharedSubscription(group)
+		})
+		if err != nil {
+			return discovery.AsDiscoveryError(fmt.Errorf("subscribing to nacos service '%s' in group '%s': %v", np.ServiceName, group, err))
+		}
+		sub := val.(*sharedSubscription)
+		np.subscriptions = append(np.subscriptions, sub)
+		np.subscriptionKeys = append(np.subscriptionKeys, key)
+		sub.subscribe(np)
+	}
+	return nil
+}
 
-			var newUpstreams []*reverseproxy.Upstream
-			for _, service := range services {
-				// 只选择健康且已启用的实例
-				if service.Enable && service.Healthy {
-					newUpstreams = append(newUpstreams, &reverseproxy.Upstream{
-						Dial: net.JoinHostPort(service.Ip, strconv.FormatUint(service.Port, 10)),
-					})
-				}
-			}
+// onServices 处理共享订阅推送的一个分组的实例列表，只更新该分组的上游列表。
+// seq 是推送的到达顺序编号。
+func (np *NacosProvider) onServices(group string, seq uint64, services []model.Instance, err error) {
+	// 推送通常在 Nacos SDK 的 goroutine 中处理，格式异常的推送数据不能导致进程崩溃
+	defer discovery.Recover(np.logger, "nacos subscribe callback")
+	defer metrics.ObserveRefresh("nacos", np.ServiceName, time.Now())
+	endSpan := tracing.StartRefresh("nacos", np.ServiceName)
+	defer func() {
+		count := len(np.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("nacos", np.ServiceName, count, err)
+	}()
+
+	if err != nil {
+		np.logger.Error("nacos subscription callback error",
+			zap.String("group", group),
+			zap.Error(err),
+		)
+		return
+	}
+
+	var groupInstances []*discovery.Instance
+	for _, service := range services {
+		// 只选择健康且已启用的实例
+		if service.Enable && service.Healthy {
+			in := discovery.NewInstance(
+				net.JoinHostPort(service.Ip, strconv.FormatUint(np.servicePort(service), 10)),
+				service.Metadata,
+				service.Weight,
+			)
+			in.ID = service.InstanceId
+			groupInstances = append(groupInstances, in)
+		}
+	}
 
-			np.mu.Lock()
-			np.upstreams = newUpstreams
-			np.mu.Unlock()
+	hash := discovery.HashInstances(groupInstances)
+	// 在闭包中持有锁并用 defer 释放，合并或更新过程中 panic 时锁也会被释放，后续回调不会死锁
+	var merged []*discovery.Instance
+	stale, applied := false, false
+	func() {
+		np.mu.Lock()
+		defer np.mu.Unlock()
+		// 同一分组并发的回调中，先到达的回调可能后拿到锁，此时它的数据已经过时
+		if seq < np.groupSeq[group] {
+			stale = true
+			return
+		}
+		np.groupSeq[group] = seq
+		if prev, ok := np.groupHash[group]; ok && prev == hash {
+			return
+		}
+		np.groupHash[group] = hash
+		np.groupInstances[group] = groupInstances
+		merged = np.capInstances(np.mergeGroupInstances())
+		applied = np.Store.Update(merged)
+	}()
+	if stale {
+		np.logger.Debug("ignoring stale nacos callback",
+			zap.String("service", np.ServiceName),
+			zap.String("group", group),
+		)
+		return
+	}
+	if !applied {
+		return
+	}
+
+	np.logger.Debug("updated upstreams from nacos",
+		zap.String("service", np.ServiceName),
+		zap.String("group", group),
+		zap.Int("group_count", len(groupInstances)),
+		zap.Int("count", len(merged)),
+	)
+}
+
+// mergeGroupInstances 按分组顺序合并各分组的实例列表，并按 Dial 去重。
+// 调用方必须持有 np.mu。
+func (np *NacosProvider) mergeGroupInstances() []*discovery.Instance {
+	var merged []*discovery.Instance
+	seen := make(map[string]struct{})
+	for _, group := range np.groups() {
+		for _, in := range np.groupInstances[group] {
+			if _, ok := seen[in.Upstream.Dial]; ok {
+				continue
+			}
+			seen[in.Upstream.Dial] = struct{}{}
+			merged = append(merged, in)
+		}
+	}
+	return merged
+}
 
-			np.logger.Debug("updated upstreams from nacos",
+// capInstances 在实例数超过 MaxInstances 时，按地址的 FNV 哈希值从小到大保留 MaxInstances 个实例，
+// 并保持原来的顺序。同一组实例总是得到同一个子集，实例增减时已保留的实例大多不受影响。
+// 调用方必须持有 np.mu。
+func (np *NacosProvider) capInstances(instances []*discovery.Instance) []*discovery.Instance {
+	if np.MaxInstances <= 0 || len(instances) <= np.MaxInstances {
+		if np.truncated > 0 {
+			np.logger.Info("nacos service is back within max_instances",
 				zap.String("service", np.ServiceName),
-				zap.Int("count", len(newUpstreams)),
+				zap.Int("count", len(instances)),
 			)
-		},
+		}
+		np.truncated = 0
+		return instances
+	}
+
+	hashes := make(map[*discovery.Instance]uint32, len(instances))
+	ranked := make([]*discovery.Instance, len(instances))
+	copy(ranked, instances)
+	for _, in := range ranked {
+		h := fnv.New32a()
+		h.Write([]byte(in.Upstream.Dial))
+		hashes[in] = h.Sum32()
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if hashes[ranked[i]] != hashes[ranked[j]] {
+			return hashes[ranked[i]] < hashes[ranked[j]]
+		}
+		return ranked[i].Upstream.Dial < ranked[j].Upstream.Dial
+	})
+	keep := make(map[*discovery.Instance]struct{}, np.MaxInstances)
+	for _, in := range ranked[:np.MaxInstances] {
+		keep[in] = struct{}{}
+	}
+	capped := make([]*discovery.Instance, 0, np.MaxInstances)
+	for _, in := range instances {
+		if _, ok := keep[in]; ok {
+			capped = append(capped, in)
+		}
 	}
 
-	if err := np.client.Subscribe(subscribeParam); err != nil {
-		return fmt.Errorf("subscribing to nacos service '%s': %v", np.ServiceName, err)
+	if dropped := len(instances) - len(capped); dropped != np.truncated {
+		np.logger.Warn("nacos service exceeds max_instances, keeping a subset",
+			zap.String("service", np.ServiceName),
+			zap.Int("count", len(instances)),
+			zap.Int("max_instances", np.MaxInstances),
+			zap.Int("dropped", dropped),
+		)
+		np.truncated = dropped
 	}
+	return capped
+}
 
+// servicePort 返回实例的流量端口，配置了 PortMetadataKey 时优先从 metadata 中读取。
+func (np *NacosProvider) servicePort(service model.Instance) uint64 {
+	if np.PortMetadataKey == "" {
+		return service.Port
+	}
+	value, ok := service.Metadata[np.PortMetadataKey]
+	if !ok {
+		return service.Port
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		np.logger.Warn("invalid port in nacos instance metadata, using service port",
+			zap.String("instance", service.InstanceId),
+			zap.String("key", np.PortMetadataKey),
+			zap.String("value", value),
+		)
+		return service.Port
+	}
+	return port
+}
+
+// ValidateConnectivity 创建一个独立的 Nacos 客户端并查询一次每个分组的实例，不建立订阅。
+// Nacos SDK 不支持 context，单次请求的超时由客户端配置的 5 秒决定。
+func (np *NacosProvider) ValidateConnectivity(ctx context.Context) error {
+	val, err := np.newSharedClient()
+	if err != nil {
+		return err
+	}
+	client := val.(*sharedClient)
+	defer client.Destruct()
+
+	for _, group := range np.groups() {
+		_, err := client.SelectAllInstances(vo.SelectAllInstancesParam{
+			ServiceName: np.ServiceName,
+			GroupName:   group,
+			Clusters:    np.Clusters,
+		})
+		if err != nil {
+			return fmt.Errorf("querying nacos service '%s' in group '%s': %v", np.ServiceName, group, err)
+		}
+	}
 	return nil
 }
 
+// RegistryAddresses 返回 Nacos 服务器的地址。
+func (np *NacosProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(np.ServerAddr, strconv.FormatUint(np.ServerPort, 10))
+}
+
+// MarshalConfig 返回用于管理接口的配置，Nacos 提供者没有敏感配置。
+func (np *NacosProvider) MarshalConfig() any {
+	return discovery.RedactConfig(np)
+}
+
 // Validate 检查必要的配置是否已提供。
 func (np *NacosProvider) Validate() error {
 	if np.ServerAddr == "" {
@@ -133,6 +378,12 @@ func (np *NacosProvider) Validate() error {
 	if np.ServiceName == "" {
 		return fmt.Errorf("nacos provider: service_name is required")
 	}
+	if np.MaxInstances < 0 {
+		return fmt.Errorf("nacos provider: max_instances must not be negative")
+	}
+	if err := np.Store.Validate(); err != nil {
+		return fmt.Errorf("nacos provider: %v", err)
+	}
 	return nil
 }
 
@@ -143,27 +394,28 @@ func (np *NacosProvider) Cleanup() error {
 		return nil
 	}
 
-	err := np.client.Unsubscribe(&vo.SubscribeParam{
-		ServiceName: np.ServiceName,
-		GroupName:   np.GroupName,
-	})
-	if err != nil {
-		return fmt.Errorf("unsubscribing from nacos service '%s': %v", np.ServiceName, err)
+	// 先释放订阅再释放客户端，最后一个订阅者取消订阅时客户端仍然可用
+	var firstErr error
+	for i, sub := range np.subscriptions {
+		sub.unsubscribe(np)
+		if _, err := subscriptionPool.Delete(np.subscriptionKeys[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	np.client.CloseClient()
-	return nil
+	if _, err := clientPool.Delete(np.clientKey); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("releasing nacos client: %v", err)
+	}
+	return firstErr
 }
 
 // GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
 // 这个方法必须是线程安全的。
 func (np *NacosProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
-	np.mu.RLock()
-	defer np.mu.RUnlock()
-
-	if len(np.upstreams) == 0 {
+	upstreams := np.Store.Upstreams()
+	if len(upstreams) == 0 {
 		return nil, fmt.Errorf("no healthy upstreams available for service: %s", np.ServiceName)
 	}
-	return np.upstreams, nil
+	return upstreams, nil
 }
 
 // UnmarshalCaddyfile 解析 Nacos 提供者特有的 Caddyfile 配置块。
@@ -199,10 +451,35 @@ func (np *NacosProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			np.GroupName = d.Val()
+		case "groups":
+			np.Groups = d.RemainingArgs()
+			if len(np.Groups) == 0 {
+				return d.ArgErr()
+			}
 		case "clusters":
 			np.Clusters = d.RemainingArgs()
+		case "port_metadata_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.PortMetadataKey = d.Val()
+		case "max_instances":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_instances '%s': %v", d.Val(), err)
+			}
+			np.MaxInstances = n
 		default:
-			return d.Errf("unrecognized nacos subdirective '%s'", d.Val())
+			ok, err := np.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized nacos subdirective '%s'", d.Val())
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,390 @@
+package nacos
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// newTestProvider 返回一个不连接 Nacos、只用于驱动订阅回调的 provider。
+func newTestProvider() *NacosProvider {
+	np := New()
+	np.ServiceName = "svc"
+	np.logger = np.Store.Setup(zap.NewNop(), np.ServiceName)
+	np.groupInstances = make(map[string][]*discovery.Instance)
+	np.groupSeq = make(map[string]uint64)
+	np.groupHash = make(map[string]uint64)
+	return np
+}
+
+// testInstance 返回一个健康且已启用的 Nacos 实例。
+func testInstance(ip string) model.Instance {
+	return model.Instance{Ip: ip, Port: 8080, Enable: true, Healthy: true, Weight: 1}
+}
+
+func TestSubscribeCallbackReleasesLockAfterPanic(t *testing.T) {
+	np := newTestProvider()
+
+	// 写入 nil map 会在持有锁时 panic，回调被 Recover 捕获后锁必须已经释放
+	np.groupInstances = nil
+	np.onServices(np.GroupName, 1, []model.Instance{testInstance("10.0.0.1")}, nil)
+	np.groupInstances = make(map[string][]*discovery.Instance)
+
+	done := make(chan struct{})
+	go func() {
+		np.onServices(np.GroupName, 2, []model.Instance{testInstance("10.0.0.2")}, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribe callback deadlocked after a panic")
+	}
+
+	ups := np.Store.Upstreams()
+	if len(ups) != 1 || ups[0].Dial != "10.0.0.2:8080" {
+		t.Fatalf("got %v, want 10.0.0.2:8080", ups)
+	}
+}
+
+// failingClient 是一个订阅总是失败的 Nacos 客户端。
+type failingClient struct {
+	naming_client.INamingClient
+}
+
+func (failingClient) Subscribe(*vo.SubscribeParam) error {
+	return errors.New("connection refused")
+}
+
+func TestSubscribeFailureIsDiscoveryError(t *testing.T) {
+	np := newTestProvider()
+	np.client = failingClient{}
+
+	err := np.subscribeToServiceChanges()
+	var de *discovery.DiscoveryError
+	if !errors.As(err, &de) {
+		t.Fatalf("got %v (%T), want a DiscoveryError", err, err)
+	}
+}
+
+// countingClient 记录订阅和取消订阅的次数，并保存最后一次订阅的回调。
+type countingClient struct {
+	naming_client.INamingClient
+
+	mu           sync.Mutex
+	subscribes   int
+	unsubscribes int
+	callback     func([]model.Instance, error)
+}
+
+func (c *countingClient) Subscribe(param *vo.SubscribeParam) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribes++
+	c.callback = param.SubscribeCallback
+	return nil
+}
+
+func (c *countingClient) Unsubscribe(*vo.SubscribeParam) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribes++
+	return nil
+}
+
+func TestIdenticalProvidersShareSubscription(t *testing.T) {
+	client := &countingClient{}
+	a, b := newTestProvider(), newTestProvider()
+	for _, np := range []*NacosProvider{a, b} {
+		np.client = client
+		np.clientKey = "shared-subscription-test"
+		if err := np.subscribeToServiceChanges(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.subscribes != 1 {
+		t.Fatalf("got %d subscriptions, want 1", client.subscribes)
+	}
+
+	client.callback([]model.Instance{testInstance("10.0.0.1")}, nil)
+	for _, np := range []*NacosProvider{a, b} {
+		if ups := np.Store.Upstreams(); len(ups) != 1 || ups[0].Dial != "10.0.0.1:8080" {
+			t.Fatalf("got %v, want 10.0.0.1:8080", ups)
+		}
+	}
+
+	if err := a.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if client.unsubscribes != 0 {
+		t.Fatal("unsubscribed while another provider still uses the subscription")
+	}
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if client.unsubscribes != 1 {
+		t.Fatalf("got %d unsubscribes, want 1", client.unsubscribes)
+	}
+}
+
+func TestIdenticalPushSkipsUpdate(t *testing.T) {
+	np := newTestProvider()
+	updates := 0
+	np.Store.OnUpdate(func([]*discovery.Instance) { updates++ })
+
+	np.onServices(np.GroupName, 1, []model.Instance{testInstance("10.0.0.1"), testInstance("10.0.0.2")}, nil)
+	first := np.Store.Upstreams()
+	np.onServices(np.GroupName, 2, []model.Instance{testInstance("10.0.0.2"), testInstance("10.0.0.1")}, nil)
+	second := np.Store.Upstreams()
+	if updates != 1 || &first[0] != &second[0] {
+		t.Fatalf("got %d updates, swapped=%v; want 1 update and no swap", updates, &first[0] != &second[0])
+	}
+
+	np.onServices(np.GroupName, 3, []model.Instance{testInstance("10.0.0.1")}, nil)
+	if updates != 2 {
+		t.Fatalf("got %d updates after a change, want 2", updates)
+	}
+}
+
+// groupClient 按分组保存订阅回调，用于分别推送每个分组的实例。
+type groupClient struct {
+	naming_client.INamingClient
+
+	mu        sync.Mutex
+	callbacks map[string]func([]model.Instance, error)
+}
+
+func (c *groupClient) Subscribe(param *vo.SubscribeParam) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.callbacks == nil {
+		c.callbacks = make(map[string]func([]model.Instance, error))
+	}
+	c.callbacks[param.GroupName] = param.SubscribeCallback
+	return nil
+}
+
+func (c *groupClient) Unsubscribe(*vo.SubscribeParam) error { return nil }
+
+func (c *groupClient) push(t *testing.T, group string, services ...model.Instance) {
+	t.Helper()
+	c.mu.Lock()
+	callback, ok := c.callbacks[group]
+	c.mu.Unlock()
+	if !ok {
+		t.Fatalf("group %s was not subscribed", group)
+	}
+	callback(services, nil)
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(np *NacosProvider) string {
+	var dials []string
+	for _, up := range np.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestMultipleGroupsMerge(t *testing.T) {
+	client := &groupClient{}
+	np := newTestProvider()
+	np.Groups = []string{"blue", "green"}
+	np.client = client
+	np.clientKey = "multi-group-test"
+	if err := np.subscribeToServiceChanges(); err != nil {
+		t.Fatal(err)
+	}
+	defer np.Cleanup()
+
+	client.push(t, "blue", testInstance("10.0.0.1"), testInstance("10.0.0.2"))
+	if got := upstreamDials(np); got != "10.0.0.1:8080,10.0.0.2:8080" {
+		t.Fatalf("got %s after the first group, want its instances", got)
+	}
+	// 两个分组中相同的地址只保留一个
+	client.push(t, "green", testInstance("10.0.0.2"), testInstance("10.0.0.3"))
+	if got := upstreamDials(np); got != "10.0.0.1:8080,10.0.0.2:8080,10.0.0.3:8080" {
+		t.Fatalf("got %s, want the merged and deduplicated groups", got)
+	}
+	// 一个分组的推送只替换该分组的实例
+	client.push(t, "blue")
+	if got := upstreamDials(np); got != "10.0.0.2:8080,10.0.0.3:8080" {
+		t.Fatalf("got %s after the first group emptied, want the second group's instances", got)
+	}
+}
+
+func TestPortMetadataKey(t *testing.T) {
+	np := newTestProvider()
+	np.PortMetadataKey = "http_port"
+
+	withPort := func(ip, port string) model.Instance {
+		in := testInstance(ip)
+		in.Metadata = map[string]string{"http_port": port, "grpc_port": "9000"}
+		return in
+	}
+	np.onServices(np.GroupName, 1, []model.Instance{
+		withPort("10.0.0.1", "9090"),
+		testInstance("10.0.0.2"),
+		// 非法的端口回退到实例的端口
+		withPort("10.0.0.3", "http"),
+		withPort("10.0.0.4", "0"),
+		withPort("10.0.0.5", "70000"),
+	}, nil)
+
+	want := "10.0.0.1:9090,10.0.0.2:8080,10.0.0.3:8080,10.0.0.4:8080,10.0.0.5:8080"
+	if got := upstreamDials(np); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// manyInstances 返回 n 个地址不同的 Nacos 实例。
+func manyInstances(n int) []model.Instance {
+	services := make([]model.Instance, n)
+	for i := range services {
+		services[i] = testInstance(fmt.Sprintf("10.0.%d.%d", i/250, i%250+1))
+	}
+	return services
+}
+
+func TestMaxInstancesKeepsStableSubset(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	np := newTestProvider()
+	np.logger = zap.New(core)
+	np.MaxInstances = 10
+
+	services := manyInstances(50)
+	np.onServices(np.GroupName, 1, services, nil)
+	first := upstreamDials(np)
+	if n := len(np.Store.Upstreams()); n != 10 {
+		t.Fatalf("got %d upstreams, want max_instances 10", n)
+	}
+	if logs.FilterMessage("nacos service exceeds max_instances, keeping a subset").Len() != 1 {
+		t.Fatalf("got logs %v, want one truncation warning", logs.All())
+	}
+
+	// 保留的子集与推送中实例的顺序无关
+	reversed := slices.Clone(services)
+	slices.Reverse(reversed)
+	np.onServices(np.GroupName, 2, reversed, nil)
+	got := strings.Split(upstreamDials(np), ",")
+	slices.Sort(got)
+	want := strings.Split(first, ",")
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got subset %v for reordered instances, want %v", got, want)
+	}
+
+	// 新增一个实例最多替换一个已保留的实例
+	np.onServices(np.GroupName, 3, append(services, testInstance("10.0.9.9")), nil)
+	kept := 0
+	for _, dial := range strings.Split(upstreamDials(np), ",") {
+		if slices.Contains(want, dial) {
+			kept++
+		}
+	}
+	if kept < 9 {
+		t.Fatalf("kept %d of the previous 10 instances after one was added, want at least 9", kept)
+	}
+	// 只在丢弃的数量变化时记录，第二次推送没有记录
+	if n := logs.FilterMessage("nacos service exceeds max_instances, keeping a subset").Len(); n != 2 {
+		t.Fatalf("got %d truncation warnings, want 2", n)
+	}
+}
+
+func TestStaleCallbackIsIgnored(t *testing.T) {
+	np := newTestProvider()
+	updates := 0
+	np.Store.OnUpdate(func([]*discovery.Instance) { updates++ })
+
+	np.onServices(np.GroupName, 2, []model.Instance{testInstance("10.0.0.2"), testInstance("10.0.0.3")}, nil)
+	// 先到达的推送晚拿到锁，它的内容已经过时
+	np.onServices(np.GroupName, 1, []model.Instance{testInstance("10.0.0.1")}, nil)
+	if got := upstreamDials(np); got != "10.0.0.2:8080,10.0.0.3:8080" || updates != 1 {
+		t.Fatalf("got %s after %d updates, want the newer push to remain", got, updates)
+	}
+
+	// 内容相同的重复推送不会触发更新
+	np.onServices(np.GroupName, 3, []model.Instance{testInstance("10.0.0.3"), testInstance("10.0.0.2")}, nil)
+	if updates != 1 {
+		t.Fatalf("got %d updates after a duplicate push, want 1", updates)
+	}
+
+	// 编号只在分组内比较
+	np.Groups = []string{np.GroupName, "other"}
+	np.onServices("other", 1, []model.Instance{testInstance("10.0.0.4")}, nil)
+	if got := upstreamDials(np); got != "10.0.0.2:8080,10.0.0.3:8080,10.0.0.4:8080" {
+		t.Fatalf("got %s, want the other group's first push applied", got)
+	}
+}
+
+func TestSharedSubscriptionNumbersPushesInArrivalOrder(t *testing.T) {
+	client := &countingClient{}
+	np := newTestProvider()
+	np.client = client
+	np.clientKey = "arrival-order-test"
+	if err := np.subscribeToServiceChanges(); err != nil {
+		t.Fatal(err)
+	}
+	defer np.Cleanup()
+
+	client.callback([]model.Instance{testInstance("10.0.0.1")}, nil)
+	client.callback([]model.Instance{testInstance("10.0.0.2")}, nil)
+	if got := upstreamDials(np); got != "10.0.0.2:8080" {
+		t.Fatalf("got %s, want the last push", got)
+	}
+
+	// 之后加入的订阅者收到最近一次推送
+	late := newTestProvider()
+	late.client = client
+	late.clientKey = np.clientKey
+	if err := late.subscribeToServiceChanges(); err != nil {
+		t.Fatal(err)
+	}
+	defer late.Cleanup()
+	if got := upstreamDials(late); got != "10.0.0.2:8080" {
+		t.Fatalf("got %s for a late subscriber, want the last push", got)
+	}
+}
+
+func TestInstanceMetadataAndWeight(t *testing.T) {
+	np := newTestProvider()
+	service := testInstance("10.0.0.1")
+	service.Weight = 3
+	service.Metadata = map[string]string{"version": "v2", "zone": "a"}
+	np.onServices(np.GroupName, 1, []model.Instance{service}, nil)
+
+	// 注册中心客户端之后修改自己的 map 不影响已发布的实例
+	service.Metadata["version"] = "v3"
+	instances := np.Store.Instances()
+	if len(instances) != 1 {
+		t.Fatalf("got %d instances, want 1", len(instances))
+	}
+	in := instances[0]
+	if v, _ := in.Meta("version"); v != "v2" || in.Metadata["zone"] != "a" || in.Weight != 3 {
+		t.Fatalf("got metadata %v and weight %v, want the instance's metadata and weight 3", in.Metadata, in.Weight)
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	np := newTestProvider()
+	service := testInstance("10.0.0.1")
+	service.InstanceId = "10.0.0.1#8080#DEFAULT#DEFAULT_GROUP@@svc"
+	np.onServices(np.GroupName, 1, []model.Instance{service}, nil)
+
+	if instances := np.Store.Instances(); len(instances) != 1 || instances[0].ID != service.InstanceId {
+		t.Fatalf("got %v, want one instance with ID %s", instances, service.InstanceId)
+	}
+}
@@ -0,0 +1,105 @@
+package nacos
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+)
+
+// subscriptionPool 按客户端、服务、分组和集群共享订阅，最后一个订阅者 Cleanup 时才取消订阅。
+// 多个 dynamic_sd 引用同一个服务时（例如不同路由指向同一个后端），只向 Nacos 订阅一次。
+var subscriptionPool = caddy.NewUsagePool()
+
+// sharedSubscription 是一个分组在 Nacos SDK 中的订阅，它把每次推送分发给所有订阅者。
+// 推送的是原始的实例列表，各订阅者按自己的配置（如 port_metadata_key、max_instances）转换并写入各自的 Store。
+type sharedSubscription struct {
+	client naming_client.INamingClient
+	param  *vo.SubscribeParam
+
+	// seq 为每次推送按到达顺序编号，订阅者据此丢弃晚到的旧推送。
+	seq atomic.Uint64
+
+	mu          sync.Mutex
+	subscribers map[*NacosProvider]struct{}
+	// received 表示已经收到过推送，last* 是最近一次推送的内容，交给之后加入的订阅者。
+	received bool
+	lastSeq  uint64
+	lastSvcs []model.Instance
+	lastErr  error
+}
+
+// subscriptionKey 返回决定订阅内容的所有配置，相同 key 的 provider 共享一个订阅。
+func (np *NacosProvider) subscriptionKey(group string) string {
+	return fmt.Sprintf("%#v", []any{np.clientKey, np.ServiceName, group, np.Clusters})
+}
+
+// newSharedSubscription 通过 client 订阅 group，订阅失败时返回错误。
+func (np *NacosProvider) newSharedSubscription(group string) (caddy.Destructor, error) {
+	s := &sharedSubscription{
+		client:      np.client,
+		subscribers: make(map[*NacosProvider]struct{}),
+	}
+	s.param = &vo.SubscribeParam{
+		ServiceName:       np.ServiceName,
+		GroupName:         group,
+		Clusters:          np.Clusters,
+		SubscribeCallback: s.dispatch,
+	}
+	if err := s.client.Subscribe(s.param); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// subscribe 将 np 加入订阅者。已经收到过推送时立即把最近一次的内容交给 np。
+func (s *sharedSubscription) subscribe(np *NacosProvider) {
+	s.mu.Lock()
+	s.subscribers[np] = struct{}{}
+	received, seq, services, err := s.received, s.lastSeq, s.lastSvcs, s.lastErr
+	s.mu.Unlock()
+
+	if received {
+		np.onServices(s.param.GroupName, seq, services, err)
+	}
+}
+
+// unsubscribe 将 np 移出订阅者，此后它不再收到推送。
+func (s *sharedSubscription) unsubscribe(np *NacosProvider) {
+	s.mu.Lock()
+	delete(s.subscribers, np)
+	s.mu.Unlock()
+}
+
+// dispatch 是 SDK 的订阅回调，它记录推送内容并分发给当前所有的订阅者。
+func (s *sharedSubscription) dispatch(services []model.Instance, err error) {
+	// 在做任何处理之前编号，使编号反映回调的到达顺序
+	seq := s.seq.Add(1)
+
+	s.mu.Lock()
+	if seq > s.lastSeq {
+		s.received, s.lastSeq, s.lastSvcs, s.lastErr = true, seq, services, err
+	}
+	subscribers := make([]*NacosProvider, 0, len(s.subscribers))
+	for np := range s.subscribers {
+		subscribers = append(subscribers, np)
+	}
+	s.mu.Unlock()
+
+	for _, np := range subscribers {
+		np.onServices(s.param.GroupName, seq, services, err)
+	}
+}
+
+// Destruct 在最后一个订阅者释放订阅时取消订阅。
+// 订阅者在释放客户端之前释放订阅，因此此时客户端仍然可用。
+func (s *sharedSubscription) Destruct() error {
+	if err := s.client.Unsubscribe(s.param); err != nil {
+		return fmt.Errorf("unsubscribing from nacos service '%s' in group '%s': %v", s.param.ServiceName, s.param.GroupName, err)
+	}
+	return nil
+}
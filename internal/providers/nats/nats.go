@@ -0,0 +1,444 @@
+// package nats 实现了用于 Caddy 的 NATS 服务发现提供者。
+// 它可以订阅一个携带实例公告的 subject，或者监听一个 JetStream KV bucket 来维护上游列表。
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	natsgo "github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	// actionRegister 和 actionDeregister 是 subject 模式下公告消息的动作。
+	actionRegister   = "register"
+	actionDeregister = "deregister"
+)
+
+// announcement 是实例公告消息，也是 KV 模式下 value 的格式。
+// KV 模式下 value 也可以直接是一个 "host:port" 字符串。
+type announcement struct {
+	Action   string            `json:"action,omitempty"`
+	Dial     string            `json:"dial"`
+	Weight   float64           `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NatsProvider 实现了 providers.Provider 接口，
+// 用于从 NATS subject 或 JetStream KV 动态获取上游服务实例。
+type NatsProvider struct {
+	// --- 配置字段 ---
+	URL         string `json:"url,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	KVBucket    string `json:"kv_bucket,omitempty"`
+	Credentials string `json:"credentials,omitempty"` // .creds 文件路径
+	Token       string `json:"token,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+
+	// Expiry 是 subject 模式下实例公告的有效期，实例需要在有效期内重复公告，否则会被移除。
+	Expiry time.Duration `json:"expiry,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	conn     *natsgo.Conn
+	sub      *natsgo.Subscription
+	watcher  natsgo.KeyWatcher
+	logger   *zap.Logger
+	stopChan chan struct{}
+
+	// entries 按 key（subject 模式下为 dial）记录当前的实例，lastSeen 记录最近一次公告的时间。
+	entries  map[string]*discovery.Instance
+	lastSeen map[string]time.Time
+	mu       sync.Mutex
+}
+
+// New 是一个构造函数，返回一个 NatsProvider 的新实例。
+func New() *NatsProvider {
+	return &NatsProvider{
+		// 设置合理的默认值
+		URL:    natsgo.DefaultURL,
+		Expiry: 30 * time.Second,
+	}
+}
+
+// Provision 连接 NATS 并开始订阅 subject 或监听 KV bucket。
+func (np *NatsProvider) Provision(logger *zap.Logger) error {
+	np.logger = np.Store.Setup(logger, np.target())
+	np.logger.Info("provisioning nats service discovery provider",
+		zap.String("url", np.URL),
+		zap.String("subject", np.Subject),
+		zap.String("kv_bucket", np.KVBucket),
+	)
+	np.stopChan = make(chan struct{})
+	np.entries = make(map[string]*discovery.Instance)
+	np.lastSeen = make(map[string]time.Time)
+
+	// 由 NATS 客户端负责断线重连，重连后订阅和 KV 监听会自动恢复
+	opts := []natsgo.Option{
+		natsgo.Name("caddy-dynamic-sd"),
+		natsgo.MaxReconnects(-1),
+		natsgo.DisconnectErrHandler(func(_ *natsgo.Conn, err error) {
+			np.logger.Warn("disconnected from nats", zap.Error(err))
+		}),
+		natsgo.ReconnectHandler(func(c *natsgo.Conn) {
+			np.logger.Info("reconnected to nats", zap.String("url", c.ConnectedUrl()))
+		}),
+	}
+	opts = append(opts, np.authOptions()...)
+
+	var err error
+	np.conn, err = natsgo.Connect(np.URL, opts...)
+	if err != nil {
+		return &discovery.DiscoveryError{Err: fmt.Errorf("connecting to nats '%s': %v", np.URL, err)}
+	}
+
+	if np.KVBucket != "" {
+		return np.watchBucket()
+	}
+
+	np.sub, err = np.conn.Subscribe(np.Subject, np.handleAnnouncement)
+	if err != nil {
+		return &discovery.DiscoveryError{Err: fmt.Errorf("subscribing to nats subject '%s': %v", np.Subject, err)}
+	}
+	discovery.Go(np.logger, "nats expire loop", np.expireLoop)
+	return nil
+}
+
+// authOptions 返回配置的认证选项。
+func (np *NatsProvider) authOptions() []natsgo.Option {
+	var opts []natsgo.Option
+	if np.Credentials != "" {
+		opts = append(opts, natsgo.UserCredentials(np.Credentials))
+	}
+	if np.Token != "" {
+		opts = append(opts, natsgo.Token(np.Token))
+	}
+	if np.Username != "" {
+		opts = append(opts, natsgo.UserInfo(np.Username, np.Password))
+	}
+	return opts
+}
+
+// target 返回用于日志和指标的服务标识。
+func (np *NatsProvider) target() string {
+	if np.KVBucket != "" {
+		return "kv:" + np.KVBucket
+	}
+	return np.Subject
+}
+
+// handleAnnouncement 处理 subject 模式下的一条实例公告。
+func (np *NatsProvider) handleAnnouncement(msg *natsgo.Msg) {
+	defer discovery.Recover(np.logger, "nats announcement handler")
+
+	var ann announcement
+	if err := json.Unmarshal(msg.Data, &ann); err != nil {
+		np.logger.Warn("ignoring malformed nats announcement", zap.String("subject", msg.Subject), zap.Error(err))
+		return
+	}
+	if !np.validDial(ann.Dial) {
+		return
+	}
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	switch ann.Action {
+	case "", actionRegister:
+		np.entries[ann.Dial] = discovery.NewInstance(ann.Dial, ann.Metadata, ann.Weight)
+		np.lastSeen[ann.Dial] = time.Now()
+	case actionDeregister:
+		delete(np.entries, ann.Dial)
+		delete(np.lastSeen, ann.Dial)
+	default:
+		np.logger.Warn("ignoring nats announcement with unknown action", zap.String("action", ann.Action))
+		return
+	}
+	np.updateUpstreams()
+}
+
+// expireLoop 定期移除超过 Expiry 没有再次公告的实例。
+func (np *NatsProvider) expireLoop() {
+	ticker := time.NewTicker(np.Expiry / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			np.mu.Lock()
+			expired := false
+			for dial, seen := range np.lastSeen {
+				if time.Since(seen) > np.Expiry {
+					delete(np.entries, dial)
+					delete(np.lastSeen, dial)
+					expired = true
+				}
+			}
+			if expired {
+				np.updateUpstreams()
+			}
+			np.mu.Unlock()
+		case <-np.stopChan:
+			np.logger.Info("stopping nats expiry loop", zap.String("subject", np.Subject))
+			return
+		}
+	}
+}
+
+// watchBucket 监听 KV bucket 中的所有 key，每个 key 对应一个实例。
+func (np *NatsProvider) watchBucket() error {
+	js, err := np.conn.JetStream()
+	if err != nil {
+		return &discovery.DiscoveryError{Err: fmt.Errorf("creating nats jetstream context: %v", err)}
+	}
+	kv, err := js.KeyValue(np.KVBucket)
+	if err != nil {
+		return &discovery.DiscoveryError{Err: fmt.Errorf("opening nats kv bucket '%s': %v", np.KVBucket, err)}
+	}
+	np.watcher, err = kv.WatchAll()
+	if err != nil {
+		return &discovery.DiscoveryError{Err: fmt.Errorf("watching nats kv bucket '%s': %v", np.KVBucket, err)}
+	}
+
+	go func() {
+		// 初始值全部到达之前会收到一个 nil 作为分隔，此后每个变更都立即更新上游
+		initialized := false
+		for entry := range np.watcher.Updates() {
+			if entry == nil {
+				initialized = true
+			}
+			np.handleKVUpdate(entry, initialized)
+		}
+	}()
+	return nil
+}
+
+// handleKVUpdate 应用一条 KV 变更，initialized 为 true 时随即更新上游。panic 时丢弃该变更。
+func (np *NatsProvider) handleKVUpdate(entry natsgo.KeyValueEntry, initialized bool) {
+	defer discovery.Recover(np.logger, "nats kv watcher")
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	if entry != nil {
+		np.applyKVEntry(entry)
+	}
+	if initialized {
+		np.updateUpstreams()
+	}
+}
+
+// applyKVEntry 根据一条 KV 变更更新实例表。调用方必须持有 np.mu。
+func (np *NatsProvider) applyKVEntry(entry natsgo.KeyValueEntry) {
+	if op := entry.Operation(); op == natsgo.KeyValueDelete || op == natsgo.KeyValuePurge {
+		delete(np.entries, entry.Key())
+		return
+	}
+
+	var ann announcement
+	if err := json.Unmarshal(entry.Value(), &ann); err != nil {
+		ann = announcement{Dial: string(entry.Value())}
+	}
+	if !np.validDial(ann.Dial) {
+		delete(np.entries, entry.Key())
+		return
+	}
+	np.entries[entry.Key()] = discovery.NewInstance(ann.Dial, ann.Metadata, ann.Weight)
+}
+
+// updateUpstreams 将实例表发布到 Store。调用方必须持有 np.mu。
+func (np *NatsProvider) updateUpstreams() {
+	defer metrics.ObserveRefresh("nats", np.target(), time.Now())
+	endSpan := tracing.StartRefresh("nats", np.target())
+	defer func() {
+		count := len(np.Store.Instances())
+		endSpan(count, nil)
+		metrics.RecordResult("nats", np.target(), count, nil)
+	}()
+
+	instances := make([]*discovery.Instance, 0, len(np.entries))
+	for _, in := range np.entries {
+		instances = append(instances, in)
+	}
+
+	if !np.Store.Update(instances) {
+		return
+	}
+
+	np.logger.Debug("updated upstreams from nats",
+		zap.String("target", np.target()),
+		zap.Int("count", len(instances)),
+	)
+}
+
+// validDial 检查公告中的地址是否是合法的 "host:port"，非法地址会被记录并跳过。
+func (np *NatsProvider) validDial(dial string) bool {
+	if _, _, err := net.SplitHostPort(dial); err != nil {
+		np.logger.Warn("skipping invalid nats upstream",
+			zap.String("target", np.target()),
+			zap.String("dial", dial),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// ValidateConnectivity 建立一个独立的 NATS 连接以确认地址和凭据可用，
+// KV 模式下还会确认 bucket 存在，不订阅也不监听。
+func (np *NatsProvider) ValidateConnectivity(ctx context.Context) error {
+	conn, err := natsgo.Connect(np.URL, append(np.authOptions(), natsgo.Name("caddy-dynamic-sd"))...)
+	if err != nil {
+		return fmt.Errorf("connecting to nats '%s': %v", np.URL, err)
+	}
+	defer conn.Close()
+
+	if np.KVBucket == "" {
+		return nil
+	}
+	js, err := conn.JetStream(natsgo.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("creating nats jetstream context: %v", err)
+	}
+	if _, err := js.KeyValue(np.KVBucket); err != nil {
+		return fmt.Errorf("opening nats kv bucket '%s': %v", np.KVBucket, err)
+	}
+	return nil
+}
+
+// RegistryAddresses 返回 NATS 服务器的地址，URL 可以是以逗号分隔的多个服务器。
+func (np *NatsProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(np.URL, "4222")
+}
+
+// MarshalConfig 返回用于管理接口的配置，Token 和 Password 被替换，URL 中的密码被隐藏。
+func (np *NatsProvider) MarshalConfig() any {
+	config := discovery.RedactConfig(np, "token", "password")
+	if np.URL != "" {
+		config["url"] = discovery.RedactURL(np.URL)
+	}
+	return config
+}
+
+// Validate 检查必要的配置是否已提供。
+func (np *NatsProvider) Validate() error {
+	if np.Subject == "" && np.KVBucket == "" {
+		return fmt.Errorf("nats provider: subject or kv_bucket is required")
+	}
+	if np.Subject != "" && np.KVBucket != "" {
+		return fmt.Errorf("nats provider: subject and kv_bucket are mutually exclusive")
+	}
+	if np.Subject != "" && np.Expiry <= 0 {
+		return fmt.Errorf("nats provider: expiry must be positive")
+	}
+	if err := np.Store.Validate(); err != nil {
+		return fmt.Errorf("nats provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止订阅和监听，并关闭 NATS 连接。
+func (np *NatsProvider) Cleanup() error {
+	np.logger.Info("cleaning up nats provider", zap.String("target", np.target()))
+	if np.stopChan != nil {
+		close(np.stopChan)
+	}
+	if np.watcher != nil {
+		if err := np.watcher.Stop(); err != nil {
+			np.logger.Warn("failed to stop nats kv watcher", zap.Error(err))
+		}
+	}
+	if np.sub != nil {
+		if err := np.sub.Unsubscribe(); err != nil {
+			np.logger.Warn("failed to unsubscribe from nats", zap.Error(err))
+		}
+	}
+	if np.conn != nil {
+		np.conn.Close()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (np *NatsProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := np.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams announced on nats: %s", np.target())
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 NATS 提供者特有的 Caddyfile 配置块。
+func (np *NatsProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.URL = d.Val()
+		case "subject":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Subject = d.Val()
+		case "kv_bucket":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.KVBucket = d.Val()
+		case "credentials":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Credentials = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Token = d.Val()
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Password = d.Val()
+		case "expiry":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for expiry: %v", err)
+			}
+			np.Expiry = dur
+		default:
+			ok, err := np.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized nats subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	natsgo "github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// fakeNATS 是一个只实现客户端核心协议（INFO、CONNECT、PING、SUB、UNSUB、PUB）的 NATS 服务器，
+// 消息按 subject 精确匹配投递给订阅者。
+type fakeNATS struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	subs     map[string][]subscriber
+	connects []map[string]any
+	changed  chan struct{}
+}
+
+// subscriber 是一个客户端连接上的订阅。
+type subscriber struct {
+	conn *natsConn
+	sid  string
+}
+
+// natsConn 是一个客户端连接，写入需要加锁。
+type natsConn struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func (c *natsConn) write(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.c, format, args...)
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{ln: ln, subs: make(map[string][]subscriber), changed: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			go f.serve(&natsConn{c: c})
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.ln.Addr().String()
+}
+
+// serve 处理一个客户端连接上的协议命令，直到连接关闭。
+func (f *fakeNATS) serve(conn *natsConn) {
+	conn.write("INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn.c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		fields := strings.Fields(args)
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+			var options map[string]any
+			json.Unmarshal([]byte(args), &options)
+			f.update(func() { f.connects = append(f.connects, options) })
+		case "PING":
+			conn.write("PONG\r\n")
+		case "SUB":
+			subject, sid := fields[0], fields[len(fields)-1]
+			f.update(func() { f.subs[subject] = append(f.subs[subject], subscriber{conn: conn, sid: sid}) })
+		case "UNSUB":
+			f.update(func() {
+				for subject, subs := range f.subs {
+					for i, s := range subs {
+						if s.conn == conn && s.sid == fields[0] {
+							f.subs[subject] = append(subs[:i:i], subs[i+1:]...)
+						}
+					}
+				}
+			})
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			f.publish(fields[0], payload[:size])
+		}
+	}
+}
+
+// update 在锁内修改服务器状态，并唤醒等待状态变化的测试。
+func (f *fakeNATS) update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// waitFor 等待 cond 在锁内返回 true。
+func (f *fakeNATS) waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		f.mu.Lock()
+		ok, changed := cond(), f.changed
+		f.mu.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// publish 将消息投递给 subject 的所有订阅者。
+func (f *fakeNATS) publish(subject string, data []byte) {
+	f.mu.Lock()
+	subs := append([]subscriber(nil), f.subs[subject]...)
+	f.mu.Unlock()
+	for _, s := range subs {
+		s.conn.write("MSG %s %s %d\r\n%s\r\n", subject, s.sid, len(data), data)
+	}
+}
+
+// announce 以 JSON 发布一条实例公告。
+func (f *fakeNATS) announce(t *testing.T, subject string, ann announcement) {
+	t.Helper()
+	data, err := json.Marshal(ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.publish(subject, data)
+}
+
+// upstreamDials 返回当前发布的上游地址，排序后以逗号连接。实例表是 map，发布的顺序不固定。
+func upstreamDials(np *NatsProvider) string {
+	var dials []string
+	for _, up := range np.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	slices.Sort(dials)
+	return strings.Join(dials, ",")
+}
+
+// waitForDials 等待发布的上游变为 want。
+func waitForDials(t *testing.T, np *NatsProvider, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(np) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q, want %q", upstreamDials(np), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// provision 返回一个订阅 f 上 services.web 的 provider，测试结束时 Cleanup。
+func provision(t *testing.T, f *fakeNATS, configure func(*NatsProvider)) *NatsProvider {
+	t.Helper()
+	np := provisionNoCleanup(t, f, configure)
+	t.Cleanup(func() { np.Cleanup() })
+	return np
+}
+
+// provisionNoCleanup 与 provision 相同，但由测试自己调用 Cleanup。
+func provisionNoCleanup(t *testing.T, f *fakeNATS, configure func(*NatsProvider)) *NatsProvider {
+	t.Helper()
+	np := New()
+	np.URL = f.url()
+	np.Subject = "services.web"
+	if configure != nil {
+		configure(np)
+	}
+	if err := np.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	f.waitFor(t, "a subscription", func() bool { return len(f.subs["services.web"]) == 1 })
+	return np
+}
+
+func TestAnnouncementsRegisterAndDeregister(t *testing.T) {
+	f := newFakeNATS(t)
+	np := provision(t, f, func(np *NatsProvider) { np.Token = "secret" })
+	if token := f.connects[0]["auth_token"]; token != "secret" {
+		t.Fatalf("got auth_token %v, want the configured token", token)
+	}
+
+	f.announce(t, "services.web", announcement{Dial: "10.0.0.1:80", Weight: 2, Metadata: map[string]string{"version": "v2"}})
+	f.announce(t, "services.web", announcement{Action: actionRegister, Dial: "10.0.0.2:80"})
+	waitForDials(t, np, "10.0.0.1:80,10.0.0.2:80")
+	// 实例来自 map，顺序不固定，按地址找到第一条公告对应的实例
+	var in *discovery.Instance
+	for _, candidate := range np.Store.Instances() {
+		if candidate.Upstream.Dial == "10.0.0.1:80" {
+			in = candidate
+		}
+	}
+	if in == nil || in.Weight != 2 || in.Metadata["version"] != "v2" {
+		t.Fatalf("got %+v, want the announced weight and metadata", in)
+	}
+
+	// 格式错误、地址非法和未知动作的公告被忽略
+	f.publish("services.web", []byte("not json"))
+	f.announce(t, "services.web", announcement{Dial: "10.0.0.3"})
+	f.announce(t, "services.web", announcement{Action: "drain", Dial: "10.0.0.1:80"})
+	f.announce(t, "services.web", announcement{Action: actionDeregister, Dial: "10.0.0.1:80"})
+	waitForDials(t, np, "10.0.0.2:80")
+}
+
+func TestAnnouncementsExpire(t *testing.T) {
+	f := newFakeNATS(t)
+	np := provision(t, f, func(np *NatsProvider) { np.Expiry = 100 * time.Millisecond })
+
+	f.announce(t, "services.web", announcement{Dial: "10.0.0.1:80"})
+	f.announce(t, "services.web", announcement{Dial: "10.0.0.2:80"})
+	waitForDials(t, np, "10.0.0.1:80,10.0.0.2:80")
+
+	// 持续公告的实例保留，停止公告的实例在 expiry 后被移除
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-time.After(20 * time.Millisecond):
+				f.announce(t, "services.web", announcement{Dial: "10.0.0.1:80"})
+			case <-stop:
+				return
+			}
+		}
+	}()
+	waitForDials(t, np, "10.0.0.1:80")
+}
+
+func TestCleanupUnsubscribes(t *testing.T) {
+	f := newFakeNATS(t)
+	np := provisionNoCleanup(t, f, nil)
+	np.Cleanup()
+	f.waitFor(t, "the subscription to end", func() bool { return len(f.subs["services.web"]) == 0 })
+}
+
+// kvEntry 是一条 KV 变更。
+type kvEntry struct {
+	key   string
+	value string
+	op    natsgo.KeyValueOp
+}
+
+func (e kvEntry) Bucket() string               { return "services" }
+func (e kvEntry) Key() string                  { return e.key }
+func (e kvEntry) Value() []byte                { return []byte(e.value) }
+func (e kvEntry) Revision() uint64             { return 1 }
+func (e kvEntry) Created() time.Time           { return time.Time{} }
+func (e kvEntry) Delta() uint64                { return 0 }
+func (e kvEntry) Operation() natsgo.KeyValueOp { return e.op }
+
+func TestKVUpdates(t *testing.T) {
+	np := New()
+	np.KVBucket = "services"
+	np.logger = np.Store.Setup(zap.NewNop(), np.target())
+	np.entries = make(map[string]*discovery.Instance)
+
+	// 初始值全部到达（收到 nil）之前不发布上游
+	np.handleKVUpdate(kvEntry{key: "web-1", value: `{"dial":"10.0.0.1:80","weight":3}`}, false)
+	np.handleKVUpdate(kvEntry{key: "web-2", value: "10.0.0.2:80"}, false)
+	if got := upstreamDials(np); got != "" {
+		t.Fatalf("got upstreams %q before the initial values were complete, want none", got)
+	}
+	np.handleKVUpdate(nil, true)
+	if got := upstreamDials(np); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %q, want both keys", got)
+	}
+
+	// 值变为非法地址或 key 被删除时移除对应的实例
+	np.handleKVUpdate(kvEntry{key: "web-1", value: "invalid"}, true)
+	if got := upstreamDials(np); got != "10.0.0.2:80" {
+		t.Fatalf("got upstreams %q after an invalid value, want web-1 removed", got)
+	}
+	np.handleKVUpdate(kvEntry{key: "web-3", value: "10.0.0.3:80"}, true)
+	np.handleKVUpdate(kvEntry{key: "web-2", op: natsgo.KeyValueDelete}, true)
+	np.handleKVUpdate(kvEntry{key: "web-3", op: natsgo.KeyValuePurge}, true)
+	if got := upstreamDials(np); got != "" {
+		t.Fatalf("got upstreams %q after deleting every key, want none", got)
+	}
+}
@@ -0,0 +1,336 @@
+// package nomad 实现了基于 HashiCorp Nomad 原生服务注册（Nomad 1.3+）的服务发现提供者。
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// waitTime 是阻塞查询的最长等待时间，超时后 Nomad 返回未变化的结果并重新发起查询。
+	waitTime = 5 * time.Minute
+
+	// requestTimeout 是非阻塞请求的超时时间；阻塞查询的超时时间在 waitTime 的基础上再加上该值。
+	requestTimeout = 10 * time.Second
+)
+
+// NomadProvider 实现了 providers.Provider 接口，
+// 通过 Nomad 的 /v1/service/{name} 接口读取服务的注册信息，并通过阻塞查询监听变化。
+type NomadProvider struct {
+	// --- 配置字段 ---
+	Address     string   `json:"address,omitempty"`
+	Namespace   string   `json:"namespace,omitempty"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Token       string   `json:"token,omitempty"`
+	Tags        []string `json:"tags,omitempty"` // 实例必须带有所有这些标签
+
+	// PollInterval 是查询失败后重试之前的等待时间。
+	PollInterval time.Duration `json:"poll_interval,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	client     *http.Client
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 NomadProvider 的新实例。
+func New() *NomadProvider {
+	return &NomadProvider{
+		// 设置合理的默认值
+		Address:      "http://127.0.0.1:4646",
+		Namespace:    "default",
+		PollInterval: 10 * time.Second,
+	}
+}
+
+// serviceRegistration 是 Nomad 服务注册接口返回的一项，只包含用到的字段。
+type serviceRegistration struct {
+	ID          string   `json:"ID"`
+	ServiceName string   `json:"ServiceName"`
+	AllocID     string   `json:"AllocID"`
+	Datacenter  string   `json:"Datacenter"`
+	Tags        []string `json:"Tags"`
+	Address     string   `json:"Address"`
+	Port        int      `json:"Port"`
+}
+
+// Provision 同步读取一次服务，然后在后台通过阻塞查询监听变化。
+func (np *NomadProvider) Provision(logger *zap.Logger) error {
+	np.logger = np.Store.Setup(logger, np.ServiceName)
+	np.logger.Info("provisioning nomad service discovery provider",
+		zap.String("address", np.Address),
+		zap.String("namespace", np.Namespace),
+		zap.String("service", np.ServiceName),
+	)
+	np.client = &http.Client{}
+
+	var ctx context.Context
+	ctx, np.cancelFunc = context.WithCancel(context.Background())
+
+	// 立即读取一次，以确保在 Caddy 启动时就有上游可用
+	regs, index, err := np.query(ctx, np.client, 0)
+	if err := np.updateUpstreams(regs, err); err != nil {
+		np.logger.Error("initial fetch from nomad failed", zap.Error(err))
+	}
+
+	discovery.Go(np.logger, "nomad watcher", func() { np.watch(ctx, index) })
+
+	return nil
+}
+
+// watch 循环发起阻塞查询，直到 ctx 被取消。查询失败时等待 PollInterval 后重试。
+func (np *NomadProvider) watch(ctx context.Context, index uint64) {
+	for {
+		regs, lastIndex, err := np.query(ctx, np.client, index)
+		if ctx.Err() != nil {
+			np.logger.Info("stopping nomad watcher", zap.String("service", np.ServiceName))
+			return
+		}
+		if err != nil {
+			if err := np.updateUpstreams(nil, err); err != nil {
+				np.logger.Error("failed to update upstreams from nomad", zap.Error(err))
+			}
+			select {
+			case <-time.After(np.PollInterval):
+			case <-ctx.Done():
+				np.logger.Info("stopping nomad watcher", zap.String("service", np.ServiceName))
+				return
+			}
+			continue
+		}
+
+		// 等待超时时索引不变，服务没有变化
+		if lastIndex == index {
+			continue
+		}
+		// 索引回退（例如集群恢复了快照）时从头开始
+		if lastIndex < index {
+			lastIndex = 0
+		}
+		index = lastIndex
+
+		if err := np.updateUpstreams(regs, nil); err != nil {
+			np.logger.Error("failed to update upstreams from nomad", zap.Error(err))
+		}
+	}
+}
+
+// query 查询服务的注册信息，index 不为 0 时发起阻塞查询，等到索引超过 index 或 waitTime 超时才返回。
+// 同时返回响应中的 X-Nomad-Index。
+func (np *NomadProvider) query(ctx context.Context, client *http.Client, index uint64) ([]serviceRegistration, uint64, error) {
+	query := url.Values{}
+	query.Set("namespace", np.Namespace)
+	timeout := requestTimeout
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", waitTime.String())
+		timeout += waitTime
+	}
+	u := strings.TrimSuffix(np.Address, "/") + "/v1/service/" + url.PathEscape(np.ServiceName) + "?" + query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if np.Token != "" {
+		req.Header.Set("X-Nomad-Token", np.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying nomad service '%s': %v", np.ServiceName, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("querying nomad service '%s': unexpected status %d: %s", np.ServiceName, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var regs []serviceRegistration
+	if err := json.NewDecoder(resp.Body).Decode(&regs); err != nil {
+		return nil, 0, fmt.Errorf("parsing nomad service '%s': %v", np.ServiceName, err)
+	}
+	lastIndex, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return regs, lastIndex, nil
+}
+
+// updateUpstreams 把查询结果中带有所有 Tags 的注册转换为上游列表并写入 Store。
+// Nomad 服务注册没有权重和 metadata，实例的 metadata 中记录了 alloc_id 和 datacenter。
+func (np *NomadProvider) updateUpstreams(regs []serviceRegistration, err error) error {
+	defer metrics.ObserveRefresh("nomad", np.ServiceName, time.Now())
+	endSpan := tracing.StartRefresh("nomad", np.ServiceName)
+	defer func() {
+		count := len(np.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("nomad", np.ServiceName, count, err)
+	}()
+	if err != nil {
+		return err
+	}
+
+	var instances []*discovery.Instance
+	for _, reg := range regs {
+		if !hasAllTags(reg.Tags, np.Tags) {
+			continue
+		}
+		if reg.Address == "" || reg.Port <= 0 {
+			np.logger.Warn("skipping nomad service registration without address",
+				zap.String("id", reg.ID),
+				zap.String("address", reg.Address),
+				zap.Int("port", reg.Port),
+			)
+			continue
+		}
+		in := discovery.NewInstance(
+			net.JoinHostPort(reg.Address, strconv.Itoa(reg.Port)),
+			map[string]string{"alloc_id": reg.AllocID, "datacenter": reg.Datacenter},
+			0,
+		)
+		in.Tags = append([]string(nil), reg.Tags...)
+		instances = append(instances, in)
+	}
+
+	if !np.Store.Update(instances) {
+		return nil
+	}
+
+	np.logger.Debug("updated upstreams from nomad",
+		zap.String("service", np.ServiceName),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// hasAllTags 报告 tags 是否包含 required 中的每一个标签。
+func hasAllTags(tags, required []string) bool {
+	for _, tag := range required {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateConnectivity 查询一次服务，不启动后台阻塞查询。
+func (np *NomadProvider) ValidateConnectivity(ctx context.Context) error {
+	_, _, err := np.query(ctx, &http.Client{}, 0)
+	return err
+}
+
+// RegistryAddresses 返回 Nomad agent 的地址。
+func (np *NomadProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(np.Address, "4646")
+}
+
+// MarshalConfig 返回用于管理接口的配置，Token 被替换。
+func (np *NomadProvider) MarshalConfig() any {
+	return discovery.RedactConfig(np, "token")
+}
+
+// Validate 检查必要的配置是否已提供。
+func (np *NomadProvider) Validate() error {
+	if np.Address == "" {
+		return fmt.Errorf("nomad provider: address is required")
+	}
+	if u, err := url.Parse(np.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("nomad provider: address must be an http or https URL")
+	}
+	if np.ServiceName == "" {
+		return fmt.Errorf("nomad provider: service_name is required")
+	}
+	if err := np.Store.ValidateInterval("poll_interval", np.PollInterval); err != nil {
+		return fmt.Errorf("nomad provider: %v", err)
+	}
+	if err := np.Store.Validate(); err != nil {
+		return fmt.Errorf("nomad provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine。
+func (np *NomadProvider) Cleanup() error {
+	np.logger.Info("cleaning up nomad provider", zap.String("service", np.ServiceName))
+	if np.cancelFunc != nil {
+		np.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (np *NomadProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := np.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available for nomad service: %s", np.ServiceName)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 nomad 提供者特有的 Caddyfile 配置块。
+func (np *NomadProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Address = d.Val()
+		case "namespace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Namespace = d.Val()
+		case "service_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.ServiceName = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			np.Token = d.Val()
+		case "tags":
+			np.Tags = d.RemainingArgs()
+		case "poll_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for poll_interval: %v", err)
+			}
+			np.PollInterval = dur
+		default:
+			ok, err := np.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized nomad subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package nomad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeNomad 是一个支持阻塞查询的 /v1/service/{name} 接口。带 index 参数的查询一直阻塞到索引变化或请求被取消。
+type fakeNomad struct {
+	mu      sync.Mutex
+	index   uint64
+	regs    []serviceRegistration
+	status  int
+	changed chan struct{}
+	queries []url.Values
+	tokens  []string
+}
+
+func newFakeNomad(t *testing.T) (*fakeNomad, *httptest.Server) {
+	t.Helper()
+	f := &fakeNomad{index: 1, changed: make(chan struct{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// set 替换注册信息和索引，唤醒所有阻塞的查询。
+func (f *fakeNomad) set(index uint64, regs ...serviceRegistration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.index, f.regs = index, regs
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// fail 使之后的查询返回 status，0 表示恢复正常。
+func (f *fakeNomad) fail(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// requests 返回收到的所有查询参数。
+func (f *fakeNomad) requests() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.queries...)
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/service/web" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.tokens = append(f.tokens, r.Header.Get("X-Nomad-Token"))
+	for {
+		index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+		if f.status != 0 || index == 0 || f.index != index {
+			break
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mu.Lock()
+	}
+	status, index, regs := f.status, f.index, f.regs
+	f.mu.Unlock()
+
+	if status != 0 {
+		http.Error(w, "no leader", status)
+		return
+	}
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(index, 10))
+	json.NewEncoder(w).Encode(regs)
+}
+
+// registration 返回一个 web 服务的注册。
+func registration(id, addr string, port int, tags ...string) serviceRegistration {
+	return serviceRegistration{ID: id, ServiceName: "web", AllocID: "alloc-" + id, Datacenter: "dc1", Address: addr, Port: port, Tags: tags}
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(np *NomadProvider) string {
+	var dials []string
+	for _, up := range np.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+// waitForDials 等待发布的上游变为 want。
+func waitForDials(t *testing.T, np *NomadProvider, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(np) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q, want %q", upstreamDials(np), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// provision 返回一个连接 srv 的 provider，测试结束时 Cleanup。
+func provision(t *testing.T, srv *httptest.Server, configure func(*NomadProvider)) *NomadProvider {
+	t.Helper()
+	np := New()
+	np.Address = srv.URL
+	np.ServiceName = "web"
+	np.PollInterval = 10 * time.Millisecond
+	if configure != nil {
+		configure(np)
+	}
+	if err := np.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { np.Cleanup() })
+	return np
+}
+
+func TestServiceRegistrations(t *testing.T) {
+	f, srv := newFakeNomad(t)
+	f.set(5,
+		registration("a", "10.0.0.1", 8080, "http", "v2"),
+		registration("b", "10.0.0.2", 8080, "http"),
+		registration("c", "", 8080, "http", "v2"),
+		registration("d", "10.0.0.4", 9090, "v2", "http", "canary"),
+	)
+	np := provision(t, srv, func(np *NomadProvider) {
+		np.Namespace = "apps"
+		np.Token = "secret"
+		np.Tags = []string{"http", "v2"}
+	})
+
+	// 只保留带有所有标签且有地址的注册
+	if got := upstreamDials(np); got != "10.0.0.1:8080,10.0.0.4:9090" {
+		t.Fatalf("got upstreams %q after Provision, want the registrations with both tags", got)
+	}
+	in := np.Store.Instances()[0]
+	if in.Metadata["alloc_id"] != "alloc-a" || in.Metadata["datacenter"] != "dc1" || !in.HasTag("v2") {
+		t.Fatalf("got %+v, want the allocation, datacenter and tags", in)
+	}
+	first := f.requests()[0]
+	if first.Get("namespace") != "apps" || first.Has("index") || f.tokens[0] != "secret" {
+		t.Fatalf("got initial query %v with token %q, want a non-blocking query in namespace apps", first, f.tokens[0])
+	}
+}
+
+func TestBlockingQueryIndex(t *testing.T) {
+	f, srv := newFakeNomad(t)
+	f.set(5, registration("a", "10.0.0.1", 8080))
+	np := provision(t, srv, nil)
+	waitForDials(t, np, "10.0.0.1:8080")
+
+	// 后台的阻塞查询从初始查询返回的索引开始，索引变化后带着新的索引继续等待
+	f.set(8, registration("a", "10.0.0.1", 8080), registration("b", "10.0.0.2", 8080))
+	waitForDials(t, np, "10.0.0.1:8080,10.0.0.2:8080")
+	waitForIndex(t, f, "8")
+
+	// 索引回退时从头查询一次
+	f.set(3, registration("c", "10.0.0.3", 8080))
+	waitForDials(t, np, "10.0.0.3:8080")
+	waitForIndex(t, f, "3")
+	var indexes []string
+	for _, q := range f.requests() {
+		indexes = append(indexes, q.Get("index"))
+	}
+	if got := strings.Join(indexes, ","); got != ",5,8,,3" {
+		t.Fatalf("got query indexes %q, want the initial query, blocking queries at 5 and 8, then a restart after the index went back", got)
+	}
+	for _, q := range f.requests()[1:] {
+		if q.Has("index") && q.Get("wait") != waitTime.String() {
+			t.Fatalf("got wait %q, want %s", q.Get("wait"), waitTime)
+		}
+	}
+}
+
+// waitForIndex 等待 provider 发起一个 index 参数为 index 的阻塞查询。
+func waitForIndex(t *testing.T, f *fakeNomad, index string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queries := f.requests()
+		if len(queries) > 0 && queries[len(queries)-1].Get("index") == index {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got queries %v, want a blocking query at index %s", queries, index)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueryErrorKeepsUpstreams(t *testing.T) {
+	f, srv := newFakeNomad(t)
+	f.set(5, registration("a", "10.0.0.1", 8080))
+	np := provision(t, srv, nil)
+	waitForIndex(t, f, "5")
+
+	// 查询失败时保留当前的上游列表，等待 poll_interval 后重试
+	f.fail(http.StatusInternalServerError)
+	time.Sleep(50 * time.Millisecond)
+	if got := upstreamDials(np); got != "10.0.0.1:8080" {
+		t.Fatalf("got upstreams %q while nomad fails, want the previous list", got)
+	}
+	f.fail(0)
+	f.set(6, registration("b", "10.0.0.2", 8080))
+	waitForDials(t, np, "10.0.0.2:8080")
+
+	if err := np.ValidateConnectivity(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	f.fail(http.StatusForbidden)
+	if err := np.ValidateConnectivity(t.Context()); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want the 403 status", err)
+	}
+}
@@ -2,13 +2,27 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/certmagic"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/providers/apollo"
 	"github.com/liuxd6825/caddy-plus/internal/providers/consul"
+	"github.com/liuxd6825/caddy-plus/internal/providers/file"
+	"github.com/liuxd6825/caddy-plus/internal/providers/gcp"
+	"github.com/liuxd6825/caddy-plus/internal/providers/httpstream"
 	"github.com/liuxd6825/caddy-plus/internal/providers/mdns"
+	"github.com/liuxd6825/caddy-plus/internal/providers/nats"
+	"github.com/liuxd6825/caddy-plus/internal/providers/nomad"
+	"github.com/liuxd6825/caddy-plus/internal/providers/redis"
+	"github.com/liuxd6825/caddy-plus/internal/providers/storage"
+	"github.com/liuxd6825/caddy-plus/internal/providers/unixsock"
+	"github.com/liuxd6825/caddy-plus/internal/providers/xds"
 	"go.uber.org/zap"
+	"time"
 
 	// 导入具体的提供者实现
 	// 请将 "github.com/your-username/caddy-dynamic-sd" 替换为你的实际模块路径
@@ -35,6 +49,56 @@ type Provider interface {
 
 	// reverseproxy.UpstreamSource 是核心接口，用于向 Caddy 的反向代理提供上游服务列表。
 	reverseproxy.UpstreamSource
+
+	// Instances 返回当前的实例列表（包含 metadata 和权重），顺序与 GetUpstreams 一致。
+	// 选择策略和管理接口通过它读取实例属性。
+	Instances() []*discovery.Instance
+
+	// OnUpdate 注册一个在每次成功刷新后调用的函数，用于持久化或同步上游列表。
+	OnUpdate(fn func(instances []*discovery.Instance))
+
+	// Service 返回 provider 发现的服务标识，用于日志和管理接口。
+	Service() string
+
+	// MarshalConfig 返回 provider 实际解析得到的配置，密码、令牌等敏感字段被替换，由管理接口以 JSON 返回。
+	MarshalConfig() any
+}
+
+// StorageUser 由需要读取 Caddy 存储的 provider 实现。
+// 主模块在调用 Provision 之前通过 SetStorage 注入当前配置的存储。
+type StorageUser interface {
+	SetStorage(storage certmagic.Storage)
+}
+
+// ContextUser 由需要感知配置生命周期的 provider 实现。
+// 主模块在调用 Provision 之前通过 SetContext 注入当前配置的 context，配置被卸载时它会被取消。
+type ContextUser interface {
+	SetContext(ctx context.Context)
+}
+
+// UpdateCoalescer 由能够合并短时间内多次上游更新的 provider 实现，嵌入 discovery.Store 的 provider 都自动实现了它。
+// 主模块在调用 Provision 之前通过 SetCoalesceWindow 设置 coalesce_window。
+type UpdateCoalescer interface {
+	SetCoalesceWindow(window time.Duration)
+}
+
+// Labeler 由支持用户自定义标签的 provider 实现，嵌入 discovery.Store 的 provider 都自动实现了它。
+// 主模块把标签加入传给 Provision 的 logger，并在 Provision 之后导出 provider_labels 指标。
+type Labeler interface {
+	ProviderLabels() map[string]string
+}
+
+// ConnectivityValidator 由能够在不启动后台任务的情况下检查连通性的 provider 实现。
+// 主模块在 validate_only 模式下调用 ValidateConnectivity 代替 Provision：
+// 它连接注册中心并执行一次查询以确认地址和凭据可用，返回前释放所有资源。
+type ConnectivityValidator interface {
+	ValidateConnectivity(ctx context.Context) error
+}
+
+// RegistryAddresser 由连接远程注册中心的 provider 实现，返回注册中心的 "host:port" 地址。
+// 主模块在解析 Caddyfile 时，如果配置了 check_registry，会尝试连接这些地址，不可达时记录警告。
+type RegistryAddresser interface {
+	RegistryAddresses() []string
 }
 
 // NewProvider 是一个工厂函数，根据给定的名称创建并返回一个具体的 Provider 实例。
@@ -53,8 +117,48 @@ func NewProvider(name string) (Provider, error) {
 		// 返回一个新的 mDNS 提供者实例
 		return mdns.New(), nil
 
+	case "redis":
+		// 返回一个新的 Redis 提供者实例
+		return redis.New(), nil
+
+	case "file":
+		// 返回一个新的文件提供者实例
+		return file.New(), nil
+
+	case "nats":
+		// 返回一个新的 NATS 提供者实例
+		return nats.New(), nil
+
+	case "caddy_storage":
+		// 返回一个新的 Caddy 存储提供者实例
+		return storage.New(), nil
+
+	case "xds":
+		// 返回一个新的 xDS 提供者实例
+		return xds.New(), nil
+
+	case "apollo":
+		// 返回一个新的 Apollo 提供者实例
+		return apollo.New(), nil
+
+	case "nomad":
+		// 返回一个新的 Nomad 提供者实例
+		return nomad.New(), nil
+
+	case "gcp":
+		// 返回一个新的 GCP 提供者实例
+		return gcp.New(), nil
+
+	case "unix_socket":
+		// 返回一个新的 Unix socket 提供者实例
+		return unixsock.New(), nil
+
+	case "http_stream":
+		// 返回一个新的 HTTP 事件流提供者实例
+		return httpstream.New(), nil
+
 	default:
 		// 如果提供者名称未知，返回一个错误
-		return nil, fmt.Errorf("unknown service discovery provider: '%s'. supported providers are: nacos, consul, mdns", name)
+		return nil, fmt.Errorf("unknown service discovery provider: '%s'. supported providers are: nacos, consul, mdns, redis, file, nats, caddy_storage, xds, apollo, nomad, gcp, unix_socket, http_stream", name)
 	}
 }
@@ -0,0 +1,318 @@
+// package redis 实现了用于 Caddy 的 Redis 服务发现提供者，
+// 它从一个 Redis key（SET 或 HASH）中读取上游地址列表。
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// keyTypeSet 表示 key 是一个 SET，每个成员是一个 "host:port"。
+	keyTypeSet = "set"
+	// keyTypeHash 表示 key 是一个 HASH，字段是 "host:port"，值是可选的数字权重。
+	keyTypeHash = "hash"
+)
+
+// RedisProvider 实现了 providers.Provider 接口，
+// 用于从 Redis 动态获取上游服务实例。
+type RedisProvider struct {
+	// --- 配置字段 ---
+	Address  string        `json:"address,omitempty"`
+	Password string        `json:"password,omitempty"`
+	DB       int           `json:"db,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	KeyType  string        `json:"key_type,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	client     *goredis.Client
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 RedisProvider 的新实例。
+func New() *RedisProvider {
+	return &RedisProvider{
+		// 设置合理的默认值
+		Address:  "127.0.0.1:6379",
+		KeyType:  keyTypeSet,
+		Interval: 10 * time.Second, // 默认每 10 秒轮询一次
+	}
+}
+
+// Provision 初始化 Redis 客户端并启动后台刷新 goroutine。
+func (rp *RedisProvider) Provision(logger *zap.Logger) error {
+	rp.logger = rp.Store.Setup(logger, rp.Key)
+	rp.logger.Info("provisioning redis service discovery provider",
+		zap.String("key", rp.Key),
+		zap.String("key_type", rp.KeyType),
+		zap.String("address", rp.Address),
+	)
+
+	// go-redis 的连接池会在连接断开后自动重连，因此这里只需要创建一次客户端
+	rp.client = goredis.NewClient(&goredis.Options{
+		Addr:     rp.Address,
+		Password: rp.Password,
+		DB:       rp.DB,
+	})
+
+	var ctx context.Context
+	ctx, rp.cancelFunc = context.WithCancel(context.Background())
+
+	// 立即执行一次服务获取，以确保在 Caddy 启动时就有上游可用
+	if err := rp.updateUpstreams(ctx); err != nil {
+		rp.logger.Error("initial fetch from redis failed", zap.Error(err))
+		// 我们不在这里返回错误，因为网络可能是暂时问题，后台轮询可能会恢复
+	}
+
+	discovery.Go(rp.logger, "redis watcher", func() { rp.watchKeyChanges(ctx) })
+
+	return nil
+}
+
+// updateUpstreams 从 Redis 读取 key 的内容并更新内部列表。
+// key 不存在时被视为空列表。
+func (rp *RedisProvider) updateUpstreams(ctx context.Context) (err error) {
+	defer metrics.ObserveRefresh("redis", rp.Key, time.Now())
+	endSpan := tracing.StartRefresh("redis", rp.Key)
+	defer func() {
+		count := len(rp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("redis", rp.Key, count, err)
+	}()
+
+	var instances []*discovery.Instance
+	switch rp.KeyType {
+	case keyTypeHash:
+		fields, err := rp.client.HGetAll(ctx, rp.Key).Result()
+		if err != nil {
+			return fmt.Errorf("reading redis hash '%s': %v", rp.Key, err)
+		}
+		instances = rp.hashInstances(fields)
+	default:
+		members, err := rp.client.SMembers(ctx, rp.Key).Result()
+		if err != nil {
+			return fmt.Errorf("reading redis set '%s': %v", rp.Key, err)
+		}
+		instances = rp.setInstances(members)
+	}
+
+	if !rp.Store.Update(instances) {
+		return nil
+	}
+
+	rp.logger.Debug("updated upstreams from redis",
+		zap.String("key", rp.Key),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// setInstances 把 SET 的成员转换为实例，非法成员被跳过。
+func (rp *RedisProvider) setInstances(members []string) []*discovery.Instance {
+	var instances []*discovery.Instance
+	for _, dial := range members {
+		if !rp.validDial(dial) {
+			continue
+		}
+		instances = append(instances, discovery.NewInstance(dial, nil, 0))
+	}
+	return instances
+}
+
+// hashInstances 把 HASH 的字段转换为实例，值是实例的权重，为空或不是数字时使用默认权重。非法字段被跳过。
+func (rp *RedisProvider) hashInstances(fields map[string]string) []*discovery.Instance {
+	var instances []*discovery.Instance
+	for dial, value := range fields {
+		if !rp.validDial(dial) {
+			continue
+		}
+		weight, _ := strconv.ParseFloat(value, 64)
+		instances = append(instances, discovery.NewInstance(dial, nil, weight))
+	}
+	return instances
+}
+
+// validDial 检查一个成员是否是合法的 "host:port"，非法成员会被记录并跳过。
+func (rp *RedisProvider) validDial(dial string) bool {
+	if _, _, err := net.SplitHostPort(dial); err != nil {
+		rp.logger.Warn("skipping invalid redis upstream member",
+			zap.String("key", rp.Key),
+			zap.String("member", dial),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// watchKeyChanges 是一个在后台运行的循环，定期从 Redis 拉取更新。
+// 如果 Redis 开启了 keyspace 通知（notify-keyspace-events 包含 "K" 和相应的事件类型），
+// key 的变更会立即触发一次刷新，而不必等待下一次轮询。
+func (rp *RedisProvider) watchKeyChanges(ctx context.Context) {
+	ticker := time.NewTicker(rp.Interval)
+	defer ticker.Stop()
+
+	channel := fmt.Sprintf("__keyspace@%d__:%s", rp.DB, rp.Key)
+	pubsub := rp.client.Subscribe(ctx, channel)
+	defer pubsub.Close()
+	notifications := pubsub.Channel()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := rp.updateUpstreams(ctx); err != nil {
+				rp.logger.Error("failed to update upstreams from redis", zap.Error(err))
+			}
+		case <-notifications:
+			if err := rp.updateUpstreams(ctx); err != nil {
+				rp.logger.Error("failed to update upstreams from redis", zap.Error(err))
+			}
+		case <-ctx.Done():
+			rp.logger.Info("stopping redis key watcher", zap.String("key", rp.Key))
+			return
+		}
+	}
+}
+
+// ValidateConnectivity 创建一个独立的 Redis 客户端，确认可以连接并且 key 的类型与配置一致。
+// key 不存在不视为错误，它可能稍后才会被写入。
+func (rp *RedisProvider) ValidateConnectivity(ctx context.Context) error {
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     rp.Address,
+		Password: rp.Password,
+		DB:       rp.DB,
+	})
+	defer client.Close()
+
+	keyType, err := client.Type(ctx, rp.Key).Result()
+	if err != nil {
+		return fmt.Errorf("checking redis key '%s': %v", rp.Key, err)
+	}
+	if keyType != "none" && keyType != rp.KeyType {
+		return fmt.Errorf("redis key '%s' is a %s, expected a %s", rp.Key, keyType, rp.KeyType)
+	}
+	return nil
+}
+
+// RegistryAddresses 返回 Redis 服务器的地址。
+func (rp *RedisProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(rp.Address, "6379")
+}
+
+// MarshalConfig 返回用于管理接口的配置，Password 被替换。
+func (rp *RedisProvider) MarshalConfig() any {
+	return discovery.RedactConfig(rp, "password")
+}
+
+// Validate 检查必要的配置是否已提供。
+func (rp *RedisProvider) Validate() error {
+	if rp.Key == "" {
+		return fmt.Errorf("redis provider: key is required")
+	}
+	if rp.KeyType != keyTypeSet && rp.KeyType != keyTypeHash {
+		return fmt.Errorf("redis provider: key_type must be '%s' or '%s'", keyTypeSet, keyTypeHash)
+	}
+	if err := rp.Store.ValidateInterval("interval", rp.Interval); err != nil {
+		return fmt.Errorf("redis provider: %v", err)
+	}
+	if err := rp.Store.Validate(); err != nil {
+		return fmt.Errorf("redis provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine 并关闭 Redis 客户端。
+func (rp *RedisProvider) Cleanup() error {
+	rp.logger.Info("cleaning up redis provider", zap.String("key", rp.Key))
+	if rp.cancelFunc != nil {
+		rp.cancelFunc()
+	}
+	if rp.client != nil {
+		if err := rp.client.Close(); err != nil {
+			return fmt.Errorf("closing redis client: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (rp *RedisProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := rp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available in redis key: %s", rp.Key)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 Redis 提供者特有的 Caddyfile 配置块。
+func (rp *RedisProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rp.Address = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rp.Password = d.Val()
+		case "db":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			db, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid db '%s': %v", d.Val(), err)
+			}
+			rp.DB = db
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rp.Key = d.Val()
+		case "key_type":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rp.KeyType = d.Val()
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for interval: %v", err)
+			}
+			rp.Interval = dur
+		default:
+			ok, err := rp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized redis subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
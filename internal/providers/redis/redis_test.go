@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+)
+
+// byDial 按地址排序实例，HASH 的字段没有固定的顺序。
+func byDial(instances []*discovery.Instance) []*discovery.Instance {
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Upstream.Dial < instances[j].Upstream.Dial })
+	return instances
+}
+
+func TestSetInstances(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	rp := New()
+	rp.Key = "upstreams"
+	rp.logger = zap.New(core)
+
+	got := byDial(rp.setInstances([]string{"10.0.0.2:80", "not-an-address", "10.0.0.1:80"}))
+	if len(got) != 2 || got[0].Upstream.Dial != "10.0.0.1:80" || got[1].Upstream.Dial != "10.0.0.2:80" {
+		t.Fatalf("got %v, want 10.0.0.1:80 and 10.0.0.2:80", got)
+	}
+	for _, in := range got {
+		if in.Weight != 0 {
+			t.Errorf("%s has weight %v, want 0", in.Upstream.Dial, in.Weight)
+		}
+	}
+	if logs.FilterField(zap.String("member", "not-an-address")).Len() != 1 {
+		t.Fatalf("got logs %v, want one warning for the invalid member", logs.All())
+	}
+}
+
+func TestHashInstances(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	rp := New()
+	rp.Key = "upstreams"
+	rp.KeyType = keyTypeHash
+	rp.logger = zap.New(core)
+
+	got := byDial(rp.hashInstances(map[string]string{
+		"10.0.0.1:80": "3",
+		"10.0.0.2:80": "",
+		"10.0.0.3:80": "heavy",
+		"10.0.0.4":    "5",
+	}))
+	want := []struct {
+		dial   string
+		weight float64
+	}{
+		{"10.0.0.1:80", 3},
+		{"10.0.0.2:80", 0},
+		{"10.0.0.3:80", 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d instances, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Upstream.Dial != w.dial || got[i].Weight != w.weight {
+			t.Errorf("instance %d = %s weight %v, want %s weight %v", i, got[i].Upstream.Dial, got[i].Weight, w.dial, w.weight)
+		}
+	}
+	if logs.FilterField(zap.String("member", "10.0.0.4")).Len() != 1 {
+		t.Fatalf("got logs %v, want one warning for the field without a port", logs.All())
+	}
+}
+
+func TestValidateIntervalFloor(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"default", "redis {\n\tkey upstreams\n}", ""},
+		{"below the floor", "redis {\n\tkey upstreams\n\tinterval 100ms\n}", "allow_aggressive_polling"},
+		{"override", "redis {\n\tkey upstreams\n\tinterval 100ms\n\tallow_aggressive_polling\n}", ""},
+	}
+	for _, tt := range tests {
+		rp := New()
+		d := caddyfile.NewTestDispenser(tt.config)
+		d.Next()
+		if err := rp.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err := rp.Validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error mentioning %s", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// package storage 实现了从 Caddy 存储中读取上游列表的服务发现提供者。
+// 在集群部署中，由某个节点将发现结果写入共享存储，其他节点通过该提供者读取，从而共享同一份上游列表。
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/certmagic"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+// StorageProvider 实现了 providers.Provider 接口，
+// 用于从 Caddy 配置的存储中读取一个 "host:port" 组成的 JSON 数组作为上游列表。
+type StorageProvider struct {
+	// --- 配置字段 ---
+	Key          string        `json:"key,omitempty"`
+	PollInterval time.Duration `json:"poll_interval,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	storage    certmagic.Storage
+	modified   time.Time
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 StorageProvider 的新实例。
+func New() *StorageProvider {
+	return &StorageProvider{
+		// 设置合理的默认值
+		Key:          "dynamic_sd/upstreams.json",
+		PollInterval: 10 * time.Second, // 默认每 10 秒轮询一次
+	}
+}
+
+// SetStorage 注入 Caddy 配置的存储，由 DynamicSD 在 Provision 之前调用。
+func (sp *StorageProvider) SetStorage(storage certmagic.Storage) {
+	sp.storage = storage
+}
+
+// Provision 读取一次存储中的上游列表并启动后台轮询 goroutine。
+func (sp *StorageProvider) Provision(logger *zap.Logger) error {
+	sp.logger = sp.Store.Setup(logger, sp.Key)
+	sp.logger.Info("provisioning caddy storage service discovery provider",
+		zap.String("key", sp.Key),
+	)
+
+	if sp.storage == nil {
+		return fmt.Errorf("caddy storage is not available")
+	}
+
+	var ctx context.Context
+	ctx, sp.cancelFunc = context.WithCancel(context.Background())
+
+	// 立即读取一次，以确保在 Caddy 启动时就有上游可用
+	if err := sp.updateUpstreams(ctx); err != nil {
+		sp.logger.Error("initial read from caddy storage failed", zap.Error(err))
+		// key 可能稍后才会被写入，后台轮询会继续尝试
+	}
+
+	discovery.Go(sp.logger, "caddy storage watcher", func() { sp.watchKey(ctx) })
+
+	return nil
+}
+
+// updateUpstreams 在 key 的修改时间变化时重新读取上游列表。key 不存在时被视为空列表。
+func (sp *StorageProvider) updateUpstreams(ctx context.Context) (err error) {
+	defer metrics.ObserveRefresh("caddy_storage", sp.Key, time.Now())
+	endSpan := tracing.StartRefresh("caddy_storage", sp.Key)
+	defer func() {
+		count := len(sp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("caddy_storage", sp.Key, count, err)
+	}()
+
+	var dials []string
+	info, err := sp.storage.Stat(ctx, sp.Key)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		sp.modified = time.Time{}
+	case err != nil:
+		return fmt.Errorf("checking caddy storage key '%s': %v", sp.Key, err)
+	default:
+		if !info.Modified.IsZero() && info.Modified.Equal(sp.modified) {
+			return nil
+		}
+		data, err := sp.storage.Load(ctx, sp.Key)
+		if err != nil {
+			return fmt.Errorf("loading caddy storage key '%s': %v", sp.Key, err)
+		}
+		if err := json.Unmarshal(data, &dials); err != nil {
+			return fmt.Errorf("parsing caddy storage key '%s': %v", sp.Key, err)
+		}
+		sp.modified = info.Modified
+	}
+
+	var instances []*discovery.Instance
+	for _, dial := range dials {
+		if _, _, err := net.SplitHostPort(dial); err != nil {
+			sp.logger.Warn("skipping invalid upstream in caddy storage",
+				zap.String("key", sp.Key),
+				zap.String("upstream", dial),
+				zap.Error(err),
+			)
+			continue
+		}
+		instances = append(instances, discovery.NewInstance(dial, nil, 0))
+	}
+
+	if !sp.Store.Update(instances) {
+		return nil
+	}
+
+	sp.logger.Debug("updated upstreams from caddy storage",
+		zap.String("key", sp.Key),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// watchKey 是一个在后台运行的循环，定期检查存储中的 key 是否发生变化。
+func (sp *StorageProvider) watchKey(ctx context.Context) {
+	ticker := time.NewTicker(sp.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := sp.updateUpstreams(ctx); err != nil {
+				sp.logger.Error("failed to update upstreams from caddy storage", zap.Error(err))
+			}
+		case <-ctx.Done():
+			sp.logger.Info("stopping caddy storage watcher", zap.String("key", sp.Key))
+			return
+		}
+	}
+}
+
+// ValidateConnectivity 检查一次存储中的 key，不启动后台轮询。key 不存在不视为错误。
+func (sp *StorageProvider) ValidateConnectivity(ctx context.Context) error {
+	if sp.storage == nil {
+		return fmt.Errorf("caddy storage is not available")
+	}
+	if _, err := sp.storage.Stat(ctx, sp.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("checking caddy storage key '%s': %v", sp.Key, err)
+	}
+	return nil
+}
+
+// MarshalConfig 返回用于管理接口的配置，存储提供者没有敏感配置。
+func (sp *StorageProvider) MarshalConfig() any {
+	return discovery.RedactConfig(sp)
+}
+
+// Validate 检查必要的配置是否已提供。
+func (sp *StorageProvider) Validate() error {
+	if sp.Key == "" {
+		return fmt.Errorf("caddy_storage provider: key is required")
+	}
+	if err := sp.Store.ValidateInterval("poll_interval", sp.PollInterval); err != nil {
+		return fmt.Errorf("caddy_storage provider: %v", err)
+	}
+	if err := sp.Store.Validate(); err != nil {
+		return fmt.Errorf("caddy_storage provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine。
+func (sp *StorageProvider) Cleanup() error {
+	sp.logger.Info("cleaning up caddy storage provider", zap.String("key", sp.Key))
+	if sp.cancelFunc != nil {
+		sp.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (sp *StorageProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := sp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available in caddy storage key: %s", sp.Key)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 caddy_storage 提供者特有的 Caddyfile 配置块。
+func (sp *StorageProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			sp.Key = d.Val()
+		case "poll_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration for poll_interval: %v", err)
+			}
+			sp.PollInterval = dur
+		default:
+			ok, err := sp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized caddy_storage subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
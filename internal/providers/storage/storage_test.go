@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// memStorage 是一个只实现了 provider 用到的方法的内存存储，每次写入都把修改时间推进一秒。
+type memStorage struct {
+	certmagic.Storage
+
+	mu      sync.Mutex
+	values  map[string][]byte
+	mtimes  map[string]time.Time
+	clock   time.Time
+	loads   int
+	statErr error
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		values: make(map[string][]byte),
+		mtimes: make(map[string]time.Time),
+		clock:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (m *memStorage) Store(_ context.Context, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = m.clock.Add(time.Second)
+	m.values[key] = value
+	m.mtimes[key] = m.clock
+	return nil
+}
+
+func (m *memStorage) Load(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads++
+	value, ok := m.values[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return value, nil
+}
+
+func (m *memStorage) Stat(_ context.Context, key string) (certmagic.KeyInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.statErr != nil {
+		return certmagic.KeyInfo{}, m.statErr
+	}
+	value, ok := m.values[key]
+	if !ok {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{Key: key, Modified: m.mtimes[key], Size: int64(len(value)), IsTerminal: true}, nil
+}
+
+func (m *memStorage) loadCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loads
+}
+
+// newTestProvider 返回一个使用 storage、还没有 Provision 的 provider。
+func newTestProvider(storage certmagic.Storage) *StorageProvider {
+	sp := New()
+	sp.SetStorage(storage)
+	return sp
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(sp *StorageProvider) string {
+	var dials []string
+	for _, up := range sp.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestReadsUpstreamsFromStorage(t *testing.T) {
+	storage := newMemStorage()
+	sp := newTestProvider(storage)
+	if err := sp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Cleanup()
+	ctx := context.Background()
+
+	// key 还没有被写入时没有上游
+	if _, err := sp.GetUpstreams(nil); err == nil {
+		t.Fatal("got upstreams before the key was written")
+	}
+
+	storage.Store(ctx, sp.Key, []byte(`["10.0.0.1:80", "not-a-dial", "10.0.0.2:80"]`))
+	if err := sp.updateUpstreams(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamDials(sp); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got %s, want the valid upstreams from storage", got)
+	}
+
+	// 修改时间没有变化时不重新读取
+	loads := storage.loadCount()
+	if err := sp.updateUpstreams(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if storage.loadCount() != loads {
+		t.Fatal("unchanged key was loaded again")
+	}
+
+	// 无法解析的内容返回错误并保留上一次的列表
+	storage.Store(ctx, sp.Key, []byte(`{"upstreams":`))
+	if err := sp.updateUpstreams(ctx); err == nil {
+		t.Fatal("got nil error for corrupt JSON")
+	}
+	if got := upstreamDials(sp); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got %s after a corrupt write, want the previous upstreams", got)
+	}
+}
+
+func TestPollsForChanges(t *testing.T) {
+	storage := newMemStorage()
+	sp := newTestProvider(storage)
+	sp.PollInterval = 10 * time.Millisecond
+	storage.Store(context.Background(), sp.Key, []byte(`["10.0.0.1:80"]`))
+	if err := sp.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Cleanup()
+	if got := upstreamDials(sp); got != "10.0.0.1:80" {
+		t.Fatalf("got %s after Provision, want the initial read", got)
+	}
+
+	storage.Store(context.Background(), sp.Key, []byte(`["10.0.0.3:80"]`))
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(sp) != "10.0.0.3:80" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %s, want the poll to pick up 10.0.0.3:80", upstreamDials(sp))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	if err := newTestProvider(nil).Provision(zap.NewNop()); err == nil {
+		t.Fatal("Provision without caddy storage returned nil")
+	}
+
+	storage := newMemStorage()
+	sp := newTestProvider(storage)
+	if err := sp.ValidateConnectivity(context.Background()); err != nil {
+		t.Fatalf("got %v for a missing key, want nil", err)
+	}
+	storage.statErr = errors.New("permission denied")
+	if err := sp.ValidateConnectivity(context.Background()); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("got %v, want the storage error", err)
+	}
+	sp.logger = zap.NewNop()
+	if err := sp.updateUpstreams(context.Background()); err == nil {
+		t.Fatal("got nil error from a failing Stat")
+	}
+}
@@ -0,0 +1,283 @@
+// package unixsock 实现了通过 Unix socket 从本地控制进程接收上游列表的服务发现提供者。
+package unixsock
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// dialTimeout 是连接控制进程的超时时间。
+	dialTimeout = 5 * time.Second
+
+	// minRetryDelay 和 maxRetryDelay 是连接断开或失败后重连等待时间的范围，每次连续失败翻倍。
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+
+	// maxLineSize 是一行命令的最大长度，SYNC 一次携带整个上游列表，因此比默认的 64KB 大。
+	maxLineSize = 1 << 20
+)
+
+// UnixSocketProvider 实现了 providers.Provider 接口，
+// 连接 SocketPath 上的本地控制进程（例如紧耦合的 sidecar 控制器），按行读取以下命令并更新上游列表：
+//
+//	ADD host:port          添加一个上游
+//	DEL host:port          移除一个上游
+//	SYNC host:port ...     用给出的地址替换整个上游列表，不带参数时清空
+//
+// 空行和以 # 开头的行被忽略，无法识别的命令记录警告后忽略。连接断开后保留当前的上游列表并按退避间隔重连，
+// 控制进程应当在每次连接建立后先发送一次 SYNC。上游运行在本机时需要设置 `skip_loopback false`。
+type UnixSocketProvider struct {
+	// --- 配置字段 ---
+	SocketPath string `json:"socket_path,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	// dials 是按命令流维护的上游集合，只在后台 goroutine 中访问。
+	dials      map[string]struct{}
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+}
+
+// New 是一个构造函数，返回一个 UnixSocketProvider 的新实例。
+func New() *UnixSocketProvider {
+	return &UnixSocketProvider{}
+}
+
+// Provision 在后台连接控制进程并读取命令流。
+func (up *UnixSocketProvider) Provision(logger *zap.Logger) error {
+	up.logger = up.Store.Setup(logger, up.SocketPath)
+	up.logger.Info("provisioning unix socket service discovery provider",
+		zap.String("socket_path", up.SocketPath),
+	)
+	up.dials = make(map[string]struct{})
+
+	var ctx context.Context
+	ctx, up.cancelFunc = context.WithCancel(context.Background())
+
+	discovery.Go(up.logger, "unix socket reader", func() { up.run(ctx) })
+
+	return nil
+}
+
+// run 连接控制进程并读取命令，连接失败或断开时按指数退避重连，直到 ctx 被取消。
+func (up *UnixSocketProvider) run(ctx context.Context) {
+	delay := minRetryDelay
+	for {
+		connected, err := up.serve(ctx)
+		if ctx.Err() != nil {
+			up.logger.Info("stopping unix socket reader", zap.String("socket_path", up.SocketPath))
+			return
+		}
+		if connected {
+			delay = minRetryDelay
+		}
+		up.updateUpstreams(err)
+		up.logger.Error("unix socket connection lost, reconnecting",
+			zap.String("socket_path", up.SocketPath),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			up.logger.Info("stopping unix socket reader", zap.String("socket_path", up.SocketPath))
+			return
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// serve 建立一次连接并应用其中的命令，直到连接断开或 ctx 被取消。connected 报告连接是否成功建立。
+func (up *UnixSocketProvider) serve(ctx context.Context) (connected bool, err error) {
+	var dialer net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	conn, err := dialer.DialContext(dialCtx, "unix", up.SocketPath)
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("connecting to unix socket '%s': %v", up.SocketPath, err)
+	}
+	defer conn.Close()
+	// ctx 被取消时关闭连接，使阻塞的读取立即返回
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	up.logger.Info("connected to unix socket control process", zap.String("socket_path", up.SocketPath))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if up.apply(scanner.Text()) {
+			up.updateUpstreams(nil)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, fmt.Errorf("reading from unix socket '%s': %v", up.SocketPath, err)
+	}
+	return true, fmt.Errorf("unix socket '%s' closed by control process", up.SocketPath)
+}
+
+// apply 把一行命令应用到 dials，返回是否需要更新上游列表。
+func (up *UnixSocketProvider) apply(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+
+	cmd, args := strings.ToUpper(fields[0]), fields[1:]
+	switch cmd {
+	case "ADD", "DEL":
+		if len(args) != 1 {
+			up.logger.Warn("ignoring unix socket command with wrong number of arguments", zap.String("line", line))
+			return false
+		}
+		if !up.validDial(args[0]) {
+			return false
+		}
+		if cmd == "ADD" {
+			up.dials[args[0]] = struct{}{}
+		} else {
+			delete(up.dials, args[0])
+		}
+	case "SYNC":
+		dials := make(map[string]struct{}, len(args))
+		for _, dial := range args {
+			if up.validDial(dial) {
+				dials[dial] = struct{}{}
+			}
+		}
+		up.dials = dials
+	default:
+		up.logger.Warn("ignoring unrecognized unix socket command", zap.String("line", line))
+		return false
+	}
+	return true
+}
+
+// validDial 报告 dial 是否为合法的 "host:port"，不合法时记录警告。
+func (up *UnixSocketProvider) validDial(dial string) bool {
+	if _, _, err := net.SplitHostPort(dial); err != nil {
+		up.logger.Warn("skipping invalid upstream from unix socket",
+			zap.String("upstream", dial),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// updateUpstreams 把当前的 dials 按地址排序后写入 Store；err 不为空时只记录这次失败，保留当前的上游列表。
+func (up *UnixSocketProvider) updateUpstreams(err error) error {
+	defer metrics.ObserveRefresh("unix_socket", up.SocketPath, time.Now())
+	endSpan := tracing.StartRefresh("unix_socket", up.SocketPath)
+	defer func() {
+		count := len(up.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("unix_socket", up.SocketPath, count, err)
+	}()
+	if err != nil {
+		return err
+	}
+
+	dials := make([]string, 0, len(up.dials))
+	for dial := range up.dials {
+		dials = append(dials, dial)
+	}
+	sort.Strings(dials)
+
+	instances := make([]*discovery.Instance, 0, len(dials))
+	for _, dial := range dials {
+		instances = append(instances, discovery.NewInstance(dial, nil, 0))
+	}
+
+	if !up.Store.Update(instances) {
+		return nil
+	}
+
+	up.logger.Debug("updated upstreams from unix socket",
+		zap.String("socket_path", up.SocketPath),
+		zap.Int("count", len(instances)),
+	)
+	return nil
+}
+
+// ValidateConnectivity 连接一次控制进程后立即断开，不读取命令。
+func (up *UnixSocketProvider) ValidateConnectivity(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", up.SocketPath)
+	if err != nil {
+		return fmt.Errorf("connecting to unix socket '%s': %v", up.SocketPath, err)
+	}
+	return conn.Close()
+}
+
+// MarshalConfig 返回用于管理接口的配置，Unix socket 提供者没有敏感配置。
+func (up *UnixSocketProvider) MarshalConfig() any {
+	return discovery.RedactConfig(up)
+}
+
+// Validate 检查必要的配置是否已提供。
+func (up *UnixSocketProvider) Validate() error {
+	if up.SocketPath == "" {
+		return fmt.Errorf("unix_socket provider: socket_path is required")
+	}
+	if err := up.Store.Validate(); err != nil {
+		return fmt.Errorf("unix_socket provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止后台 goroutine 并关闭连接。
+func (up *UnixSocketProvider) Cleanup() error {
+	up.logger.Info("cleaning up unix socket provider", zap.String("socket_path", up.SocketPath))
+	if up.cancelFunc != nil {
+		up.cancelFunc()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (up *UnixSocketProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := up.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams available from unix socket: %s", up.SocketPath)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 unix_socket 提供者特有的 Caddyfile 配置块。
+func (up *UnixSocketProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "socket_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			up.SocketPath = d.Val()
+		default:
+			ok, err := up.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized unix_socket subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
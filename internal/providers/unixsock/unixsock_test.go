@@ -0,0 +1,147 @@
+package unixsock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// controlServer 是一个在临时目录的 Unix socket 上监听的假控制进程，把每个连接交给测试。
+type controlServer struct {
+	path  string
+	conns chan net.Conn
+}
+
+func newControlServer(t *testing.T) *controlServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cs := &controlServer{path: path, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			cs.conns <- conn
+		}
+	}()
+	return cs
+}
+
+// accept 等待 provider 建立下一个连接。
+func (cs *controlServer) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-cs.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("provider did not connect to the control socket")
+		return nil
+	}
+}
+
+// send 向连接写入命令行。
+func send(t *testing.T, conn net.Conn, lines ...string) {
+	t.Helper()
+	if _, err := fmt.Fprint(conn, strings.Join(lines, "\n")+"\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(up *UnixSocketProvider) string {
+	var dials []string
+	for _, u := range up.Store.Upstreams() {
+		dials = append(dials, u.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+// waitForDials 等待发布的上游变为 want。
+func waitForDials(t *testing.T, up *UnixSocketProvider, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamDials(up) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got upstreams %q, want %q", upstreamDials(up), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCommandStream(t *testing.T) {
+	cs := newControlServer(t)
+	up := New()
+	up.SocketPath = cs.path
+	if err := up.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer up.Cleanup()
+	conn := cs.accept(t)
+
+	send(t, conn, "SYNC 10.0.0.2:80 10.0.0.1:80")
+	waitForDials(t, up, "10.0.0.1:80,10.0.0.2:80")
+
+	// 注释、无法识别的命令和非法的地址被忽略
+	send(t, conn, "# comment", "", "BOGUS 10.0.0.5:80", "ADD not-a-dial", "add 10.0.0.3:80", "DEL 10.0.0.1:80")
+	waitForDials(t, up, "10.0.0.2:80,10.0.0.3:80")
+
+	send(t, conn, "SYNC")
+	waitForDials(t, up, "")
+}
+
+func TestReconnectKeepsUpstreams(t *testing.T) {
+	cs := newControlServer(t)
+	up := New()
+	up.SocketPath = cs.path
+	if err := up.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer up.Cleanup()
+
+	conn := cs.accept(t)
+	send(t, conn, "SYNC 10.0.0.1:80")
+	waitForDials(t, up, "10.0.0.1:80")
+
+	// 控制进程断开后保留当前的上游列表，重连后由新的 SYNC 替换
+	conn.Close()
+	conn = cs.accept(t)
+	if got := upstreamDials(up); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %q after the connection was lost, want the previous list", got)
+	}
+	send(t, conn, "SYNC 10.0.0.9:80")
+	waitForDials(t, up, "10.0.0.9:80")
+
+	// Cleanup 关闭连接
+	up.Cleanup()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is still open after Cleanup")
+	}
+}
+
+func TestValidateConnectivity(t *testing.T) {
+	cs := newControlServer(t)
+	up := New()
+	up.SocketPath = cs.path
+	if err := up.ValidateConnectivity(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	up.SocketPath = filepath.Join(t.TempDir(), "missing.sock")
+	if err := up.ValidateConnectivity(context.Background()); err == nil {
+		t.Fatal("got nil error for a missing socket")
+	}
+}
@@ -0,0 +1,424 @@
+// package xds 实现了通过 xDS 聚合发现服务（ADS）订阅 EDS 端点的服务发现提供者，
+// 可以对接 Istio 或自定义的 xDS 控制面。
+package xds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/liuxd6825/caddy-plus/internal/discovery"
+	"github.com/liuxd6825/caddy-plus/internal/metrics"
+	"github.com/liuxd6825/caddy-plus/internal/tracing"
+	"go.uber.org/zap"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// edsTypeURL 是 EDS 资源 ClusterLoadAssignment 的类型 URL。
+	edsTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	// minBackoff 和 maxBackoff 是 ADS 流断开后重连的等待时间范围，每次失败翻倍。
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// initialFetchTimeout 是 Provision 等待第一次 EDS 响应的最长时间，超时后在后台继续等待。
+	initialFetchTimeout = 5 * time.Second
+)
+
+// XdsProvider 实现了 providers.Provider 接口，
+// 用于通过 ADS 流订阅一个集群的 EDS 端点作为上游列表。
+type XdsProvider struct {
+	// --- 配置字段 ---
+	Server      string `json:"server,omitempty"`       // 管理服务器地址，例如 "istiod.istio-system:15010"
+	ClusterName string `json:"cluster_name,omitempty"` // 要订阅的 EDS 资源名
+	NodeID      string `json:"node_id,omitempty"`      // 上报给控制面的节点 ID
+
+	// TLS 为 true 时使用 TLS 连接管理服务器，设置了 CAFile 或 CertFile 时自动启用。
+	TLS      bool   `json:"tls,omitempty"`
+	CAFile   string `json:"ca_file,omitempty"`
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// Store 保存当前的上游列表，并提供 min_upstreams 等通用的刷新保护。
+	discovery.Store
+
+	// --- 内部状态 ---
+	conn       *grpc.ClientConn
+	logger     *zap.Logger
+	cancelFunc context.CancelFunc
+
+	// version 是最近一次被接受的资源版本，重连时发送给控制面以便恢复。
+	version   string
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// New 是一个构造函数，返回一个 XdsProvider 的新实例。
+func New() *XdsProvider {
+	return &XdsProvider{
+		// 设置合理的默认值
+		NodeID: "caddy",
+	}
+}
+
+// Provision 连接管理服务器并启动后台 ADS 订阅 goroutine。
+func (xp *XdsProvider) Provision(logger *zap.Logger) error {
+	xp.logger = xp.Store.Setup(logger, xp.ClusterName)
+	xp.logger.Info("provisioning xds service discovery provider",
+		zap.String("server", xp.Server),
+		zap.String("cluster", xp.ClusterName),
+	)
+	xp.ready = make(chan struct{})
+
+	creds, err := xp.transportCredentials()
+	if err != nil {
+		return err
+	}
+	xp.conn, err = grpc.NewClient(xp.Server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("creating xds client for '%s': %v", xp.Server, err)
+	}
+
+	var ctx context.Context
+	ctx, xp.cancelFunc = context.WithCancel(context.Background())
+	discovery.Go(xp.logger, "xds stream", func() { xp.run(ctx) })
+
+	// 尽量在 Caddy 启动时就有上游可用，控制面暂时不可用时不阻止启动
+	select {
+	case <-xp.ready:
+	case <-time.After(initialFetchTimeout):
+		xp.logger.Warn("no eds response from xds server yet, continuing in background",
+			zap.String("server", xp.Server),
+			zap.String("cluster", xp.ClusterName),
+		)
+	}
+	return nil
+}
+
+// transportCredentials 根据 TLS 配置创建 gRPC 传输凭据。
+func (xp *XdsProvider) transportCredentials() (credentials.TransportCredentials, error) {
+	if !xp.TLS && xp.CAFile == "" && xp.CertFile == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if xp.CAFile != "" {
+		pem, err := os.ReadFile(xp.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading xds ca_file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in xds ca_file '%s'", xp.CAFile)
+		}
+	}
+	if xp.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(xp.CertFile, xp.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading xds client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// run 维持一个 ADS 流，流断开后按指数退避重连，直到 ctx 被取消。
+func (xp *XdsProvider) run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		received, err := xp.stream(ctx)
+		if ctx.Err() != nil {
+			xp.logger.Info("stopping xds stream", zap.String("cluster", xp.ClusterName))
+			return
+		}
+		// 流上收到过响应说明连接本身是正常的，重新从最短的等待时间开始
+		if received {
+			backoff = minBackoff
+		}
+		xp.logger.Warn("xds stream closed, reconnecting",
+			zap.String("server", xp.Server),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// stream 建立一个 ADS 流并处理 EDS 响应，直到流出错。received 报告是否收到过响应。
+func (xp *XdsProvider) stream(ctx context.Context) (received bool, err error) {
+	client := discoveryv3.NewAggregatedDiscoveryServiceClient(xp.conn)
+	stream, err := client.StreamAggregatedResources(ctx)
+	if err != nil {
+		return false, fmt.Errorf("opening ads stream: %v", err)
+	}
+
+	// 带上最近一次接受的版本，控制面可以据此判断是否需要重新下发
+	if err := stream.Send(xp.request(xp.version, "", nil)); err != nil {
+		return false, fmt.Errorf("sending eds request: %v", err)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if resp.GetTypeUrl() != edsTypeURL {
+			continue
+		}
+
+		var detail *rpcstatus.Status
+		if err := xp.updateUpstreams(resp); err != nil {
+			// NACK：保留之前的版本并告知控制面拒绝的原因
+			xp.logger.Error("rejecting eds response",
+				zap.String("version", resp.GetVersionInfo()),
+				zap.Error(err),
+			)
+			detail = &rpcstatus.Status{Code: int32(codes.InvalidArgument), Message: err.Error()}
+		} else {
+			xp.version = resp.GetVersionInfo()
+		}
+		if err := stream.Send(xp.request(xp.version, resp.GetNonce(), detail)); err != nil {
+			return received, fmt.Errorf("acknowledging eds response: %v", err)
+		}
+	}
+}
+
+// request 构造一个订阅 ClusterName 的 EDS 请求，同时用于首次订阅和 ACK/NACK。
+func (xp *XdsProvider) request(version, nonce string, detail *rpcstatus.Status) *discoveryv3.DiscoveryRequest {
+	return &discoveryv3.DiscoveryRequest{
+		VersionInfo:   version,
+		Node:          &corev3.Node{Id: xp.NodeID},
+		ResourceNames: []string{xp.ClusterName},
+		TypeUrl:       edsTypeURL,
+		ResponseNonce: nonce,
+		ErrorDetail:   detail,
+	}
+}
+
+// updateUpstreams 将 EDS 响应中 ClusterName 的端点转换为上游列表。
+// 响应中没有该集群时保留之前的列表。
+func (xp *XdsProvider) updateUpstreams(resp *discoveryv3.DiscoveryResponse) (err error) {
+	defer metrics.ObserveRefresh("xds", xp.ClusterName, time.Now())
+	endSpan := tracing.StartRefresh("xds", xp.ClusterName)
+	defer func() {
+		count := len(xp.Store.Instances())
+		endSpan(count, err)
+		metrics.RecordResult("xds", xp.ClusterName, count, err)
+	}()
+
+	for _, res := range resp.GetResources() {
+		cla := &endpointv3.ClusterLoadAssignment{}
+		if err := res.UnmarshalTo(cla); err != nil {
+			return fmt.Errorf("decoding cluster load assignment: %v", err)
+		}
+		if cla.GetClusterName() != xp.ClusterName {
+			continue
+		}
+
+		instances := claInstances(cla)
+		if xp.Store.Update(instances) {
+			xp.logger.Debug("updated upstreams from xds",
+				zap.String("cluster", xp.ClusterName),
+				zap.String("version", resp.GetVersionInfo()),
+				zap.Int("count", len(instances)),
+			)
+		}
+		xp.readyOnce.Do(func() { close(xp.ready) })
+		return nil
+	}
+	return nil
+}
+
+// claInstances 返回 ClusterLoadAssignment 中所有可用的端点。
+// 端点的 locality 作为 metadata（region、zone、sub_zone），负载均衡权重作为实例权重。
+func claInstances(cla *endpointv3.ClusterLoadAssignment) []*discovery.Instance {
+	var instances []*discovery.Instance
+	for _, locality := range cla.GetEndpoints() {
+		metadata := make(map[string]string)
+		if l := locality.GetLocality(); l != nil {
+			for k, v := range map[string]string{"region": l.GetRegion(), "zone": l.GetZone(), "sub_zone": l.GetSubZone()} {
+				if v != "" {
+					metadata[k] = v
+				}
+			}
+		}
+
+		for _, lb := range locality.GetLbEndpoints() {
+			switch lb.GetHealthStatus() {
+			case corev3.HealthStatus_UNKNOWN, corev3.HealthStatus_HEALTHY, corev3.HealthStatus_DEGRADED:
+			default:
+				continue
+			}
+			addr := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			if addr == nil || addr.GetAddress() == "" {
+				continue
+			}
+			dial := net.JoinHostPort(addr.GetAddress(), strconv.FormatUint(uint64(addr.GetPortValue()), 10))
+			instances = append(instances, discovery.NewInstance(dial, metadata, float64(lb.GetLoadBalancingWeight().GetValue())))
+		}
+	}
+	return instances
+}
+
+// ValidateConnectivity 建立一个独立的 ADS 流，等待管理服务器对 ClusterName 的第一个 EDS 响应后关闭。
+func (xp *XdsProvider) ValidateConnectivity(ctx context.Context) error {
+	creds, err := xp.transportCredentials()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.NewClient(xp.Server, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("creating xds client for '%s': %v", xp.Server, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := discoveryv3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return fmt.Errorf("opening ads stream: %v", err)
+	}
+	if err := stream.Send(xp.request("", "", nil)); err != nil {
+		return fmt.Errorf("sending eds request: %v", err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("waiting for eds response: %v", err)
+		}
+		if resp.GetTypeUrl() == edsTypeURL {
+			return nil
+		}
+	}
+}
+
+// RegistryAddresses 返回 xDS 管理服务器的地址。
+func (xp *XdsProvider) RegistryAddresses() []string {
+	return discovery.DialAddresses(xp.Server, "15010")
+}
+
+// MarshalConfig 返回用于管理接口的配置，证书和私钥只以文件路径出现。
+func (xp *XdsProvider) MarshalConfig() any {
+	return discovery.RedactConfig(xp)
+}
+
+// Validate 检查必要的配置是否已提供。
+func (xp *XdsProvider) Validate() error {
+	if xp.Server == "" {
+		return fmt.Errorf("xds provider: server is required")
+	}
+	if xp.ClusterName == "" {
+		return fmt.Errorf("xds provider: cluster_name is required")
+	}
+	if xp.NodeID == "" {
+		return fmt.Errorf("xds provider: node_id must not be empty")
+	}
+	if (xp.CertFile == "") != (xp.KeyFile == "") {
+		return fmt.Errorf("xds provider: cert_file and key_file must be set together")
+	}
+	if err := xp.Store.Validate(); err != nil {
+		return fmt.Errorf("xds provider: %v", err)
+	}
+	return nil
+}
+
+// Cleanup 停止 ADS 流并关闭 gRPC 连接。
+func (xp *XdsProvider) Cleanup() error {
+	xp.logger.Info("cleaning up xds provider", zap.String("cluster", xp.ClusterName))
+	if xp.cancelFunc != nil {
+		xp.cancelFunc()
+	}
+	if xp.conn != nil {
+		return xp.conn.Close()
+	}
+	return nil
+}
+
+// GetUpstreams 由 Caddy 的反向代理调用以获取当前的上游列表。
+func (xp *XdsProvider) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	upstreams := xp.Store.Upstreams()
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no xds endpoints available for cluster: %s", xp.ClusterName)
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile 解析 xDS 提供者特有的 Caddyfile 配置块。
+func (xp *XdsProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "server":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.Server = d.Val()
+		case "cluster_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.ClusterName = d.Val()
+		case "node_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.NodeID = d.Val()
+		case "tls":
+			xp.TLS = true
+			if d.NextArg() {
+				val, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid boolean for tls: %v", err)
+				}
+				xp.TLS = val
+			}
+		case "ca_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.CAFile = d.Val()
+		case "cert_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.CertFile = d.Val()
+		case "key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			xp.KeyFile = d.Val()
+		default:
+			ok, err := xp.Store.UnmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized xds subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package xds
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeADS 是一个由测试驱动的 ADS 管理服务器，每个新建立的流都通过 streams 交给测试。
+type fakeADS struct {
+	discoveryv3.UnimplementedAggregatedDiscoveryServiceServer
+	streams chan *adsStream
+}
+
+// adsStream 是一个 ADS 流：requests 收到客户端的请求，responses 中的响应被发送给客户端，向 closed 发送错误时流结束。
+type adsStream struct {
+	requests  chan *discoveryv3.DiscoveryRequest
+	responses chan *discoveryv3.DiscoveryResponse
+	closed    chan error
+}
+
+func newFakeADS(t *testing.T) (*fakeADS, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeADS{streams: make(chan *adsStream, 4)}
+	srv := grpc.NewServer()
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(srv, f)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return f, ln.Addr().String()
+}
+
+func (f *fakeADS) StreamAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	s := &adsStream{
+		requests:  make(chan *discoveryv3.DiscoveryRequest, 8),
+		responses: make(chan *discoveryv3.DiscoveryResponse),
+		closed:    make(chan error, 1),
+	}
+	f.streams <- s
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			s.requests <- req
+		}
+	}()
+	for {
+		select {
+		case resp := <-s.responses:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case err := <-s.closed:
+			return err
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// next 等待下一个流建立。
+func (f *fakeADS) next(t *testing.T) *adsStream {
+	t.Helper()
+	select {
+	case s := <-f.streams:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an ads stream")
+		return nil
+	}
+}
+
+// request 等待客户端的下一个请求。
+func (s *adsStream) request(t *testing.T) *discoveryv3.DiscoveryRequest {
+	t.Helper()
+	select {
+	case req := <-s.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a discovery request")
+		return nil
+	}
+}
+
+// send 发送一个 EDS 响应。
+func (s *adsStream) send(t *testing.T, version, nonce string, resources ...proto.Message) {
+	t.Helper()
+	resp := &discoveryv3.DiscoveryResponse{VersionInfo: version, Nonce: nonce, TypeUrl: edsTypeURL}
+	for _, res := range resources {
+		a, err := anypb.New(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Resources = append(resp.Resources, a)
+	}
+	s.responses <- resp
+}
+
+// endpoint 返回一个指定地址、权重和健康状态的 LbEndpoint。
+func endpoint(addr string, port uint32, weight uint32, health corev3.HealthStatus) *endpointv3.LbEndpoint {
+	lb := &endpointv3.LbEndpoint{
+		HealthStatus: health,
+		HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+			Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+				Address:       addr,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: port},
+			}}},
+		}},
+	}
+	if weight > 0 {
+		lb.LoadBalancingWeight = wrapperspb.UInt32(weight)
+	}
+	return lb
+}
+
+// assignment 返回集群 cluster 在一个 locality 中的 ClusterLoadAssignment。
+func assignment(cluster string, locality *corev3.Locality, endpoints ...*endpointv3.LbEndpoint) *endpointv3.ClusterLoadAssignment {
+	return &endpointv3.ClusterLoadAssignment{
+		ClusterName: cluster,
+		Endpoints:   []*endpointv3.LocalityLbEndpoints{{Locality: locality, LbEndpoints: endpoints}},
+	}
+}
+
+// upstreamDials 返回当前发布的上游地址，以逗号连接。
+func upstreamDials(xp *XdsProvider) string {
+	var dials []string
+	for _, up := range xp.Store.Upstreams() {
+		dials = append(dials, up.Dial)
+	}
+	return strings.Join(dials, ",")
+}
+
+func TestClusterLoadAssignmentInstances(t *testing.T) {
+	cla := assignment("web", &corev3.Locality{Region: "us-east1", Zone: "us-east1-b"},
+		endpoint("10.0.0.1", 8080, 3, corev3.HealthStatus_HEALTHY),
+		endpoint("10.0.0.2", 8080, 0, corev3.HealthStatus_UNKNOWN),
+		endpoint("10.0.0.3", 8080, 1, corev3.HealthStatus_DEGRADED),
+		endpoint("10.0.0.4", 8080, 1, corev3.HealthStatus_UNHEALTHY),
+		endpoint("10.0.0.5", 8080, 1, corev3.HealthStatus_DRAINING),
+		endpoint("", 8080, 1, corev3.HealthStatus_HEALTHY),
+	)
+	cla.Endpoints = append(cla.Endpoints, &endpointv3.LocalityLbEndpoints{
+		LbEndpoints: []*endpointv3.LbEndpoint{endpoint("2001:db8::1", 443, 0, corev3.HealthStatus_HEALTHY)},
+	})
+
+	instances := claInstances(cla)
+	var dials []string
+	for _, in := range instances {
+		dials = append(dials, in.Upstream.Dial)
+	}
+	if got := strings.Join(dials, ","); got != "10.0.0.1:8080,10.0.0.2:8080,10.0.0.3:8080,[2001:db8::1]:443" {
+		t.Fatalf("got %q, want the healthy, unknown and degraded endpoints with an address", got)
+	}
+	if in := instances[0]; in.Weight != 3 || in.Metadata["region"] != "us-east1" || in.Metadata["zone"] != "us-east1-b" || in.Metadata["sub_zone"] != "" {
+		t.Fatalf("got %+v, want the load balancing weight and locality", in)
+	}
+	if len(instances[3].Metadata) != 0 {
+		t.Fatalf("got metadata %v for an endpoint without a locality, want none", instances[3].Metadata)
+	}
+}
+
+func TestStreamAcksAndReconnects(t *testing.T) {
+	f, addr := newFakeADS(t)
+	xp := New()
+	xp.Server = addr
+	xp.ClusterName = "web"
+	provisioned := make(chan error, 1)
+	go func() { provisioned <- xp.Provision(zap.NewNop()) }()
+	t.Cleanup(func() { xp.Cleanup() })
+
+	s := f.next(t)
+	if req := s.request(t); req.GetVersionInfo() != "" || req.GetResponseNonce() != "" || req.GetResourceNames()[0] != "web" || req.GetNode().GetId() != "caddy" {
+		t.Fatalf("got initial request %v, want a subscription to web without a version", req)
+	}
+
+	// 其他集群的资源被忽略，ACK 带上响应的版本和 nonce
+	s.send(t, "1", "n1",
+		assignment("other", nil, endpoint("10.0.9.1", 80, 0, corev3.HealthStatus_HEALTHY)),
+		assignment("web", nil, endpoint("10.0.0.1", 80, 0, corev3.HealthStatus_HEALTHY)),
+	)
+	if err := <-provisioned; err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamDials(xp); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %q, want the web endpoints", got)
+	}
+	if ack := s.request(t); ack.GetVersionInfo() != "1" || ack.GetResponseNonce() != "n1" || ack.GetErrorDetail() != nil {
+		t.Fatalf("got %v, want an ACK of version 1", ack)
+	}
+
+	// 无法解析的资源被 NACK：保留之前的版本和上游列表
+	s.send(t, "2", "n2", &corev3.Node{Id: "not an assignment"})
+	if nack := s.request(t); nack.GetVersionInfo() != "1" || nack.GetResponseNonce() != "n2" || nack.GetErrorDetail() == nil {
+		t.Fatalf("got %v, want a NACK keeping version 1", nack)
+	}
+	if got := upstreamDials(xp); got != "10.0.0.1:80" {
+		t.Fatalf("got upstreams %q after a NACK, want the previous list", got)
+	}
+
+	// 流断开后重连，新的流从最近接受的版本开始
+	s.closed <- nil
+	s = f.next(t)
+	if req := s.request(t); req.GetVersionInfo() != "1" || req.GetResponseNonce() != "" {
+		t.Fatalf("got %v after reconnecting, want a request for version 1 without a nonce", req)
+	}
+	s.send(t, "3", "n3", assignment("web", nil,
+		endpoint("10.0.0.1", 80, 0, corev3.HealthStatus_HEALTHY),
+		endpoint("10.0.0.2", 80, 0, corev3.HealthStatus_HEALTHY),
+	))
+	if ack := s.request(t); ack.GetVersionInfo() != "3" || ack.GetResponseNonce() != "n3" {
+		t.Fatalf("got %v, want an ACK of version 3", ack)
+	}
+	if got := upstreamDials(xp); got != "10.0.0.1:80,10.0.0.2:80" {
+		t.Fatalf("got upstreams %q after reconnecting, want the new assignment", got)
+	}
+}
+
+func TestValidateConnectivity(t *testing.T) {
+	f, addr := newFakeADS(t)
+	xp := New()
+	xp.Server = addr
+	xp.ClusterName = "web"
+
+	validated := make(chan error, 1)
+	go func() { validated <- xp.ValidateConnectivity(t.Context()) }()
+	s := f.next(t)
+	s.request(t)
+	s.send(t, "1", "n1", assignment("web", nil))
+	if err := <-validated; err != nil {
+		t.Fatal(err)
+	}
+}
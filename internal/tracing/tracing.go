@@ -0,0 +1,32 @@
+// package tracing 为服务发现的刷新过程创建 OpenTelemetry span。
+// 它使用全局的 TracerProvider，未配置时 otel 默认的实现不会产生任何开销。
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracerName 是本模块创建 span 时使用的 instrumentation 名称。
+const tracerName = "github.com/liuxd6825/caddy-plus"
+
+// StartRefresh 开始一个名为 "dynamic_sd.refresh" 的 span，并返回结束该 span 的函数。
+// 结束函数应在刷新完成时调用，count 为刷新后的实例数量，err 为刷新的结果。
+func StartRefresh(provider, service string) func(count int, err error) {
+	_, span := otel.Tracer(tracerName).Start(context.Background(), "dynamic_sd.refresh")
+	span.SetAttributes(
+		attribute.String("dynamic_sd.provider", provider),
+		attribute.String("dynamic_sd.service", service),
+	)
+	return func(count int, err error) {
+		span.SetAttributes(attribute.Int("dynamic_sd.count", count))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans 把全局的 TracerProvider 替换为记录 span 的实现，测试结束时恢复。
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func TestStartRefresh(t *testing.T) {
+	sr := recordSpans(t)
+
+	StartRefresh("consul", "orders")(3, nil)
+	StartRefresh("consul", "orders")(0, errors.New("connection refused"))
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	for _, span := range spans {
+		if span.Name() != "dynamic_sd.refresh" {
+			t.Errorf("got span %q, want dynamic_sd.refresh", span.Name())
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if attrs["dynamic_sd.provider"].AsString() != "consul" || attrs["dynamic_sd.service"].AsString() != "orders" {
+			t.Errorf("got attributes %v, want provider consul and service orders", span.Attributes())
+		}
+	}
+
+	ok, failed := spans[0], spans[1]
+	if ok.Status().Code != codes.Unset || len(ok.Events()) != 0 {
+		t.Errorf("successful refresh has status %v and %d events, want unset and none", ok.Status(), len(ok.Events()))
+	}
+	if failed.Status().Code != codes.Error || failed.Status().Description != "connection refused" {
+		t.Errorf("failed refresh has status %v, want error connection refused", failed.Status())
+	}
+	if len(failed.Events()) != 1 || failed.Events()[0].Name != "exception" {
+		t.Errorf("failed refresh has events %v, want one exception", failed.Events())
+	}
+	for _, kv := range ok.Attributes() {
+		if kv.Key == "dynamic_sd.count" && kv.Value.AsInt64() != 3 {
+			t.Errorf("got count %d, want 3", kv.Value.AsInt64())
+		}
+	}
+}